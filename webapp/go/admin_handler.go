@@ -0,0 +1,319 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+type PutUserRoleRequest struct {
+	Role Role `json:"role"`
+}
+
+type UserRoleResponse struct {
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+	Role     Role   `json:"role"`
+}
+
+type PostTagRequest struct {
+	Name string `json:"name"`
+}
+
+type IconBlocklistModel struct {
+	Hash      string `db:"hash" json:"hash"`
+	Reason    string `db:"reason" json:"reason"`
+	CreatedAt int64  `db:"created_at" json:"created_at"`
+}
+
+type PostIconBlocklistRequest struct {
+	Hash   string `json:"hash"`
+	Reason string `json:"reason"`
+}
+
+// ユーザのロール取得API
+// GET /api/admin/user/:username/role
+func getUserRoleHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	username := c.Param("username")
+
+	userModel, err := dataStore.Users().GetByName(ctx, username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	role, err := dataStore.Users().GetRole(ctx, userModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user role: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &UserRoleResponse{
+		UserID:   userModel.ID,
+		Username: userModel.Name,
+		Role:     role,
+	})
+}
+
+// ユーザのロール変更API
+// PUT /api/admin/user/:username/role
+func putUserRoleHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	username := c.Param("username")
+
+	var req *PutUserRoleRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	// 配信ごとのモデレーターは配信者が付与するので、ここでは扱わない
+	if !req.Role.Valid() || req.Role == RoleStreamerModerator {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid role")
+	}
+
+	tx, err := dataStore.BeginTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel, err := tx.Users().GetByName(ctx, username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	if err := tx.Users().SetRole(ctx, userModel.ID, req.Role); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update user role: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &UserRoleResponse{
+		UserID:   userModel.ID,
+		Username: userModel.Name,
+		Role:     req.Role,
+	})
+}
+
+// タグ追加API
+// POST /api/admin/tag
+func postTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	var req *PostTagRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "tag name must not be empty")
+	}
+
+	tagID, err := dataStore.Tags().Create(ctx, req.Name)
+	if isDuplicateEntryError(err) {
+		return echo.NewHTTPError(http.StatusConflict, "the tag already exists")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag: "+err.Error())
+	}
+
+	tagCache.Add(TagModel{
+		ID:   tagID,
+		Name: req.Name,
+	})
+	cacheBus.Publish(InvalidationEvent{Kind: InvalidateTag, TagID: tagID})
+
+	return c.JSON(http.StatusCreated, &Tag{
+		ID:   tagID,
+		Name: req.Name,
+	})
+}
+
+type PostUserSuspensionRequest struct {
+	Reason string `json:"reason"`
+	// 凍結の期限 (UNIX秒)。0なら無期限
+	ExpiresAt int64 `json:"expires_at"`
+	// 既存のライブコメントも非表示にするか
+	HideLivecomments bool `json:"hide_livecomments"`
+}
+
+// ユーザの凍結状態取得API
+// GET /api/admin/user/:username/suspension
+func getUserSuspensionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userModel, err := dataStore.Users().GetByName(ctx, c.Param("username"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	suspensionModel, err := dataStore.Users().GetSuspension(ctx, userModel.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "the user is not suspended")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user suspension: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, suspensionModel)
+}
+
+// ユーザ凍結API
+// POST /api/admin/user/:username/suspension
+func postUserSuspensionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	var req *PostUserSuspensionRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	now := time.Now()
+	if req.ExpiresAt != 0 && req.ExpiresAt <= now.Unix() {
+		return echo.NewHTTPError(http.StatusBadRequest, "expires_at must be in the future")
+	}
+
+	tx, err := dataStore.BeginTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel, err := tx.Users().GetByName(ctx, c.Param("username"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	role, err := tx.Users().GetRole(ctx, userModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user role: "+err.Error())
+	}
+	if role.AtLeast(RoleAdmin) {
+		return echo.NewHTTPError(http.StatusBadRequest, "admins can't be suspended")
+	}
+
+	suspensionModel := UserSuspensionModel{
+		UserID:           userModel.ID,
+		Reason:           req.Reason,
+		HideLivecomments: req.HideLivecomments,
+		ExpiresAt:        req.ExpiresAt,
+		CreatedAt:        now.Unix(),
+	}
+	if err := tx.Users().PutSuspension(ctx, suspensionModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user suspension: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	suspensionCache.Set(suspensionModel)
+	cacheBus.Publish(InvalidationEvent{Kind: InvalidateUser, UserID: userModel.ID, UserName: userModel.Name})
+
+	return c.JSON(http.StatusCreated, suspensionModel)
+}
+
+// ユーザ凍結解除API
+// DELETE /api/admin/user/:username/suspension
+func deleteUserSuspensionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	userModel, err := dataStore.Users().GetByName(ctx, c.Param("username"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	if err := dataStore.Users().DeleteSuspension(ctx, userModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete user suspension: "+err.Error())
+	}
+
+	suspensionCache.Delete(userModel.ID)
+	cacheBus.Publish(InvalidationEvent{Kind: InvalidateUser, UserID: userModel.ID, UserName: userModel.Name})
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// アイコンのブロックリスト取得API
+// GET /api/admin/icon/blocklist
+func getIconBlocklistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	blocklist, err := dataStore.Icons().ListBlocklist(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icon blocklist: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, blocklist)
+}
+
+// アイコンのブロックリスト追加API
+// POST /api/admin/icon/blocklist
+func postIconBlocklistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	var req *PostIconBlocklistRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if !iconHashPattern.MatchString(req.Hash) {
+		return echo.NewHTTPError(http.StatusBadRequest, "hash must be a lowercase hex encoded sha256 digest")
+	}
+
+	blocklistModel := IconBlocklistModel{
+		Hash:      req.Hash,
+		Reason:    req.Reason,
+		CreatedAt: time.Now().Unix(),
+	}
+	if err := dataStore.Icons().PutBlocklist(ctx, blocklistModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert icon blocklist: "+err.Error())
+	}
+
+	blockedIconCache.Store(blocklistModel.Hash, struct{}{})
+	cacheBus.Publish(InvalidationEvent{Kind: InvalidateIcon, Hash: blocklistModel.Hash})
+
+	return c.JSON(http.StatusCreated, blocklistModel)
+}
+
+// アイコンのブロックリスト削除API
+// DELETE /api/admin/icon/blocklist/:hash
+func deleteIconBlocklistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	hash := c.Param("hash")
+	n, err := dataStore.Icons().DeleteBlocklist(ctx, hash)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete icon blocklist: "+err.Error())
+	}
+	if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "not found blocked icon that has the given hash")
+	}
+
+	blockedIconCache.Delete(hash)
+	cacheBus.Publish(InvalidationEvent{Kind: InvalidateIcon, Hash: hash})
+
+	return c.NoContent(http.StatusNoContent)
+}
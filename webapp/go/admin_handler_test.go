@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUserRole(t *testing.T) {
+	ts := newTestServer(t)
+	alice, aliceUser := ts.signup("alice")
+	admin := ts.admin()
+
+	role := decodeJSON[UserRoleResponse](t, admin.get("/api/admin/user/alice/role"), http.StatusOK)
+	if role != (UserRoleResponse{UserID: aliceUser.ID, Username: "alice", Role: RoleUser}) {
+		t.Errorf("role = %+v", role)
+	}
+	expectError(t, admin.get("/api/admin/user/nobody/role"), http.StatusNotFound)
+
+	// 配信ごとのモデレーターは配信者が付与するので、ここでは指定できない
+	expectError(t, admin.do(http.MethodPut, "/api/admin/user/alice/role", PutUserRoleRequest{Role: RoleStreamerModerator}), http.StatusBadRequest)
+	expectError(t, admin.do(http.MethodPut, "/api/admin/user/alice/role", PutUserRoleRequest{Role: "superuser"}), http.StatusBadRequest)
+	expectError(t, admin.do(http.MethodPut, "/api/admin/user/alice/role", "admin"), http.StatusBadRequest)
+	expectError(t, admin.do(http.MethodPut, "/api/admin/user/nobody/role", PutUserRoleRequest{Role: RoleAdmin}), http.StatusNotFound)
+
+	// 管理者になればトークンなしでセッションだけで管理APIを使える
+	expectError(t, alice.get("/api/admin/cluster/peers"), http.StatusForbidden)
+	role = decodeJSON[UserRoleResponse](t, admin.do(http.MethodPut, "/api/admin/user/alice/role", PutUserRoleRequest{Role: RoleAdmin}), http.StatusOK)
+	if role.Role != RoleAdmin {
+		t.Errorf("role = %+v", role)
+	}
+	decodeJSON[[]PeerHealth](t, alice.get("/api/admin/cluster/peers"), http.StatusOK)
+	if role := decodeJSON[UserRoleResponse](t, alice.get("/api/admin/user/alice/role"), http.StatusOK); role.Role != RoleAdmin {
+		t.Errorf("role = %+v", role)
+	}
+
+	// 一般ユーザに戻せば使えなくなる
+	decodeJSON[UserRoleResponse](t, admin.do(http.MethodPut, "/api/admin/user/alice/role", PutUserRoleRequest{Role: RoleUser}), http.StatusOK)
+	expectError(t, alice.get("/api/admin/cluster/peers"), http.StatusForbidden)
+}
+
+func TestUserSuspension(t *testing.T) {
+	ts := newTestServer(t)
+	alice, aliceUser := ts.signup("alice")
+	ts.signup("bob")
+	admin := ts.admin()
+
+	expectError(t, admin.get("/api/admin/user/alice/suspension"), http.StatusNotFound)
+	expectError(t, admin.get("/api/admin/user/nobody/suspension"), http.StatusNotFound)
+	expectError(t, admin.post("/api/admin/user/nobody/suspension", PostUserSuspensionRequest{Reason: "spam"}), http.StatusNotFound)
+	expectError(t, admin.post("/api/admin/user/alice/suspension", PostUserSuspensionRequest{Reason: "spam", ExpiresAt: time.Now().Add(-time.Hour).Unix()}), http.StatusBadRequest)
+	expectError(t, admin.post("/api/admin/user/alice/suspension", "spam"), http.StatusBadRequest)
+
+	expiresAt := time.Now().Add(time.Hour).Unix()
+	suspension := decodeJSON[UserSuspensionModel](t, admin.post("/api/admin/user/alice/suspension", PostUserSuspensionRequest{Reason: "spam", ExpiresAt: expiresAt, HideLivecomments: true}), http.StatusCreated)
+	if suspension.UserID != aliceUser.ID || suspension.Reason != "spam" || suspension.ExpiresAt != expiresAt || !suspension.HideLivecomments || suspension.CreatedAt == 0 {
+		t.Errorf("suspension = %+v", suspension)
+	}
+	ts.waitForEvent(InvalidateUser, func(e InvalidationEvent) bool { return e.UserID == aliceUser.ID })
+	if got := decodeJSON[UserSuspensionModel](t, admin.get("/api/admin/user/alice/suspension"), http.StatusOK); got != suspension {
+		t.Errorf("suspension = %+v, want %+v", got, suspension)
+	}
+
+	// 凍結中は既存のセッションもログインも拒否される
+	expectError(t, alice.get("/api/user/me"), http.StatusForbidden)
+	expectError(t, ts.client().post("/api/login", LoginRequest{Username: "alice", Password: "alice-password"}), http.StatusForbidden)
+
+	expectStatus(t, admin.do(http.MethodDelete, "/api/admin/user/alice/suspension", nil), http.StatusNoContent)
+	expectError(t, admin.get("/api/admin/user/alice/suspension"), http.StatusNotFound)
+	expectError(t, admin.do(http.MethodDelete, "/api/admin/user/nobody/suspension", nil), http.StatusNotFound)
+	decodeJSON[User](t, alice.get("/api/user/me"), http.StatusOK)
+	expectStatus(t, ts.client().post("/api/login", LoginRequest{Username: "alice", Password: "alice-password"}), http.StatusOK)
+
+	// 管理者は凍結できない
+	decodeJSON[UserRoleResponse](t, admin.do(http.MethodPut, "/api/admin/user/bob/role", PutUserRoleRequest{Role: RoleAdmin}), http.StatusOK)
+	expectError(t, admin.post("/api/admin/user/bob/suspension", PostUserSuspensionRequest{Reason: "spam"}), http.StatusBadRequest)
+}
+
+func TestPostTag(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	admin := ts.admin()
+
+	tag := decodeJSON[Tag](t, admin.post("/api/admin/tag", PostTagRequest{Name: "歌ってみた"}), http.StatusCreated)
+	if tag.ID == 0 || tag.Name != "歌ってみた" {
+		t.Errorf("tag = %+v", tag)
+	}
+	ts.waitForEvent(InvalidateTag, func(e InvalidationEvent) bool { return e.TagID == tag.ID })
+
+	expectError(t, admin.post("/api/admin/tag", PostTagRequest{Name: "歌ってみた"}), http.StatusConflict)
+	expectError(t, admin.post("/api/admin/tag", PostTagRequest{}), http.StatusBadRequest)
+	expectError(t, admin.post("/api/admin/tag", "tag"), http.StatusBadRequest)
+
+	// 追加したタグはすぐに一覧と予約で使える
+	tags := decodeJSON[TagsResponse](t, alice.get("/api/tag"), http.StatusOK)
+	found := false
+	for _, got := range tags.Tags {
+		found = found || *got == tag
+	}
+	if !found {
+		t.Errorf("%+v not found in tags", tag)
+	}
+	livestream := ts.reserve(alice, 1, "sing", tag.ID)
+	if len(livestream.Tags) != 1 || livestream.Tags[0] != tag {
+		t.Errorf("livestream tags = %+v", livestream.Tags)
+	}
+	searched := decodeJSON[[]Livestream](t, alice.get("/api/livestream/search?tag=歌ってみた"), http.StatusOK)
+	if len(searched) != 1 || searched[0].ID != livestream.ID {
+		t.Errorf("searched = %+v", searched)
+	}
+}
+
+func TestDNSReconcile(t *testing.T) {
+	ts := newTestServer(t)
+	ts.signup("alice")
+	ts.signup("bob")
+	ts.signup("carol")
+	admin := ts.admin()
+
+	expectError(t, admin.get("/api/admin/dns/reconcile"), http.StatusNotFound)
+	expectError(t, admin.post("/api/admin/dns/reconcile?repair=maybe", nil), http.StatusBadRequest)
+
+	// レコードの欠落・向き先違い・孤立を作る
+	ctx := context.Background()
+	if err := ts.dns.DeleteRecord(ctx, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.dns.DeleteRecord(ctx, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.dns.AddRecord(ctx, "bob", "198.51.100.1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.dns.AddRecord(ctx, "ghost", testSubdomainAddress); err != nil {
+		t.Fatal(err)
+	}
+
+	report := decodeJSON[DNSReconcileReport](t, admin.post("/api/admin/dns/reconcile", nil), http.StatusOK)
+	if report.Repair || report.Users != 3 || report.Repaired != 0 ||
+		fmt.Sprint(report.Missing) != "[alice]" || fmt.Sprint(report.Mismatched) != "[bob]" || fmt.Sprint(report.Orphaned) != "[ghost]" {
+		t.Errorf("report = %+v", report)
+	}
+	if _, ok := ts.dns.Lookup("ghost"); !ok {
+		t.Error("record was deleted without repair")
+	}
+	if got := decodeJSON[DNSReconcileReport](t, admin.get("/api/admin/dns/reconcile"), http.StatusOK); fmt.Sprint(got) != fmt.Sprint(report) {
+		t.Errorf("last report = %+v, want %+v", got, report)
+	}
+
+	report = decodeJSON[DNSReconcileReport](t, admin.post("/api/admin/dns/reconcile?repair=true", nil), http.StatusOK)
+	if !report.Repair || report.Repaired != 3 || len(report.Errors) != 0 {
+		t.Errorf("report = %+v", report)
+	}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if addr, ok := ts.dns.Lookup(name); !ok || addr != testSubdomainAddress {
+			t.Errorf("%s: record = %q, %v", name, addr, ok)
+		}
+	}
+	if _, ok := ts.dns.Lookup("ghost"); ok {
+		t.Error("orphaned record was not deleted")
+	}
+
+	report = decodeJSON[DNSReconcileReport](t, admin.post("/api/admin/dns/reconcile", nil), http.StatusOK)
+	if report.Drifted() {
+		t.Errorf("report after repair = %+v", report)
+	}
+}
@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	cacheBusBatchSize     = 100
+	cacheBusMaxPending    = 10000
+	cacheBusSendTimeout   = 5 * time.Second
+	cacheBusMinBackoff    = 500 * time.Millisecond
+	cacheBusMaxBackoff    = 30 * time.Second
+	cacheBusSeenRetention = 10 * time.Minute
+)
+
+// InvalidationKind は他のサーバに捨てさせたいキャッシュの種類です
+type InvalidationKind string
+
+const (
+	// アイコンの変更 (UserID) またはブロックリストの変更 (Hash)
+	InvalidateIcon InvalidationKind = "icon"
+	// タグの追加 (TagID)
+	InvalidateTag InvalidationKind = "tag"
+	// ユーザの登録・削除・凍結の変更 (UserID, UserName)
+	InvalidateUser InvalidationKind = "user"
+	// NGワードの追加 (LivestreamID)
+	InvalidateNGWord InvalidationKind = "ngword"
+	// 全てのキャッシュを作り直す
+	InvalidateAll InvalidationKind = "all"
+)
+
+// InvalidationEvent は他のサーバに送るキャッシュ無効化の通知です。
+// 値そのものは送らず、受け取った側がDBから読み直すので、同じ通知を何度受け取っても結果は変わりません。
+type InvalidationEvent struct {
+	ID           string           `json:"id"`
+	Kind         InvalidationKind `json:"kind"`
+	UserID       int64            `json:"user_id,omitempty"`
+	UserName     string           `json:"user_name,omitempty"`
+	Hash         string           `json:"hash,omitempty"`
+	TagID        int64            `json:"tag_id,omitempty"`
+	LivestreamID int64            `json:"livestream_id,omitempty"`
+	Origin       string           `json:"origin"`
+	CreatedAt    int64            `json:"created_at"`
+}
+
+type InvalidationRequest struct {
+	Events []InvalidationEvent `json:"events"`
+}
+
+// CacheBusTransport は通知を1台のサーバに届けます。エラーを返した通知は後で送り直します
+type CacheBusTransport interface {
+	Send(ctx context.Context, peer string, events []InvalidationEvent) error
+}
+
+// PeerHealth は他のサーバへの配送状況です
+type PeerHealth struct {
+	Peer                string `json:"peer"`
+	Healthy             bool   `json:"healthy"`
+	Pending             int    `json:"pending"`
+	Delivered           int64  `json:"delivered"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	LastSuccessAt       int64  `json:"last_success_at"`
+	LastFailureAt       int64  `json:"last_failure_at"`
+	LastError           string `json:"last_error,omitempty"`
+}
+
+// CacheBus は設定された他のサーバへキャッシュ無効化の通知を配ります。
+// 通知はサーバごとの送信待ちに積み、届くまで送り直します (at-least-once)。
+// 受け取った側は通知のIDで重複を取り除いてから、種類ごとの購読者に渡します。
+type CacheBus struct {
+	origin    string
+	transport CacheBusTransport
+	outboxes  []*peerOutbox
+	logger    *slog.Logger
+
+	mu       sync.RWMutex
+	handlers map[InvalidationKind][]func(context.Context, InvalidationEvent) error
+
+	seenMu sync.Mutex
+	seen   map[string]time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+type peerOutbox struct {
+	peer   string
+	notify chan struct{}
+
+	mu      sync.Mutex
+	pending []InvalidationEvent
+	health  PeerHealth
+}
+
+var cacheBus = NewCacheBus("", nil, nil, nil)
+
+func NewCacheBus(origin string, peers []string, transport CacheBusTransport, logger *slog.Logger) *CacheBus {
+	b := &CacheBus{
+		origin:    origin,
+		transport: transport,
+		logger:    logger,
+		handlers:  make(map[InvalidationKind][]func(context.Context, InvalidationEvent) error),
+		seen:      make(map[string]time.Time),
+		stop:      make(chan struct{}),
+	}
+	for _, peer := range peers {
+		b.outboxes = append(b.outboxes, &peerOutbox{
+			peer:   peer,
+			notify: make(chan struct{}, 1),
+			health: PeerHealth{Peer: peer, Healthy: true},
+		})
+	}
+	return b
+}
+
+// Subscribe は kind の通知を受け取ったときに呼ぶ処理を登録する
+func (b *CacheBus) Subscribe(kind InvalidationKind, handler func(context.Context, InvalidationEvent) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers[kind] = append(b.handlers[kind], handler)
+}
+
+// Start はサーバごとの配送を始める
+func (b *CacheBus) Start() {
+	for _, outbox := range b.outboxes {
+		b.wg.Add(1)
+		go func(outbox *peerOutbox) {
+			defer b.wg.Done()
+			b.deliver(outbox)
+		}(outbox)
+	}
+}
+
+// Stop は配送を止め、送信中のものが終わるまで待つ。送信待ちの通知は捨てる
+func (b *CacheBus) Stop() {
+	b.stopOnce.Do(func() { close(b.stop) })
+	b.wg.Wait()
+}
+
+func (b *CacheBus) stamp(event InvalidationEvent) InvalidationEvent {
+	if event.ID == "" {
+		event.ID = uuid.NewString()
+	}
+	event.Origin = b.origin
+	event.CreatedAt = time.Now().Unix()
+	return event
+}
+
+// Publish は通知を全てのサーバの送信待ちに積み、すぐに返る
+func (b *CacheBus) Publish(event InvalidationEvent) {
+	event = b.stamp(event)
+	for _, outbox := range b.outboxes {
+		b.enqueue(outbox, event)
+	}
+}
+
+func (b *CacheBus) enqueue(outbox *peerOutbox, event InvalidationEvent) {
+	outbox.mu.Lock()
+	if len(outbox.pending) >= cacheBusMaxPending {
+		// 溜まりすぎたら個別の通知は捨てて、全キャッシュの作り直しにまとめる
+		outbox.pending = []InvalidationEvent{b.stamp(InvalidationEvent{Kind: InvalidateAll})}
+	}
+	outbox.pending = append(outbox.pending, event)
+	outbox.health.Pending = len(outbox.pending)
+	outbox.mu.Unlock()
+
+	select {
+	case outbox.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Broadcast は全てのサーバに通知を直接送り、届くのを待つ
+// 初期化のように、他のサーバが反映し終わってから応答したい場合に使う
+// 届かなかったサーバには送信待ちに積んで、Publish と同じく届くまで送り直す
+func (b *CacheBus) Broadcast(ctx context.Context, event InvalidationEvent) error {
+	event = b.stamp(event)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, outbox := range b.outboxes {
+		wg.Add(1)
+		go func(outbox *peerOutbox) {
+			defer wg.Done()
+			err := b.transport.Send(ctx, outbox.peer, []InvalidationEvent{event})
+			outbox.record(1, err)
+			if err != nil {
+				b.enqueue(outbox, event)
+				mu.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", outbox.peer, err))
+				mu.Unlock()
+			}
+		}(outbox)
+	}
+	wg.Wait()
+
+	return errors.Join(errs...)
+}
+
+func (b *CacheBus) deliver(outbox *peerOutbox) {
+	backoff := cacheBusMinBackoff
+	for {
+		outbox.mu.Lock()
+		n := len(outbox.pending)
+		if n > cacheBusBatchSize {
+			n = cacheBusBatchSize
+		}
+		batch := append([]InvalidationEvent{}, outbox.pending[:n]...)
+		outbox.mu.Unlock()
+
+		if len(batch) == 0 {
+			select {
+			case <-outbox.notify:
+			case <-b.stop:
+				return
+			}
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cacheBusSendTimeout)
+		err := b.transport.Send(ctx, outbox.peer, batch)
+		cancel()
+		outbox.record(len(batch), err)
+
+		if err != nil {
+			if b.logger != nil {
+				b.logger.Warn("failed to deliver invalidation events", "peer", outbox.peer, "events", len(batch), "error", err)
+			}
+			select {
+			case <-time.After(backoff):
+			case <-b.stop:
+				return
+			}
+			backoff = min(backoff*2, cacheBusMaxBackoff)
+			continue
+		}
+		backoff = cacheBusMinBackoff
+
+		outbox.mu.Lock()
+		// 送っている間に溢れてまとめられていた場合は、先頭が送った通知ではなくなっている
+		if len(outbox.pending) >= len(batch) && outbox.pending[0].ID == batch[0].ID {
+			outbox.pending = outbox.pending[len(batch):]
+		}
+		outbox.health.Pending = len(outbox.pending)
+		outbox.mu.Unlock()
+	}
+}
+
+func (o *peerOutbox) record(n int, err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	now := time.Now().Unix()
+	if err != nil {
+		o.health.Healthy = false
+		o.health.ConsecutiveFailures++
+		o.health.LastFailureAt = now
+		o.health.LastError = err.Error()
+		return
+	}
+	o.health.Healthy = true
+	o.health.ConsecutiveFailures = 0
+	o.health.LastSuccessAt = now
+	o.health.LastError = ""
+	o.health.Delivered += int64(n)
+}
+
+// Health は他のサーバごとの配送状況を返す
+func (b *CacheBus) Health() []PeerHealth {
+	health := make([]PeerHealth, 0, len(b.outboxes))
+	for _, outbox := range b.outboxes {
+		outbox.mu.Lock()
+		health = append(health, outbox.health)
+		outbox.mu.Unlock()
+	}
+	return health
+}
+
+// Receive は他のサーバから届いた通知を反映する。一度反映した通知は無視する
+func (b *CacheBus) Receive(ctx context.Context, events []InvalidationEvent) error {
+	for _, event := range events {
+		if !b.markSeen(event.ID) {
+			continue
+		}
+
+		b.mu.RLock()
+		handlers := b.handlers[event.Kind]
+		b.mu.RUnlock()
+
+		for _, handler := range handlers {
+			if err := handler(ctx, event); err != nil {
+				// 送り直してもらえるように、反映できなかった通知は未読に戻す
+				b.unmarkSeen(event.ID)
+				return fmt.Errorf("failed to apply %s event %s: %w", event.Kind, event.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (b *CacheBus) markSeen(id string) bool {
+	b.seenMu.Lock()
+	defer b.seenMu.Unlock()
+
+	now := time.Now()
+	for seenID, at := range b.seen {
+		if now.Sub(at) > cacheBusSeenRetention {
+			delete(b.seen, seenID)
+		}
+	}
+	if _, ok := b.seen[id]; ok {
+		return false
+	}
+	b.seen[id] = now
+	return true
+}
+
+func (b *CacheBus) unmarkSeen(id string) {
+	b.seenMu.Lock()
+	defer b.seenMu.Unlock()
+	delete(b.seen, id)
+}
+
+// HTTPで他のサーバの /api/internal/invalidate を呼び出す
+type httpCacheBusTransport struct {
+	client *http.Client
+	token  string
+}
+
+func (t *httpCacheBusTransport) Send(ctx context.Context, peer string, events []InvalidationEvent) error {
+	body, err := json.Marshal(InvalidationRequest{Events: events})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(peer, "/")+"/api/internal/invalidate", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(adminTokenHeader, t.token)
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("peer returned %s: %s", res.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// 設定から通知の配送を組み立てて開始する
+func startCacheBus(cfg *Config, logger *slog.Logger) {
+	origin, err := os.Hostname()
+	if err != nil {
+		origin = cfg.ListenAddr
+	}
+	transport := &httpCacheBusTransport{
+		client: &http.Client{Timeout: cacheBusSendTimeout},
+		token:  cfg.AdminToken,
+	}
+	cacheBus = NewCacheBus(origin, cfg.Peers, transport, logger)
+	subscribeCacheInvalidations(cacheBus)
+	cacheBus.Start()
+}
+
+// 通知の種類ごとに、このサーバのキャッシュをDBから読み直す処理を登録する
+// NGワードは今はキャッシュしていないので購読しない
+func subscribeCacheInvalidations(bus *CacheBus) {
+	bus.Subscribe(InvalidateIcon, func(ctx context.Context, event InvalidationEvent) error {
+		if event.Hash != "" {
+			if err := refreshBlockedIcon(ctx, event.Hash); err != nil {
+				return err
+			}
+		}
+		if event.UserID != 0 {
+			return refreshUserCaches(ctx, event.UserID, event.UserName)
+		}
+		return nil
+	})
+	bus.Subscribe(InvalidateTag, func(ctx context.Context, event InvalidationEvent) error {
+		tagModel, err := dataStore.Tags().Get(ctx, event.TagID)
+		if err != nil {
+			return err
+		}
+		tagCache.Add(tagModel)
+		return nil
+	})
+	bus.Subscribe(InvalidateUser, func(ctx context.Context, event InvalidationEvent) error {
+		return refreshUserCaches(ctx, event.UserID, event.UserName)
+	})
+	bus.Subscribe(InvalidateAll, func(ctx context.Context, event InvalidationEvent) error {
+		return reloadAllCaches(ctx)
+	})
+}
+
+// ユーザのアイコン・凍結・DNSレコードのキャッシュをDBから読み直す。削除済みなら消す
+func refreshUserCaches(ctx context.Context, userID int64, userName string) error {
+	userModel, err := dataStore.Users().Get(ctx, userID)
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		iconHashCache.Delete(userID)
+		iconHashCacheByUserName.Delete(userName)
+		suspensionCache.Delete(userID)
+		if dnsServer, ok := dnsProvider.(*embeddedDNSServer); ok && userName != "" {
+			return dnsServer.DeleteRecord(ctx, userName)
+		}
+		return nil
+	}
+
+	if iconModel, err := dataStore.Icons().GetCurrent(ctx, userID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		iconHashCache.Delete(userID)
+		iconHashCacheByUserName.Delete(userModel.Name)
+	} else {
+		addIconHash(userID, iconModel.Hash)
+		addIconHashByUserName(userModel.Name, iconModel.Hash)
+	}
+
+	if suspensionModel, err := dataStore.Users().GetSuspension(ctx, userID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		suspensionCache.Delete(userID)
+	} else {
+		suspensionCache.Set(suspensionModel)
+	}
+
+	if dnsServer, ok := dnsProvider.(*embeddedDNSServer); ok {
+		return dnsServer.AddRecord(ctx, userModel.Name, powerDNSSubdomainAddress)
+	}
+	return nil
+}
+
+// ブロックリストの1件をDBから読み直す
+func refreshBlockedIcon(ctx context.Context, hash string) error {
+	blocked, err := dataStore.Icons().IsBlocked(ctx, hash)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		blockedIconCache.Store(hash, struct{}{})
+	} else {
+		blockedIconCache.Delete(hash)
+	}
+	return nil
+}
+
+// このサーバの全てのキャッシュをDBから作り直す
+func reloadAllCaches(ctx context.Context) error {
+	if err := warmIconHashCache(ctx); err != nil {
+		return fmt.Errorf("failed to load icon hashes: %w", err)
+	}
+	if err := loadSuspensionCache(ctx); err != nil {
+		return fmt.Errorf("failed to load suspensions: %w", err)
+	}
+	if err := loadBlockedIconCache(ctx); err != nil {
+		return fmt.Errorf("failed to load icon blocklist: %w", err)
+	}
+	if err := loadTagCache(ctx); err != nil {
+		return fmt.Errorf("failed to load tags: %w", err)
+	}
+	if err := reloadEmbeddedDNSRecords(ctx); err != nil {
+		return fmt.Errorf("failed to load dns records: %w", err)
+	}
+	return nil
+}
+
+// キャッシュ無効化の通知受信API
+// POST /api/internal/invalidate
+func postInvalidateHandler(c echo.Context) error {
+	defer c.Request().Body.Close()
+
+	var req InvalidationRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	if err := cacheBus.Receive(c.Request().Context(), req.Events); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 他のサーバへの配送状況取得API
+// GET /api/admin/cluster/peers
+func getClusterPeersHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, cacheBus.Health())
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	// セッションクッキーを <username>.u.isucon.dev の全てで共有するためのドメイン
+	sessionCookieDomain = dnsZone
+	// <username>.<channelDomain> を配信者のチャンネルとして扱う
+	channelDomain = dnsZone
+)
+
+// チャンネルのサブドメイン直下で提供するパスと、書き換え先の /api/user/:username 以下のパス
+var channelRoutes = map[string]string{
+	"/profile":    "",
+	"/theme":      "/theme",
+	"/livestream": "/livestream",
+	"/statistics": "/statistics",
+	"/icon":       "/icon",
+}
+
+// ログイン・ログアウトで使うセッションクッキーの設定
+func sessionOptions(maxAge int) *sessions.Options {
+	return &sessions.Options{
+		Domain: sessionCookieDomain,
+		MaxAge: maxAge,
+		Path:   "/",
+	}
+}
+
+// Hostヘッダのサブドメインから配信者のユーザ名を取り出す
+// ゾーン頂点や予約済みの名前 (pipe, wwwなど) はチャンネルではない
+func channelUsernameFromHost(host string) (string, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	name, ok := strings.CutSuffix(host, "."+channelDomain)
+	if !ok || !usernamePattern.MatchString(name) || reservedUsernames.Contains(name) {
+		return "", false
+	}
+	return name, true
+}
+
+// <username>.u.isucon.dev へのリクエストのうちチャンネル用のパスを、
+// ルーティングの前に /api/user/:username 以下のAPIへ書き換える
+// それ以外のパス (/api/... など) はサブドメインでもそのまま扱う
+func channelHostMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		name, ok := channelUsernameFromHost(c.Request().Host)
+		if !ok {
+			return next(c)
+		}
+		req := c.Request()
+		if suffix, ok := channelRoutes[strings.TrimSuffix(req.URL.Path, "/")]; ok {
+			req.URL.Path = "/api/user/" + name + suffix
+			req.URL.RawPath = ""
+		}
+
+		return next(c)
+	}
+}
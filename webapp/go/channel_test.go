@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestChannelUsernameFromHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "alice.u.isucon.dev", want: "alice"},
+		{host: "alice.u.isucon.dev:8080", want: "alice"},
+		{host: "alice.u.isucon.dev.", want: "alice"},
+		{host: "alice.u.isucon.dev.:443", want: "alice"},
+		{host: "Alice.U.Isucon.Dev", want: "alice"},
+		{host: "isu-con-2023.u.isucon.dev", want: "isu-con-2023"},
+		// ゾーン頂点
+		{host: "u.isucon.dev"},
+		{host: "u.isucon.dev:8080"},
+		{host: ".u.isucon.dev"},
+		// 予約済みの名前
+		{host: "pipe.u.isucon.dev"},
+		{host: "www.u.isucon.dev:443"},
+		// ユーザ名にならない名前や、ゾーンの外
+		{host: "a.b.u.isucon.dev"},
+		{host: "-alice.u.isucon.dev"},
+		{host: "alice_.u.isucon.dev"},
+		{host: "alice.xu.isucon.dev"},
+		{host: "alice.isucon.dev"},
+		{host: "localhost:8080"},
+		{host: "127.0.0.1"},
+		{host: ""},
+	}
+	for _, tt := range tests {
+		got, ok := channelUsernameFromHost(tt.host)
+		if got != tt.want || ok != (tt.want != "") {
+			t.Errorf("channelUsernameFromHost(%q) = %q, %v, want %q", tt.host, got, ok, tt.want)
+		}
+	}
+}
+
+func TestChannelHostMiddleware(t *testing.T) {
+	e := echo.New()
+	e.Pre(channelHostMiddleware)
+	e.Any("/*", func(c echo.Context) error {
+		return c.String(http.StatusOK, c.Request().URL.Path)
+	})
+
+	tests := []struct {
+		host string
+		path string
+		want string
+	}{
+		{host: "alice.u.isucon.dev", path: "/profile", want: "/api/user/alice"},
+		{host: "alice.u.isucon.dev", path: "/profile/", want: "/api/user/alice"},
+		{host: "alice.u.isucon.dev:8080", path: "/theme", want: "/api/user/alice/theme"},
+		{host: "alice.u.isucon.dev.", path: "/livestream", want: "/api/user/alice/livestream"},
+		{host: "alice.u.isucon.dev", path: "/statistics", want: "/api/user/alice/statistics"},
+		{host: "alice.u.isucon.dev", path: "/icon", want: "/api/user/alice/icon"},
+		// チャンネル用以外のパスはそのまま
+		{host: "alice.u.isucon.dev", path: "/api/tag", want: "/api/tag"},
+		{host: "alice.u.isucon.dev", path: "/profile/edit", want: "/profile/edit"},
+		{host: "alice.u.isucon.dev", path: "/", want: "/"},
+		// チャンネルでないホストは書き換えない
+		{host: "pipe.u.isucon.dev", path: "/profile", want: "/profile"},
+		{host: "u.isucon.dev", path: "/theme", want: "/theme"},
+		{host: "localhost:8080", path: "/icon", want: "/icon"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Body.String() != tt.want {
+			t.Errorf("%s%s: %d %s, want %s", tt.host, tt.path, rec.Code, rec.Body, tt.want)
+		}
+	}
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	configFileEnvKey = "ISUCON13_CONFIG"
+
+	redactedValue = "***"
+)
+
+// Config はアプリケーションの設定です。
+// デフォルト値 → 設定ファイル (JSON) → 環境変数 → コマンドライン引数 の順に上書きして作ります。
+type Config struct {
+	// HTTPサーバの待ち受けアドレス
+	ListenAddr string `json:"listen_addr"`
+	// pprof/fgprofの待ち受けアドレス。空なら起動しない
+	PprofAddr string `json:"pprof_addr"`
+	// キャッシュの無効化を通知する他のサーバ (例: http://isucon-s2:8080)。既定では単独で動く
+	// 通知は AdminToken で認証するので、指定するときは AdminToken も設定する
+	Peers []string `json:"peers"`
+	// 運営用APIをセッションなしで呼ぶためのトークン
+	// 最初のadminはこのトークンを付けて PUT /api/admin/user/:username/role で作るか、AdminUsers に書く
+	AdminToken string `json:"admin_token"`
+	// /api/initialize のたびにadminにするユーザ名
+	// 初期化でロールはすべて消えるので、ここに書いたユーザだけは付け直さずに運営を続けられる
+	AdminUsers []string `json:"admin_users"`
+	// <username>.<ChannelDomain> を配信者のチャンネルとして扱う
+	ChannelDomain string `json:"channel_domain"`
+	// 既定の予約語に追加で登録させない名前
+	ExtraReservedUsernames []string `json:"extra_reserved_usernames"`
+
+	MySQL   MySQLConfig   `json:"mysql"`
+	Session SessionConfig `json:"session"`
+	Icon    IconConfig    `json:"icon"`
+	DNS     DNSConfig     `json:"dns"`
+	Tracing TracingConfig `json:"tracing"`
+	Log     LogConfig     `json:"log"`
+
+	QueryStats QueryStatsConfig `json:"query_stats"`
+}
+
+type MySQLConfig struct {
+	Net       string `json:"net"`
+	Host      string `json:"host"`
+	Port      int    `json:"port"`
+	User      string `json:"user"`
+	Password  string `json:"password"`
+	Database  string `json:"database"`
+	ParseTime bool   `json:"parse_time"`
+	// 読み取り専用のトランザクションを振り分けるレプリカ (host:port)
+	Replicas []string `json:"replicas"`
+	// これ以上遅れているレプリカには振り分けない
+	MaxReplicaLag Duration `json:"max_replica_lag"`
+	// レプリカの遅延を確認する間隔
+	ReplicaCheckInterval Duration `json:"replica_check_interval"`
+	// 起動時に未適用のマイグレーションを適用する
+	MigrateOnStart bool `json:"migrate_on_start"`
+	// 初期化で読み込む init.sql と initial_*.sql の置き場所
+	SeedDir string `json:"seed_dir"`
+}
+
+type SessionConfig struct {
+	// セッションクッキーの署名鍵。推測されるとセッションを偽造できるので既定値は持たず、必ず設定する
+	SecretKey    string `json:"secret_key"`
+	CookieDomain string `json:"cookie_domain"`
+}
+
+type IconConfig struct {
+	// local, db, s3
+	Store    string       `json:"store"`
+	Dir      string       `json:"dir"`
+	MaxBytes int64        `json:"max_bytes"`
+	S3       IconS3Config `json:"s3"`
+}
+
+type IconS3Config struct {
+	Endpoint        string `json:"endpoint"`
+	Bucket          string `json:"bucket"`
+	Region          string `json:"region"`
+	AccessKeyID     string `json:"access_key_id"`
+	SecretAccessKey string `json:"secret_access_key"`
+}
+
+type DNSConfig struct {
+	// pdnsutil, api, memory, embedded
+	Provider string `json:"provider"`
+	// ユーザのサブドメインのAレコードが指すアドレス
+	SubdomainAddress  string   `json:"subdomain_address"`
+	PowerDNSAPIURL    string   `json:"powerdns_api_url"`
+	PowerDNSAPIKey    string   `json:"powerdns_api_key"`
+	PowerDNSServerID  string   `json:"powerdns_server_id"`
+	ServerAddr        string   `json:"server_addr"`
+	ZoneTemplate      string   `json:"zone_template"`
+	ReconcileInterval Duration `json:"reconcile_interval"`
+	ReconcileRepair   bool     `json:"reconcile_repair"`
+}
+
+type TracingConfig struct {
+	// none, file, otlp
+	Exporter string `json:"exporter"`
+	// file: spanを1行に1つずつJSONで追記するファイル
+	File string `json:"file"`
+	// otlp: OTLP/HTTPの送信先 (例: http://127.0.0.1:4318)。/v1/traces に送る
+	OTLPEndpoint string `json:"otlp_endpoint"`
+	ServiceName  string `json:"service_name"`
+	// traceparentのないリクエストを記録する割合 (0〜1)
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+type LogConfig struct {
+	// json, text
+	Format string `json:"format"`
+	// debug, info, warn, error
+	Level string `json:"level"`
+	// サブシステム (http, app, db, dns, cache, tracing) ごとのレベル。指定がなければ level を使う
+	Levels map[string]string `json:"levels"`
+}
+
+type QueryStatsConfig struct {
+	// レスポンスにクエリの回数と時間のヘッダ (X-Sql-Queries, Server-Timing) を付ける
+	Header bool `json:"header"`
+	// 1リクエストで同じSQLをこの回数以上実行したらN+1として警告する。0なら調べない
+	RepeatThreshold int `json:"repeat_threshold"`
+	// ルート ("GET /api/livestream/:livestream_id/livecomment") ごとのクエリ数の上限
+	Budgets map[string]int `json:"budgets"`
+	// 上限を超えたクエリを失敗させる。テストで上限を守らせるためのもので、本番では使わない
+	Enforce bool `json:"enforce"`
+}
+
+// Duration は設定ファイルで "30s" のように書ける時間です
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// 起動時に読み込んだ設定
+var appConfig = defaultConfig()
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr:    ":8080",
+		PprofAddr:     ":6060",
+		ChannelDomain: dnsZone,
+		MySQL: MySQLConfig{
+			Net:                  "tcp",
+			Host:                 "127.0.0.1",
+			Port:                 3306,
+			User:                 "isucon",
+			Password:             "isucon",
+			Database:             "isupipe",
+			ParseTime:            true,
+			MaxReplicaLag:        Duration(time.Second),
+			ReplicaCheckInterval: Duration(time.Second),
+			MigrateOnStart:       true,
+			SeedDir:              "../sql",
+		},
+		Session: SessionConfig{
+			CookieDomain: dnsZone,
+		},
+		Icon: IconConfig{
+			Store:    "local",
+			Dir:      "/opt/icons",
+			MaxBytes: 5 * 1024 * 1024,
+			S3: IconS3Config{
+				Region: "us-east-1",
+			},
+		},
+		DNS: DNSConfig{
+			Provider:         "pdnsutil",
+			PowerDNSAPIURL:   "http://127.0.0.1:8081",
+			PowerDNSServerID: "localhost",
+			ServerAddr:       ":53",
+			ZoneTemplate:     "../pdns/u.isucon.dev.zone",
+		},
+		Tracing: TracingConfig{
+			Exporter:     "none",
+			OTLPEndpoint: "http://127.0.0.1:4318",
+			ServiceName:  "isupipe",
+			SampleRatio:  1,
+		},
+		Log: LogConfig{
+			Format: "json",
+			Level:  "info",
+		},
+		QueryStats: QueryStatsConfig{
+			RepeatThreshold: 10,
+		},
+	}
+}
+
+// 環境変数と設定項目の対応。名前は従来の環境変数をそのまま使う
+func (c *Config) envBindings() map[string]func(string) error {
+	return map[string]func(string) error{
+		"ISUCON13_LISTEN_ADDR":                  stringSetter(&c.ListenAddr),
+		"ISUCON13_PPROF_ADDR":                   stringSetter(&c.PprofAddr),
+		"ISUCON13_PEERS":                        listSetter(&c.Peers),
+		"ISUCON13_ADMIN_TOKEN":                  stringSetter(&c.AdminToken),
+		"ISUCON13_ADMIN_USERS":                  listSetter(&c.AdminUsers),
+		"ISUCON13_CHANNEL_DOMAIN":               stringSetter(&c.ChannelDomain),
+		"ISUCON13_RESERVED_USERNAMES":           listSetter(&c.ExtraReservedUsernames),
+		"ISUCON13_MYSQL_DIALCONFIG_NET":         stringSetter(&c.MySQL.Net),
+		"ISUCON13_MYSQL_DIALCONFIG_ADDRESS":     stringSetter(&c.MySQL.Host),
+		"ISUCON13_MYSQL_DIALCONFIG_PORT":        intSetter(&c.MySQL.Port),
+		"ISUCON13_MYSQL_DIALCONFIG_USER":        stringSetter(&c.MySQL.User),
+		"ISUCON13_MYSQL_DIALCONFIG_PASSWORD":    stringSetter(&c.MySQL.Password),
+		"ISUCON13_MYSQL_DIALCONFIG_DATABASE":    stringSetter(&c.MySQL.Database),
+		"ISUCON13_MYSQL_DIALCONFIG_PARSETIME":   boolSetter(&c.MySQL.ParseTime),
+		"ISUCON13_MYSQL_REPLICAS":               listSetter(&c.MySQL.Replicas),
+		"ISUCON13_MYSQL_MAX_REPLICA_LAG":        durationSetter(&c.MySQL.MaxReplicaLag),
+		"ISUCON13_MYSQL_REPLICA_CHECK_INTERVAL": durationSetter(&c.MySQL.ReplicaCheckInterval),
+		"ISUCON13_MYSQL_MIGRATE_ON_START":       boolSetter(&c.MySQL.MigrateOnStart),
+		"ISUCON13_MYSQL_SEED_DIR":               stringSetter(&c.MySQL.SeedDir),
+		"ISUCON13_SESSION_SECRETKEY":            stringSetter(&c.Session.SecretKey),
+		"ISUCON13_SESSION_COOKIE_DOMAIN":        stringSetter(&c.Session.CookieDomain),
+		"ISUCON13_ICON_STORE":                   stringSetter(&c.Icon.Store),
+		"ISUCON13_ICON_DIR":                     stringSetter(&c.Icon.Dir),
+		"ISUCON13_ICON_MAX_BYTES":               int64Setter(&c.Icon.MaxBytes),
+		"ISUCON13_ICON_S3_ENDPOINT":             stringSetter(&c.Icon.S3.Endpoint),
+		"ISUCON13_ICON_S3_BUCKET":               stringSetter(&c.Icon.S3.Bucket),
+		"ISUCON13_ICON_S3_REGION":               stringSetter(&c.Icon.S3.Region),
+		"ISUCON13_ICON_S3_ACCESS_KEY_ID":        stringSetter(&c.Icon.S3.AccessKeyID),
+		"ISUCON13_ICON_S3_SECRET_ACCESS_KEY":    stringSetter(&c.Icon.S3.SecretAccessKey),
+		"ISUCON13_DNS_PROVIDER":                 stringSetter(&c.DNS.Provider),
+		"ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS":   stringSetter(&c.DNS.SubdomainAddress),
+		"ISUCON13_POWERDNS_API_URL":             stringSetter(&c.DNS.PowerDNSAPIURL),
+		"ISUCON13_POWERDNS_API_KEY":             stringSetter(&c.DNS.PowerDNSAPIKey),
+		"ISUCON13_POWERDNS_SERVER_ID":           stringSetter(&c.DNS.PowerDNSServerID),
+		"ISUCON13_DNS_SERVER_ADDR":              stringSetter(&c.DNS.ServerAddr),
+		"ISUCON13_DNS_ZONE_TEMPLATE":            stringSetter(&c.DNS.ZoneTemplate),
+		"ISUCON13_DNS_RECONCILE_INTERVAL":       durationSetter(&c.DNS.ReconcileInterval),
+		"ISUCON13_DNS_RECONCILE_REPAIR":         boolSetter(&c.DNS.ReconcileRepair),
+		"ISUCON13_TRACING_EXPORTER":             stringSetter(&c.Tracing.Exporter),
+		"ISUCON13_TRACING_FILE":                 stringSetter(&c.Tracing.File),
+		"ISUCON13_TRACING_OTLP_ENDPOINT":        stringSetter(&c.Tracing.OTLPEndpoint),
+		"ISUCON13_TRACING_SERVICE_NAME":         stringSetter(&c.Tracing.ServiceName),
+		"ISUCON13_TRACING_SAMPLE_RATIO":         float64Setter(&c.Tracing.SampleRatio),
+		"ISUCON13_LOG_FORMAT":                   stringSetter(&c.Log.Format),
+		"ISUCON13_LOG_LEVEL":                    stringSetter(&c.Log.Level),
+		"ISUCON13_LOG_LEVELS":                   mapSetter(&c.Log.Levels),
+		"ISUCON13_QUERY_STATS_HEADER":           boolSetter(&c.QueryStats.Header),
+		"ISUCON13_QUERY_REPEAT_THRESHOLD":       intSetter(&c.QueryStats.RepeatThreshold),
+		"ISUCON13_QUERY_BUDGETS":                intMapSetter(&c.QueryStats.Budgets),
+		"ISUCON13_QUERY_BUDGETS_ENFORCE":        boolSetter(&c.QueryStats.Enforce),
+	}
+}
+
+func stringSetter(p *string) func(string) error {
+	return func(v string) error {
+		*p = v
+		return nil
+	}
+}
+
+// カンマ区切りのリスト
+func listSetter(p *[]string) func(string) error {
+	return func(v string) error {
+		*p = nil
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				*p = append(*p, s)
+			}
+		}
+		return nil
+	}
+}
+
+// カンマ区切りの key=value
+func mapSetter(p *map[string]string) func(string) error {
+	return func(v string) error {
+		m := make(map[string]string)
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s == "" {
+				continue
+			}
+			key, value, ok := strings.Cut(s, "=")
+			if !ok {
+				return fmt.Errorf("%q is not key=value", s)
+			}
+			m[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+		*p = m
+		return nil
+	}
+}
+
+// カンマ区切りの key=数値
+func intMapSetter(p *map[string]int) func(string) error {
+	return func(v string) error {
+		var kv map[string]string
+		if err := mapSetter(&kv)(v); err != nil {
+			return err
+		}
+		m := make(map[string]int, len(kv))
+		for key, value := range kv {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			m[key] = n
+		}
+		*p = m
+		return nil
+	}
+}
+
+func intSetter(p *int) func(string) error {
+	return func(v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*p = n
+		return nil
+	}
+}
+
+func int64Setter(p *int64) func(string) error {
+	return func(v string) error {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return err
+		}
+		*p = n
+		return nil
+	}
+}
+
+func float64Setter(p *float64) func(string) error {
+	return func(v string) error {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return err
+		}
+		*p = f
+		return nil
+	}
+}
+
+func boolSetter(p *bool) func(string) error {
+	return func(v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		*p = b
+		return nil
+	}
+}
+
+func durationSetter(p *Duration) func(string) error {
+	return func(v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*p = Duration(d)
+		return nil
+	}
+}
+
+// -dump-config で設定を書き出したときに loadConfig が返す。呼び出し元は正常終了する
+var errConfigDumped = errors.New("config dumped")
+
+// flag.Value として使えるようにする
+type flagSetter func(string) error
+
+func (f flagSetter) String() string     { return "" }
+func (f flagSetter) Set(v string) error { return f(v) }
+
+// fs に共通の引数を登録してから args を解釈し、設定を読み込む
+// -dump-config が指定されていれば、有効な設定を秘匿値を伏せて標準出力に書き出し、errConfigDumped を返す
+func loadConfig(fs *flag.FlagSet, args []string) (*Config, error) {
+	return loadConfigWith(fs, args, (*Config).Validate)
+}
+
+// validate で検証する設定を読み込む
+// サブコマンドはWebサーバの秘密鍵などを持たない環境でも動くよう、使う部分だけを検証する
+func loadConfigWith(fs *flag.FlagSet, args []string, validate func(*Config) error) (*Config, error) {
+	cfg := defaultConfig()
+
+	configPath := fs.String("config", os.Getenv(configFileEnvKey), "path to a JSON config file")
+	dumpConfig := fs.Bool("dump-config", false, "print the effective config with secrets redacted and exit")
+
+	// 引数は環境変数より優先するので、解釈した値は後から適用する
+	var overrides []func() error
+	override := func(name, usage string, set func(string) error) {
+		fs.Var(flagSetter(func(v string) error {
+			overrides = append(overrides, func() error { return set(v) })
+			return nil
+		}), name, usage)
+	}
+	override("listen", "HTTP listen address", stringSetter(&cfg.ListenAddr))
+	override("pprof", "pprof listen address (empty to disable)", stringSetter(&cfg.PprofAddr))
+	override("peers", "comma separated base URLs of the other app servers", listSetter(&cfg.Peers))
+	override("dns-provider", "dns provider (pdnsutil, api, memory, embedded)", stringSetter(&cfg.DNS.Provider))
+	override("icon-store", "icon store (local, db, s3)", stringSetter(&cfg.Icon.Store))
+	override("tracing-exporter", "trace exporter (none, file, otlp)", stringSetter(&cfg.Tracing.Exporter))
+	override("log-level", "log level (debug, info, warn, error)", stringSetter(&cfg.Log.Level))
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configPath != "" {
+		b, err := os.ReadFile(*configPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		if err := json.Unmarshal(b, cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", *configPath, err)
+		}
+	}
+
+	for key, set := range cfg.envBindings() {
+		if v, ok := os.LookupEnv(key); ok {
+			if err := set(v); err != nil {
+				return nil, fmt.Errorf("failed to parse environment variable '%s': %w", key, err)
+			}
+		}
+	}
+
+	for _, apply := range overrides {
+		if err := apply(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := validate(cfg); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	if *dumpConfig {
+		b, err := json.MarshalIndent(cfg.Redacted(), "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println(string(b))
+		return nil, errConfigDumped
+	}
+
+	return cfg, nil
+}
+
+// 設定全体を検証する。サブコマンドは使う部分だけを個別に検証する
+func (c *Config) Validate() error {
+	return errors.Join(
+		c.validateServer(),
+		c.validateMySQL(),
+		c.validateSession(),
+		c.validateIcon(),
+		c.validateDNS(),
+		c.validateTracing(),
+		c.validateLog(),
+		c.validateQueryStats(),
+	)
+}
+
+// HTTPサーバとサーバ間の通知の設定
+func (c *Config) validateServer() error {
+	var errs []error
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		errs = append(errs, fmt.Errorf("listen_addr: %w", err))
+	}
+	if c.PprofAddr != "" {
+		if _, _, err := net.SplitHostPort(c.PprofAddr); err != nil {
+			errs = append(errs, fmt.Errorf("pprof_addr: %w", err))
+		}
+	}
+	for _, peer := range c.Peers {
+		if u, err := url.Parse(peer); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("peers: invalid url %q", peer))
+		}
+	}
+	if len(c.Peers) > 0 && c.AdminToken == "" {
+		// 他のサーバの /api/internal/invalidate は管理者のトークンで認証する
+		errs = append(errs, errors.New("peers: admin_token is required to notify other servers"))
+	}
+	if c.ChannelDomain == "" {
+		errs = append(errs, errors.New("channel_domain must not be empty"))
+	}
+	return errors.Join(errs...)
+}
+
+// MySQLの設定
+func (c *Config) validateMySQL() error {
+	var errs []error
+	if c.MySQL.Port <= 0 || c.MySQL.Port > 65535 {
+		errs = append(errs, fmt.Errorf("mysql.port: out of range: %d", c.MySQL.Port))
+	}
+	if c.MySQL.Database == "" {
+		errs = append(errs, errors.New("mysql.database must not be empty"))
+	}
+	for _, replica := range c.MySQL.Replicas {
+		if _, _, err := net.SplitHostPort(replica); err != nil {
+			errs = append(errs, fmt.Errorf("mysql.replicas: %w", err))
+		}
+	}
+	if c.MySQL.SeedDir == "" {
+		errs = append(errs, errors.New("mysql.seed_dir must not be empty"))
+	}
+	if len(c.MySQL.Replicas) > 0 && (c.MySQL.MaxReplicaLag <= 0 || c.MySQL.ReplicaCheckInterval <= 0) {
+		errs = append(errs, errors.New("mysql.max_replica_lag and mysql.replica_check_interval must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// セッションの設定
+func (c *Config) validateSession() error {
+	if c.Session.SecretKey == "" {
+		return errors.New("session.secret_key must not be empty (set ISUCON13_SESSION_SECRETKEY)")
+	}
+	return nil
+}
+
+// アイコンの保存先の設定
+func (c *Config) validateIcon() error {
+	var errs []error
+	switch c.Icon.Store {
+	case "local":
+		if c.Icon.Dir == "" {
+			errs = append(errs, errors.New("icon.dir must not be empty for local icon store"))
+		}
+	case "db":
+	case "s3":
+		if c.Icon.S3.Endpoint == "" || c.Icon.S3.Bucket == "" {
+			errs = append(errs, errors.New("icon.s3.endpoint and icon.s3.bucket must be provided for s3 icon store"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("icon.store: unknown icon store: %s", c.Icon.Store))
+	}
+	if c.Icon.MaxBytes <= 0 {
+		errs = append(errs, fmt.Errorf("icon.max_bytes: must be positive: %d", c.Icon.MaxBytes))
+	}
+	return errors.Join(errs...)
+}
+
+// DNSの設定
+func (c *Config) validateDNS() error {
+	var errs []error
+	if ip, err := netip.ParseAddr(c.DNS.SubdomainAddress); err != nil || !ip.Is4() {
+		errs = append(errs, fmt.Errorf("dns.subdomain_address: must be an IPv4 address: %q", c.DNS.SubdomainAddress))
+	}
+	switch c.DNS.Provider {
+	case "pdnsutil", "memory":
+	case "api":
+		if c.DNS.PowerDNSAPIKey == "" {
+			errs = append(errs, errors.New("dns.powerdns_api_key must be provided for powerdns api provider"))
+		}
+	case "embedded":
+		if _, _, err := net.SplitHostPort(c.DNS.ServerAddr); err != nil {
+			errs = append(errs, fmt.Errorf("dns.server_addr: %w", err))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("dns.provider: unknown dns provider: %s", c.DNS.Provider))
+	}
+	if c.DNS.ReconcileInterval < 0 {
+		errs = append(errs, errors.New("dns.reconcile_interval must not be negative"))
+	}
+	return errors.Join(errs...)
+}
+
+// トレースの設定
+func (c *Config) validateTracing() error {
+	var errs []error
+	switch c.Tracing.Exporter {
+	case "none":
+	case "file":
+		if c.Tracing.File == "" {
+			errs = append(errs, errors.New("tracing.file must be provided for file trace exporter"))
+		}
+	case "otlp":
+		if u, err := url.Parse(c.Tracing.OTLPEndpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, fmt.Errorf("tracing.otlp_endpoint: invalid url %q", c.Tracing.OTLPEndpoint))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("tracing.exporter: unknown trace exporter: %s", c.Tracing.Exporter))
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		errs = append(errs, fmt.Errorf("tracing.sample_ratio: out of range: %v", c.Tracing.SampleRatio))
+	}
+	return errors.Join(errs...)
+}
+
+// ログの設定
+func (c *Config) validateLog() error {
+	var errs []error
+	if c.Log.Format != "json" && c.Log.Format != "text" {
+		errs = append(errs, fmt.Errorf("log.format: unknown log format: %s", c.Log.Format))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.Log.Level)); err != nil {
+		errs = append(errs, fmt.Errorf("log.level: %w", err))
+	}
+	for subsystem, l := range c.Log.Levels {
+		if _, ok := logLevels[subsystem]; !ok {
+			errs = append(errs, fmt.Errorf("log.levels: unknown subsystem: %s", subsystem))
+		}
+		if err := level.UnmarshalText([]byte(l)); err != nil {
+			errs = append(errs, fmt.Errorf("log.levels.%s: %w", subsystem, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// リクエストごとのSQLの計測の設定
+func (c *Config) validateQueryStats() error {
+	var errs []error
+	if c.QueryStats.RepeatThreshold < 0 {
+		errs = append(errs, errors.New("query_stats.repeat_threshold must not be negative"))
+	}
+	for route, budget := range c.QueryStats.Budgets {
+		if !isValidQueryBudgetRoute(route) {
+			errs = append(errs, fmt.Errorf("query_stats.budgets: route must be \"METHOD /path\": %q", route))
+		}
+		if budget < 0 {
+			errs = append(errs, fmt.Errorf("query_stats.budgets.%s: must not be negative", route))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// 秘匿値を伏せた複製を返す
+func (c *Config) Redacted() *Config {
+	r := *c
+	for _, p := range []*string{
+		&r.AdminToken,
+		&r.MySQL.Password,
+		&r.Session.SecretKey,
+		&r.Icon.S3.SecretAccessKey,
+		&r.DNS.PowerDNSAPIKey,
+	} {
+		if *p != "" {
+			*p = redactedValue
+		}
+	}
+	return &r
+}
+
+// 読み込んだ設定を各所のグローバル変数に反映する
+func applyConfig(cfg *Config) {
+	appConfig = cfg
+	secret = []byte(cfg.Session.SecretKey)
+	adminToken = cfg.AdminToken
+	powerDNSSubdomainAddress = cfg.DNS.SubdomainAddress
+	sessionCookieDomain = cfg.Session.CookieDomain
+	channelDomain = strings.TrimSuffix(cfg.ChannelDomain, ".")
+	iconMaxBytes = cfg.Icon.MaxBytes
+	loadReservedUsernames(cfg.ExtraReservedUsernames)
+	configureLogging(cfg.Log, os.Stderr)
+}
+
+// MySQLの接続先 (host:port)
+func (c MySQLConfig) Addr() string {
+	return net.JoinHostPort(c.Host, strconv.Itoa(c.Port))
+}
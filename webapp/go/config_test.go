@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 環境変数だけで loadConfig を呼ぶ
+func loadTestConfig(t *testing.T, env map[string]string, args ...string) (*Config, error) {
+	t.Helper()
+	return loadTestConfigWith(t, (*Config).Validate, env, args...)
+}
+
+func loadTestConfigWith(t *testing.T, validate func(*Config) error, env map[string]string, args ...string) (*Config, error) {
+	t.Helper()
+	// 実行環境の ISUCON13_* は使わない
+	t.Setenv(configFileEnvKey, "")
+	for key := range defaultConfig().envBindings() {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+	for key, v := range env {
+		t.Setenv(key, v)
+	}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return loadConfigWith(fs, args, validate)
+}
+
+func TestLoadConfigSessionSecret(t *testing.T) {
+	// 署名鍵を設定しなければ起動させない
+	_, err := loadTestConfig(t, map[string]string{
+		"ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS": testSubdomainAddress,
+	})
+	if err == nil || !strings.Contains(err.Error(), "session.secret_key") {
+		t.Errorf("err = %v", err)
+	}
+
+	cfg, err := loadTestConfig(t, map[string]string{
+		"ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS": testSubdomainAddress,
+		"ISUCON13_SESSION_SECRETKEY":          testSessionSecretKey,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Session.SecretKey != testSessionSecretKey {
+		t.Errorf("secret key = %q", cfg.Session.SecretKey)
+	}
+}
+
+func TestLoadConfigDump(t *testing.T) {
+	out, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	stdout := os.Stdout
+	os.Stdout = out
+	t.Cleanup(func() { os.Stdout = stdout })
+
+	// 終了はせず、書き出したことをエラーで知らせる
+	cfg, err := loadTestConfig(t, map[string]string{
+		"ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS": testSubdomainAddress,
+		"ISUCON13_SESSION_SECRETKEY":          testSessionSecretKey,
+	}, "-dump-config", "-listen", ":9090")
+	os.Stdout = stdout
+	if !errors.Is(err, errConfigDumped) || cfg != nil {
+		t.Fatalf("cfg = %+v, err = %v", cfg, err)
+	}
+
+	b, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dumped := string(b)
+	if !strings.Contains(dumped, `"listen_addr": ":9090"`) || !strings.Contains(dumped, `"secret_key": "`+redactedValue+`"`) ||
+		strings.Contains(dumped, testSessionSecretKey) {
+		t.Errorf("dumped config = %s", dumped)
+	}
+
+	// 設定が正しくなければ書き出さずにエラーにする
+	if _, err := loadTestConfig(t, nil, "-dump-config"); err == nil || errors.Is(err, errConfigDumped) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestConfigPeersRequireAdminToken(t *testing.T) {
+	// 既定では他のサーバに通知しない
+	if cfg := defaultConfig(); len(cfg.Peers) != 0 {
+		t.Errorf("default peers = %v", cfg.Peers)
+	}
+
+	cfg := newTestConfig()
+	cfg.Peers = []string{"http://isucon-s2:8080"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "admin_token") {
+		t.Errorf("err = %v", err)
+	}
+	cfg.AdminToken = testAdminToken
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestLoadConfigForSubcommands(t *testing.T) {
+	// マイグレーションはセッションの署名鍵やDNSの設定がなくても動かせる
+	if _, err := loadTestConfigWith(t, validateMigrateConfig, nil); err != nil {
+		t.Errorf("migrate: err = %v", err)
+	}
+	if _, err := loadTestConfigWith(t, validateMigrateConfig, map[string]string{"ISUCON13_MYSQL_DIALCONFIG_PORT": "0"}); err == nil || !strings.Contains(err.Error(), "mysql.port") {
+		t.Errorf("migrate: err = %v", err)
+	}
+
+	// DNSの突き合わせはレコードの向き先を使う
+	_, err := loadTestConfigWith(t, validateReconcileDNSConfig, nil)
+	if err == nil || !strings.Contains(err.Error(), "dns.subdomain_address") || strings.Contains(err.Error(), "session.secret_key") {
+		t.Errorf("reconcile-dns: err = %v", err)
+	}
+	if _, err := loadTestConfigWith(t, validateReconcileDNSConfig, map[string]string{"ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS": testSubdomainAddress}); err != nil {
+		t.Errorf("reconcile-dns: err = %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// ReplicaStatus はレプリカの状態です
+type ReplicaStatus struct {
+	Addr      string `json:"addr"`
+	Healthy   bool   `json:"healthy"`
+	LagSecond int64  `json:"lag_seconds"`
+	CheckedAt int64  `json:"checked_at"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+type replica struct {
+	addr string
+	db   *sqlx.DB
+
+	mu     sync.RWMutex
+	status ReplicaStatus
+}
+
+func (r *replica) healthy() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.status.Healthy
+}
+
+// ReplicaPool は読み取り専用のトランザクションを遅延の小さいレプリカに振り分けます。
+// 使えるレプリカがなければプライマリを使います。
+type ReplicaPool struct {
+	replicas []*replica
+	maxLag   time.Duration
+	next     atomic.Uint64
+}
+
+var replicaPool = &ReplicaPool{}
+
+func newReplicaPool(cfg MySQLConfig) (*ReplicaPool, error) {
+	pool := &ReplicaPool{maxLag: time.Duration(cfg.MaxReplicaLag)}
+	for _, addr := range cfg.Replicas {
+		db, err := openMySQL(cfg, addr)
+		if err != nil {
+			pool.Close()
+			return nil, fmt.Errorf("failed to connect replica %s: %w", addr, err)
+		}
+		pool.replicas = append(pool.replicas, &replica{
+			addr:   addr,
+			db:     db,
+			status: ReplicaStatus{Addr: addr},
+		})
+	}
+	return pool, nil
+}
+
+func (p *ReplicaPool) Close() {
+	for _, r := range p.replicas {
+		r.db.Close()
+	}
+}
+
+// 遅延を定期的に確認する。最初の確認が終わるまではどのレプリカも使わない
+func (p *ReplicaPool) Start(interval time.Duration, logger *slog.Logger) {
+	if len(p.replicas) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			for _, r := range p.replicas {
+				p.check(r, logger)
+			}
+			<-ticker.C
+		}
+	}()
+}
+
+func (p *ReplicaPool) check(r *replica, logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	lag, err := replicationLag(ctx, r.db)
+	if err == nil && lag > p.maxLag {
+		err = fmt.Errorf("replication lag %s exceeds %s", lag, p.maxLag)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	wasHealthy := r.status.Healthy
+	r.status.CheckedAt = time.Now().Unix()
+	r.status.LagSecond = int64(lag / time.Second)
+	r.status.Healthy = err == nil
+	r.status.LastError = ""
+	if err != nil {
+		r.status.LastError = err.Error()
+		if wasHealthy && logger != nil {
+			logger.Warn("replica is out of rotation", "replica", r.addr, "error", err)
+		}
+	}
+}
+
+// SHOW REPLICA STATUS (古いMySQLでは SHOW SLAVE STATUS) から遅延を読む
+// レプリケーションが止まっている・設定されていない場合はエラーを返す
+func replicationLag(ctx context.Context, db *sqlx.DB) (time.Duration, error) {
+	for _, q := range []struct{ query, column string }{
+		{"SHOW REPLICA STATUS", "Seconds_Behind_Source"},
+		{"SHOW SLAVE STATUS", "Seconds_Behind_Master"},
+	} {
+		rows, err := db.QueryxContext(ctx, q.query)
+		if err != nil {
+			continue
+		}
+		defer rows.Close()
+
+		if !rows.Next() {
+			return 0, errors.New("replication is not configured")
+		}
+		row := map[string]interface{}{}
+		if err := rows.MapScan(row); err != nil {
+			return 0, err
+		}
+		v, ok := row[q.column]
+		if !ok || v == nil {
+			return 0, errors.New("replication is not running")
+		}
+		var s string
+		switch v := v.(type) {
+		case []byte:
+			s = string(v)
+		default:
+			s = fmt.Sprint(v)
+		}
+		seconds, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("failed to parse %s: %w", q.column, err)
+		}
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return 0, errors.New("failed to get replica status")
+}
+
+// 使えるレプリカを順番に返す。なければnil
+func (p *ReplicaPool) pick() *sqlx.DB {
+	n := len(p.replicas)
+	if n == 0 {
+		return nil
+	}
+	start := p.next.Add(1)
+	for i := 0; i < n; i++ {
+		r := p.replicas[(start+uint64(i))%uint64(n)]
+		if r.healthy() {
+			return r.db
+		}
+	}
+	return nil
+}
+
+func (p *ReplicaPool) Status() []ReplicaStatus {
+	statuses := make([]ReplicaStatus, 0, len(p.replicas))
+	for _, r := range p.replicas {
+		r.mu.RLock()
+		statuses = append(statuses, r.status)
+		r.mu.RUnlock()
+	}
+	return statuses
+}
+
+type primaryOnlyKey struct{}
+
+// 書き込みを伴うリクエストでは、同じリクエスト内の読み取りも全てプライマリで行う
+// (書いた直後の値がレプリカにまだ届いていないことがあるため)
+func dbRoutingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		switch c.Request().Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			req := c.Request()
+			c.SetRequest(req.WithContext(context.WithValue(req.Context(), primaryOnlyKey{}, true)))
+		}
+		return next(c)
+	}
+}
+
+// 読み取りに使う接続を返す。レプリカが使えればレプリカ、なければ primary
+func (p *ReplicaPool) readDB(ctx context.Context, primary *sqlx.DB) *sqlx.DB {
+	if primaryOnly, _ := ctx.Value(primaryOnlyKey{}).(bool); primaryOnly {
+		return primary
+	}
+	if replica := p.pick(); replica != nil {
+		return replica
+	}
+	return primary
+}
+
+// レプリカの状態取得API
+// GET /api/admin/db/replicas
+func getDBReplicasHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, replicaPool.Status())
+}
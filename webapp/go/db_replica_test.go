@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 接続はしないので、どのDBが選ばれたかだけを確かめられる
+func openUnconnectedDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	db, err := sqlx.Open("mysql", "isucon@tcp(127.0.0.1:0)/isupipe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestReplicaPoolReadDB(t *testing.T) {
+	primary := openUnconnectedDB(t)
+	healthy := &replica{addr: "replica1:3306", db: openUnconnectedDB(t), status: ReplicaStatus{Healthy: true}}
+	lagging := &replica{addr: "replica2:3306", db: openUnconnectedDB(t)}
+	pool := &ReplicaPool{replicas: []*replica{lagging, healthy}}
+	ctx := context.Background()
+
+	// 遅れているレプリカは飛ばす
+	for i := 0; i < 4; i++ {
+		if db := pool.readDB(ctx, primary); db != healthy.db {
+			t.Errorf("read db = %p, want healthy replica", db)
+		}
+	}
+	// 書き込みを伴うリクエストの中ではプライマリで読む
+	if db := pool.readDB(context.WithValue(ctx, primaryOnlyKey{}, true), primary); db != primary {
+		t.Errorf("primary only: read db = %p", db)
+	}
+	// 使えるレプリカがなければプライマリ
+	healthy.status.Healthy = false
+	if db := pool.readDB(ctx, primary); db != primary {
+		t.Errorf("no healthy replica: read db = %p", db)
+	}
+	if db := (&ReplicaPool{}).readDB(ctx, primary); db != primary {
+		t.Errorf("no replicas: read db = %p", db)
+	}
+
+	// Storeはグローバルの接続ではなく、渡されたプライマリとレプリカを使う
+	store := newMySQLStore(primary, pool)
+	if store.db != primary || store.replicas != pool {
+		t.Errorf("store = %+v", store)
+	}
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnsZone = "u.isucon.dev"
+
+	dnsRecordMaxAttempts  = 3
+	dnsRecordRetryBackoff = 100 * time.Millisecond
+)
+
+// DNSProvider はユーザごとのサブドメインのAレコードを管理します。
+// レコードの追加・削除はどちらも冪等で、リトライしても結果が変わらないようにします。
+type DNSProvider interface {
+	// name のAレコードを addr で置き換える (なければ作る)
+	AddRecord(ctx context.Context, name, addr string) error
+	// name のAレコードを削除する。存在しなくてもエラーにしない
+	DeleteRecord(ctx context.Context, name string) error
+	// ゾーン内の全てのAレコードを、ゾーン名を除いた名前ごとに返す。ゾーン頂点の名前は空文字列
+	ListRecords(ctx context.Context) (map[string][]string, error)
+}
+
+var dnsProvider DNSProvider
+
+func newDNSProvider(cfg DNSConfig) (DNSProvider, error) {
+	switch cfg.Provider {
+	case "pdnsutil":
+		return &pdnsutilDNSProvider{zone: dnsZone}, nil
+	case "api":
+		return &powerDNSAPIProvider{
+			baseURL:  strings.TrimSuffix(cfg.PowerDNSAPIURL, "/"),
+			apiKey:   cfg.PowerDNSAPIKey,
+			serverID: cfg.PowerDNSServerID,
+			zone:     dnsZone,
+			client:   &http.Client{Timeout: 5 * time.Second},
+		}, nil
+	case "memory":
+		return newMemoryDNSProvider(), nil
+	case "embedded":
+		return newEmbeddedDNSServer(dnsZone, cfg.ZoneTemplate, cfg.SubdomainAddress)
+	default:
+		return nil, fmt.Errorf("unknown dns provider: %s", cfg.Provider)
+	}
+}
+
+// 一時的な失敗に備えて、バックオフを挟みながら何度か試す
+func addDNSRecordWithRetry(ctx context.Context, name, addr string) error {
+	backoff := dnsRecordRetryBackoff
+	var err error
+	for attempt := 1; attempt <= dnsRecordMaxAttempts; attempt++ {
+		if err = dnsProvider.AddRecord(ctx, name, addr); err == nil {
+			return nil
+		}
+		if attempt == dnsRecordMaxAttempts {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w (last error: %v)", ctx.Err(), err)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return fmt.Errorf("failed to add dns record after %d attempts: %w", dnsRecordMaxAttempts, err)
+}
+
+// pdnsutilコマンドを呼び出す。PowerDNSと同じホストで動かす場合向け
+type pdnsutilDNSProvider struct {
+	zone string
+}
+
+func (p *pdnsutilDNSProvider) AddRecord(ctx context.Context, name, addr string) error {
+	// add-recordは同じレコードを重ねて追加してしまうので、リトライしても安全なreplace-rrsetを使う
+	if out, err := runCommand(ctx, "pdnsutil", "replace-rrset", p.zone, name, "A", "0", addr); err != nil {
+		return fmt.Errorf("pdnsutil replace-rrset failed: %s: %w", string(out), err)
+	}
+	return nil
+}
+
+func (p *pdnsutilDNSProvider) DeleteRecord(ctx context.Context, name string) error {
+	if out, err := runCommand(ctx, "pdnsutil", "delete-rrset", p.zone, name, "A"); err != nil {
+		return fmt.Errorf("pdnsutil delete-rrset failed: %s: %w", string(out), err)
+	}
+	return nil
+}
+
+func (p *pdnsutilDNSProvider) ListRecords(ctx context.Context) (map[string][]string, error) {
+	out, err := commandOutput(ctx, "pdnsutil", "list-zone", p.zone)
+	if err != nil {
+		return nil, fmt.Errorf("pdnsutil list-zone failed: %w", err)
+	}
+
+	// 1行が "name ttl class type content" の形式
+	records := make(map[string][]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[3] != "A" {
+			continue
+		}
+		name, ok := relativeDNSName(fields[0], p.zone)
+		if !ok {
+			continue
+		}
+		records[name] = append(records[name], fields[4])
+	}
+	return records, nil
+}
+
+// テンプレートのアドレスを埋めたゾーンファイルで、ゾーンを丸ごと置き換える
+func (p *pdnsutilDNSProvider) loadZone(ctx context.Context, templatePath, addr string) error {
+	template, err := os.ReadFile(templatePath)
+	if err != nil {
+		return fmt.Errorf("failed to read zone template: %w", err)
+	}
+
+	f, err := os.CreateTemp("", p.zone+".*.zone")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(strings.ReplaceAll(string(template), dnsZoneTemplateAddrMark, addr)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if out, err := runCommand(ctx, "pdnsutil", "load-zone", p.zone, f.Name()); err != nil {
+		return fmt.Errorf("pdnsutil load-zone failed: %s: %w", string(out), err)
+	}
+	return nil
+}
+
+// 初期化でゾーンを初期データのusersテーブルに合わせる
+// pdnsutilはゾーンファイルを読み込み直し、組み込みのDNSサーバはキャッシュの作り直しでusersテーブルから読み込むので何もしない。
+// それ以外はusersテーブルとの突き合わせで直す
+func resetDNSZone(ctx context.Context) error {
+	switch p := dnsProvider.(type) {
+	case *pdnsutilDNSProvider:
+		return p.loadZone(ctx, appConfig.DNS.ZoneTemplate, powerDNSSubdomainAddress)
+	case *embeddedDNSServer:
+		return nil
+	default:
+		report, err := reconcileDNS(ctx, true)
+		if err != nil {
+			return err
+		}
+		if len(report.Errors) > 0 {
+			return fmt.Errorf("failed to repair %d dns records: %s", len(report.Errors), strings.Join(report.Errors, "; "))
+		}
+		return nil
+	}
+}
+
+// FQDNからゾーン名を取り除く。ゾーン外の名前ならfalseを返す
+func relativeDNSName(fqdn, zone string) (string, bool) {
+	fqdn = strings.TrimSuffix(fqdn, ".")
+	if fqdn == zone {
+		return "", true
+	}
+	name, ok := strings.CutSuffix(fqdn, "."+zone)
+	return name, ok
+}
+
+// PowerDNSのHTTP APIを呼び出す。PowerDNSが別ホストにあっても使える
+type powerDNSAPIProvider struct {
+	baseURL  string
+	apiKey   string
+	serverID string
+	zone     string
+	client   *http.Client
+}
+
+type powerDNSRRSets struct {
+	RRSets []powerDNSRRSet `json:"rrsets"`
+}
+
+type powerDNSRRSet struct {
+	Name       string           `json:"name"`
+	Type       string           `json:"type"`
+	TTL        int              `json:"ttl"`
+	ChangeType string           `json:"changetype,omitempty"`
+	Records    []powerDNSRecord `json:"records"`
+}
+
+type powerDNSRecord struct {
+	Content  string `json:"content"`
+	Disabled bool   `json:"disabled"`
+}
+
+func (p *powerDNSAPIProvider) AddRecord(ctx context.Context, name, addr string) error {
+	return p.patchRRSet(ctx, powerDNSRRSet{
+		Name:       p.fqdn(name),
+		Type:       "A",
+		ChangeType: "REPLACE",
+		Records:    []powerDNSRecord{{Content: addr}},
+	})
+}
+
+func (p *powerDNSAPIProvider) DeleteRecord(ctx context.Context, name string) error {
+	return p.patchRRSet(ctx, powerDNSRRSet{
+		Name:       p.fqdn(name),
+		Type:       "A",
+		ChangeType: "DELETE",
+		Records:    []powerDNSRecord{},
+	})
+}
+
+func (p *powerDNSAPIProvider) ListRecords(ctx context.Context) (map[string][]string, error) {
+	res, err := p.do(ctx, http.MethodGet, p.zoneURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, p.responseError(res)
+	}
+
+	var zone powerDNSRRSets
+	if err := json.NewDecoder(res.Body).Decode(&zone); err != nil {
+		return nil, fmt.Errorf("failed to decode zone: %w", err)
+	}
+
+	records := make(map[string][]string)
+	for _, rrset := range zone.RRSets {
+		if rrset.Type != "A" {
+			continue
+		}
+		name, ok := relativeDNSName(rrset.Name, p.zone)
+		if !ok {
+			continue
+		}
+		for _, record := range rrset.Records {
+			if !record.Disabled {
+				records[name] = append(records[name], record.Content)
+			}
+		}
+	}
+	return records, nil
+}
+
+func (p *powerDNSAPIProvider) fqdn(name string) string {
+	return name + "." + p.zone + "."
+}
+
+func (p *powerDNSAPIProvider) zoneURL() string {
+	return fmt.Sprintf("%s/api/v1/servers/%s/zones/%s", p.baseURL, url.PathEscape(p.serverID), url.PathEscape(p.zone+"."))
+}
+
+func (p *powerDNSAPIProvider) patchRRSet(ctx context.Context, rrset powerDNSRRSet) error {
+	body, err := json.Marshal(powerDNSRRSets{RRSets: []powerDNSRRSet{rrset}})
+	if err != nil {
+		return err
+	}
+	res, err := p.do(ctx, http.MethodPatch, p.zoneURL(), body)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return p.responseError(res)
+	}
+	return nil
+}
+
+func (p *powerDNSAPIProvider) do(ctx context.Context, method, u string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-API-Key", p.apiKey)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return p.client.Do(req)
+}
+
+func (p *powerDNSAPIProvider) responseError(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("powerdns api returned %s: %s", res.Status, strings.TrimSpace(string(body)))
+}
+
+// メモリ上にレコードを持つだけの実装。テストやDNSを使わない環境向け
+type memoryDNSProvider struct {
+	mu      sync.RWMutex
+	records map[string]string
+}
+
+func newMemoryDNSProvider() *memoryDNSProvider {
+	return &memoryDNSProvider{
+		records: make(map[string]string),
+	}
+}
+
+func (p *memoryDNSProvider) AddRecord(_ context.Context, name, addr string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.records[name] = addr
+	return nil
+}
+
+func (p *memoryDNSProvider) DeleteRecord(_ context.Context, name string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.records, name)
+	return nil
+}
+
+func (p *memoryDNSProvider) ListRecords(_ context.Context) (map[string][]string, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	records := make(map[string][]string, len(p.records))
+	for name, addr := range p.records {
+		records[name] = []string{addr}
+	}
+	return records, nil
+}
+
+// name のレコードを返す
+func (p *memoryDNSProvider) Lookup(name string) (string, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	addr, ok := p.records[name]
+	return addr, ok
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// DNSReconcileReport はusersテーブルとゾーンの差分を突き合わせた結果です
+type DNSReconcileReport struct {
+	StartedAt  int64 `json:"started_at"`
+	FinishedAt int64 `json:"finished_at"`
+	Repair     bool  `json:"repair"`
+	Users      int   `json:"users"`
+	Records    int   `json:"records"`
+	// ユーザはいるがレコードがない
+	Missing []string `json:"missing"`
+	// レコードはあるが向き先が違う
+	Mismatched []string `json:"mismatched"`
+	// ユーザがいないのにレコードがある (削除済み・登録が取り消されたユーザなど)
+	Orphaned []string `json:"orphaned"`
+	Repaired int      `json:"repaired"`
+	Errors   []string `json:"errors"`
+}
+
+func (r *DNSReconcileReport) Drifted() bool {
+	return len(r.Missing) > 0 || len(r.Mismatched) > 0 || len(r.Orphaned) > 0
+}
+
+var (
+	// 同時に複数の突き合わせが走らないようにする
+	dnsReconcileMu sync.Mutex
+
+	lastDNSReconcileMu     sync.RWMutex
+	lastDNSReconcileReport *DNSReconcileReport
+)
+
+// usersテーブルとゾーンを突き合わせ、repair ならゾーンをusersテーブルに合わせて直す
+func reconcileDNS(ctx context.Context, repair bool) (*DNSReconcileReport, error) {
+	dnsReconcileMu.Lock()
+	defer dnsReconcileMu.Unlock()
+
+	report := &DNSReconcileReport{
+		StartedAt:  time.Now().Unix(),
+		Repair:     repair,
+		Missing:    []string{},
+		Mismatched: []string{},
+		Orphaned:   []string{},
+		Errors:     []string{},
+	}
+
+	// レコードはユーザのコミット後に作られるので、ゾーンを先に読めば
+	// 登録途中のユーザのレコードを孤立したものと誤判定することはない
+	records, err := dnsProvider.ListRecords(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dns records: %w", err)
+	}
+
+	names, err := dataStore.Users().ListNames(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user names: %w", err)
+	}
+	report.Users = len(names)
+	report.Records = len(records)
+
+	users := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		users[name] = struct{}{}
+		addrs, ok := records[name]
+		switch {
+		case !ok:
+			report.Missing = append(report.Missing, name)
+		case len(addrs) != 1 || addrs[0] != powerDNSSubdomainAddress:
+			report.Mismatched = append(report.Mismatched, name)
+		}
+	}
+	for name := range records {
+		if _, ok := users[name]; ok {
+			continue
+		}
+		// ゾーン頂点やns1などゾーンファイルにある固定のレコードは予約済みのユーザ名になっている
+		if name == "" || reservedUsernames.Contains(name) {
+			continue
+		}
+		report.Orphaned = append(report.Orphaned, name)
+	}
+	sort.Strings(report.Missing)
+	sort.Strings(report.Mismatched)
+	sort.Strings(report.Orphaned)
+
+	if repair {
+		for _, name := range append(append([]string{}, report.Missing...), report.Mismatched...) {
+			if err := addDNSRecordWithRetry(ctx, name, powerDNSSubdomainAddress); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", name, err))
+				continue
+			}
+			report.Repaired++
+		}
+		for _, name := range report.Orphaned {
+			if err := dnsProvider.DeleteRecord(ctx, name); err != nil {
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", name, err))
+				continue
+			}
+			report.Repaired++
+		}
+	}
+
+	report.FinishedAt = time.Now().Unix()
+
+	lastDNSReconcileMu.Lock()
+	lastDNSReconcileReport = report
+	lastDNSReconcileMu.Unlock()
+
+	return report, nil
+}
+
+// 設定で間隔が指定されていれば、定期的に突き合わせを行う
+func startDNSReconciler(cfg DNSConfig, logger *slog.Logger) {
+	interval := time.Duration(cfg.ReconcileInterval)
+	if interval <= 0 {
+		return
+	}
+	repair := cfg.ReconcileRepair
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			report, err := reconcileDNS(context.Background(), repair)
+			if err != nil {
+				logger.Warn("dns reconciliation failed", "error", err)
+				continue
+			}
+			if report.Drifted() {
+				logger.Warn("dns drift detected",
+					"missing", len(report.Missing), "mismatched", len(report.Mismatched), "orphaned", len(report.Orphaned),
+					"repaired", report.Repaired, "errors", len(report.Errors))
+			}
+		}
+	}()
+}
+
+// DNS突き合わせの直近の結果取得API
+// GET /api/admin/dns/reconcile
+func getDNSReconcileHandler(c echo.Context) error {
+	lastDNSReconcileMu.RLock()
+	report := lastDNSReconcileReport
+	lastDNSReconcileMu.RUnlock()
+
+	if report == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "dns reconciliation has not run yet")
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+// DNS突き合わせ実行API
+// POST /api/admin/dns/reconcile?repair=true
+func postDNSReconcileHandler(c echo.Context) error {
+	repair := false
+	if v := c.QueryParam("repair"); v != "" {
+		var err error
+		repair, err = strconv.ParseBool(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "repair query parameter must be bool")
+		}
+	}
+
+	report, err := reconcileDNS(c.Request().Context(), repair)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reconcile dns: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, report)
+}
+
+// usersテーブルとゾーンだけを使うので、Webサーバの秘密鍵などは要らない
+func validateReconcileDNSConfig(c *Config) error {
+	return errors.Join(c.validateMySQL(), c.validateDNS(), c.validateLog())
+}
+
+// isupipe reconcile-dns [-repair]
+// 結果をJSONで標準出力に書き出す。差分が残っていれば終了コード2を返す
+func runReconcileDNSCommand(args []string) int {
+	fs := flag.NewFlagSet("reconcile-dns", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "fix drift by adding missing records and deleting orphaned ones")
+
+	logger := dnsLogger.With("command", "reconcile-dns")
+
+	cfg, err := loadConfigWith(fs, args, validateReconcileDNSConfig)
+	if errors.Is(err, errConfigDumped) {
+		return 0
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		return 1
+	}
+	applyConfig(cfg)
+
+	conn, err := connectDB()
+	if err != nil {
+		logger.Error("failed to connect db", "error", err)
+		return 1
+	}
+	defer conn.Close()
+	dbConn = conn
+	// 差分の確認はプライマリだけで行う
+	dataStore = newMySQLStore(conn, &ReplicaPool{})
+
+	provider, err := newDNSProvider(cfg.DNS)
+	if err != nil {
+		logger.Error("failed to set up dns provider", "error", err)
+		return 1
+	}
+	dnsProvider = provider
+
+	report, err := reconcileDNS(context.Background(), *repair)
+	if err != nil {
+		logger.Error(err.Error())
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		logger.Error("failed to write report", "error", err)
+		return 1
+	}
+
+	if len(report.Errors) > 0 {
+		return 1
+	}
+	if report.Drifted() && !*repair {
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	dnsZoneTemplateAddrMark = "<ISUCON_SUBDOMAIN_ADDRESS>"
+
+	// ユーザのレコードはpdnsutilで登録していたときと同じくTTL 0で返す
+	dnsUserRecordTTL = 0
+	dnsTCPTimeout    = 5 * time.Second
+	dnsUDPMaxSize    = 512
+)
+
+// ゾーンファイルから読み込んだ固定のレコード
+type dnsStaticRecord struct {
+	Type dnsmessage.Type
+	TTL  uint32
+	A    [4]byte
+	NS   dnsmessage.Name
+	SOA  dnsmessage.SOAResource
+}
+
+// embeddedDNSServer はPowerDNSの代わりにu.isucon.devゾーンに直接応答する権威DNSサーバです。
+// SOA/NSなどの固定のレコードはゾーンファイルのテンプレートから、ユーザのAレコードはusersテーブルから作ります。
+// DNSProviderも実装しているので、ユーザの登録・削除がそのままメモリ上の索引に反映されます。
+type embeddedDNSServer struct {
+	zone   string
+	origin dnsmessage.Name
+	soa    dnsStaticRecord
+	// ゾーン名を除いた名前ごとの固定のレコード。ゾーン頂点は空文字列
+	static map[string][]dnsStaticRecord
+
+	mu    sync.RWMutex
+	users map[string][4]byte
+}
+
+func newEmbeddedDNSServer(zone, templatePath, addr string) (*embeddedDNSServer, error) {
+	f, err := os.Open(templatePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open zone template: %w", err)
+	}
+	defer f.Close()
+
+	s := &embeddedDNSServer{
+		zone:   zone,
+		origin: dnsmessage.MustNewName(zone + "."),
+		static: make(map[string][]dnsStaticRecord),
+		users:  make(map[string][4]byte),
+	}
+	if err := s.loadZoneTemplate(f, addr); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// PowerDNS向けのゾーンファイルのうち、このサーバが使う範囲 ($TTL, SOA, NS, A) を読み込む
+// テンプレートに含まれるユーザのAレコードはusersテーブルと二重管理になるので、予約済みの名前のものだけを使う
+func (s *embeddedDNSServer) loadZoneTemplate(r io.Reader, addr string) error {
+	var (
+		defaultTTL uint32 = 3600
+		lastName   string
+		pending    []string
+		depth      int
+		foundSOA   bool
+	)
+
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.ReplaceAll(line, dnsZoneTemplateAddrMark, addr)
+
+		// 名前が省略された行は直前の名前を引き継ぐ
+		if depth == 0 && len(pending) == 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && strings.TrimSpace(line) != "" {
+			pending = append(pending, lastName)
+		}
+		for _, field := range strings.Fields(line) {
+			switch field {
+			case "(":
+				depth++
+			case ")":
+				depth--
+			default:
+				field = strings.TrimPrefix(field, "(")
+				if strings.HasSuffix(field, ")") {
+					depth--
+					field = strings.TrimSuffix(field, ")")
+				}
+				if strings.HasPrefix(field, "(") || field == "" {
+					continue
+				}
+				pending = append(pending, field)
+			}
+		}
+		if depth > 0 || len(pending) == 0 {
+			continue
+		}
+
+		fields := pending
+		pending = nil
+		if fields[0] == "$TTL" {
+			if len(fields) < 2 {
+				return fmt.Errorf("zone template line %d: $TTL requires a value", lineNo)
+			}
+			ttl, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return fmt.Errorf("zone template line %d: %w", lineNo, err)
+			}
+			defaultTTL = uint32(ttl)
+			continue
+		}
+
+		name := fields[0]
+		lastName = name
+		fields = fields[1:]
+		ttl := defaultTTL
+		if len(fields) > 0 {
+			if v, err := strconv.ParseUint(fields[0], 10, 32); err == nil {
+				ttl = uint32(v)
+				fields = fields[1:]
+			}
+		}
+		if len(fields) > 0 && strings.EqualFold(fields[0], "IN") {
+			fields = fields[1:]
+		}
+		if len(fields) < 2 {
+			return fmt.Errorf("zone template line %d: record has no data", lineNo)
+		}
+
+		rel, ok := s.relativeName(name)
+		if !ok {
+			return fmt.Errorf("zone template line %d: %s is out of zone", lineNo, name)
+		}
+
+		rdata := fields[1:]
+		switch strings.ToUpper(fields[0]) {
+		case "SOA":
+			if len(rdata) != 7 {
+				return fmt.Errorf("zone template line %d: SOA requires 7 fields", lineNo)
+			}
+			var nums [5]uint32
+			for i := range nums {
+				v, err := strconv.ParseUint(rdata[2+i], 10, 32)
+				if err != nil {
+					return fmt.Errorf("zone template line %d: %w", lineNo, err)
+				}
+				nums[i] = uint32(v)
+			}
+			mbox, err := s.absoluteName(rdata[1])
+			if err != nil {
+				return fmt.Errorf("zone template line %d: %w", lineNo, err)
+			}
+			ns, err := s.absoluteName(rdata[0])
+			if err != nil {
+				return fmt.Errorf("zone template line %d: %w", lineNo, err)
+			}
+			s.soa = dnsStaticRecord{
+				Type: dnsmessage.TypeSOA,
+				TTL:  ttl,
+				SOA: dnsmessage.SOAResource{
+					NS:      ns,
+					MBox:    mbox,
+					Serial:  nums[0],
+					Refresh: nums[1],
+					Retry:   nums[2],
+					Expire:  nums[3],
+					MinTTL:  nums[4],
+				},
+			}
+			foundSOA = true
+		case "NS":
+			ns, err := s.absoluteName(rdata[0])
+			if err != nil {
+				return fmt.Errorf("zone template line %d: %w", lineNo, err)
+			}
+			s.static[rel] = append(s.static[rel], dnsStaticRecord{Type: dnsmessage.TypeNS, TTL: ttl, NS: ns})
+		case "A":
+			if rel != "" && !reservedUsernames.Contains(rel) {
+				continue
+			}
+			ip, err := netip.ParseAddr(rdata[0])
+			if err != nil || !ip.Is4() {
+				return fmt.Errorf("zone template line %d: invalid A record %q", lineNo, rdata[0])
+			}
+			s.static[rel] = append(s.static[rel], dnsStaticRecord{Type: dnsmessage.TypeA, TTL: ttl, A: ip.As4()})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read zone template: %w", err)
+	}
+	if !foundSOA {
+		return errors.New("zone template has no SOA record")
+	}
+	return nil
+}
+
+// ゾーン内の名前ならゾーン名を除いた小文字の名前を返す
+func (s *embeddedDNSServer) relativeName(name string) (string, bool) {
+	if name == "@" {
+		return "", true
+	}
+	if !strings.HasSuffix(name, ".") {
+		return strings.ToLower(name), true
+	}
+	return relativeDNSName(strings.ToLower(name), s.zone)
+}
+
+func (s *embeddedDNSServer) absoluteName(name string) (dnsmessage.Name, error) {
+	if name == "@" {
+		return s.origin, nil
+	}
+	if !strings.HasSuffix(name, ".") {
+		name = name + "." + s.zone + "."
+	}
+	return dnsmessage.NewName(name)
+}
+
+// usersテーブルから索引を作り直す
+func (s *embeddedDNSServer) loadUsers(ctx context.Context, addr string) error {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil || !ip.Is4() {
+		return fmt.Errorf("invalid subdomain address %q", addr)
+	}
+
+	names, err := dataStore.Users().ListNames(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get user names: %w", err)
+	}
+
+	users := make(map[string][4]byte, len(names))
+	for _, name := range names {
+		users[strings.ToLower(name)] = ip.As4()
+	}
+
+	s.mu.Lock()
+	s.users = users
+	s.mu.Unlock()
+
+	return nil
+}
+
+// 組み込みのDNSサーバを使っていれば、初期化後のusersテーブルから索引を作り直す
+func reloadEmbeddedDNSRecords(ctx context.Context) error {
+	dnsServer, ok := dnsProvider.(*embeddedDNSServer)
+	if !ok {
+		return nil
+	}
+	return dnsServer.loadUsers(ctx, powerDNSSubdomainAddress)
+}
+
+func (s *embeddedDNSServer) AddRecord(_ context.Context, name, addr string) error {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil || !ip.Is4() {
+		return fmt.Errorf("invalid A record %q", addr)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[strings.ToLower(name)] = ip.As4()
+	return nil
+}
+
+func (s *embeddedDNSServer) DeleteRecord(_ context.Context, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, strings.ToLower(name))
+	return nil
+}
+
+func (s *embeddedDNSServer) ListRecords(_ context.Context) (map[string][]string, error) {
+	records := make(map[string][]string)
+	for name, rrs := range s.static {
+		for _, rr := range rrs {
+			if rr.Type == dnsmessage.TypeA {
+				records[name] = append(records[name], netip.AddrFrom4(rr.A).String())
+			}
+		}
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for name, a := range s.users {
+		records[name] = append(records[name], netip.AddrFrom4(a).String())
+	}
+	return records, nil
+}
+
+// name に対する応答用のレコードを返す。名前が存在しなければfalse
+func (s *embeddedDNSServer) lookup(name string) ([]dnsStaticRecord, bool) {
+	// 固定のレコードのスライスは共有しているので、書き換えないように複製する
+	var rrs []dnsStaticRecord
+	if name == "" {
+		rrs = append(rrs, s.soa)
+	}
+	rrs = append(rrs, s.static[name]...)
+
+	s.mu.RLock()
+	a, ok := s.users[name]
+	s.mu.RUnlock()
+	if ok {
+		rrs = append(rrs, dnsStaticRecord{Type: dnsmessage.TypeA, TTL: dnsUserRecordTTL, A: a})
+	}
+
+	return rrs, len(rrs) > 0
+}
+
+// 1件のクエリに対する応答を組み立てる。応答できない不正なクエリならnilを返す
+func (s *embeddedDNSServer) answer(query []byte) []byte {
+	var p dnsmessage.Parser
+	reqHeader, err := p.Start(query)
+	if err != nil || reqHeader.Response {
+		return nil
+	}
+
+	header := dnsmessage.Header{
+		ID:               reqHeader.ID,
+		Response:         true,
+		OpCode:           reqHeader.OpCode,
+		RecursionDesired: reqHeader.RecursionDesired,
+	}
+
+	questions, err := p.AllQuestions()
+	if err != nil {
+		header.RCode = dnsmessage.RCodeFormatError
+		return s.build(header, nil, nil, nil)
+	}
+	if reqHeader.OpCode != 0 {
+		header.RCode = dnsmessage.RCodeNotImplemented
+		return s.build(header, questions, nil, nil)
+	}
+	if len(questions) != 1 {
+		header.RCode = dnsmessage.RCodeFormatError
+		return s.build(header, questions, nil, nil)
+	}
+
+	q := questions[0]
+	name, ok := relativeDNSName(strings.ToLower(q.Name.String()), s.zone)
+	if !ok || (q.Class != dnsmessage.ClassINET && q.Class != dnsmessage.ClassANY) {
+		// このゾーン以外には答えない
+		header.RCode = dnsmessage.RCodeRefused
+		return s.build(header, questions, nil, nil)
+	}
+	header.Authoritative = true
+
+	rrs, found := s.lookup(name)
+	if !found {
+		header.RCode = dnsmessage.RCodeNameError
+		return s.build(header, questions, nil, []dnsStaticRecord{s.soa})
+	}
+
+	var answers []dnsStaticRecord
+	for _, rr := range rrs {
+		if q.Type == dnsmessage.TypeALL || rr.Type == q.Type {
+			answers = append(answers, rr)
+		}
+	}
+	if len(answers) == 0 {
+		// 名前は存在するが該当する型のレコードがない (NODATA)
+		return s.build(header, questions, nil, []dnsStaticRecord{s.soa})
+	}
+	return s.build(header, questions, answers, nil)
+}
+
+func (s *embeddedDNSServer) build(header dnsmessage.Header, questions []dnsmessage.Question, answers, authorities []dnsStaticRecord) []byte {
+	b := dnsmessage.NewBuilder(make([]byte, 0, dnsUDPMaxSize), header)
+	b.EnableCompression()
+
+	if err := b.StartQuestions(); err != nil {
+		return nil
+	}
+	for _, q := range questions {
+		if err := b.Question(q); err != nil {
+			return nil
+		}
+	}
+
+	if err := b.StartAnswers(); err != nil {
+		return nil
+	}
+	for _, rr := range answers {
+		if err := s.buildResource(&b, questions[0].Name, rr); err != nil {
+			return nil
+		}
+	}
+
+	if err := b.StartAuthorities(); err != nil {
+		return nil
+	}
+	for _, rr := range authorities {
+		if err := s.buildResource(&b, s.origin, rr); err != nil {
+			return nil
+		}
+	}
+
+	msg, err := b.Finish()
+	if err != nil {
+		return nil
+	}
+	return msg
+}
+
+func (s *embeddedDNSServer) buildResource(b *dnsmessage.Builder, name dnsmessage.Name, rr dnsStaticRecord) error {
+	h := dnsmessage.ResourceHeader{Name: name, Class: dnsmessage.ClassINET, TTL: rr.TTL}
+	switch rr.Type {
+	case dnsmessage.TypeA:
+		return b.AResource(h, dnsmessage.AResource{A: rr.A})
+	case dnsmessage.TypeNS:
+		return b.NSResource(h, dnsmessage.NSResource{NS: rr.NS})
+	case dnsmessage.TypeSOA:
+		return b.SOAResource(h, rr.SOA)
+	default:
+		return fmt.Errorf("unsupported record type: %v", rr.Type)
+	}
+}
+
+// UDPとTCPの両方で待ち受ける。待ち受けを始めたらすぐに返る
+func (s *embeddedDNSServer) Start(addr string, logger *slog.Logger) error {
+	udpConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen udp: %w", err)
+	}
+	tcpListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		udpConn.Close()
+		return fmt.Errorf("failed to listen tcp: %w", err)
+	}
+
+	go s.serveUDP(udpConn, logger)
+	go s.serveTCP(tcpListener, logger)
+
+	return nil
+}
+
+func (s *embeddedDNSServer) serveUDP(conn net.PacketConn, logger *slog.Logger) {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			logger.Error("dns udp server stopped", "error", err)
+			return
+		}
+		res := s.answer(buf[:n])
+		if res == nil {
+			continue
+		}
+		if len(res) > dnsUDPMaxSize {
+			// 収まらない場合はTCPで問い合わせ直してもらう
+			res = s.truncate(res)
+		}
+		if _, err := conn.WriteTo(res, addr); err != nil {
+			logger.Warn("failed to write dns response", "error", err)
+		}
+	}
+}
+
+// ヘッダと質問だけを残してTCフラグを立てる
+func (s *embeddedDNSServer) truncate(msg []byte) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(msg)
+	if err != nil {
+		return nil
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil
+	}
+	header.Truncated = true
+	return s.build(header, questions, nil, nil)
+}
+
+func (s *embeddedDNSServer) serveTCP(l net.Listener, logger *slog.Logger) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			logger.Error("dns tcp server stopped", "error", err)
+			return
+		}
+		go s.handleTCP(conn)
+	}
+}
+
+// 2バイトの長さに続けてメッセージを送る形式で、接続が閉じられるまで応答する
+func (s *embeddedDNSServer) handleTCP(conn net.Conn) {
+	defer conn.Close()
+	for {
+		_ = conn.SetDeadline(time.Now().Add(dnsTCPTimeout))
+
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		query := make([]byte, length)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		res := s.answer(query)
+		if res == nil {
+			return
+		}
+		out := make([]byte, 2+len(res))
+		binary.BigEndian.PutUint16(out, uint16(len(res)))
+		copy(out[2:], res)
+		if _, err := conn.Write(out); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// UDPとTCPで別々のポートを待ち受けて応答させる
+type testDNSServer struct {
+	*embeddedDNSServer
+	udpAddr string
+	tcpAddr string
+}
+
+func startTestDNSServer(t *testing.T, s *embeddedDNSServer) *testDNSServer {
+	t.Helper()
+	udpConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		udpConn.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		udpConn.Close()
+		tcpListener.Close()
+	})
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	go s.serveUDP(udpConn, logger)
+	go s.serveTCP(tcpListener, logger)
+	return &testDNSServer{embeddedDNSServer: s, udpAddr: udpConn.LocalAddr().String(), tcpAddr: tcpListener.Addr().String()}
+}
+
+func (s *testDNSServer) query(t *testing.T, network, name string, qtype dnsmessage.Type) *dnsmessage.Message {
+	t.Helper()
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 4649, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: dnsmessage.MustNewName(name), Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := s.udpAddr
+	if network == "tcp" {
+		addr = s.tcpAddr
+	}
+	conn, err := net.DialTimeout(network, addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var res []byte
+	if network == "tcp" {
+		out := binary.BigEndian.AppendUint16(nil, uint16(len(packed)))
+		if _, err := conn.Write(append(out, packed...)); err != nil {
+			t.Fatal(err)
+		}
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			t.Fatal(err)
+		}
+		res = make([]byte, length)
+		if _, err := io.ReadFull(conn, res); err != nil {
+			t.Fatal(err)
+		}
+	} else {
+		if _, err := conn.Write(packed); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 65535)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res = buf[:n]
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(res); err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Response || msg.ID != query.ID || len(msg.Questions) != 1 || msg.Questions[0] != query.Questions[0] {
+		t.Fatalf("%s %s %v: unexpected response header %+v", network, name, qtype, msg)
+	}
+	return &msg
+}
+
+func newTestEmbeddedDNSServer(t *testing.T) *embeddedDNSServer {
+	t.Helper()
+	s, err := newEmbeddedDNSServer(dnsZone, "../pdns/u.isucon.dev.zone", testSubdomainAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// テンプレートのファイルを使わずにゾーンを読み込む
+func loadTestDNSZone(zone string) (*embeddedDNSServer, error) {
+	s := &embeddedDNSServer{
+		zone:   dnsZone,
+		origin: dnsmessage.MustNewName(dnsZone + "."),
+		static: make(map[string][]dnsStaticRecord),
+		users:  make(map[string][4]byte),
+	}
+	return s, s.loadZoneTemplate(strings.NewReader(zone), testSubdomainAddress)
+}
+
+// 応答のレコードを "型 名前 TTL 値" の文字列にする
+func formatDNSResources(rrs []dnsmessage.Resource) []string {
+	var got []string
+	for _, rr := range rrs {
+		var v string
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			v = net.IP(body.A[:]).String()
+		case *dnsmessage.NSResource:
+			v = body.NS.String()
+		case *dnsmessage.SOAResource:
+			v = fmt.Sprintf("%s %s %d %d %d %d %d", body.NS, body.MBox, body.Serial, body.Refresh, body.Retry, body.Expire, body.MinTTL)
+		default:
+			v = rr.Body.GoString()
+		}
+		got = append(got, fmt.Sprintf("%v %s %d %s", rr.Header.Type, rr.Header.Name, rr.Header.TTL, v))
+	}
+	return got
+}
+
+func TestEmbeddedDNSServer(t *testing.T) {
+	s := startTestDNSServer(t, newTestEmbeddedDNSServer(t))
+	if err := s.AddRecord(context.Background(), "alice", testSubdomainAddress); err != nil {
+		t.Fatal(err)
+	}
+	const soa = "TypeSOA u.isucon.dev. 3600 ns1.u.isucon.dev. hostmaster.u.isucon.dev. 0 10800 3600 604800 3600"
+
+	tests := []struct {
+		name        string
+		qname       string
+		qtype       dnsmessage.Type
+		rcode       dnsmessage.RCode
+		answers     []string
+		authorities []string
+	}{
+		{
+			name:    "user",
+			qname:   "alice.u.isucon.dev.",
+			qtype:   dnsmessage.TypeA,
+			answers: []string{"TypeA alice.u.isucon.dev. 0 192.0.2.1"},
+		},
+		{
+			name:    "name is case insensitive",
+			qname:   "Alice.U.Isucon.Dev.",
+			qtype:   dnsmessage.TypeA,
+			answers: []string{"TypeA Alice.U.Isucon.Dev. 0 192.0.2.1"},
+		},
+		{
+			name:    "reserved name from the zone template",
+			qname:   "pipe.u.isucon.dev.",
+			qtype:   dnsmessage.TypeA,
+			answers: []string{"TypeA pipe.u.isucon.dev. 0 192.0.2.1"},
+		},
+		{
+			name:    "apex A",
+			qname:   "u.isucon.dev.",
+			qtype:   dnsmessage.TypeA,
+			answers: []string{"TypeA u.isucon.dev. 0 192.0.2.1"},
+		},
+		{
+			name:    "apex NS",
+			qname:   "u.isucon.dev.",
+			qtype:   dnsmessage.TypeNS,
+			answers: []string{"TypeNS u.isucon.dev. 0 ns1.u.isucon.dev."},
+		},
+		{
+			name:    "apex SOA",
+			qname:   "u.isucon.dev.",
+			qtype:   dnsmessage.TypeSOA,
+			answers: []string{soa},
+		},
+		{
+			name:        "NXDOMAIN",
+			qname:       "bob.u.isucon.dev.",
+			qtype:       dnsmessage.TypeA,
+			rcode:       dnsmessage.RCodeNameError,
+			authorities: []string{soa},
+		},
+		{
+			// テンプレートにあっても予約済みでない名前はusersテーブルに任せる
+			name:        "unreserved name in the zone template",
+			qname:       "test001.u.isucon.dev.",
+			qtype:       dnsmessage.TypeA,
+			rcode:       dnsmessage.RCodeNameError,
+			authorities: []string{soa},
+		},
+		{
+			name:        "NODATA",
+			qname:       "alice.u.isucon.dev.",
+			qtype:       dnsmessage.TypeAAAA,
+			authorities: []string{soa},
+		},
+		{
+			name:  "out of zone",
+			qname: "example.com.",
+			qtype: dnsmessage.TypeA,
+			rcode: dnsmessage.RCodeRefused,
+		},
+		{
+			name:  "zone name as a suffix of another label",
+			qname: "alice.xu.isucon.dev.",
+			qtype: dnsmessage.TypeA,
+			rcode: dnsmessage.RCodeRefused,
+		},
+	}
+	for _, network := range []string{"udp", "tcp"} {
+		for _, tt := range tests {
+			msg := s.query(t, network, tt.qname, tt.qtype)
+			if msg.RCode != tt.rcode {
+				t.Errorf("%s %s: rcode = %v, want %v", network, tt.name, msg.RCode, tt.rcode)
+			}
+			if want := tt.rcode != dnsmessage.RCodeRefused; msg.Authoritative != want {
+				t.Errorf("%s %s: authoritative = %v", network, tt.name, msg.Authoritative)
+			}
+			if !msg.RecursionDesired || msg.RecursionAvailable || msg.Truncated {
+				t.Errorf("%s %s: header = %+v", network, tt.name, msg.Header)
+			}
+			if got := formatDNSResources(msg.Answers); fmt.Sprint(got) != fmt.Sprint(tt.answers) {
+				t.Errorf("%s %s: answers = %q, want %q", network, tt.name, got, tt.answers)
+			}
+			if got := formatDNSResources(msg.Authorities); fmt.Sprint(got) != fmt.Sprint(tt.authorities) {
+				t.Errorf("%s %s: authorities = %q, want %q", network, tt.name, got, tt.authorities)
+			}
+		}
+	}
+
+	// 削除したユーザは引けなくなる
+	if err := s.DeleteRecord(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := s.query(t, "udp", "alice.u.isucon.dev.", dnsmessage.TypeA); msg.RCode != dnsmessage.RCodeNameError {
+		t.Errorf("rcode after delete = %v", msg.RCode)
+	}
+}
+
+func TestEmbeddedDNSServerTruncation(t *testing.T) {
+	// UDPの512バイトに収まらないNSレコードを持つゾーン
+	var zone strings.Builder
+	zone.WriteString("$TTL 60\n@ SOA ns1 hostmaster 1 2 3 4 5\n")
+	for i := 0; i < 20; i++ {
+		// 名前の圧縮で小さくならないよう、ラベルを全て変える
+		label := strings.Repeat(string(rune('a'+i)), 40)
+		fmt.Fprintf(&zone, "@ NS ns.%s.%s.\n", label, label)
+	}
+	es, err := loadTestDNSZone(zone.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := startTestDNSServer(t, es)
+
+	// UDPでは質問だけを返してTCPでの再問い合わせを促す
+	msg := s.query(t, "udp", "u.isucon.dev.", dnsmessage.TypeNS)
+	if !msg.Truncated || msg.RCode != dnsmessage.RCodeSuccess || len(msg.Answers) != 0 {
+		t.Errorf("udp: header = %+v, answers = %d", msg.Header, len(msg.Answers))
+	}
+	msg = s.query(t, "tcp", "u.isucon.dev.", dnsmessage.TypeNS)
+	if msg.Truncated || len(msg.Answers) != 20 {
+		t.Errorf("tcp: header = %+v, answers = %d", msg.Header, len(msg.Answers))
+	}
+
+	// 収まる応答はUDPでもそのまま返す
+	if msg := s.query(t, "udp", "u.isucon.dev.", dnsmessage.TypeSOA); msg.Truncated || len(msg.Answers) != 1 {
+		t.Errorf("udp soa: header = %+v, answers = %d", msg.Header, len(msg.Answers))
+	}
+}
+
+func TestLoadZoneTemplate(t *testing.T) {
+	s := newTestEmbeddedDNSServer(t)
+
+	want := dnsmessage.SOAResource{
+		NS:      dnsmessage.MustNewName("ns1.u.isucon.dev."),
+		MBox:    dnsmessage.MustNewName("hostmaster.u.isucon.dev."),
+		Serial:  0,
+		Refresh: 10800,
+		Retry:   3600,
+		Expire:  604800,
+		MinTTL:  3600,
+	}
+	if s.soa.Type != dnsmessage.TypeSOA || s.soa.TTL != 3600 || s.soa.SOA != want {
+		t.Errorf("soa = %+v", s.soa)
+	}
+
+	records, err := s.ListRecords(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 予約済みの名前とゾーン頂点のAレコードだけを読み込み、プレースホルダはアドレスに置き換える
+	for _, name := range []string{"", "ns1", "pipe", "www", "mail"} {
+		if fmt.Sprint(records[name]) != "["+testSubdomainAddress+"]" {
+			t.Errorf("records[%q] = %v", name, records[name])
+		}
+	}
+	for name := range records {
+		if name != "" && !reservedUsernames.Contains(name) {
+			t.Errorf("unreserved name %q is loaded", name)
+		}
+	}
+	if ns := s.static[""]; len(ns) != 2 || ns[0].Type != dnsmessage.TypeNS || ns[0].TTL != 0 || ns[0].NS.String() != "ns1.u.isucon.dev." {
+		t.Errorf("apex records = %+v", ns)
+	}
+
+	for name, zone := range map[string]string{
+		"no SOA":             "@ NS ns1\n",
+		"out of zone":        "@ SOA ns1 hostmaster 1 2 3 4 5\nexample.com. A 192.0.2.1\n",
+		"invalid A":          "@ SOA ns1 hostmaster 1 2 3 4 5\nwww A ::1\n",
+		"short SOA":          "@ SOA ns1 hostmaster 1 2 3\n",
+		"invalid SOA field":  "@ SOA ns1 hostmaster 1 2 3 4 x\n",
+		"invalid $TTL":       "$TTL forever\n@ SOA ns1 hostmaster 1 2 3 4 5\n",
+		"record has no data": "@ SOA ns1 hostmaster 1 2 3 4 5\nwww A\n",
+	} {
+		if _, err := loadTestDNSZone(zone); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	exportStatusRunning   = "running"
+	exportStatusCompleted = "completed"
+	exportStatusFailed    = "failed"
+
+	// 小さいアカウントならこの時間内に終わるので、そのままアーカイブを返す
+	exportSyncWait = 2 * time.Second
+	// 完了したアーカイブを保持しておく期間
+	exportRetention = 1 * time.Hour
+	// これより長く実行中のままのジョブは作り直す
+	exportTimeout = 10 * time.Minute
+)
+
+type UserExportStatus struct {
+	ID          string `json:"id"`
+	Status      string `json:"status"`
+	CreatedAt   int64  `json:"created_at"`
+	CompletedAt int64  `json:"completed_at,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+type UserExport struct {
+	ExportedAt   int64                   `json:"exported_at"`
+	Profile      User                    `json:"profile"`
+	Theme        Theme                   `json:"theme"`
+	Livestreams  []UserExportLivestream  `json:"livestreams"`
+	Livecomments []UserExportLivecomment `json:"livecomments"`
+	Reactions    []UserExportReaction    `json:"reactions"`
+	Reports      []UserExportReport      `json:"reports"`
+	Statistics   UserStatistics          `json:"statistics"`
+}
+
+type UserExportLivestream struct {
+	LivestreamModel
+	Tags []Tag `json:"tags"`
+}
+
+type UserExportLivecomment struct {
+	ID           int64  `json:"id"`
+	LivestreamID int64  `json:"livestream_id"`
+	Comment      string `json:"comment"`
+	Tip          int64  `json:"tip"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+type UserExportReaction struct {
+	ID           int64  `json:"id"`
+	LivestreamID int64  `json:"livestream_id"`
+	EmojiName    string `json:"emoji_name"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+type UserExportReport struct {
+	ID            int64 `json:"id"`
+	LivestreamID  int64 `json:"livestream_id"`
+	LivecommentID int64 `json:"livecomment_id"`
+	CreatedAt     int64 `json:"created_at"`
+}
+
+// UserExportModel はエクスポートのジョブです。
+// アーカイブを作るのは受け付けたサーバだが、状況とアーカイブはどのサーバからでも取れる
+type UserExportModel struct {
+	ID     string `db:"id"`
+	UserID int64  `db:"user_id"`
+	Status string `db:"status"`
+	// 完了したときだけ持つ
+	Archive     []byte `db:"archive"`
+	Error       string `db:"error"`
+	CreatedAt   int64  `db:"created_at"`
+	CompletedAt int64  `db:"completed_at"`
+}
+
+func (e UserExportModel) status() UserExportStatus {
+	return UserExportStatus{
+		ID:          e.ID,
+		Status:      e.Status,
+		CreatedAt:   e.CreatedAt,
+		CompletedAt: e.CompletedAt,
+		Error:       e.Error,
+	}
+}
+
+// 期限が切れたジョブは無いものとして扱う
+// 実行中のまま古くなったジョブは、実行していたサーバが落ちたものとみなす
+func (e UserExportModel) expired(now time.Time) bool {
+	if e.Status == exportStatusRunning {
+		return now.Sub(time.Unix(e.CreatedAt, 0)) > exportTimeout
+	}
+	return now.Sub(time.Unix(e.CompletedAt, 0)) > exportRetention
+}
+
+// このサーバで実行中のジョブが終わると閉じられるチャネル (ジョブID → chan struct{})
+// すぐ終わるジョブを待ってからレスポンスを返すためだけに使う
+var userExportDone sync.Map
+
+// 個人データエクスポートAPI
+// GET /api/user/me/export
+// 完了済みのアーカイブがあればそれを返し、なければ生成を開始して202を返す
+// ?refresh=true で作り直す
+func getUserExportHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	export, err := startUserExportJob(ctx, userID, c.QueryParam("refresh") == "true")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to start export: "+err.Error())
+	}
+
+	if v, ok := userExportDone.Load(export.ID); ok {
+		select {
+		case <-v.(chan struct{}):
+		case <-time.After(exportSyncWait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		export, err = dataStore.Users().GetExport(ctx, userID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get export: "+err.Error())
+		}
+	}
+
+	switch export.Status {
+	case exportStatusCompleted:
+		archive, err := dataStore.Users().GetExportArchive(ctx, export.ID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get export archive: "+err.Error())
+		}
+		c.Response().Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=\"isupipe-export-%s.zip\"", export.ID))
+		return c.Blob(http.StatusOK, "application/zip", archive)
+	case exportStatusFailed:
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to export user data: "+export.Error)
+	default:
+		return c.JSON(http.StatusAccepted, export.status())
+	}
+}
+
+// 個人データエクスポートの状況取得API
+// GET /api/user/me/export/status
+func getUserExportStatusHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	export, err := dataStore.Users().GetExport(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && export.expired(time.Now())) {
+		return echo.NewHTTPError(http.StatusNotFound, "export has not been requested")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get export: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, export.status())
+}
+
+// ユーザのジョブを返す。使えるジョブがなければ新しく始める
+// 実行中のジョブは refresh でも作り直さない
+func startUserExportJob(ctx context.Context, userID int64, refresh bool) (UserExportModel, error) {
+	tx, err := dataStore.BeginTx(ctx)
+	if err != nil {
+		return UserExportModel{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// 同じユーザのジョブを複数のサーバが同時に始めないよう、ユーザの行をロックする
+	if _, err := tx.Users().GetForUpdate(ctx, userID); err != nil {
+		return UserExportModel{}, fmt.Errorf("failed to get user: %w", err)
+	}
+	now := time.Now()
+	current, err := tx.Users().GetExport(ctx, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return UserExportModel{}, fmt.Errorf("failed to get export: %w", err)
+	}
+	if err == nil && !current.expired(now) {
+		if current.Status == exportStatusRunning || (current.Status == exportStatusCompleted && !refresh) {
+			return current, nil
+		}
+	}
+
+	export := UserExportModel{
+		ID:        uuid.NewString(),
+		UserID:    userID,
+		Status:    exportStatusRunning,
+		CreatedAt: now.Unix(),
+	}
+	if err := tx.Users().PutExport(ctx, export); err != nil {
+		return UserExportModel{}, fmt.Errorf("failed to put export: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return UserExportModel{}, fmt.Errorf("failed to commit: %w", err)
+	}
+
+	done := make(chan struct{})
+	userExportDone.Store(export.ID, done)
+	go func() {
+		defer userExportDone.Delete(export.ID)
+		defer close(done)
+		runUserExportJob(export)
+	}()
+
+	return export, nil
+}
+
+func runUserExportJob(export UserExportModel) {
+	ctx := context.Background()
+	archive, err := buildUserExportArchive(ctx, export.UserID)
+	export.CompletedAt = time.Now().Unix()
+	if err != nil {
+		export.Status = exportStatusFailed
+		export.Error = err.Error()
+	} else {
+		export.Status = exportStatusCompleted
+		export.Archive = archive
+	}
+	if err := dataStore.Users().FinishExport(ctx, export); err != nil {
+		appLogger.Error("failed to save export", "export_id", export.ID, "user_id", export.UserID, "error", err)
+	}
+}
+
+func buildUserExportArchive(ctx context.Context, userID int64) ([]byte, error) {
+	tx, err := dataStore.BeginReadTx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	export, err := collectUserExport(ctx, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit: %w", err)
+	}
+
+	var icon []byte
+	if iconHash, found := getIconHash(userID); found && !isIconBlocked(iconHash) {
+		icon, err = iconStore.Get(ctx, iconHash)
+		if err != nil && !errors.Is(err, errIconNotFound) {
+			return nil, fmt.Errorf("failed to get icon: %w", err)
+		}
+	}
+	if icon == nil {
+		icon, err = os.ReadFile(fallbackImage)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read icon: %w", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+
+	w, err := zw.Create("export.json")
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(export); err != nil {
+		return nil, fmt.Errorf("failed to encode export: %w", err)
+	}
+
+	w, err = zw.Create("icon" + iconFileExtension(http.DetectContentType(icon)))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(icon); err != nil {
+		return nil, err
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// アイコンは再エンコードしたPNGと、既定のJPEGがある
+func iconFileExtension(contentType string) string {
+	switch contentType {
+	case "image/png":
+		return ".png"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	default:
+		return ".jpg"
+	}
+}
+
+func collectUserExport(ctx context.Context, tx Tx, userID int64) (*UserExport, error) {
+	userModel, err := tx.Users().Get(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+	user, err := fillUserResponse(ctx, tx, userModel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fill user: %w", err)
+	}
+
+	livestreamModels, err := tx.Livestreams().ListByUser(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get livestreams: %w", err)
+	}
+	livestreams := make([]UserExportLivestream, len(livestreamModels))
+	for i, livestreamModel := range livestreamModels {
+		livestreamTagModels, err := tx.Livestreams().ListTags(ctx, livestreamModel.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get livestream tags: %w", err)
+		}
+		tags := make([]Tag, 0, len(livestreamTagModels))
+		for _, livestreamTagModel := range livestreamTagModels {
+			if tagModel, found := tagCache.GetTagByID(livestreamTagModel.TagID); found {
+				tags = append(tags, Tag{ID: tagModel.ID, Name: tagModel.Name})
+			}
+		}
+		livestreams[i] = UserExportLivestream{
+			LivestreamModel: *livestreamModel,
+			Tags:            tags,
+		}
+	}
+
+	livecommentModels, err := tx.Livecomments().ListByUser(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get livecomments: %w", err)
+	}
+	livecomments := make([]UserExportLivecomment, len(livecommentModels))
+	for i, livecommentModel := range livecommentModels {
+		livecomments[i] = UserExportLivecomment{
+			ID:           livecommentModel.ID,
+			LivestreamID: livecommentModel.LivestreamID,
+			Comment:      livecommentModel.Comment,
+			Tip:          livecommentModel.Tip,
+			CreatedAt:    livecommentModel.CreatedAt,
+		}
+	}
+
+	reactionModels, err := tx.Reactions().ListByUser(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reactions: %w", err)
+	}
+	reactions := make([]UserExportReaction, len(reactionModels))
+	for i, reactionModel := range reactionModels {
+		reactions[i] = UserExportReaction{
+			ID:           reactionModel.ID,
+			LivestreamID: reactionModel.LivestreamID,
+			EmojiName:    reactionModel.EmojiName,
+			CreatedAt:    reactionModel.CreatedAt,
+		}
+	}
+
+	reportModels, err := tx.Reports().ListByUser(ctx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get livecomment reports: %w", err)
+	}
+	reports := make([]UserExportReport, len(reportModels))
+	for i, reportModel := range reportModels {
+		reports[i] = UserExportReport{
+			ID:            reportModel.ID,
+			LivestreamID:  reportModel.LivestreamID,
+			LivecommentID: reportModel.LivecommentID,
+			CreatedAt:     reportModel.CreatedAt,
+		}
+	}
+
+	stats, err := calcUserStatistics(ctx, tx, userModel)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UserExport{
+		ExportedAt:   time.Now().Unix(),
+		Profile:      user,
+		Theme:        user.Theme,
+		Livestreams:  livestreams,
+		Livecomments: livecomments,
+		Reactions:    reactions,
+		Reports:      reports,
+		Statistics:   stats,
+	}, nil
+}
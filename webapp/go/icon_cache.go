@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+)
+
+// ユーザがアイコンを設定していないときに返す画像とそのicon_hash
+var (
+	fallbackImageData []byte
+	fallbackImageHash string
+)
+
+var iconHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// 運営がブロックした画像のハッシュ
+var blockedIconCache sync.Map
+
+// ブロックされた画像かどうか
+func isIconBlocked(hash string) bool {
+	_, ok := blockedIconCache.Load(hash)
+	return ok
+}
+
+// icon_blocklistからブロックリストのキャッシュを作り直す
+func loadBlockedIconCache(ctx context.Context) error {
+	hashes, err := dataStore.Icons().ListBlockedHashes(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get icon blocklist: %w", err)
+	}
+
+	blockedIconCache = sync.Map{}
+	for _, hash := range hashes {
+		blockedIconCache.Store(hash, struct{}{})
+	}
+
+	return nil
+}
+
+// フォールバック画像は起動時に一度だけ読み込んでハッシュを計算する
+func loadFallbackImage() error {
+	image, err := os.ReadFile(fallbackImage)
+	if err != nil {
+		return err
+	}
+	fallbackImageData = image
+	fallbackImageHash = fmt.Sprintf("%x", sha256.Sum256(image))
+	return nil
+}
+
+type iconHashRow struct {
+	UserID   int64  `db:"user_id"`
+	UserName string `db:"name"`
+	Hash     string `db:"hash"`
+}
+
+// iconsテーブルからアイコンハッシュのキャッシュを作り直す
+func warmIconHashCache(ctx context.Context) error {
+	rows, err := dataStore.Icons().ListHashes(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get icon hashes: %w", err)
+	}
+
+	InitCache()
+	for _, row := range rows {
+		addIconHash(row.UserID, row.Hash)
+		addIconHashByUserName(row.UserName, row.Hash)
+	}
+
+	return nil
+}
+
+type legacyIconRow struct {
+	ID    int64  `db:"id"`
+	Image []byte `db:"image"`
+}
+
+// hashカラムが空の古い行を埋める
+// imageにファイル名 (=ハッシュ) が入っている行はそのまま使い、画像本体が入っている行はハッシュを計算してiconStoreにも保存する
+func backfillIconHashes(ctx context.Context) error {
+	var rows []*legacyIconRow
+	if err := dbConn.SelectContext(ctx, &rows, "SELECT id, image FROM icons WHERE hash = ''"); err != nil {
+		return fmt.Errorf("failed to get icons without hash: %w", err)
+	}
+
+	for _, row := range rows {
+		if len(row.Image) == 0 {
+			continue
+		}
+
+		var hash string
+		if iconHashPattern.Match(row.Image) {
+			hash = string(row.Image)
+		} else {
+			hash = fmt.Sprintf("%x", sha256.Sum256(row.Image))
+		}
+
+		if _, err := dbConn.ExecContext(ctx, "UPDATE icons SET hash = ? WHERE id = ?", hash, row.ID); err != nil {
+			return fmt.Errorf("failed to update icon hash: %w", err)
+		}
+		if hash != string(row.Image) {
+			if err := iconStore.Put(ctx, hash, row.Image); err != nil {
+				return fmt.Errorf("failed to save icon: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"strconv"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+const (
+	// アップロードされた画像の縦横の上限
+	iconMaxDimension = 4096
+	// 再エンコード時のJPEG品質
+	iconJPEGQuality = 90
+)
+
+// 配信する縮小版のサイズ (正方形の一辺)
+var iconVariantSizes = []int{64, 128, 256}
+
+// アップロードされた画像のバイト数上限
+var iconMaxBytes int64
+
+var (
+	errIconTooLarge          = errors.New("icon image is too large")
+	errIconDimensionTooLarge = fmt.Errorf("icon image must be at most %dx%d pixels", iconMaxDimension, iconMaxDimension)
+	errIconUnsupportedFormat = errors.New("icon image must be JPEG, PNG, GIF or WebP")
+	errIconInvalidSize       = errors.New("unsupported icon size")
+)
+
+type processedIcon struct {
+	// メタデータを落として再エンコードした画像。これのハッシュがicon_hashになる
+	Original []byte
+	// サイズごとの縮小版
+	Variants map[int][]byte
+}
+
+// アップロードされた画像を検証し、再エンコードと縮小版の生成を行う
+// JPEGはJPEGのまま、それ以外 (PNG/GIF/WebP) はPNGとして保存する
+func processIconImage(data []byte) (*processedIcon, error) {
+	if int64(len(data)) > iconMaxBytes {
+		return nil, errIconTooLarge
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errIconUnsupportedFormat
+	}
+	switch format {
+	case "jpeg", "png", "gif", "webp":
+	default:
+		return nil, errIconUnsupportedFormat
+	}
+	if config.Width > iconMaxDimension || config.Height > iconMaxDimension {
+		return nil, errIconDimensionTooLarge
+	}
+	if config.Width == 0 || config.Height == 0 {
+		return nil, errIconUnsupportedFormat
+	}
+
+	// GIFはアニメーションでも先頭フレームだけを使う
+	var img image.Image
+	if format == "gif" {
+		img, err = gif.Decode(bytes.NewReader(data))
+	} else {
+		img, _, err = image.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, errIconUnsupportedFormat
+	}
+
+	encode := encodePNG
+	if format == "jpeg" {
+		encode = encodeJPEG
+	}
+
+	original, err := encode(img)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode icon: %w", err)
+	}
+
+	variants := make(map[int][]byte, len(iconVariantSizes))
+	for _, size := range iconVariantSizes {
+		variant, err := encode(resizeIcon(img, size))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %dpx icon: %w", size, err)
+		}
+		variants[size] = variant
+	}
+
+	return &processedIcon{
+		Original: original,
+		Variants: variants,
+	}, nil
+}
+
+// 縦横比を保ったまま、size x size に収まるように縮小する (拡大はしない)
+func resizeIcon(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+
+	if w >= h {
+		h = h * size / w
+		w = size
+	} else {
+		w = w * size / h
+		h = size
+	}
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Over, nil)
+	return dst
+}
+
+func encodeJPEG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: iconJPEGQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ?size= の値をサイズに変換する。空なら0 (元画像)
+func parseIconSize(v string) (int, error) {
+	if v == "" {
+		return 0, nil
+	}
+	size, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errIconInvalidSize
+	}
+	for _, s := range iconVariantSizes {
+		if s == size {
+			return size, nil
+		}
+	}
+	return 0, errIconInvalidSize
+}
+
+// iconStore上のキー。縮小版は "<hash>_<size>"
+func iconStoreKey(hash string, size int) string {
+	if size == 0 {
+		return hash
+	}
+	return hash + "_" + strconv.Itoa(size)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errIconNotFound = errors.New("icon not found")
+
+// IconStore はアイコン画像の保存先です。画像はSHA-256のハッシュ値をキーにして保存します。
+// 複数台構成でもどのサーバからでも同じ画像が引けるよう、保存先は設定で切り替えられます。
+type IconStore interface {
+	// アップロードされた画像は縮小版を作るために全て読み込んでいるので、バイト列で受け取る
+	Put(ctx context.Context, hash string, image []byte) error
+	// 見つからなければ errIconNotFound を返す
+	Get(ctx context.Context, hash string) ([]byte, error)
+	Delete(ctx context.Context, hash string) error
+}
+
+var iconStore IconStore
+
+func newIconStore(cfg IconConfig, store Store) (IconStore, error) {
+	switch cfg.Store {
+	case "local":
+		return newLocalIconStore(cfg.Dir)
+	case "db":
+		return newDBIconStore(store), nil
+	case "s3":
+		return &s3IconStore{
+			endpoint:  cfg.S3.Endpoint,
+			bucket:    cfg.S3.Bucket,
+			region:    cfg.S3.Region,
+			accessKey: cfg.S3.AccessKeyID,
+			secretKey: cfg.S3.SecretAccessKey,
+			client:    &http.Client{Timeout: 10 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown icon store: %s", cfg.Store)
+	}
+}
+
+// ローカルディスクに保存する。単一サーバ構成向け
+type localIconStore struct {
+	dir string
+}
+
+func newLocalIconStore(dir string) (*localIconStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &localIconStore{dir: dir}, nil
+}
+
+func (s *localIconStore) path(hash string) string {
+	return filepath.Join(s.dir, filepath.Base(hash))
+}
+
+// 書きかけのファイルを読まれないように、一時ファイルに書いてからrenameする
+func (s *localIconStore) Put(_ context.Context, hash string, image []byte) error {
+	f, err := os.CreateTemp(s.dir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(image); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path(hash))
+}
+
+func (s *localIconStore) Get(_ context.Context, hash string) ([]byte, error) {
+	image, err := os.ReadFile(s.path(hash))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errIconNotFound
+	}
+	return image, err
+}
+
+func (s *localIconStore) Delete(_ context.Context, hash string) error {
+	if err := os.Remove(s.path(hash)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// DBに保存する (icon_imagesテーブル)
+// iconsの行とは別に持つので、縮小版も同じように保存できる
+type dbIconStore struct {
+	store Store
+}
+
+func newDBIconStore(store Store) *dbIconStore {
+	return &dbIconStore{store: store}
+}
+
+func (s *dbIconStore) Put(ctx context.Context, hash string, image []byte) error {
+	return s.store.Icons().PutImage(ctx, hash, image)
+}
+
+func (s *dbIconStore) Get(ctx context.Context, hash string) ([]byte, error) {
+	image, err := s.store.Icons().GetImage(ctx, hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errIconNotFound
+	}
+	return image, err
+}
+
+func (s *dbIconStore) Delete(ctx context.Context, hash string) error {
+	return s.store.Icons().DeleteImage(ctx, hash)
+}
+
+// S3互換のオブジェクトストレージに保存する (path-styleでアクセスする)
+type s3IconStore struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func (s *s3IconStore) Put(ctx context.Context, hash string, image []byte) error {
+	res, err := s.do(ctx, http.MethodPut, hash, image)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return s.responseError(res)
+	}
+	return nil
+}
+
+func (s *s3IconStore) Get(ctx context.Context, hash string) ([]byte, error) {
+	res, err := s.do(ctx, http.MethodGet, hash, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		return nil, errIconNotFound
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, s.responseError(res)
+	}
+	return io.ReadAll(res.Body)
+}
+
+func (s *s3IconStore) Delete(ctx context.Context, hash string) error {
+	res, err := s.do(ctx, http.MethodDelete, hash, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNotFound {
+		return s.responseError(res)
+	}
+	return nil
+}
+
+func (s *s3IconStore) responseError(res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+	return fmt.Errorf("s3 responded %d: %s", res.StatusCode, string(body))
+}
+
+func (s *s3IconStore) do(ctx context.Context, method, key string, body []byte) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.endpoint, "/") + "/" + url.PathEscape(s.bucket) + "/" + url.PathEscape(key))
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	s.sign(req, body, time.Now().UTC())
+	return s.client.Do(req)
+}
+
+// AWS Signature Version 4 で署名する
+// 転送中に壊れた画像を保存しないよう、ペイロードのハッシュも署名に含める
+func (s *s3IconStore) sign(req *http.Request, payload []byte, now time.Time) {
+	payloadHash := sha256.Sum256(payload)
+	payloadHashHex := hex.EncodeToString(payloadHash[:])
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHashHex)
+	if s.accessKey == "" {
+		return
+	}
+
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHashHex + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHashHex,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testS3Bucket    = "icons"
+	testS3Region    = "ap-northeast-1"
+	testS3AccessKey = "AKIDEXAMPLE"
+	testS3SecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+// 署名を検証してからオブジェクトを出し入れする、path-styleのS3
+type fakeS3 struct {
+	t *testing.T
+
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// 署名の誤りはクライアントにエラーとして見える
+	if err := verifySigV4(r, body); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+testS3Bucket+"/")
+	if !ok || key == "" || strings.Contains(key, "/") {
+		f.t.Errorf("unexpected path %s", r.URL.Path)
+		http.Error(w, "bad path", http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[key] = body
+	case http.MethodGet:
+		object, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(object)
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// s3IconStore.sign とは別に、受け取ったリクエストから署名を計算し直して比べる
+func verifySigV4(r *http.Request, body []byte) error {
+	payloadHash := sha256.Sum256(body)
+	if got := r.Header.Get("X-Amz-Content-Sha256"); got != hex.EncodeToString(payloadHash[:]) {
+		return errors.New("x-amz-content-sha256 does not match the body: " + got)
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	if _, err := time.Parse("20060102T150405Z", amzDate); err != nil {
+		return err
+	}
+	scope := amzDate[:8] + "/" + testS3Region + "/s3/aws4_request"
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	prefix := "AWS4-HMAC-SHA256 Credential=" + testS3AccessKey + "/" + scope + ", SignedHeaders=" + signedHeaders + ", Signature="
+	auth := r.Header.Get("Authorization")
+	signature, ok := strings.CutPrefix(auth, prefix)
+	if !ok {
+		return errors.New("unexpected authorization: " + auth)
+	}
+
+	canonicalRequest := r.Method + "\n" +
+		r.URL.EscapedPath() + "\n" +
+		r.URL.RawQuery + "\n" +
+		"host:" + r.Host + "\n" +
+		"x-amz-content-sha256:" + r.Header.Get("X-Amz-Content-Sha256") + "\n" +
+		"x-amz-date:" + amzDate + "\n" +
+		"\n" +
+		signedHeaders + "\n" +
+		r.Header.Get("X-Amz-Content-Sha256")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := mac([]byte("AWS4"+testS3SecretKey), amzDate[:8])
+	key = mac(key, testS3Region)
+	key = mac(key, "s3")
+	key = mac(key, "aws4_request")
+	if want := hex.EncodeToString(mac(key, stringToSign)); signature != want {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// 保存、取得、削除と、見つからないときの errIconNotFound
+func testIconStoreRoundTrip(t *testing.T, store IconStore) {
+	t.Helper()
+	ctx := context.Background()
+	hash := "0123456789abcdef"
+	image := []byte("\x89PNG\r\n\x1a\nimage")
+
+	if _, err := store.Get(ctx, hash); !errors.Is(err, errIconNotFound) {
+		t.Errorf("get before put: err = %v", err)
+	}
+	if err := store.Put(ctx, hash, image); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, iconStoreKey(hash, 64), []byte("variant")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Get(ctx, hash); err != nil || !bytes.Equal(got, image) {
+		t.Errorf("get = %q, %v", got, err)
+	}
+	if got, err := store.Get(ctx, iconStoreKey(hash, 64)); err != nil || string(got) != "variant" {
+		t.Errorf("get variant = %q, %v", got, err)
+	}
+
+	// 同じキーは上書きする
+	if err := store.Put(ctx, hash, []byte("updated")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Get(ctx, hash); err != nil || string(got) != "updated" {
+		t.Errorf("get after overwrite = %q, %v", got, err)
+	}
+
+	if err := store.Delete(ctx, hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, hash); !errors.Is(err, errIconNotFound) {
+		t.Errorf("get after delete: err = %v", err)
+	}
+	// 無いものを消してもエラーにしない
+	if err := store.Delete(ctx, hash); err != nil {
+		t.Errorf("delete twice: err = %v", err)
+	}
+	if got, err := store.Get(ctx, iconStoreKey(hash, 64)); err != nil || string(got) != "variant" {
+		t.Errorf("variant after deleting original = %q, %v", got, err)
+	}
+}
+
+func TestLocalIconStore(t *testing.T) {
+	store, err := newLocalIconStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testIconStoreRoundTrip(t, store)
+}
+
+func TestDBIconStore(t *testing.T) {
+	testIconStoreRoundTrip(t, newDBIconStore(newMemoryStore()))
+}
+
+func TestS3IconStore(t *testing.T) {
+	fake := &fakeS3{t: t, objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	store, err := newIconStore(IconConfig{
+		Store: "s3",
+		S3: IconS3Config{
+			Endpoint:        server.URL + "/",
+			Bucket:          testS3Bucket,
+			Region:          testS3Region,
+			AccessKeyID:     testS3AccessKey,
+			SecretAccessKey: testS3SecretKey,
+		},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testIconStoreRoundTrip(t, store)
+
+	fake.mu.Lock()
+	if _, ok := fake.objects[iconStoreKey("0123456789abcdef", 64)]; !ok || len(fake.objects) != 1 {
+		t.Errorf("objects = %v", fake.objects)
+	}
+	fake.mu.Unlock()
+
+	// 署名が合わなければ失敗として返す
+	store.(*s3IconStore).secretKey = "wrong"
+	if err := store.Put(context.Background(), "0123456789abcdef", []byte("image")); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Errorf("put with wrong key: err = %v", err)
+	}
+	if _, err := store.Get(context.Background(), "0123456789abcdef"); err == nil || errors.Is(err, errIconNotFound) {
+		t.Errorf("get with wrong key: err = %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestLivecomments(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	bob, bobUser := ts.signup("bob")
+
+	livestream := ts.reserve(alice, 1, "stream")
+	path := fmt.Sprintf("/api/livestream/%d/livecomment", livestream.ID)
+
+	first := decodeJSON[Livecomment](t, bob.post(path, PostLivecommentRequest{Comment: "hello", Tip: 100}), http.StatusCreated)
+	if first.ID == 0 || first.Comment != "hello" || first.Tip != 100 || first.User != bobUser || first.Livestream.ID != livestream.ID {
+		t.Errorf("livecomment = %+v", first)
+	}
+	second := decodeJSON[Livecomment](t, alice.post(path, PostLivecommentRequest{Comment: "welcome"}), http.StatusCreated)
+
+	// 新しい順に返る
+	livecomments := decodeJSON[[]Livecomment](t, bob.get(path), http.StatusOK)
+	if len(livecomments) != 2 || livecomments[0].ID != second.ID || livecomments[1].ID != first.ID {
+		t.Errorf("livecomments = %+v", livecomments)
+	}
+	limited := decodeJSON[[]Livecomment](t, bob.get(path+"?limit=1"), http.StatusOK)
+	if len(limited) != 1 || limited[0].ID != second.ID {
+		t.Errorf("limited = %+v", limited)
+	}
+
+	expectError(t, bob.get(path+"?limit=abc"), http.StatusBadRequest)
+	expectError(t, bob.post("/api/livestream/999/livecomment", PostLivecommentRequest{Comment: "hello"}), http.StatusNotFound)
+	expectError(t, bob.post("/api/livestream/abc/livecomment", PostLivecommentRequest{Comment: "hello"}), http.StatusBadRequest)
+	expectError(t, bob.do(http.MethodPost, path, "hello"), http.StatusBadRequest)
+	expectError(t, ts.client().get(path), http.StatusForbidden)
+	expectError(t, ts.client().post(path, PostLivecommentRequest{Comment: "hello"}), http.StatusForbidden)
+}
+
+func TestReportLivecomment(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	bob, _ := ts.signup("bob")
+	carol, carolUser := ts.signup("carol")
+
+	livestream := ts.reserve(alice, 1, "stream")
+	livecomment := decodeJSON[Livecomment](t, bob.post(fmt.Sprintf("/api/livestream/%d/livecomment", livestream.ID), PostLivecommentRequest{Comment: "rude"}), http.StatusCreated)
+
+	report := decodeJSON[LivecommentReport](t, carol.post(fmt.Sprintf("/api/livestream/%d/livecomment/%d/report", livestream.ID, livecomment.ID), nil), http.StatusCreated)
+	if report.ID == 0 || report.Reporter != carolUser || report.Livecomment.ID != livecomment.ID {
+		t.Errorf("report = %+v", report)
+	}
+	expectError(t, carol.post(fmt.Sprintf("/api/livestream/%d/livecomment/999/report", livestream.ID), nil), http.StatusNotFound)
+	expectError(t, carol.post(fmt.Sprintf("/api/livestream/999/livecomment/%d/report", livecomment.ID), nil), http.StatusNotFound)
+	expectError(t, carol.post(fmt.Sprintf("/api/livestream/%d/livecomment/abc/report", livestream.ID), nil), http.StatusBadRequest)
+
+	// 通報一覧は配信者だけが見られる
+	reports := decodeJSON[[]LivecommentReport](t, alice.get(fmt.Sprintf("/api/livestream/%d/report", livestream.ID)), http.StatusOK)
+	if len(reports) != 1 || reports[0].ID != report.ID {
+		t.Errorf("reports = %+v", reports)
+	}
+	expectError(t, carol.get(fmt.Sprintf("/api/livestream/%d/report", livestream.ID)), http.StatusForbidden)
+
+	stats := decodeJSON[LivestreamStatistics](t, alice.get(fmt.Sprintf("/api/livestream/%d/statistics", livestream.ID)), http.StatusOK)
+	if stats.TotalReports != 1 {
+		t.Errorf("total_reports = %d", stats.TotalReports)
+	}
+}
+
+func TestModerate(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	bob, _ := ts.signup("bob")
+	carol, _ := ts.signup("carol")
+
+	livestream := ts.reserve(alice, 1, "stream")
+	other := ts.reserve(alice, 2, "other")
+	path := fmt.Sprintf("/api/livestream/%d", livestream.ID)
+
+	spam := decodeJSON[Livecomment](t, bob.post(path+"/livecomment", PostLivecommentRequest{Comment: "buy SPAM now"}), http.StatusCreated)
+	kept := decodeJSON[Livecomment](t, bob.post(path+"/livecomment", PostLivecommentRequest{Comment: "nice stream"}), http.StatusCreated)
+	decodeJSON[Livecomment](t, bob.post(fmt.Sprintf("/api/livestream/%d/livecomment", other.ID), PostLivecommentRequest{Comment: "spam elsewhere"}), http.StatusCreated)
+
+	expectError(t, bob.post(path+"/moderate", ModerateRequest{NGWord: "spam"}), http.StatusBadRequest)
+	expectError(t, alice.post("/api/livestream/999/moderate", ModerateRequest{NGWord: "spam"}), http.StatusBadRequest)
+
+	type moderateResponse struct {
+		WordID int64 `json:"word_id"`
+	}
+	res := decodeJSON[moderateResponse](t, alice.post(path+"/moderate", ModerateRequest{NGWord: "spam"}), http.StatusCreated)
+	if res.WordID == 0 {
+		t.Errorf("word_id = %d", res.WordID)
+	}
+	ts.waitForEvent(InvalidateNGWord, func(e InvalidationEvent) bool { return e.LivestreamID == livestream.ID })
+
+	// NGワードを含む過去のコメントは消え、他の配信には影響しない
+	livecomments := decodeJSON[[]Livecomment](t, bob.get(path+"/livecomment"), http.StatusOK)
+	if len(livecomments) != 1 || livecomments[0].ID != kept.ID {
+		t.Errorf("livecomments = %+v, want only %d (not %d)", livecomments, kept.ID, spam.ID)
+	}
+	others := decodeJSON[[]Livecomment](t, bob.get(fmt.Sprintf("/api/livestream/%d/livecomment", other.ID)), http.StatusOK)
+	if len(others) != 1 {
+		t.Errorf("other livecomments = %+v", others)
+	}
+
+	// 以後はスパム判定される
+	expectError(t, bob.post(path+"/livecomment", PostLivecommentRequest{Comment: "more Spam"}), http.StatusBadRequest)
+	decodeJSON[Livecomment](t, bob.post(fmt.Sprintf("/api/livestream/%d/livecomment", other.ID), PostLivecommentRequest{Comment: "more spam"}), http.StatusCreated)
+
+	ngWords := decodeJSON[[]NGWord](t, alice.get(path+"/ngwords"), http.StatusOK)
+	if len(ngWords) != 1 || ngWords[0].ID != res.WordID || ngWords[0].Word != "spam" || ngWords[0].LivestreamID != livestream.ID {
+		t.Errorf("ngwords = %+v", ngWords)
+	}
+	// 権限のない配信やない配信では、従来どおり空のリストを返す
+	for _, p := range []string{path + "/ngwords", "/api/livestream/999/ngwords"} {
+		if ngWords := decodeJSON[[]NGWord](t, carol.get(p), http.StatusOK); len(ngWords) != 0 {
+			t.Errorf("%s: ngwords = %+v", p, ngWords)
+		}
+	}
+
+	// 配信ごとのモデレーターもNGワードを登録でき、配信者のものとして扱われる
+	decodeJSON[LivestreamModerator](t, alice.post(path+"/moderator", PostLivestreamModeratorRequest{Username: "carol"}), http.StatusCreated)
+	decodeJSON[moderateResponse](t, carol.post(path+"/moderate", ModerateRequest{NGWord: "scam"}), http.StatusCreated)
+	ngWords = decodeJSON[[]NGWord](t, carol.get(path+"/ngwords"), http.StatusOK)
+	if len(ngWords) != 2 || ngWords[0].UserID != livestream.Owner.ID || ngWords[1].UserID != livestream.Owner.ID {
+		t.Errorf("ngwords = %+v", ngWords)
+	}
+}
+
+func TestSuspendedLivecommentsHidden(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	bob, _ := ts.signup("bob")
+	carol, _ := ts.signup("carol")
+
+	livestream := ts.reserve(alice, 1, "stream")
+	path := fmt.Sprintf("/api/livestream/%d/livecomment", livestream.ID)
+	decodeJSON[Livecomment](t, bob.post(path, PostLivecommentRequest{Comment: "from bob"}), http.StatusCreated)
+	decodeJSON[Livecomment](t, carol.post(path, PostLivecommentRequest{Comment: "from carol"}), http.StatusCreated)
+	decodeJSON[Livecomment](t, bob.post(path, PostLivecommentRequest{Comment: "from bob again"}), http.StatusCreated)
+
+	// 非表示指定なしの凍結ではコメントは残る
+	decodeJSON[UserSuspensionModel](t, ts.admin().post("/api/admin/user/carol/suspension", PostUserSuspensionRequest{Reason: "rude"}), http.StatusCreated)
+	if livecomments := decodeJSON[[]Livecomment](t, alice.get(path), http.StatusOK); len(livecomments) != 3 {
+		t.Errorf("livecomments = %+v", livecomments)
+	}
+
+	decodeJSON[UserSuspensionModel](t, ts.admin().post("/api/admin/user/bob/suspension", PostUserSuspensionRequest{Reason: "spam", HideLivecomments: true}), http.StatusCreated)
+	livecomments := decodeJSON[[]Livecomment](t, alice.get(path), http.StatusOK)
+	if len(livecomments) != 1 || livecomments[0].Comment != "from carol" {
+		t.Errorf("livecomments = %+v", livecomments)
+	}
+	// 新しいコメントが隠されていても、見えるコメントでlimit件を埋める
+	livecomments = decodeJSON[[]Livecomment](t, alice.get(path+"?limit=1"), http.StatusOK)
+	if len(livecomments) != 1 || livecomments[0].Comment != "from carol" {
+		t.Errorf("livecomments with limit = %+v", livecomments)
+	}
+
+	// 凍結を解除すれば元に戻る
+	expectStatus(t, ts.admin().do(http.MethodDelete, "/api/admin/user/bob/suspension", nil), http.StatusNoContent)
+	if livecomments := decodeJSON[[]Livecomment](t, alice.get(path), http.StatusOK); len(livecomments) != 3 {
+		t.Errorf("livecomments after unsuspend = %+v", livecomments)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReserveLivestream(t *testing.T) {
+	ts := newTestServer(t)
+	alice, user := ts.signup("alice")
+	bob, _ := ts.signup("bob")
+
+	req := reserveRequest(3, "first", ts.tagID("ライブ配信"), ts.tagID("ゲーム実況"))
+	livestream := decodeJSON[Livestream](t, alice.post("/api/livestream/reservation", req), http.StatusCreated)
+	if livestream.ID == 0 || livestream.Title != req.Title || livestream.Description != req.Description ||
+		livestream.PlaylistUrl != req.PlaylistUrl || livestream.ThumbnailUrl != req.ThumbnailUrl ||
+		livestream.StartAt != req.StartAt || livestream.EndAt != req.EndAt {
+		t.Errorf("livestream = %+v", livestream)
+	}
+	if livestream.Owner != user {
+		t.Errorf("owner = %+v, want %+v", livestream.Owner, user)
+	}
+	if len(livestream.Tags) != 2 || livestream.Tags[0].Name != "ライブ配信" || livestream.Tags[1].Name != "ゲーム実況" {
+		t.Errorf("tags = %+v", livestream.Tags)
+	}
+	if slot, _ := ts.store.Slots().Remaining(context.Background(), req.StartAt, req.EndAt); slot != testSlotCapacity-1 {
+		t.Errorf("slot = %d", slot)
+	}
+
+	// 枠を使い切ったら予約できない
+	decodeJSON[Livestream](t, bob.post("/api/livestream/reservation", reserveRequest(3, "second")), http.StatusCreated)
+	expectError(t, bob.post("/api/livestream/reservation", reserveRequest(3, "third")), http.StatusBadRequest)
+
+	// 期間外
+	outside := reserveRequest(0, "outside")
+	outside.StartAt = testTermStartAt.Add(-2 * time.Hour).Unix()
+	outside.EndAt = testTermStartAt.Unix()
+	expectError(t, alice.post("/api/livestream/reservation", outside), http.StatusBadRequest)
+	outside.StartAt = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC).Unix()
+	outside.EndAt = outside.StartAt + 3600
+	expectError(t, alice.post("/api/livestream/reservation", outside), http.StatusBadRequest)
+
+	expectError(t, alice.do(http.MethodPost, "/api/livestream/reservation", "title"), http.StatusBadRequest)
+	expectError(t, ts.client().post("/api/livestream/reservation", reserveRequest(4, "anonymous")), http.StatusForbidden)
+}
+
+func TestSearchLivestreams(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	bob, _ := ts.signup("bob")
+
+	game := ts.reserve(alice, 1, "game", ts.tagID("ゲーム実況"))
+	talk := ts.reserve(bob, 2, "talk", ts.tagID("雑談"))
+	both := ts.reserve(bob, 3, "both", ts.tagID("ゲーム実況"), ts.tagID("雑談"))
+
+	// 検索はログインしていなくても使える
+	c := ts.client()
+	all := decodeJSON[[]Livestream](t, c.get("/api/livestream/search"), http.StatusOK)
+	if ids := livestreamIDs(all); fmt.Sprint(ids) != fmt.Sprint([]int64{both.ID, talk.ID, game.ID}) {
+		t.Errorf("all = %v", ids)
+	}
+	limited := decodeJSON[[]Livestream](t, c.get("/api/livestream/search?limit=2"), http.StatusOK)
+	if ids := livestreamIDs(limited); fmt.Sprint(ids) != fmt.Sprint([]int64{both.ID, talk.ID}) {
+		t.Errorf("limited = %v", ids)
+	}
+	tagged := decodeJSON[[]Livestream](t, c.get("/api/livestream/search?tag=ゲーム実況"), http.StatusOK)
+	if ids := livestreamIDs(tagged); fmt.Sprint(ids) != fmt.Sprint([]int64{both.ID, game.ID}) {
+		t.Errorf("tagged = %v", ids)
+	}
+	if tagged[0].Owner.Name != "bob" || len(tagged[0].Tags) != 2 {
+		t.Errorf("tagged[0] = %+v", tagged[0])
+	}
+	expectError(t, c.get("/api/livestream/search?limit=abc"), http.StatusBadRequest)
+
+	// 凍結中の配信者の配信は出さない
+	decodeJSON[UserSuspensionModel](t, ts.admin().post("/api/admin/user/bob/suspension", PostUserSuspensionRequest{Reason: "spam"}), http.StatusCreated)
+	all = decodeJSON[[]Livestream](t, c.get("/api/livestream/search"), http.StatusOK)
+	if ids := livestreamIDs(all); fmt.Sprint(ids) != fmt.Sprint([]int64{game.ID}) {
+		t.Errorf("without suspended = %v", ids)
+	}
+}
+
+func livestreamIDs(livestreams []Livestream) []int64 {
+	ids := make([]int64, len(livestreams))
+	for i, livestream := range livestreams {
+		ids[i] = livestream.ID
+	}
+	return ids
+}
+
+func TestListUserLivestreams(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	bob, _ := ts.signup("bob")
+
+	first := ts.reserve(alice, 1, "first")
+	second := ts.reserve(alice, 2, "second")
+	ts.reserve(bob, 3, "bob")
+
+	mine := decodeJSON[[]Livestream](t, alice.get("/api/livestream"), http.StatusOK)
+	if ids := livestreamIDs(mine); fmt.Sprint(ids) != fmt.Sprint([]int64{first.ID, second.ID}) {
+		t.Errorf("mine = %v", ids)
+	}
+	expectError(t, ts.client().get("/api/livestream"), http.StatusForbidden)
+
+	users := decodeJSON[[]Livestream](t, bob.get("/api/user/alice/livestream"), http.StatusOK)
+	if ids := livestreamIDs(users); fmt.Sprint(ids) != fmt.Sprint([]int64{first.ID, second.ID}) {
+		t.Errorf("alice's = %v", ids)
+	}
+	expectError(t, bob.get("/api/user/nobody/livestream"), http.StatusNotFound)
+
+	_, carol := ts.signup("carol")
+	none := decodeJSON[[]Livestream](t, bob.get("/api/user/"+carol.Name+"/livestream"), http.StatusOK)
+	if len(none) != 0 {
+		t.Errorf("carol's = %+v", none)
+	}
+}
+
+func TestGetLivestream(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	bob, _ := ts.signup("bob")
+
+	livestream := ts.reserve(alice, 1, "stream", ts.tagID("雑談"))
+
+	got := decodeJSON[Livestream](t, bob.get(fmt.Sprintf("/api/livestream/%d", livestream.ID)), http.StatusOK)
+	if got.ID != livestream.ID || got.Title != livestream.Title || got.Owner != livestream.Owner || len(got.Tags) != 1 {
+		t.Errorf("livestream = %+v, want %+v", got, livestream)
+	}
+	expectError(t, bob.get("/api/livestream/999"), http.StatusNotFound)
+	expectError(t, bob.get("/api/livestream/abc"), http.StatusBadRequest)
+	expectError(t, ts.client().get(fmt.Sprintf("/api/livestream/%d", livestream.ID)), http.StatusForbidden)
+}
+
+func TestEnterExitLivestream(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	bob, _ := ts.signup("bob")
+	carol, _ := ts.signup("carol")
+
+	livestream := ts.reserve(alice, 1, "stream")
+	path := fmt.Sprintf("/api/livestream/%d", livestream.ID)
+
+	expectStatus(t, bob.post(path+"/enter", nil), http.StatusOK)
+	expectStatus(t, carol.post(path+"/enter", nil), http.StatusOK)
+	stats := decodeJSON[LivestreamStatistics](t, alice.get(path+"/statistics"), http.StatusOK)
+	if stats.ViewersCount != 2 {
+		t.Errorf("viewers after enter = %d", stats.ViewersCount)
+	}
+
+	expectStatus(t, bob.do(http.MethodDelete, path+"/exit", nil), http.StatusOK)
+	stats = decodeJSON[LivestreamStatistics](t, alice.get(path+"/statistics"), http.StatusOK)
+	if stats.ViewersCount != 1 {
+		t.Errorf("viewers after exit = %d", stats.ViewersCount)
+	}
+
+	expectError(t, bob.post("/api/livestream/abc/enter", nil), http.StatusBadRequest)
+	expectError(t, bob.do(http.MethodDelete, "/api/livestream/abc/exit", nil), http.StatusBadRequest)
+	expectError(t, ts.client().post(path+"/enter", nil), http.StatusForbidden)
+	expectError(t, ts.client().do(http.MethodDelete, path+"/exit", nil), http.StatusForbidden)
+}
+
+func TestLivestreamModerators(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	bob, bobUser := ts.signup("bob")
+	carol, _ := ts.signup("carol")
+
+	livestream := ts.reserve(alice, 1, "stream")
+	path := fmt.Sprintf("/api/livestream/%d/moderator", livestream.ID)
+
+	empty := decodeJSON[[]LivestreamModerator](t, alice.get(path), http.StatusOK)
+	if len(empty) != 0 {
+		t.Errorf("moderators = %+v", empty)
+	}
+
+	// 配信者以外は追加・削除できない
+	expectError(t, bob.post(path, PostLivestreamModeratorRequest{Username: "bob"}), http.StatusForbidden)
+	expectError(t, bob.get(path), http.StatusForbidden)
+	expectError(t, alice.post(path, PostLivestreamModeratorRequest{Username: "nobody"}), http.StatusNotFound)
+	expectError(t, alice.post("/api/livestream/999/moderator", PostLivestreamModeratorRequest{Username: "bob"}), http.StatusNotFound)
+
+	added := decodeJSON[LivestreamModerator](t, alice.post(path, PostLivestreamModeratorRequest{Username: "Bob"}), http.StatusCreated)
+	if added.User != bobUser || added.CreatedAt == 0 {
+		t.Errorf("added = %+v", added)
+	}
+	expectError(t, alice.post(path, PostLivestreamModeratorRequest{Username: "bob"}), http.StatusConflict)
+
+	// モデレーターは一覧を見られるが、追加はできない
+	moderators := decodeJSON[[]LivestreamModerator](t, bob.get(path), http.StatusOK)
+	if len(moderators) != 1 || moderators[0] != added {
+		t.Errorf("moderators = %+v", moderators)
+	}
+	expectError(t, bob.post(path, PostLivestreamModeratorRequest{Username: "carol"}), http.StatusForbidden)
+	expectError(t, carol.get(path), http.StatusForbidden)
+
+	expectError(t, bob.do(http.MethodDelete, path+"/bob", nil), http.StatusForbidden)
+	expectStatus(t, alice.do(http.MethodDelete, path+"/bob", nil), http.StatusNoContent)
+	expectError(t, bob.get(path), http.StatusForbidden)
+	expectError(t, alice.do(http.MethodDelete, "/api/livestream/999/moderator/bob", nil), http.StatusNotFound)
+
+	// プラットフォームモデレーターは全ての配信を扱える
+	decodeJSON[UserRoleResponse](t, ts.admin().do(http.MethodPut, "/api/admin/user/carol/role", PutUserRoleRequest{Role: RolePlatformModerator}), http.StatusOK)
+	decodeJSON[[]LivestreamModerator](t, carol.get(path), http.StatusOK)
+}
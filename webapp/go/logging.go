@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// 構造化ログ (log/slog)
+// サブシステムごとにレベルを変えられる。リクエストの中で ctx を渡して書いたログには、
+// アクセスログと突き合わせられるようにリクエストIDなどが付く
+
+// サブシステムごとのロガー。設定を読む前に作られるので、書くときに設定を見る
+var (
+	// アクセスログ
+	accessLogger = newSubsystemLogger("http")
+	// ハンドラとサーバの起動
+	appLogger = newSubsystemLogger("app")
+	// レプリカの監視とマイグレーション
+	dbLogger = newSubsystemLogger("db")
+	// DNSレコードの管理と組み込みのDNSサーバ
+	dnsLogger = newSubsystemLogger("dns")
+	// サーバ間のキャッシュ無効化
+	cacheLogger = newSubsystemLogger("cache")
+	// spanの書き出し
+	tracingLogger = newSubsystemLogger("tracing")
+)
+
+var (
+	logLevels      = make(map[string]*slog.LevelVar)
+	logBaseHandler atomic.Pointer[baseHandler]
+)
+
+// atomic.Pointer に入れるための箱
+type baseHandler struct {
+	h slog.Handler
+}
+
+func init() {
+	configureLogging(defaultConfig().Log, os.Stderr)
+}
+
+func newSubsystemLogger(subsystem string) *slog.Logger {
+	level := new(slog.LevelVar)
+	logLevels[subsystem] = level
+	h := &subsystemHandler{level: level}
+	return slog.New(h.WithAttrs([]slog.Attr{slog.String("subsystem", subsystem)}))
+}
+
+// 設定に合わせてログの形式と書き出し先、サブシステムごとのレベルを変える
+// 設定は Validate 済みなので、レベルの解釈には失敗しない
+func configureLogging(cfg LogConfig, w io.Writer) {
+	// レベルはサブシステムごとに判定するので、ここでは全て通す
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	var h slog.Handler
+	if cfg.Format == "text" {
+		h = slog.NewTextHandler(w, opts)
+	} else {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	logBaseHandler.Store(&baseHandler{h: requestContextHandler{h}})
+
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(cfg.Level))
+	for subsystem, v := range logLevels {
+		l := level
+		if s, ok := cfg.Levels[subsystem]; ok {
+			_ = l.UnmarshalText([]byte(s))
+		}
+		v.Set(l)
+	}
+
+	// 標準のlogパッケージとslogのデフォルトもappのロガーに流す
+	slog.SetDefault(appLogger)
+}
+
+// サブシステムのレベルで絞ってから、書くときの設定のハンドラに渡す
+type subsystemHandler struct {
+	level *slog.LevelVar
+	// WithAttrs, WithGroup を書くときのハンドラにも順に適用する
+	derive []func(slog.Handler) slog.Handler
+}
+
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	base := logBaseHandler.Load().h
+	for _, derive := range h.derive {
+		base = derive(base)
+	}
+	return base.Handle(ctx, r)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(base slog.Handler) slog.Handler { return base.WithAttrs(attrs) })
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(base slog.Handler) slog.Handler { return base.WithGroup(name) })
+}
+
+func (h *subsystemHandler) with(derive func(slog.Handler) slog.Handler) *subsystemHandler {
+	return &subsystemHandler{
+		level:  h.level,
+		derive: append(append([]func(slog.Handler) slog.Handler{}, h.derive...), derive),
+	}
+}
+
+// ctx にリクエストの情報があれば、ログに付け足す
+type requestContextHandler struct {
+	slog.Handler
+}
+
+func (h requestContextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if fields := requestLogFieldsFromContext(ctx); fields != nil {
+		r.AddAttrs(fields.attrs()...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestContextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestContextHandler) WithGroup(name string) slog.Handler {
+	return requestContextHandler{h.Handler.WithGroup(name)}
+}
+
+// requestLogFields はリクエストの中のログに付ける項目です。
+// ユーザはセッションを確かめてから分かるので、ハンドラの途中で書き足す
+type requestLogFields struct {
+	mu           sync.Mutex
+	requestID    string
+	traceID      string
+	userID       int64
+	livestreamID int64
+}
+
+type requestLogFieldsKey struct{}
+
+func requestLogFieldsFromContext(ctx context.Context) *requestLogFields {
+	fields, _ := ctx.Value(requestLogFieldsKey{}).(*requestLogFields)
+	return fields
+}
+
+func (f *requestLogFields) attrs() []slog.Attr {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	attrs := []slog.Attr{slog.String("request_id", f.requestID)}
+	if f.traceID != "" {
+		attrs = append(attrs, slog.String("trace_id", f.traceID))
+	}
+	if f.userID != 0 {
+		attrs = append(attrs, slog.Int64("user_id", f.userID))
+	}
+	if f.livestreamID != 0 {
+		attrs = append(attrs, slog.Int64("livestream_id", f.livestreamID))
+	}
+	return attrs
+}
+
+func setLogUserID(ctx context.Context, userID int64) {
+	if fields := requestLogFieldsFromContext(ctx); fields != nil {
+		fields.mu.Lock()
+		fields.userID = userID
+		fields.mu.Unlock()
+	}
+}
+
+func setLogTraceID(ctx context.Context, traceID string) {
+	if fields := requestLogFieldsFromContext(ctx); fields != nil {
+		fields.mu.Lock()
+		fields.traceID = traceID
+		fields.mu.Unlock()
+	}
+}
+
+// リクエストIDを決めてレスポンスヘッダで返し、リクエストの中のログに付ける
+// 前段のプロキシなどが付けたIDがあればそれを使う
+func requestIDMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		req := c.Request()
+		requestID := req.Header.Get(echo.HeaderXRequestID)
+		if !isValidRequestID(requestID) {
+			requestID = uuid.NewString()
+		}
+		c.Response().Header().Set(echo.HeaderXRequestID, requestID)
+
+		fields := &requestLogFields{requestID: requestID}
+		if livestreamID, err := strconv.ParseInt(c.Param("livestream_id"), 10, 64); err == nil {
+			fields.livestreamID = livestreamID
+		}
+		c.SetRequest(req.WithContext(context.WithValue(req.Context(), requestLogFieldsKey{}, fields)))
+
+		return next(c)
+	}
+}
+
+// ログを壊さないよう、表示できるASCII文字だけの短いものに限る
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// middleware.Loggerの代わりにアクセスログを書く
+// ハンドラが返したエラーはここでエラーハンドラに渡し、書かれたレスポンスを記録する
+func accessLogMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+
+		req := c.Request()
+		res := c.Response()
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		accessLogger.LogAttrs(req.Context(), slog.LevelInfo, "request",
+			slog.String("method", req.Method),
+			slog.String("route", route),
+			slog.String("uri", req.RequestURI),
+			slog.Int("status", res.Status),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.Int64("bytes_out", res.Size),
+			slog.String("remote_ip", c.RealIP()),
+			slog.String("user_agent", req.UserAgent()),
+		)
+		return nil
+	}
+}
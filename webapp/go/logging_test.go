@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// テストの間だけログを buf に書き出す
+func captureLogs(t *testing.T, cfg LogConfig) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	configureLogging(cfg, &buf)
+	t.Cleanup(func() { configureLogging(defaultConfig().Log, io.Discard) })
+	return &buf
+}
+
+func parseLogLines(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	t.Helper()
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid log line %q: %v", line, err)
+		}
+		lines = append(lines, entry)
+	}
+	return lines
+}
+
+func TestRequestLogs(t *testing.T) {
+	ts := newTestServer(t)
+	alice, aliceUser := ts.signup("alice")
+	bob, bobUser := ts.signup("bob")
+	livestream := ts.reserve(alice, 1, "stream")
+	spans := enableTestTracing(t, 1)
+	buf := captureLogs(t, LogConfig{Format: "json", Level: "info"})
+
+	path := fmt.Sprintf("/api/livestream/%d/livecomment", livestream.ID)
+	rec := bob.post(path, PostLivecommentRequest{Comment: "hello"})
+	expectStatus(t, rec, http.StatusCreated)
+	requestID := rec.Header().Get(echo.HeaderXRequestID)
+	if requestID == "" {
+		t.Fatal("request id is empty")
+	}
+
+	// 前段で付けられたリクエストIDはそのまま使う
+	req := httptest.NewRequest(http.MethodGet, "/api/livestream/999", nil)
+	req.Header.Set(echo.HeaderXRequestID, "upstream-id")
+	rec = alice.send(req)
+	expectError(t, rec, http.StatusNotFound)
+	if got := rec.Header().Get(echo.HeaderXRequestID); got != "upstream-id" {
+		t.Errorf("request id = %q", got)
+	}
+	spans()
+
+	lines := parseLogLines(t, buf)
+	var access, failed []map[string]any
+	for _, line := range lines {
+		switch line["msg"] {
+		case "request":
+			access = append(access, line)
+		case "request failed":
+			failed = append(failed, line)
+		}
+	}
+	if len(access) != 2 || len(failed) != 1 {
+		t.Fatalf("logs = %s", buf)
+	}
+
+	if access[0]["subsystem"] != "http" || access[0]["request_id"] != requestID || access[0]["route"] != "/api/livestream/:livestream_id/livecomment" ||
+		access[0]["status"] != float64(http.StatusCreated) || access[0]["user_id"] != float64(bobUser.ID) ||
+		access[0]["livestream_id"] != float64(livestream.ID) || len(fmt.Sprint(access[0]["trace_id"])) != 32 {
+		t.Errorf("access log = %v", access[0])
+	}
+
+	// ハンドラのログとアクセスログは同じリクエストIDで突き合わせられる
+	if failed[0]["subsystem"] != "app" || failed[0]["request_id"] != "upstream-id" || failed[0]["user_id"] != float64(aliceUser.ID) ||
+		failed[0]["livestream_id"] != float64(999) || failed[0]["status"] != float64(http.StatusNotFound) || failed[0]["level"] != "INFO" {
+		t.Errorf("handler log = %v", failed[0])
+	}
+	if access[1]["request_id"] != "upstream-id" || access[1]["trace_id"] != failed[0]["trace_id"] {
+		t.Errorf("access log = %v", access[1])
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	buf := captureLogs(t, LogConfig{Format: "text", Level: "debug", Levels: map[string]string{"http": "warn"}})
+
+	expectError(t, alice.get("/api/user/nobody"), http.StatusNotFound)
+	logs := buf.String()
+	if strings.Contains(logs, "subsystem=http") {
+		t.Errorf("access log is written at warn level: %s", logs)
+	}
+	if !strings.Contains(logs, "subsystem=app") || !strings.Contains(logs, `msg="request failed"`) {
+		t.Errorf("handler log is not written: %s", logs)
+	}
+
+	buf = captureLogs(t, LogConfig{Format: "json", Level: "error"})
+	expectError(t, alice.get("/api/user/nobody"), http.StatusNotFound)
+	if buf.Len() != 0 {
+		t.Errorf("logs = %s", buf)
+	}
+
+	for _, cfg := range []LogConfig{
+		{Format: "xml", Level: "info"},
+		{Format: "json", Level: "verbose"},
+		{Format: "json", Level: "info", Levels: map[string]string{"nothing": "debug"}},
+		{Format: "json", Level: "info", Levels: map[string]string{"dns": "loud"}},
+	} {
+		c := newTestConfig()
+		c.Log = cfg
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "log.") {
+			t.Errorf("%+v: err = %v", cfg, err)
+		}
+	}
+}
+
+func TestErrorResponse(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+
+	// レスポンスのボディは従来どおりエラーの文字列
+	res := decodeJSON[ErrorResponse](t, alice.get("/api/user/nobody"), http.StatusNotFound)
+	if res.Error != "code=404, message=not found user that has the given username" {
+		t.Errorf("error = %q", res.Error)
+	}
+
+	rec := httptest.NewRecorder()
+	c := ts.e.NewContext(httptest.NewRequest(http.MethodGet, "/", nil), rec)
+	errorResponseHandler(fmt.Errorf("dial tcp 127.0.0.1:3306: connection refused"), c)
+	res = decodeJSON[ErrorResponse](t, rec, http.StatusInternalServerError)
+	if res.Error != "dial tcp 127.0.0.1:3306: connection refused" {
+		t.Errorf("error = %q", res.Error)
+	}
+}
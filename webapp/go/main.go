@@ -4,97 +4,49 @@ package main
 // sqlx的な参考: https://jmoiron.github.io/sqlx/
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/felixge/fgprof"
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
-	"log"
-	"net"
+	"log/slog"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
-	"os/exec"
-	"strconv"
+	"time"
 
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
-	echolog "github.com/labstack/gommon/log"
-)
-
-const (
-	listenPort                     = 8080
-	powerDNSSubdomainAddressEnvKey = "ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS"
 )
 
 var (
 	powerDNSSubdomainAddress string
 	dbConn                   *sqlx.DB
-	secret                   = []byte("isucon13_session_cookiestore_defaultsecret")
+	secret                   []byte
 )
 
-func init() {
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
-	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
-		secret = []byte(secretKey)
-	}
-}
-
 type InitializeResponse struct {
 	Language string `json:"language"`
 }
 
-func connectDB(logger echo.Logger) (*sqlx.DB, error) {
-	const (
-		networkTypeEnvKey = "ISUCON13_MYSQL_DIALCONFIG_NET"
-		addrEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_ADDRESS"
-		portEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_PORT"
-		userEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_USER"
-		passwordEnvKey    = "ISUCON13_MYSQL_DIALCONFIG_PASSWORD"
-		dbNameEnvKey      = "ISUCON13_MYSQL_DIALCONFIG_DATABASE"
-		parseTimeEnvKey   = "ISUCON13_MYSQL_DIALCONFIG_PARSETIME"
-	)
+func connectDB() (*sqlx.DB, error) {
+	return openMySQL(appConfig.MySQL, appConfig.MySQL.Addr())
+}
 
+// addr のMySQLに接続する。レプリカも接続先以外はプライマリと同じ設定を使う
+func openMySQL(mysqlConfig MySQLConfig, addr string) (*sqlx.DB, error) {
 	conf := mysql.NewConfig()
-
-	// 環境変数がセットされていなかった場合でも一旦動かせるように、デフォルト値を入れておく
-	// この挙動を変更して、エラーを出すようにしてもいいかもしれない
-	conf.Net = "tcp"
-	conf.Addr = net.JoinHostPort("127.0.0.1", "3306")
-	conf.User = "isucon"
-	conf.Passwd = "isucon"
-	conf.DBName = "isupipe"
-	conf.ParseTime = true
+	conf.Net = mysqlConfig.Net
+	conf.Addr = addr
+	conf.User = mysqlConfig.User
+	conf.Passwd = mysqlConfig.Password
+	conf.DBName = mysqlConfig.Database
+	conf.ParseTime = mysqlConfig.ParseTime
 	conf.InterpolateParams = true
 
-	if v, ok := os.LookupEnv(networkTypeEnvKey); ok {
-		conf.Net = v
-	}
-	if addr, ok := os.LookupEnv(addrEnvKey); ok {
-		if port, ok2 := os.LookupEnv(portEnvKey); ok2 {
-			conf.Addr = net.JoinHostPort(addr, port)
-		} else {
-			conf.Addr = net.JoinHostPort(addr, "3306")
-		}
-	}
-	if v, ok := os.LookupEnv(userEnvKey); ok {
-		conf.User = v
-	}
-	if v, ok := os.LookupEnv(passwordEnvKey); ok {
-		conf.Passwd = v
-	}
-	if v, ok := os.LookupEnv(dbNameEnvKey); ok {
-		conf.DBName = v
-	}
-	if v, ok := os.LookupEnv(parseTimeEnvKey); ok {
-		parseTime, err := strconv.ParseBool(v)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", parseTimeEnvKey, err)
-		}
-		conf.ParseTime = parseTime
-	}
-
 	db, err := sqlx.Open("mysql", conf.FormatDSN())
 	if err != nil {
 		return nil, err
@@ -108,24 +60,48 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 	return db, nil
 }
 
+// DBを最新のスキーマにして初期データを入れ直す
+// テストではメモリ上のStoreを使うので差し替える
+var initializeDatabase = defaultInitializeDatabase
+
+func defaultInitializeDatabase(ctx context.Context) error {
+	m, err := newMigrator(dbConn)
+	if err != nil {
+		return err
+	}
+	// 他のサーバが古いスキーマのまま動いていても、初期データを入れる前に最新にしておく
+	if _, err := m.Up(ctx); err != nil {
+		return fmt.Errorf("failed to migrate: %w", err)
+	}
+	if err := m.Seed(ctx, appConfig.MySQL.SeedDir); err != nil {
+		return fmt.Errorf("failed to load seed data: %w", err)
+	}
+	return nil
+}
+
 func initializeHandler(c echo.Context) error {
-	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
-		c.Logger().Warnf("init.sh failed with err=%s", string(out))
+	ctx := c.Request().Context()
+
+	if err := initializeDatabase(ctx); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
+	// 初期データを入れ直すとロールも消えるので、設定のadminを付け直す
+	if err := seedAdminUsers(ctx, appConfig.AdminUsers); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to seed admin users: "+err.Error())
+	}
+	if err := resetDNSZone(ctx); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reset dns zone: "+err.Error())
+	}
 
-	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
-	response, err := http.Post("http://isucon-s2:8080/api/initCache", "application/json", nil)
-	if err != nil {
+	if err := reloadAllCaches(ctx); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
-	defer response.Body.Close()
 
-	response2, err := http.Post("http://isucon-s2:8080/api/initTag", "application/json", nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
+	// 他のサーバのキャッシュも作り直してから応答する
+	// 落ちているサーバには後から送り直すので、初期化は失敗させない
+	if err := cacheBus.Broadcast(ctx, InvalidationEvent{Kind: InvalidateAll}); err != nil {
+		appLogger.WarnContext(ctx, "failed to notify peers of initialization", "error", err)
 	}
-	defer response2.Body.Close()
 
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "golang",
@@ -133,30 +109,60 @@ func initializeHandler(c echo.Context) error {
 }
 
 func initCacheHandler(c echo.Context) error {
-	InitCache()
+	if err := reloadAllCaches(c.Request().Context()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize cache: "+err.Error())
+	}
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "golang",
 	})
 }
 
-func main() {
-	http.DefaultServeMux.Handle("/debug/fgprof", fgprof.Handler())
-	go func() {
-		log.Println(http.ListenAndServe(":6060", nil))
-	}()
+// ミドルウェアとルーティングを設定したechoを作る
+func newEcho() *echo.Echo {
 	e := echo.New()
-	e.Debug = true
-	e.Logger.SetLevel(echolog.DEBUG)
-	e.Use(middleware.Logger())
+	// アクセスログがエラーレスポンスを書いた後のステータスを数えるので、一番外側に置く
+	e.Use(metricsMiddleware)
+	e.Use(requestIDMiddleware)
+	e.Use(accessLogMiddleware)
+	// ハンドラが返したエラーをspanに残すので、アクセスログより内側に置く
+	e.Use(tracingMiddleware)
+	// リクエストごとのSQLの回数。ログにリクエストIDが付くよう、その内側に置く
+	e.Use(queryStatsMiddleware)
+	// <username>.u.isucon.dev のチャンネル用のパスはルーティング前に書き換える
+	e.Pre(channelHostMiddleware)
 	cookieStore := sessions.NewCookieStore(secret)
-	cookieStore.Options.Domain = "*.u.isucon.dev"
+	cookieStore.Options.Domain = sessionCookieDomain
 	e.Use(session.Middleware(cookieStore))
+	e.Use(dbRoutingMiddleware)
 	// e.Use(middleware.Recover())
 
+	// Prometheus向けの指標
+	e.GET("/metrics", getMetricsHandler)
+
+	requireAdmin := requireRole(RoleAdmin)
 	// 初期化
+	// ベンチマーカーが認証なしで呼ぶので、/api/initialize だけは誰でも呼べる
 	e.POST("/api/initialize", initializeHandler)
-	e.POST("/api/initCache", initCacheHandler)
-	e.POST("/api/initTag", initTagCache)
+	// 他のサーバへの通知はキャッシュ無効化の仕組みで行うので、キャッシュの作り直しは運営だけが呼べる
+	e.POST("/api/initCache", initCacheHandler, requireAdmin)
+	e.POST("/api/initTag", initTagCache, requireAdmin)
+	// サーバ間のキャッシュ無効化 (admin)
+	e.POST("/api/internal/invalidate", postInvalidateHandler, requireAdmin)
+	e.GET("/api/admin/cluster/peers", getClusterPeersHandler, requireAdmin)
+	e.GET("/api/admin/db/replicas", getDBReplicasHandler, requireAdmin)
+
+	// admin
+	e.POST("/api/admin/tag", postTagHandler, requireAdmin)
+	e.GET("/api/admin/user/:username/role", getUserRoleHandler, requireAdmin)
+	e.PUT("/api/admin/user/:username/role", putUserRoleHandler, requireAdmin)
+	e.GET("/api/admin/user/:username/suspension", getUserSuspensionHandler, requireAdmin)
+	e.POST("/api/admin/user/:username/suspension", postUserSuspensionHandler, requireAdmin)
+	e.DELETE("/api/admin/user/:username/suspension", deleteUserSuspensionHandler, requireAdmin)
+	e.GET("/api/admin/icon/blocklist", getIconBlocklistHandler, requireAdmin)
+	e.POST("/api/admin/icon/blocklist", postIconBlocklistHandler, requireAdmin)
+	e.DELETE("/api/admin/icon/blocklist/:hash", deleteIconBlocklistHandler, requireAdmin)
+	e.GET("/api/admin/dns/reconcile", getDNSReconcileHandler, requireAdmin)
+	e.POST("/api/admin/dns/reconcile", postDNSReconcileHandler, requireAdmin)
 
 	// top
 	e.GET("/api/tag", getTagHandler)
@@ -185,6 +191,10 @@ func main() {
 	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/report", reportLivecommentHandler)
 	// 配信者によるモデレーション (NGワード登録)
 	e.POST("/api/livestream/:livestream_id/moderate", moderateHandler)
+	// 配信ごとのモデレーター管理
+	e.GET("/api/livestream/:livestream_id/moderator", getLivestreamModeratorsHandler)
+	e.POST("/api/livestream/:livestream_id/moderator", postLivestreamModeratorHandler)
+	e.DELETE("/api/livestream/:livestream_id/moderator/:username", deleteLivestreamModeratorHandler)
 
 	// livestream_viewersにINSERTするため必要
 	// ユーザ視聴開始 (viewer)
@@ -194,13 +204,23 @@ func main() {
 
 	// user
 	e.POST("/api/register", registerHandler)
+	e.GET("/api/register/availability", getUsernameAvailabilityHandler)
 	e.POST("/api/login", loginHandler)
 	e.GET("/api/user/me", getMeHandler)
+	e.DELETE("/api/user/me", deleteMeHandler)
+	// 個人データのエクスポート
+	e.GET("/api/user/me/export", getUserExportHandler)
+	e.GET("/api/user/me/export/status", getUserExportStatusHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
 	e.GET("/api/user/:username", getUserHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
 	e.GET("/api/user/:username/icon", getIconHandler)
+	e.HEAD("/api/user/:username/icon", getIconHandler)
+	e.GET("/api/icon/:hash", getIconByHashHandler)
+	e.HEAD("/api/icon/:hash", getIconByHashHandler)
 	e.POST("/api/icon", postIconHandler)
+	e.GET("/api/icon/history", getIconHistoryHandler)
+	e.POST("/api/icon/history/:icon_id/revert", revertIconHandler)
 
 	// stats
 	// ライブ配信統計情報
@@ -211,26 +231,141 @@ func main() {
 
 	e.HTTPErrorHandler = errorResponseHandler
 
+	return e
+}
+
+func main() {
+	// サブコマンド
+	if len(os.Args) > 1 && os.Args[1] == "reconcile-dns" {
+		os.Exit(runReconcileDNSCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(runMigrateCommand(os.Args[2:]))
+	}
+
+	cfg, err := loadConfig(flag.CommandLine, os.Args[1:])
+	if errors.Is(err, errConfigDumped) {
+		os.Exit(0)
+	}
+	if err != nil {
+		appLogger.Error("failed to load config", "error", err)
+		os.Exit(1)
+	}
+	applyConfig(cfg)
+
+	if cfg.PprofAddr != "" {
+		http.DefaultServeMux.Handle("/debug/fgprof", fgprof.Handler())
+		go func() {
+			appLogger.Error("pprof server stopped", "error", http.ListenAndServe(cfg.PprofAddr, nil))
+		}()
+	}
+	e := newEcho()
+	e.Debug = true
+	appLogger.Info("effective config", "config", cfg.Redacted())
+
+	t, err := newTracerFromConfig(cfg.Tracing, tracingLogger)
+	if err != nil {
+		appLogger.Error("failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	if t != nil {
+		tracer = t
+	}
+
 	// DB接続
-	conn, err := connectDB(e.Logger)
+	conn, err := connectDB()
 	if err != nil {
-		e.Logger.Errorf("failed to connect db: %v", err)
+		appLogger.Error("failed to connect db", "error", err)
 		os.Exit(1)
 	}
 	defer conn.Close()
 	dbConn = conn
 
-	subdomainAddr, ok := os.LookupEnv(powerDNSSubdomainAddressEnvKey)
-	if !ok {
-		e.Logger.Errorf("environ %s must be provided", powerDNSSubdomainAddressEnvKey)
+	if cfg.MySQL.MigrateOnStart {
+		m, err := newMigrator(conn)
+		if err != nil {
+			appLogger.Error("failed to load migrations", "error", err)
+			os.Exit(1)
+		}
+		applied, err := m.Up(context.Background())
+		if err != nil {
+			appLogger.Error("failed to migrate", "error", err)
+			os.Exit(1)
+		}
+		for _, mig := range applied {
+			dbLogger.Info("applied migration", "migration", mig.String())
+		}
+	}
+
+	pool, err := newReplicaPool(cfg.MySQL)
+	if err != nil {
+		appLogger.Error("failed to connect replicas", "error", err)
+		os.Exit(1)
+	}
+	defer pool.Close()
+	replicaPool = pool
+	replicaPool.Start(time.Duration(cfg.MySQL.ReplicaCheckInterval), dbLogger)
+	dataStore = newMySQLStore(conn, pool)
+
+	if err := loadSuspensionCache(context.Background()); err != nil {
+		appLogger.Error("failed to load suspensions", "error", err)
+		os.Exit(1)
+	}
+
+	store, err := newIconStore(cfg.Icon, dataStore)
+	if err != nil {
+		appLogger.Error("failed to set up icon store", "error", err)
 		os.Exit(1)
 	}
-	powerDNSSubdomainAddress = subdomainAddr
+	iconStore = store
+
+	// 再起動してもアイコンがNoImageにならないように、キャッシュをDBから温めておく
+	if err := loadFallbackImage(); err != nil {
+		appLogger.Error("failed to load fallback image", "error", err)
+		os.Exit(1)
+	}
+	if err := backfillIconHashes(context.Background()); err != nil {
+		appLogger.Error("failed to backfill icon hashes", "error", err)
+		os.Exit(1)
+	}
+	if err := warmIconHashCache(context.Background()); err != nil {
+		appLogger.Error("failed to warm icon cache", "error", err)
+		os.Exit(1)
+	}
+	if err := loadBlockedIconCache(context.Background()); err != nil {
+		appLogger.Error("failed to load icon blocklist", "error", err)
+		os.Exit(1)
+	}
+	if err := loadTagCache(context.Background()); err != nil {
+		appLogger.Error("failed to load tags", "error", err)
+		os.Exit(1)
+	}
+
+	provider, err := newDNSProvider(cfg.DNS)
+	if err != nil {
+		appLogger.Error("failed to set up dns provider", "error", err)
+		os.Exit(1)
+	}
+	dnsProvider = provider
+
+	// 組み込みのDNSサーバを使う場合は、usersテーブルから索引を作ってから待ち受ける
+	if dnsServer, ok := provider.(*embeddedDNSServer); ok {
+		if err := dnsServer.loadUsers(context.Background(), powerDNSSubdomainAddress); err != nil {
+			appLogger.Error("failed to load dns records", "error", err)
+			os.Exit(1)
+		}
+		if err := dnsServer.Start(cfg.DNS.ServerAddr, dnsLogger); err != nil {
+			appLogger.Error("failed to start dns server", "error", err)
+			os.Exit(1)
+		}
+	}
+
+	startDNSReconciler(cfg.DNS, dnsLogger)
+	startCacheBus(cfg, cacheLogger)
 
 	// HTTPサーバ起動
-	listenAddr := net.JoinHostPort("", strconv.Itoa(listenPort))
-	if err := e.Start(listenAddr); err != nil {
-		e.Logger.Errorf("failed to start HTTP server: %v", err)
+	if err := e.Start(cfg.ListenAddr); err != nil {
+		appLogger.Error("failed to start HTTP server", "error", err)
 		os.Exit(1)
 	}
 }
@@ -239,16 +374,27 @@ type ErrorResponse struct {
 	Error string `json:"error"`
 }
 
+// ハンドラのエラーをログに書き、従来どおり err.Error() をそのままJSONで返す
+// echo.HTTPErrorでないエラーは500にする
 func errorResponseHandler(err error, c echo.Context) {
-	c.Logger().Errorf("error at %s: %+v", c.Path(), err)
-	if he, ok := err.(*echo.HTTPError); ok {
-		if e := c.JSON(he.Code, &ErrorResponse{Error: err.Error()}); e != nil {
-			c.Logger().Errorf("%+v", e)
-		}
+	ctx := c.Request().Context()
+	if c.Response().Committed {
+		appLogger.WarnContext(ctx, "error after the response was written", "error", err)
 		return
 	}
 
-	if e := c.JSON(http.StatusInternalServerError, &ErrorResponse{Error: err.Error()}); e != nil {
-		c.Logger().Errorf("%+v", e)
+	status := http.StatusInternalServerError
+	if he, ok := err.(*echo.HTTPError); ok {
+		status = he.Code
+	}
+
+	level := slog.LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	appLogger.Log(ctx, level, "request failed", "status", status, "error", err)
+
+	if e := c.JSON(status, &ErrorResponse{Error: err.Error()}); e != nil {
+		appLogger.ErrorContext(ctx, "failed to write error response", "error", e)
 	}
 }
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	testAdminToken       = "test-admin-token"
+	testSubdomainAddress = "192.0.2.1"
+	testSessionSecretKey = "test-session-secret-key"
+	// テスト用に作る予約枠1つあたりの枠数
+	testSlotCapacity = 2
+)
+
+// 予約可能期間の始まり (2023/11/25 10:00 JST)
+var testTermStartAt = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
+
+// 送られた通知を記録するだけのCacheBusTransport
+type fakeCacheBusTransport struct {
+	mu     sync.Mutex
+	events []InvalidationEvent
+	// 設定されていれば、落ちているサーバとして送信を失敗させる
+	err error
+}
+
+func (t *fakeCacheBusTransport) Send(_ context.Context, _ string, events []InvalidationEvent) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	t.events = append(t.events, events...)
+	return nil
+}
+
+func (t *fakeCacheBusTransport) setError(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.err = err
+}
+
+func (t *fakeCacheBusTransport) sent(kind InvalidationKind) []InvalidationEvent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var events []InvalidationEvent
+	for _, event := range t.events {
+		if event.Kind == kind {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+type testServer struct {
+	t         *testing.T
+	e         *echo.Echo
+	store     *memoryStore
+	dns       *memoryDNSProvider
+	transport *fakeCacheBusTransport
+}
+
+// 既定値のない必須の設定を埋めた、Validateを通る設定
+func newTestConfig() *Config {
+	cfg := defaultConfig()
+	cfg.Session.SecretKey = testSessionSecretKey
+	cfg.DNS.SubdomainAddress = testSubdomainAddress
+	return cfg
+}
+
+// メモリ上のStoreとDNSで、main.goと同じルーティングのサーバを組み立てる
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	ctx := context.Background()
+
+	cfg := newTestConfig()
+	cfg.AdminToken = testAdminToken
+	cfg.Session.CookieDomain = ""
+	cfg.DNS.Provider = "memory"
+	cfg.Icon.Dir = t.TempDir()
+	applyConfig(cfg)
+	configureLogging(cfg.Log, io.Discard)
+
+	store := newMemoryStore()
+	dataStore = store
+	for _, name := range []string{"ライブ配信", "ゲーム実況", "雑談"} {
+		if _, err := store.Tags().Create(ctx, name); err != nil {
+			t.Fatalf("failed to create tag: %v", err)
+		}
+	}
+	// 期間の最初の1日分を1時間ごとの予約枠にする
+	for i := 0; i < 24; i++ {
+		startAt := testTermStartAt.Add(time.Duration(i) * time.Hour)
+		store.tables.slots = append(store.tables.slots, ReservationSlotModel{
+			ID:      store.tables.nextID("reservation_slots"),
+			Slot:    testSlotCapacity,
+			StartAt: startAt.Unix(),
+			EndAt:   startAt.Add(time.Hour).Unix(),
+		})
+	}
+
+	dns := newMemoryDNSProvider()
+	dnsProvider = dns
+
+	icons, err := newLocalIconStore(cfg.Icon.Dir)
+	if err != nil {
+		t.Fatalf("failed to set up icon store: %v", err)
+	}
+	iconStore = icons
+	if err := loadFallbackImage(); err != nil {
+		t.Fatalf("failed to load fallback image: %v", err)
+	}
+
+	transport := &fakeCacheBusTransport{}
+	bus := NewCacheBus("test", []string{"http://peer.test"}, transport, nil)
+	subscribeCacheInvalidations(bus)
+	bus.Start()
+	t.Cleanup(bus.Stop)
+	cacheBus = bus
+
+	lastDNSReconcileMu.Lock()
+	lastDNSReconcileReport = nil
+	lastDNSReconcileMu.Unlock()
+
+	if err := reloadAllCaches(ctx); err != nil {
+		t.Fatalf("failed to load caches: %v", err)
+	}
+
+	e := newEcho()
+	e.Logger.SetOutput(io.Discard)
+
+	return &testServer{
+		t:         t,
+		e:         e,
+		store:     store,
+		dns:       dns,
+		transport: transport,
+	}
+}
+
+// matchに合うkindの通知が他のサーバに届くまで待つ
+func (ts *testServer) waitForEvent(kind InvalidationKind, match func(InvalidationEvent) bool) InvalidationEvent {
+	ts.t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, event := range ts.transport.sent(kind) {
+			if match(event) {
+				return event
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	ts.t.Fatalf("%s event was not delivered", kind)
+	return InvalidationEvent{}
+}
+
+// クッキーを持ち回るクライアント
+type testClient struct {
+	ts      *testServer
+	header  http.Header
+	cookies map[string]*http.Cookie
+}
+
+func (ts *testServer) client() *testClient {
+	return &testClient{
+		ts:      ts,
+		header:  make(http.Header),
+		cookies: make(map[string]*http.Cookie),
+	}
+}
+
+// adminトークン付きのクライアント
+func (ts *testServer) admin() *testClient {
+	c := ts.client()
+	c.header.Set(adminTokenHeader, testAdminToken)
+	return c
+}
+
+func (c *testClient) send(req *http.Request) *httptest.ResponseRecorder {
+	for key, values := range c.header {
+		req.Header[key] = values
+	}
+	for _, cookie := range c.cookies {
+		req.AddCookie(cookie)
+	}
+
+	rec := httptest.NewRecorder()
+	c.ts.e.ServeHTTP(rec, req)
+
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.MaxAge < 0 {
+			delete(c.cookies, cookie.Name)
+			continue
+		}
+		c.cookies[cookie.Name] = cookie
+	}
+	return rec
+}
+
+// bodyがnilでなければJSONとして送る
+func (c *testClient) do(method, path string, body any) *httptest.ResponseRecorder {
+	c.ts.t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			c.ts.t.Fatalf("failed to encode request body: %v", err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req := httptest.NewRequest(method, path, r)
+	if body != nil {
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	}
+	return c.send(req)
+}
+
+func (c *testClient) get(path string) *httptest.ResponseRecorder {
+	return c.do(http.MethodGet, path, nil)
+}
+
+func (c *testClient) post(path string, body any) *httptest.ResponseRecorder {
+	return c.do(http.MethodPost, path, body)
+}
+
+// ユーザを登録してログインしたクライアントを返す
+func (ts *testServer) signup(name string) (*testClient, User) {
+	ts.t.Helper()
+	c := ts.client()
+	user := decodeJSON[User](ts.t, c.post("/api/register", PostUserRequest{
+		Name:        name,
+		DisplayName: strings.ToUpper(name),
+		Description: name + " description",
+		Password:    name + "-password",
+		Theme:       PostUserRequestTheme{DarkMode: true},
+	}), http.StatusCreated)
+	expectStatus(ts.t, c.post("/api/login", LoginRequest{Username: name, Password: name + "-password"}), http.StatusOK)
+	return c, user
+}
+
+// statusを確認して、レスポンスをJSONの型に沿って読む
+// 型にないフィールドが返ってきた場合も失敗にする
+func decodeJSON[T any](t *testing.T, rec *httptest.ResponseRecorder, status int) T {
+	t.Helper()
+	expectStatus(t, rec, status)
+	if ct := rec.Header().Get(echo.HeaderContentType); !strings.HasPrefix(ct, echo.MIMEApplicationJSON) {
+		t.Fatalf("content type = %q, want json", ct)
+	}
+	var v T
+	dec := json.NewDecoder(rec.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&v); err != nil {
+		t.Fatalf("failed to decode response %T: %v", v, err)
+	}
+	return v
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, status, rec.Body.String())
+	}
+}
+
+// エラーレスポンスの形とstatusを確認する
+func expectError(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	res := decodeJSON[ErrorResponse](t, rec, status)
+	if res.Error == "" {
+		t.Fatalf("error message is empty")
+	}
+}
+
+// 予約枠の先頭からhours時間後に始まる1時間の配信を予約する
+func reserveRequest(hours int, title string, tags ...int64) ReserveLivestreamRequest {
+	startAt := testTermStartAt.Add(time.Duration(hours) * time.Hour)
+	return ReserveLivestreamRequest{
+		Tags:         tags,
+		Title:        title,
+		Description:  title + " description",
+		PlaylistUrl:  "https://media.example.com/" + title + "/playlist.m3u8",
+		ThumbnailUrl: "https://media.example.com/" + title + "/thumbnail.jpg",
+		StartAt:      startAt.Unix(),
+		EndAt:        startAt.Add(time.Hour).Unix(),
+	}
+}
+
+func (ts *testServer) reserve(c *testClient, hours int, title string, tags ...int64) Livestream {
+	ts.t.Helper()
+	return decodeJSON[Livestream](ts.t, c.post("/api/livestream/reservation", reserveRequest(hours, title, tags...)), http.StatusCreated)
+}
+
+func (ts *testServer) tagID(name string) int64 {
+	ts.t.Helper()
+	id, ok := tagCache.GetTagIDByName(name)
+	if !ok {
+		ts.t.Fatalf("tag %s not found", name)
+	}
+	return id
+}
+
+func TestInitCache(t *testing.T) {
+	ts := newTestServer(t)
+	_, user := ts.signup("alice")
+
+	// キャッシュを消してもDBから作り直される
+	InitCache()
+	tagCache = NewTagCache()
+	suspensionCache.Set(UserSuspensionModel{UserID: user.ID})
+
+	// 運営だけが呼べる
+	res := decodeJSON[InitializeResponse](t, ts.admin().post("/api/initCache", nil), http.StatusOK)
+	if res.Language != "golang" {
+		t.Errorf("language = %q", res.Language)
+	}
+	if _, ok := tagCache.GetTagIDByName("ゲーム実況"); !ok {
+		t.Errorf("tag cache was not reloaded")
+	}
+	if suspensionCache.IsSuspended(user.ID) {
+		t.Errorf("suspension cache was not reloaded")
+	}
+	tagCache = NewTagCache()
+	decodeJSON[TagsResponse](t, ts.admin().post("/api/initTag", nil), http.StatusOK)
+	if _, ok := tagCache.GetTagIDByName("雑談"); !ok {
+		t.Errorf("tag cache was not reloaded by initTag")
+	}
+}
+
+// 他のサーバが落ちていても初期化は成功させ、通知は後から届ける
+func TestInitializeWithFailingPeer(t *testing.T) {
+	ts := newTestServer(t)
+	initializeDatabase = func(context.Context) error { return nil }
+	t.Cleanup(func() { initializeDatabase = defaultInitializeDatabase })
+	ts.transport.setError(errors.New("connection refused"))
+
+	res := decodeJSON[InitializeResponse](t, ts.client().post("/api/initialize", nil), http.StatusOK)
+	if res.Language != "golang" {
+		t.Errorf("language = %q", res.Language)
+	}
+	if health := cacheBus.Health(); len(health) != 1 || health[0].Healthy || health[0].Pending == 0 {
+		t.Errorf("health = %+v", health)
+	}
+
+	ts.transport.setError(nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(ts.transport.sent(InvalidateAll)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("invalidation was not redelivered: %+v", cacheBus.Health())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 送り直しを待っている間でも、配送のgoroutineを止められる
+func TestCacheBusStop(t *testing.T) {
+	transport := &fakeCacheBusTransport{}
+	transport.setError(errors.New("connection refused"))
+	bus := NewCacheBus("test", []string{"http://peer1.test", "http://peer2.test"}, transport, nil)
+	bus.Start()
+	bus.Publish(InvalidationEvent{Kind: InvalidateAll})
+
+	done := make(chan struct{})
+	go func() {
+		bus.Stop()
+		// 2回目も返る
+		bus.Stop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("cache bus did not stop")
+	}
+}
+
+// 初期化で消えたロールのうち、設定したadminは付け直す
+func TestInitializeSeedsAdminUsers(t *testing.T) {
+	ts := newTestServer(t)
+	initializeDatabase = func(context.Context) error { return nil }
+	t.Cleanup(func() { initializeDatabase = defaultInitializeDatabase })
+	alice, _ := ts.signup("alice")
+	ts.signup("bob")
+	appConfig.AdminUsers = []string{"alice", "nobody"}
+
+	decodeJSON[InitializeResponse](t, ts.client().post("/api/initialize", nil), http.StatusOK)
+	if role := decodeJSON[UserRoleResponse](t, alice.get("/api/admin/user/alice/role"), http.StatusOK); role.Role != RoleAdmin {
+		t.Errorf("alice role = %q", role.Role)
+	}
+	if role := decodeJSON[UserRoleResponse](t, ts.admin().get("/api/admin/user/bob/role"), http.StatusOK); role.Role != RoleUser {
+		t.Errorf("bob role = %q", role.Role)
+	}
+}
+
+func TestAdminRoutesRequireAdmin(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+
+	routes := []struct {
+		method, path string
+	}{
+		{http.MethodPost, "/api/initCache"},
+		{http.MethodPost, "/api/initTag"},
+		{http.MethodPost, "/api/internal/invalidate"},
+		{http.MethodGet, "/api/admin/cluster/peers"},
+		{http.MethodGet, "/api/admin/db/replicas"},
+		{http.MethodPost, "/api/admin/tag"},
+		{http.MethodGet, "/api/admin/user/alice/role"},
+		{http.MethodPut, "/api/admin/user/alice/role"},
+		{http.MethodGet, "/api/admin/user/alice/suspension"},
+		{http.MethodPost, "/api/admin/user/alice/suspension"},
+		{http.MethodDelete, "/api/admin/user/alice/suspension"},
+		{http.MethodGet, "/api/admin/icon/blocklist"},
+		{http.MethodPost, "/api/admin/icon/blocklist"},
+		{http.MethodDelete, "/api/admin/icon/blocklist/0000"},
+		{http.MethodGet, "/api/admin/dns/reconcile"},
+		{http.MethodPost, "/api/admin/dns/reconcile"},
+	}
+	for _, route := range routes {
+		expectError(t, ts.client().do(route.method, route.path, nil), http.StatusForbidden)
+		expectError(t, alice.do(route.method, route.path, nil), http.StatusForbidden)
+	}
+
+	// 間違ったトークンはセッションなしと同じ扱い
+	c := ts.client()
+	c.header.Set(adminTokenHeader, "wrong")
+	expectError(t, c.get("/api/admin/cluster/peers"), http.StatusForbidden)
+}
+
+func TestClusterAndReplicaStatus(t *testing.T) {
+	ts := newTestServer(t)
+
+	peers := decodeJSON[[]PeerHealth](t, ts.admin().get("/api/admin/cluster/peers"), http.StatusOK)
+	if len(peers) != 1 || peers[0].Peer != "http://peer.test" || !peers[0].Healthy {
+		t.Errorf("peers = %+v", peers)
+	}
+
+	replicas := decodeJSON[[]ReplicaStatus](t, ts.admin().get("/api/admin/db/replicas"), http.StatusOK)
+	if len(replicas) != 0 {
+		t.Errorf("replicas = %+v", replicas)
+	}
+}
+
+func TestInternalInvalidate(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+
+	// 他のサーバで追加されたタグを通知で取り込む
+	tagID, err := ts.store.Tags().Create(ctx, "他のサーバのタグ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := InvalidationRequest{Events: []InvalidationEvent{{ID: "event-1", Kind: InvalidateTag, TagID: tagID}}}
+	expectStatus(t, ts.admin().post("/api/internal/invalidate", req), http.StatusNoContent)
+	if _, ok := tagCache.GetTagByID(tagID); !ok {
+		t.Errorf("tag %d was not added to the cache", tagID)
+	}
+
+	// 同じ通知は二度反映しない
+	tagCache = NewTagCache()
+	expectStatus(t, ts.admin().post("/api/internal/invalidate", req), http.StatusNoContent)
+	if _, ok := tagCache.GetTagByID(tagID); ok {
+		t.Errorf("duplicated event was applied")
+	}
+
+	expectError(t, ts.admin().do(http.MethodPost, "/api/internal/invalidate", "not an object"), http.StatusBadRequest)
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Prometheusのテキスト形式 (version 0.0.4) で /metrics に出す指標
+
+var (
+	httpRequestsTotal = newCounterVec("isupipe_http_requests_total",
+		"Number of HTTP requests by route and status code.", "method", "route", "status")
+	httpRequestDuration = newHistogramVec("isupipe_http_request_duration_seconds",
+		"HTTP request latency by route.", []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "method", "route")
+
+	sqlQueryDuration = newHistogramVec("isupipe_sql_query_duration_seconds",
+		"SQL query latency by query name (repository method).", []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}, "query")
+	sqlQueryErrorsTotal = newCounterVec("isupipe_sql_query_errors_total",
+		"Number of failed SQL queries by query name, not counting sql.ErrNoRows.", "query")
+
+	// ヒット率は hit / (hit + miss) で求める
+	cacheRequestsTotal = newCounterVec("isupipe_cache_requests_total",
+		"Number of cache lookups by cache and result (hit or miss).", "cache", "result")
+
+	livecommentsTotal = newCounterVec("isupipe_livecomments_total",
+		"Number of posted livecomments.")
+	tipsTotal = newCounterVec("isupipe_tips_total",
+		"Sum of tips posted with livecomments.")
+	reactionsTotal = newCounterVec("isupipe_reactions_total",
+		"Number of posted reactions.")
+	reservationsTotal = newCounterVec("isupipe_reservations_total",
+		"Number of reserved livestreams.")
+	spamRejectionsTotal = newCounterVec("isupipe_spam_rejections_total",
+		"Number of livecomments rejected by NG words.")
+)
+
+func init() {
+	newFuncMetric("isupipe_db_max_open_connections", "gauge",
+		"Maximum number of open connections to the database.", dbStatsSamples(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }), "db")
+	newFuncMetric("isupipe_db_open_connections", "gauge",
+		"Number of established connections both in use and idle.", dbStatsSamples(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }), "db")
+	newFuncMetric("isupipe_db_in_use_connections", "gauge",
+		"Number of connections currently in use.", dbStatsSamples(func(s sql.DBStats) float64 { return float64(s.InUse) }), "db")
+	newFuncMetric("isupipe_db_idle_connections", "gauge",
+		"Number of idle connections.", dbStatsSamples(func(s sql.DBStats) float64 { return float64(s.Idle) }), "db")
+	newFuncMetric("isupipe_db_wait_count_total", "counter",
+		"Total number of connections waited for.", dbStatsSamples(func(s sql.DBStats) float64 { return float64(s.WaitCount) }), "db")
+	newFuncMetric("isupipe_db_wait_duration_seconds_total", "counter",
+		"Total time blocked waiting for a new connection.", dbStatsSamples(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }), "db")
+}
+
+// プライマリとレプリカの接続プールの状態を db ラベルつきで返す
+func dbStatsSamples(value func(sql.DBStats) float64) func() []metricSample {
+	return func() []metricSample {
+		var samples []metricSample
+		if dbConn != nil {
+			samples = append(samples, metricSample{labelValues: []string{"primary"}, value: value(dbConn.Stats())})
+		}
+		for _, r := range replicaPool.replicas {
+			samples = append(samples, metricSample{labelValues: []string{r.addr}, value: value(r.db.Stats())})
+		}
+		return samples
+	}
+}
+
+// キャッシュの参照結果を数える
+func observeCacheLookup(cache string, hit bool) {
+	if hit {
+		cacheRequestsTotal.Inc(cache, "hit")
+	} else {
+		cacheRequestsTotal.Inc(cache, "miss")
+	}
+}
+
+// ルートごとのレイテンシとステータスコードを記録する
+// エラーはaccessLogMiddlewareがレスポンスに書くので、その外側で使う
+func metricsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		err := next(c)
+
+		// どのルートにも当たらなかったリクエストはパスごとに分けない
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request().Method
+		status := responseStatus(c, err)
+		httpRequestsTotal.Inc(method, route, strconv.Itoa(status))
+		httpRequestDuration.Observe(time.Since(start).Seconds(), method, route)
+
+		return err
+	}
+}
+
+// ハンドラがエラーを返したときは、エラーハンドラが返すはずのステータスにする
+func responseStatus(c echo.Context, err error) int {
+	if err == nil {
+		return c.Response().Status
+	}
+	if he, ok := err.(*echo.HTTPError); ok {
+		return he.Code
+	}
+	return http.StatusInternalServerError
+}
+
+// 指標取得API
+// GET /metrics
+func getMetricsHandler(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderContentType, "text/plain; version=0.0.4; charset=utf-8")
+	c.Response().WriteHeader(http.StatusOK)
+	return writeMetrics(c.Response())
+}
+
+type metric interface {
+	metricName() string
+	write(w *bufio.Writer)
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []metric
+)
+
+func registerMetric(m metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metrics = append(metrics, m)
+}
+
+// 登録された指標を名前順に書き出す
+func writeMetrics(w io.Writer) error {
+	metricsMu.Lock()
+	sorted := append([]metric{}, metrics...)
+	metricsMu.Unlock()
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].metricName() < sorted[j].metricName() })
+
+	bw := bufio.NewWriter(w)
+	for _, m := range sorted {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+type metricDesc struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d metricDesc) metricName() string { return d.name }
+
+func (d metricDesc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.typ)
+}
+
+// name{label="value",...} value の行を書く。extra はヒストグラムの le のような追加のラベル
+func (d metricDesc) writeSample(w *bufio.Writer, suffix string, labelValues []string, extraName, extraValue string, value float64) {
+	w.WriteString(d.name)
+	w.WriteString(suffix)
+	if len(labelValues) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i, v := range labelValues {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", d.labels[i], escapeLabelValue(v))
+		}
+		if extraName != "" {
+			if len(labelValues) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatMetricValue(value))
+	w.WriteByte('\n')
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func formatMetricValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// ラベルの値の組を map のキーにする
+func labelKey(labelValues []string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type counterVec struct {
+	metricDesc
+	mu     sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	c := &counterVec{
+		metricDesc: metricDesc{name: name, help: help, typ: "counter", labels: labels},
+		series:     make(map[string]*counterSeries),
+	}
+	registerMetric(c)
+	return c
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	if len(labelValues) != len(c.labels) {
+		panic(fmt.Sprintf("%s: want %d label values, got %d", c.name, len(c.labels), len(labelValues)))
+	}
+	key := labelKey(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{labelValues: append([]string{}, labelValues...)}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+// 現在の値。テストで差分を見るのに使う
+func (c *counterVec) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.series[labelKey(labelValues)]; ok {
+		return s.value
+	}
+	return 0
+}
+
+func (c *counterVec) write(w *bufio.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeHeader(w)
+	// ラベルのない指標は、まだ一度も増えていなくても0を出す
+	if len(c.labels) == 0 && len(c.series) == 0 {
+		c.writeSample(w, "", nil, "", "", 0)
+		return
+	}
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		c.writeSample(w, "", s.labelValues, "", "", s.value)
+	}
+}
+
+type histogramVec struct {
+	metricDesc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	// バケットごとの数 (累積ではない)。最後は +Inf
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		metricDesc: metricDesc{name: name, help: help, typ: "histogram", labels: labels},
+		buckets:    buckets,
+		series:     make(map[string]*histogramSeries),
+	}
+	registerMetric(h)
+	return h
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	if len(labelValues) != len(h.labels) {
+		panic(fmt.Sprintf("%s: want %d label values, got %d", h.name, len(h.labels), len(labelValues)))
+	}
+	key := labelKey(labelValues)
+	i := sort.SearchFloat64s(h.buckets, v)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{
+			labelValues: append([]string{}, labelValues...),
+			counts:      make([]uint64, len(h.buckets)+1),
+		}
+		h.series[key] = s
+	}
+	s.counts[i]++
+	s.sum += v
+	s.count++
+}
+
+// 観測した回数。テストで差分を見るのに使う
+func (h *histogramVec) Count(labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[labelKey(labelValues)]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *histogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeHeader(w)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			h.writeSample(w, "_bucket", s.labelValues, "le", formatMetricValue(upper), float64(cumulative))
+		}
+		h.writeSample(w, "_bucket", s.labelValues, "le", "+Inf", float64(s.count))
+		h.writeSample(w, "_sum", s.labelValues, "", "", s.sum)
+		h.writeSample(w, "_count", s.labelValues, "", "", float64(s.count))
+	}
+}
+
+// 書き出すときに値を集める指標。接続プールの状態のように、他が持っている値を出すのに使う
+type funcMetric struct {
+	metricDesc
+	collect func() []metricSample
+}
+
+type metricSample struct {
+	labelValues []string
+	value       float64
+}
+
+func newFuncMetric(name, typ, help string, collect func() []metricSample, labels ...string) *funcMetric {
+	m := &funcMetric{
+		metricDesc: metricDesc{name: name, help: help, typ: typ, labels: labels},
+		collect:    collect,
+	}
+	registerMetric(m)
+	return m
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.writeHeader(w)
+	for _, s := range m.collect() {
+		m.writeSample(w, "", s.labelValues, "", "", s.value)
+	}
+}
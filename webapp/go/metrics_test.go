@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	bob, _ := ts.signup("bob")
+
+	// 指標はプロセス全体で共有されるので、前後の差分を見る
+	route := "/api/livestream/:livestream_id/livecomment"
+	requests := httpRequestsTotal.Value(http.MethodPost, route, "201")
+	notFound := httpRequestsTotal.Value(http.MethodPost, route, "404")
+	durations := httpRequestDuration.Count(http.MethodPost, route)
+	livecomments := livecommentsTotal.Value()
+	tips := tipsTotal.Value()
+	spams := spamRejectionsTotal.Value()
+	reactions := reactionsTotal.Value()
+	reservations := reservationsTotal.Value()
+	tagHits := cacheRequestsTotal.Value("tag", "hit")
+	tagMisses := cacheRequestsTotal.Value("tag", "miss")
+
+	livestream := ts.reserve(alice, 1, "stream", ts.tagID("雑談"))
+	path := fmt.Sprintf("/api/livestream/%d", livestream.ID)
+	decodeJSON[Livecomment](t, bob.post(path+"/livecomment", PostLivecommentRequest{Comment: "hello", Tip: 100}), http.StatusCreated)
+	decodeJSON[Livecomment](t, bob.post(path+"/livecomment", PostLivecommentRequest{Comment: "nice", Tip: 20}), http.StatusCreated)
+	expectError(t, bob.post("/api/livestream/999/livecomment", PostLivecommentRequest{Comment: "hello"}), http.StatusNotFound)
+	decodeJSON[Reaction](t, bob.post(path+"/reaction", PostReactionRequest{EmojiName: "tada"}), http.StatusCreated)
+	expectStatus(t, alice.post(path+"/moderate", ModerateRequest{NGWord: "spam"}), http.StatusCreated)
+	expectError(t, bob.post(path+"/livecomment", PostLivecommentRequest{Comment: "buy spam"}), http.StatusBadRequest)
+	if _, ok := tagCache.GetTagIDByName("nothing"); ok {
+		t.Error("unknown tag is found")
+	}
+
+	for _, tt := range []struct {
+		name string
+		got  float64
+		want float64
+	}{
+		{"requests", httpRequestsTotal.Value(http.MethodPost, route, "201") - requests, 2},
+		{"not found", httpRequestsTotal.Value(http.MethodPost, route, "404") - notFound, 1},
+		{"durations", float64(httpRequestDuration.Count(http.MethodPost, route) - durations), 4},
+		{"livecomments", livecommentsTotal.Value() - livecomments, 2},
+		{"tips", tipsTotal.Value() - tips, 120},
+		{"spam rejections", spamRejectionsTotal.Value() - spams, 1},
+		{"reactions", reactionsTotal.Value() - reactions, 1},
+		{"reservations", reservationsTotal.Value() - reservations, 1},
+		{"tag cache misses", cacheRequestsTotal.Value("tag", "miss") - tagMisses, 1},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+	if cacheRequestsTotal.Value("tag", "hit") <= tagHits {
+		t.Error("tag cache hits are not counted")
+	}
+
+	rec := ts.client().get("/metrics")
+	expectStatus(t, rec, http.StatusOK)
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("content type = %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE isupipe_http_requests_total counter\n",
+		`isupipe_http_requests_total{method="POST",route="/api/livestream/:livestream_id/livecomment",status="201"} `,
+		"# TYPE isupipe_http_request_duration_seconds histogram\n",
+		`isupipe_http_request_duration_seconds_bucket{method="POST",route="/api/livestream/:livestream_id/livecomment",le="+Inf"} `,
+		`isupipe_cache_requests_total{cache="tag",result="hit"} `,
+		"# TYPE isupipe_db_open_connections gauge\n",
+		"\nisupipe_livecomments_total ",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics do not contain %q", want)
+		}
+	}
+}
+
+func TestMetricsFormat(t *testing.T) {
+	counter := &counterVec{
+		metricDesc: metricDesc{name: "test_total", help: "Test counter.", typ: "counter", labels: []string{"name"}},
+		series:     make(map[string]*counterSeries),
+	}
+	counter.Inc("b")
+	counter.Add(2.5, `a"\`+"\n")
+	histogram := &histogramVec{
+		metricDesc: metricDesc{name: "test_seconds", help: "Test histogram.", typ: "histogram"},
+		buckets:    []float64{0.1, 1},
+		series:     make(map[string]*histogramSeries),
+	}
+	histogram.Observe(0.1)
+	histogram.Observe(0.5)
+	histogram.Observe(3)
+
+	var b strings.Builder
+	w := bufio.NewWriter(&b)
+	counter.write(w)
+	histogram.write(w)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{name="a\"\\\n"} 2.5
+test_total{name="b"} 1
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="0.1"} 1
+test_seconds_bucket{le="1"} 2
+test_seconds_bucket{le="+Inf"} 3
+test_seconds_sum 3.6
+test_seconds_count 3
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
+
+// 何も返さないqueryer
+type fakeQueryer struct {
+	err error
+}
+
+func (q fakeQueryer) GetContext(context.Context, interface{}, string, ...interface{}) error {
+	return q.err
+}
+
+func (q fakeQueryer) SelectContext(context.Context, interface{}, string, ...interface{}) error {
+	return q.err
+}
+
+func (q fakeQueryer) ExecContext(context.Context, string, ...interface{}) (sql.Result, error) {
+	return nil, q.err
+}
+
+func (q fakeQueryer) NamedExecContext(context.Context, string, interface{}) (sql.Result, error) {
+	return nil, q.err
+}
+
+func TestInstrumentedQueryer(t *testing.T) {
+	ctx := context.Background()
+	const name = "UserRepository.GetByName"
+	count := sqlQueryDuration.Count(name)
+	errs := sqlQueryErrorsTotal.Value(name)
+
+	// 見つからないのはエラーとして数えない
+	users := mysqlUserRepository{q: instrumentedQueryer{q: fakeQueryer{err: sql.ErrNoRows}}}
+	if _, err := users.GetByName(ctx, "alice"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("err = %v", err)
+	}
+	users = mysqlUserRepository{q: instrumentedQueryer{q: fakeQueryer{err: errors.New("connection refused")}}}
+	if _, err := users.GetByName(ctx, "alice"); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if got := sqlQueryDuration.Count(name) - count; got != 2 {
+		t.Errorf("queries = %d, want 2", got)
+	}
+	if got := sqlQueryErrorsTotal.Value(name) - errs; got != 1 {
+		t.Errorf("errors = %v, want 1", got)
+	}
+
+	// リポジトリ以外から呼んだクエリはまとめる
+	count = sqlQueryDuration.Count("unknown")
+	if err := (instrumentedQueryer{q: fakeQueryer{}}).GetContext(ctx, nil, "SELECT 1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := sqlQueryDuration.Count("unknown") - count; got != 1 {
+		t.Errorf("unknown queries = %d, want 1", got)
+	}
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"embed"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// 複数台が同時に起動・初期化しても、適用は一台ずつになるようにするMySQLのユーザロック
+	migrationLockName    = "isupipe_schema_migration"
+	migrationLockTimeout = 60 * time.Second
+)
+
+// スキーマの変更は migrations/<version>_<name>.up.sql と .down.sql の組で追加する
+// MySQLのDDLは暗黙にコミットされ、途中で失敗すると適用済みの文は戻らないので、
+// up は IF NOT EXISTS や information_schema での確認を使って再実行できるように書く
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// 初期データのファイル。テーブルを空にしてから、依存される側のテーブルから読み込む
+var seedFiles = []string{
+	"init.sql",
+	"initial_users.sql",
+	"initial_livestreams.sql",
+	"initial_tags.sql",
+	"initial_livestream_tags.sql",
+	"initial_reservation_slots.sql",
+	"initial_reactions.sql",
+	"initial_ngwords.sql",
+	"initial_livecomments.sql",
+}
+
+type migration struct {
+	Version int64
+	Name    string
+	Up      string
+	Down    string
+}
+
+func (m migration) String() string {
+	return fmt.Sprintf("%04d_%s", m.Version, m.Name)
+}
+
+type schemaMigrationModel struct {
+	Version   int64  `db:"version"`
+	Name      string `db:"name"`
+	AppliedAt int64  `db:"applied_at"`
+}
+
+type MigrationStatus struct {
+	Version int64  `json:"version"`
+	Name    string `json:"name"`
+	Applied bool   `json:"applied"`
+	// 未適用なら0
+	AppliedAt int64 `json:"applied_at"`
+	// DBには適用済みだが、このバイナリが知らない (新しいバイナリが適用した) もの
+	Unknown bool `json:"unknown"`
+}
+
+// fsys 直下の <version>_<name>.up.sql と .down.sql を組にして、バージョン順に返す
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	byVersion := make(map[int64]*migration)
+	for _, entry := range entries {
+		fileName := entry.Name()
+		var base string
+		var up bool
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			base, up = strings.TrimSuffix(fileName, ".up.sql"), true
+		case strings.HasSuffix(fileName, ".down.sql"):
+			base = strings.TrimSuffix(fileName, ".down.sql")
+		default:
+			return nil, fmt.Errorf("unexpected migration file: %s", fileName)
+		}
+
+		v, name, ok := strings.Cut(base, "_")
+		version, err := strconv.ParseInt(v, 10, 64)
+		if !ok || name == "" || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration file name must be <version>_<name>.(up|down).sql: %s", fileName)
+		}
+
+		b, err := fs.ReadFile(fsys, fileName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", fileName, err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration version %d is used by both %s and %s", version, m.Name, name)
+		}
+		if up {
+			m.Up = string(b)
+		} else {
+			m.Down = string(b)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if strings.TrimSpace(m.Up) == "" || strings.TrimSpace(m.Down) == "" {
+			return nil, fmt.Errorf("migration %s must have both up and down", m)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// migrator はスキーマのマイグレーションと初期データの読み込みを行います
+type migrator struct {
+	db         *sqlx.DB
+	migrations []migration
+}
+
+func newMigrator(db *sqlx.DB) (*migrator, error) {
+	sub, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		return nil, err
+	}
+	migrations, err := loadMigrations(sub)
+	if err != nil {
+		return nil, err
+	}
+	return &migrator{db: db, migrations: migrations}, nil
+}
+
+// 他のノードと排他して fn を実行する。GET_LOCKは接続に紐づくので、fn には同じ接続を渡す
+func (m *migrator) withLock(ctx context.Context, fn func(conn *sqlx.Conn) error) error {
+	conn, err := m.db.Connx(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	var acquired sql.NullInt64
+	if err := conn.GetContext(ctx, &acquired, "SELECT GET_LOCK(?, ?)", migrationLockName, int(migrationLockTimeout.Seconds())); err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %w", err)
+	}
+	if !acquired.Valid || acquired.Int64 != 1 {
+		return errors.New("timed out waiting for migration lock held by another node")
+	}
+	// 接続を閉じればロックも外れるが、プールに戻る接続なので明示的に外す
+	defer conn.ExecContext(context.Background(), "DO RELEASE_LOCK(?)", migrationLockName)
+
+	return fn(conn)
+}
+
+func (m *migrator) applied(ctx context.Context, conn *sqlx.Conn) (map[int64]schemaMigrationModel, error) {
+	if _, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS `schema_migrations` ("+
+		"`version` BIGINT NOT NULL PRIMARY KEY, "+
+		"`name` VARCHAR(255) NOT NULL, "+
+		"`applied_at` BIGINT NOT NULL"+
+		") ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin"); err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+
+	var models []schemaMigrationModel
+	if err := conn.SelectContext(ctx, &models, "SELECT * FROM schema_migrations"); err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	applied := make(map[int64]schemaMigrationModel, len(models))
+	for _, model := range models {
+		applied[model.Version] = model
+	}
+	return applied, nil
+}
+
+// 未適用のマイグレーションを古い順に全て適用し、適用したものを返す
+func (m *migrator) Up(ctx context.Context) ([]migration, error) {
+	var done []migration
+	err := m.withLock(ctx, func(conn *sqlx.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+			_, span := startSpan(ctx, "migration "+mig.String(), trace.SpanKindInternal, attribute.String("db.system", "mysql"))
+			err := execSQLStatements(ctx, conn, strings.NewReader(mig.Up))
+			recordSpanError(span, err)
+			span.End()
+			if err != nil {
+				return fmt.Errorf("failed to apply migration %s: %w", mig, err)
+			}
+			if _, err := conn.ExecContext(ctx, "INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", mig.Version, mig.Name, time.Now().Unix()); err != nil {
+				return fmt.Errorf("failed to record migration %s: %w", mig, err)
+			}
+			done = append(done, mig)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// 適用済みのマイグレーションを新しい順に steps 個戻し、戻したものを返す
+func (m *migrator) Down(ctx context.Context, steps int) ([]migration, error) {
+	if steps <= 0 {
+		return nil, fmt.Errorf("steps must be positive: %d", steps)
+	}
+
+	known := make(map[int64]migration, len(m.migrations))
+	for _, mig := range m.migrations {
+		known[mig.Version] = mig
+	}
+
+	var done []migration
+	err := m.withLock(ctx, func(conn *sqlx.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		versions := make([]int64, 0, len(applied))
+		for version := range applied {
+			versions = append(versions, version)
+		}
+		sort.Slice(versions, func(i, j int) bool { return versions[i] > versions[j] })
+
+		for _, version := range versions {
+			if len(done) == steps {
+				break
+			}
+			mig, ok := known[version]
+			if !ok {
+				return fmt.Errorf("migration %04d_%s was applied by a newer binary and can't be reverted by this one", version, applied[version].Name)
+			}
+			if err := execSQLStatements(ctx, conn, strings.NewReader(mig.Down)); err != nil {
+				return fmt.Errorf("failed to revert migration %s: %w", mig, err)
+			}
+			if _, err := conn.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version = ?", mig.Version); err != nil {
+				return fmt.Errorf("failed to record migration %s: %w", mig, err)
+			}
+			done = append(done, mig)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// 既知のマイグレーションと、DBにだけ記録されているマイグレーションの適用状況をバージョン順に返す
+func (m *migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	conn, err := m.db.Connx(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, mig := range m.migrations {
+		model, ok := applied[mig.Version]
+		statuses = append(statuses, MigrationStatus{
+			Version:   mig.Version,
+			Name:      mig.Name,
+			Applied:   ok,
+			AppliedAt: model.AppliedAt,
+		})
+		delete(applied, mig.Version)
+	}
+	for _, model := range applied {
+		statuses = append(statuses, MigrationStatus{
+			Version:   model.Version,
+			Name:      model.Name,
+			Applied:   true,
+			AppliedAt: model.AppliedAt,
+			Unknown:   true,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Version < statuses[j].Version })
+
+	return statuses, nil
+}
+
+// dir にある初期データでテーブルの中身を入れ替える
+func (m *migrator) Seed(ctx context.Context, dir string) error {
+	// 途中で見つからずにテーブルが空のまま残らないよう、先に全てのファイルがあるか確かめる
+	for _, name := range seedFiles {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			return fmt.Errorf("seed file is not available: %w", err)
+		}
+	}
+
+	return m.withLock(ctx, func(conn *sqlx.Conn) error {
+		for _, name := range seedFiles {
+			f, err := os.Open(filepath.Join(dir, name))
+			if err != nil {
+				return fmt.Errorf("failed to open seed file: %w", err)
+			}
+			// 1ファイルが数千文になるので、文ごとではなくファイルごとにspanを作る
+			_, span := startSpan(ctx, "seed "+name, trace.SpanKindInternal, attribute.String("db.system", "mysql"))
+			err = execSQLStatements(ctx, conn, f)
+			f.Close()
+			recordSpanError(span, err)
+			span.End()
+			if err != nil {
+				return fmt.Errorf("failed to load %s: %w", name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// DSNでmultiStatementsを有効にしていないので、ファイルの中身は一文ずつ実行する
+func execSQLStatements(ctx context.Context, conn *sqlx.Conn, r io.Reader) error {
+	return splitSQLStatements(r, func(stmt string) error {
+		_, err := conn.ExecContext(ctx, stmt)
+		return err
+	})
+}
+
+// r のSQLを ; ごとに区切って fn に渡す
+// 引用符の中とコメントの中の ; では区切らない。-- と # の行コメントは取り除き、
+// /*! ... */ のようにMySQLが解釈するものがあるので /* */ のコメントは残す
+func splitSQLStatements(r io.Reader, fn func(stmt string) error) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+
+	var (
+		stmt strings.Builder
+		// 引用符の中ならその引用符
+		quote        byte
+		lineComment  bool
+		blockComment bool
+		prev         byte
+	)
+	flush := func() error {
+		s := strings.TrimSpace(stmt.String())
+		stmt.Reset()
+		if s == "" {
+			return nil
+		}
+		return fn(s)
+	}
+
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case lineComment:
+			if c == '\n' {
+				lineComment = false
+				stmt.WriteByte(c)
+			}
+			continue
+		case blockComment:
+			stmt.WriteByte(c)
+			if prev == '*' && c == '/' {
+				blockComment = false
+				c = 0
+			}
+			prev = c
+			continue
+		case quote != 0:
+			stmt.WriteByte(c)
+			// 識別子以外はバックスラッシュで次の文字をエスケープできる
+			if c == '\\' && quote != '`' {
+				next, err := br.ReadByte()
+				if err == io.EOF {
+					return fmt.Errorf("unterminated %c quote", quote)
+				}
+				if err != nil {
+					return err
+				}
+				stmt.WriteByte(next)
+				continue
+			}
+			// '' のように重ねた引用符は、閉じてすぐ開き直したのと同じになる
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+
+		switch c {
+		case '\'', '"', '`':
+			quote = c
+		case '#':
+			lineComment = true
+			continue
+		case '-':
+			// MySQLでは "--" の後に空白が必要
+			if b, _ := br.Peek(2); len(b) > 0 && b[0] == '-' && (len(b) == 1 || isSQLSpace(b[1])) {
+				br.ReadByte()
+				lineComment = true
+				continue
+			}
+		case '/':
+			if b, _ := br.Peek(1); len(b) == 1 && b[0] == '*' {
+				br.ReadByte()
+				stmt.WriteString("/*")
+				blockComment = true
+				prev = 0
+				continue
+			}
+		case ';':
+			if err := flush(); err != nil {
+				return err
+			}
+			continue
+		}
+		stmt.WriteByte(c)
+	}
+
+	if quote != 0 {
+		return fmt.Errorf("unterminated %c quote", quote)
+	}
+	if blockComment {
+		return errors.New("unterminated comment")
+	}
+	return flush()
+}
+
+func isSQLSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// DBのホストでも動かすので、Webサーバの秘密鍵などは要らない
+func validateMigrateConfig(c *Config) error {
+	return errors.Join(c.validateMySQL(), c.validateLog())
+}
+
+// isupipe migrate [up|down|status|seed] [-steps N]
+// up は未適用のマイグレーションを全て適用し、down は -steps 個戻す。seed は初期データを読み込み直す
+func runMigrateCommand(args []string) int {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	steps := flags.Int("steps", 1, "number of migrations to revert with down")
+
+	logger := dbLogger.With("command", "migrate")
+
+	action := "up"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		action, args = args[0], args[1:]
+	}
+
+	cfg, err := loadConfigWith(flags, args, validateMigrateConfig)
+	if errors.Is(err, errConfigDumped) {
+		return 0
+	}
+	if err != nil {
+		logger.Error(err.Error())
+		return 1
+	}
+	applyConfig(cfg)
+
+	conn, err := connectDB()
+	if err != nil {
+		logger.Error("failed to connect db", "error", err)
+		return 1
+	}
+	defer conn.Close()
+
+	m, err := newMigrator(conn)
+	if err != nil {
+		logger.Error(err.Error())
+		return 1
+	}
+
+	ctx := context.Background()
+	switch action {
+	case "up":
+		applied, err := m.Up(ctx)
+		for _, mig := range applied {
+			fmt.Printf("applied %s\n", mig)
+		}
+		if err != nil {
+			logger.Error(err.Error())
+			return 1
+		}
+	case "down":
+		reverted, err := m.Down(ctx, *steps)
+		for _, mig := range reverted {
+			fmt.Printf("reverted %s\n", mig)
+		}
+		if err != nil {
+			logger.Error(err.Error())
+			return 1
+		}
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			logger.Error(err.Error())
+			return 1
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(statuses); err != nil {
+			logger.Error("failed to write status", "error", err)
+			return 1
+		}
+	case "seed":
+		if err := m.Seed(ctx, cfg.MySQL.SeedDir); err != nil {
+			logger.Error(err.Error())
+			return 1
+		}
+	default:
+		logger.Error("unknown migrate action (want up, down, status or seed)", "action", action)
+		return 1
+	}
+
+	return 0
+}
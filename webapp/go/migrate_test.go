@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	sub, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := loadMigrations(sub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no migrations")
+	}
+
+	// 作ったテーブルは同じマイグレーションの down で消す
+	created := map[string]bool{}
+	createRe := regexp.MustCompile("(?i)CREATE TABLE IF NOT EXISTS `([a-z_]+)`")
+	dropRe := regexp.MustCompile("(?i)DROP TABLE IF EXISTS `([a-z_]+)`")
+	for _, m := range migrations {
+		remaining := map[string]bool{}
+		for _, match := range createRe.FindAllStringSubmatch(m.Up, -1) {
+			created[match[1]] = true
+			remaining[match[1]] = true
+		}
+		for _, match := range dropRe.FindAllStringSubmatch(m.Down, -1) {
+			if !remaining[match[1]] {
+				t.Errorf("%s: down drops table %s that up does not create", m, match[1])
+			}
+			delete(remaining, match[1])
+		}
+		if len(remaining) > 0 {
+			t.Errorf("%s: tables not dropped by down: %v", m, remaining)
+		}
+		// ALTER TABLE には IF NOT EXISTS がないので、適用済みかどうかを確かめてから実行する
+		if strings.Contains(m.Up, "ALTER TABLE") && !strings.Contains(m.Up, "information_schema") {
+			t.Errorf("%s: up cannot be re-run", m)
+		}
+		for _, sql := range []string{m.Up, m.Down} {
+			if err := splitSQLStatements(strings.NewReader(sql), func(string) error { return nil }); err != nil {
+				t.Errorf("%s: %v", m, err)
+			}
+		}
+	}
+
+	// 最初のマイグレーションは initdb.d/10_schema.sql で作った既存のDBと同じスキーマで、
+	// アイコンのハッシュなどは後のマイグレーションで足す
+	if migrations[0].Version != 1 || strings.Contains(migrations[0].Up, "`hash`") {
+		t.Errorf("first migration is not the initial schema: %s", migrations[0])
+	}
+	var addsIconHash bool
+	for _, m := range migrations[1:] {
+		if strings.Contains(m.Up, "ALTER TABLE `icons`") && strings.Contains(m.Up, "ADD COLUMN `hash`") &&
+			strings.Contains(m.Down, "DROP COLUMN `hash`") {
+			addsIconHash = true
+		}
+	}
+	if !addsIconHash {
+		t.Error("no migration adds icons.hash")
+	}
+
+	// init.sql で空にするテーブルは全てマイグレーションで作られる
+	for _, table := range []string{
+		"users", "icons", "themes", "livestreams", "reservation_slots", "tags", "livestream_tags",
+		"livestream_viewers_history", "livecomments", "livecomment_reports", "ng_words", "reactions",
+		"user_roles", "livestream_moderators", "user_suspensions", "icon_blocklist", "user_exports", "icon_images",
+	} {
+		if !created[table] {
+			t.Errorf("table %s is not created", table)
+		}
+	}
+
+	// マイグレーションで作ったテーブルは全て init.sql で空にする
+	initSQL, err := os.ReadFile(filepath.Join("..", "sql", "init.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for table := range created {
+		if !strings.Contains(string(initSQL), "TRUNCATE TABLE "+table+";") {
+			t.Errorf("table %s is not truncated in init.sql", table)
+		}
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	file := func(s string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(s)} }
+
+	migrations, err := loadMigrations(fstest.MapFS{
+		"0010_add_index.up.sql":         file("ALTER TABLE a ADD INDEX idx (b);"),
+		"0010_add_index.down.sql":       file("ALTER TABLE a DROP INDEX idx;"),
+		"0002_create_a.up.sql":          file("CREATE TABLE a (b INT);"),
+		"0002_create_a.down.sql":        file("DROP TABLE a;"),
+		"0003_multi_word_name.up.sql":   file("SELECT 1;"),
+		"0003_multi_word_name.down.sql": file("SELECT 1;"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(migrations[0], migrations[1], migrations[2]); got != "0002_create_a 0003_multi_word_name 0010_add_index" {
+		t.Errorf("migrations = %s", got)
+	}
+	if migrations[0].Up != "CREATE TABLE a (b INT);" || migrations[0].Down != "DROP TABLE a;" {
+		t.Errorf("migration = %+v", migrations[0])
+	}
+
+	tests := map[string]fstest.MapFS{
+		"missing down": {
+			"0001_a.up.sql": file("SELECT 1;"),
+		},
+		"missing up": {
+			"0001_a.down.sql": file("SELECT 1;"),
+		},
+		"duplicated version": {
+			"0001_a.up.sql":   file("SELECT 1;"),
+			"0001_a.down.sql": file("SELECT 1;"),
+			"0001_b.up.sql":   file("SELECT 1;"),
+			"0001_b.down.sql": file("SELECT 1;"),
+		},
+		"no version": {
+			"a.up.sql":   file("SELECT 1;"),
+			"a.down.sql": file("SELECT 1;"),
+		},
+		"zero version": {
+			"0000_a.up.sql":   file("SELECT 1;"),
+			"0000_a.down.sql": file("SELECT 1;"),
+		},
+		"unexpected file": {
+			"README.md": file("migrations"),
+		},
+	}
+	for name, fsys := range tests {
+		if _, err := loadMigrations(fsys); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestSplitSQLStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want []string
+	}{
+		{
+			name: "statements",
+			sql:  "CREATE TABLE a (b INT);\n\nINSERT INTO a VALUES (1);\nSELECT 1",
+			want: []string{"CREATE TABLE a (b INT)", "INSERT INTO a VALUES (1)", "SELECT 1"},
+		},
+		{
+			name: "semicolons in quotes",
+			sql:  "INSERT INTO a VALUES ('x;y', \"z;\", `c;d`);INSERT INTO a VALUES ('it''s;')",
+			want: []string{"INSERT INTO a VALUES ('x;y', \"z;\", `c;d`)", "INSERT INTO a VALUES ('it''s;')"},
+		},
+		{
+			name: "escaped quotes",
+			sql:  `INSERT INTO a VALUES ('\';'), ("\\");SELECT 2;`,
+			want: []string{`INSERT INTO a VALUES ('\';'), ("\\")`, "SELECT 2"},
+		},
+		{
+			name: "line comments",
+			sql:  "-- comment;\nSELECT 1; # another;\nSELECT 2 -- trailing;\n;",
+			want: []string{"SELECT 1", "SELECT 2"},
+		},
+		{
+			name: "double dash without space is not a comment",
+			sql:  "SELECT 1--1;",
+			want: []string{"SELECT 1--1"},
+		},
+		{
+			name: "block comments are kept",
+			sql:  "/*!40101 SET NAMES utf8mb4; */;SELECT /* a;b */ 1;",
+			want: []string{"/*!40101 SET NAMES utf8mb4; */", "SELECT /* a;b */ 1"},
+		},
+		{
+			name: "multibyte",
+			sql:  "INSERT INTO tags (name) VALUES ('ライブ配信;');",
+			want: []string{"INSERT INTO tags (name) VALUES ('ライブ配信;')"},
+		},
+	}
+	for _, tt := range tests {
+		var got []string
+		if err := splitSQLStatements(strings.NewReader(tt.sql), func(stmt string) error {
+			got = append(got, stmt)
+			return nil
+		}); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if fmt.Sprintf("%q", got) != fmt.Sprintf("%q", tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	for _, sql := range []string{"SELECT 'a;", "SELECT `a", "SELECT 1 /* a", `SELECT 'a\`} {
+		if err := splitSQLStatements(strings.NewReader(sql), func(string) error { return nil }); err == nil {
+			t.Errorf("%q: expected error", sql)
+		}
+	}
+}
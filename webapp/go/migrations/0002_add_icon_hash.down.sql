@@ -0,0 +1,5 @@
+ALTER TABLE `icons`
+  DROP INDEX `idx_icons_hash`,
+  DROP INDEX `idx_icons_user_id`,
+  DROP COLUMN `created_at`,
+  DROP COLUMN `hash`;
@@ -0,0 +1,17 @@
+-- アイコンを内容のハッシュで引けるようにし、履歴を残すために作成日時を持つ
+-- MySQLでは1つのALTER TABLEはまとめて適用されるか全く適用されないので、hash列があれば適用済みとみなす
+-- (ALTERの後、適用済みを記録する前に止まった場合も再実行できるようにする)
+SET @icons_has_hash := (
+  SELECT COUNT(*) FROM information_schema.COLUMNS
+  WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'icons' AND COLUMN_NAME = 'hash'
+);
+SET @add_icon_hash := IF(@icons_has_hash = 0,
+  'ALTER TABLE `icons`
+    ADD COLUMN `hash` VARCHAR(64) NOT NULL DEFAULT '''' AFTER `user_id`,
+    ADD COLUMN `created_at` BIGINT NOT NULL DEFAULT 0,
+    ADD INDEX `idx_icons_user_id` (`user_id`),
+    ADD INDEX `idx_icons_hash` (`hash`)',
+  'DO 0');
+PREPARE add_icon_hash FROM @add_icon_hash;
+EXECUTE add_icon_hash;
+DEALLOCATE PREPARE add_icon_hash;
@@ -0,0 +1,15 @@
+-- プラットフォーム全体でのロール (行がないユーザは一般ユーザ)
+CREATE TABLE IF NOT EXISTS `user_roles` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  -- platform_moderator, admin
+  `role` VARCHAR(32) NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者が指名した配信ごとのモデレーター
+CREATE TABLE IF NOT EXISTS `livestream_moderators` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_livestream_moderator` (`livestream_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,9 @@
+-- 運営によるユーザの凍結
+CREATE TABLE IF NOT EXISTS `user_suspensions` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `reason` TEXT NOT NULL,
+  `hide_livecomments` BOOLEAN NOT NULL DEFAULT FALSE,
+  -- 0なら無期限
+  `expires_at` BIGINT NOT NULL DEFAULT 0,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
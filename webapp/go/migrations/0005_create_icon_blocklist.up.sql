@@ -0,0 +1,6 @@
+-- 運営によってアイコンとしての利用を禁止された画像
+CREATE TABLE IF NOT EXISTS `icon_blocklist` (
+  `hash` VARCHAR(64) NOT NULL PRIMARY KEY,
+  `reason` TEXT NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,14 @@
+-- 個人データエクスポートのジョブ。どのサーバからでも状況とアーカイブを取れるようにDBに置く
+-- ユーザごとに直近の1件だけ持つ
+CREATE TABLE IF NOT EXISTS `user_exports` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `id` VARCHAR(36) NOT NULL,
+  -- running, completed, failed
+  `status` VARCHAR(16) NOT NULL,
+  `archive` LONGBLOB NOT NULL,
+  `error` TEXT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  -- 実行中なら0
+  `completed_at` BIGINT NOT NULL DEFAULT 0,
+  UNIQUE `uniq_user_export_id` (`id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,6 @@
+-- icon.store=db のときの画像本体。元画像と縮小版を iconStore のキー (<hash>, <hash>_<size>) で持つ
+-- iconsの行とは別に持つので、縮小版も保存でき、行をコミットする前に画像を保存できる
+CREATE TABLE IF NOT EXISTS `icon_images` (
+  `key` VARCHAR(80) NOT NULL PRIMARY KEY,
+  `image` LONGBLOB NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPaymentResult(t *testing.T) {
+	ts := newTestServer(t)
+
+	if got := decodeJSON[PaymentResult](t, ts.client().get("/api/payment"), http.StatusOK); got.TotalTip != 0 {
+		t.Errorf("total_tip before tips = %d", got.TotalTip)
+	}
+
+	seedStatistics(t, ts)
+	if got := decodeJSON[PaymentResult](t, ts.client().get("/api/payment"), http.StatusOK); got.TotalTip != 800 {
+		t.Errorf("total_tip = %d, want 800", got.TotalTip)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// リクエストごとのSQLの回数と時間
+// テーブルの大きさに比例してクエリを投げているハンドラ (N+1) に気付けるようにする
+
+const (
+	// レスポンスに付けるクエリの回数
+	sqlQueriesHeader = "X-Sql-Queries"
+	// クエリの時間はブラウザの開発者ツールで見られるよう Server-Timing で返す
+	serverTimingHeader = "Server-Timing"
+)
+
+// 予算を超えたクエリは実行せずにこのエラーを返す (query_stats.enforce が有効なとき)
+var errQueryBudgetExceeded = errors.New("sql query budget exceeded")
+
+// queryStats は1リクエストで実行したクエリの集計です
+type queryStats struct {
+	// ルートごとのクエリ数の上限。-1なら上限なし
+	budget  int
+	enforce bool
+
+	mu       sync.Mutex
+	count    int
+	duration time.Duration
+	// 同じSQLを何回実行したか。引数が違っても同じ文ならN+1を疑う
+	statements map[string]int
+}
+
+type queryStatsKey struct{}
+
+func queryStatsFromContext(ctx context.Context) *queryStats {
+	stats, _ := ctx.Value(queryStatsKey{}).(*queryStats)
+	return stats
+}
+
+// クエリを実行する前に数える。予算を超えていて止める設定ならエラーを返す
+func (s *queryStats) begin(query string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count++
+	s.statements[query]++
+	if s.enforce && s.budget >= 0 && s.count > s.budget {
+		return fmt.Errorf("%w: %d queries (budget %d)", errQueryBudgetExceeded, s.count, s.budget)
+	}
+	return nil
+}
+
+func (s *queryStats) finish(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.duration += d
+}
+
+func (s *queryStats) snapshot() (int, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count, s.duration
+}
+
+type repeatedStatement struct {
+	statement string
+	count     int
+}
+
+// threshold 回以上実行した文を、多い順に返す
+func (s *queryStats) repeated(threshold int) []repeatedStatement {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var repeated []repeatedStatement
+	for statement, count := range s.statements {
+		if count >= threshold {
+			repeated = append(repeated, repeatedStatement{statement: statement, count: count})
+		}
+	}
+	sort.Slice(repeated, func(i, j int) bool {
+		if repeated[i].count != repeated[j].count {
+			return repeated[i].count > repeated[j].count
+		}
+		return repeated[i].statement < repeated[j].statement
+	})
+	return repeated
+}
+
+// リクエストの中のクエリを数え、終わったらログに書く
+// ルートの予算を超えたら警告し、query_stats.enforce が有効ならそれ以降のクエリを失敗させる
+func queryStatsMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		cfg := appConfig.QueryStats
+		req := c.Request()
+		ctx := req.Context()
+		route := req.Method + " " + c.Path()
+
+		stats := &queryStats{budget: -1, enforce: cfg.Enforce, statements: make(map[string]int)}
+		if budget, ok := cfg.Budgets[route]; ok {
+			stats.budget = budget
+		}
+		c.SetRequest(req.WithContext(context.WithValue(ctx, queryStatsKey{}, stats)))
+
+		// ヘッダはレスポンスを書き始める前にしか付けられないので、それまでのクエリを返す
+		if cfg.Header {
+			c.Response().Before(func() {
+				count, duration := stats.snapshot()
+				h := c.Response().Header()
+				h.Set(sqlQueriesHeader, strconv.Itoa(count))
+				h.Add(serverTimingHeader, fmt.Sprintf(`sql;dur=%.3f;desc="%d queries"`, float64(duration.Microseconds())/1000, count))
+			})
+		}
+
+		err := next(c)
+
+		count, duration := stats.snapshot()
+		if count == 0 {
+			return err
+		}
+		dbLogger.DebugContext(ctx, "sql queries", "route", route, "queries", count, "duration_ms", float64(duration.Microseconds())/1000)
+		if stats.budget >= 0 && count > stats.budget {
+			dbLogger.WarnContext(ctx, "sql query budget exceeded", "route", route, "queries", count, "budget", stats.budget)
+		}
+		if cfg.RepeatThreshold > 0 {
+			for _, r := range stats.repeated(cfg.RepeatThreshold) {
+				dbLogger.WarnContext(ctx, "repeated sql statement", "route", route, "statement", r.statement, "count", r.count)
+			}
+		}
+		return err
+	}
+}
+
+// 予算のキーが "GET /api/tag" の形になっているか
+func isValidQueryBudgetRoute(route string) bool {
+	method, path, ok := strings.Cut(route, " ")
+	if !ok || len(path) == 0 || path[0] != '/' {
+		return false
+	}
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ユーザ名の数だけユーザを1人ずつ引く (N+1) ハンドラを持つecho
+// メモリのストアはSQLを使わないので、クエリは fakeQueryer に流す
+func newQueryStatsTestEcho(t *testing.T, cfg QueryStatsConfig) *echo.Echo {
+	t.Helper()
+	appConfig.QueryStats = cfg
+	t.Cleanup(func() { appConfig.QueryStats = defaultConfig().QueryStats })
+
+	e := echo.New()
+	e.HTTPErrorHandler = errorResponseHandler
+	e.Use(requestIDMiddleware)
+	e.Use(accessLogMiddleware)
+	e.Use(queryStatsMiddleware)
+	e.GET("/api/users", func(c echo.Context) error {
+		ctx := c.Request().Context()
+		users := mysqlUserRepository{q: instrumentedQueryer{q: fakeQueryer{}}}
+		for _, name := range strings.Split(c.QueryParam("names"), ",") {
+			if _, err := users.GetByName(ctx, name); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+			}
+		}
+		tags := mysqlTagRepository{q: instrumentedQueryer{q: fakeQueryer{}}}
+		if _, err := tags.List(ctx); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+		}
+		return c.NoContent(http.StatusOK)
+	})
+	e.GET("/api/none", func(c echo.Context) error {
+		return c.NoContent(http.StatusOK)
+	})
+	return e
+}
+
+func serveQueryStats(e *echo.Echo, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func TestQueryStats(t *testing.T) {
+	e := newQueryStatsTestEcho(t, QueryStatsConfig{Header: true, RepeatThreshold: 3})
+	buf := captureLogs(t, LogConfig{Format: "json", Level: "debug"})
+
+	rec := serveQueryStats(e, "/api/users?names=alice,bob,carol")
+	expectStatus(t, rec, http.StatusOK)
+	if got := rec.Header().Get(sqlQueriesHeader); got != "4" {
+		t.Errorf("%s = %q", sqlQueriesHeader, got)
+	}
+	if got := rec.Header().Get(serverTimingHeader); !strings.HasPrefix(got, "sql;dur=") || !strings.HasSuffix(got, `;desc="4 queries"`) {
+		t.Errorf("%s = %q", serverTimingHeader, got)
+	}
+	// クエリを投げないハンドラもヘッダは返すが、ログは書かない
+	rec = serveQueryStats(e, "/api/none")
+	if got := rec.Header().Get(sqlQueriesHeader); got != "0" {
+		t.Errorf("%s = %q", sqlQueriesHeader, got)
+	}
+
+	var queries, repeated []map[string]any
+	for _, line := range parseLogLines(t, buf) {
+		switch line["msg"] {
+		case "sql queries":
+			queries = append(queries, line)
+		case "repeated sql statement":
+			repeated = append(repeated, line)
+		}
+	}
+	if len(queries) != 1 || queries[0]["subsystem"] != "db" || queries[0]["route"] != "GET /api/users" ||
+		queries[0]["queries"] != float64(4) || queries[0]["request_id"] == nil {
+		t.Errorf("query logs = %v", queries)
+	}
+	// 1回だけのタグの一覧は報告しない
+	if len(repeated) != 1 || repeated[0]["statement"] != "SELECT * FROM users WHERE name = ?" ||
+		repeated[0]["count"] != float64(3) || repeated[0]["level"] != "WARN" {
+		t.Errorf("repeated logs = %v", repeated)
+	}
+
+	// 既定ではヘッダを付けない
+	e = newQueryStatsTestEcho(t, defaultConfig().QueryStats)
+	if got := serveQueryStats(e, "/api/users?names=alice").Header().Get(sqlQueriesHeader); got != "" {
+		t.Errorf("%s = %q", sqlQueriesHeader, got)
+	}
+}
+
+func TestQueryBudget(t *testing.T) {
+	budgets := map[string]int{"GET /api/users": 3}
+
+	// 普段は警告するだけで、リクエストは成功させる
+	e := newQueryStatsTestEcho(t, QueryStatsConfig{Budgets: budgets})
+	buf := captureLogs(t, LogConfig{Format: "json", Level: "warn"})
+	expectStatus(t, serveQueryStats(e, "/api/users?names=alice,bob"), http.StatusOK)
+	if buf.Len() != 0 {
+		t.Errorf("logs = %s", buf)
+	}
+	expectStatus(t, serveQueryStats(e, "/api/users?names=alice,bob,carol"), http.StatusOK)
+	lines := parseLogLines(t, buf)
+	if len(lines) != 1 || lines[0]["msg"] != "sql query budget exceeded" || lines[0]["queries"] != float64(4) || lines[0]["budget"] != float64(3) {
+		t.Errorf("logs = %s", buf)
+	}
+
+	// テストでは上限を超えたクエリを失敗させる
+	e = newQueryStatsTestEcho(t, QueryStatsConfig{Header: true, Budgets: budgets, Enforce: true})
+	expectStatus(t, serveQueryStats(e, "/api/users?names=alice,bob"), http.StatusOK)
+	rec := serveQueryStats(e, "/api/users?names=alice,bob,carol")
+	expectError(t, rec, http.StatusInternalServerError)
+	if got := rec.Header().Get(sqlQueriesHeader); got != "4" {
+		t.Errorf("%s = %q", sqlQueriesHeader, got)
+	}
+	// 上限のないルートは止めない
+	appConfig.QueryStats.Budgets = map[string]int{"GET /api/tag": 0}
+	expectStatus(t, serveQueryStats(e, "/api/users?names=alice,bob,carol"), http.StatusOK)
+
+	stats := &queryStats{budget: 0, enforce: true, statements: make(map[string]int)}
+	if err := stats.begin("SELECT 1"); !errors.Is(err, errQueryBudgetExceeded) {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestQueryStatsConfig(t *testing.T) {
+	cfg := defaultConfig()
+	if err := cfg.envBindings()["ISUCON13_QUERY_BUDGETS"]("GET /api/tag=1, POST /api/livestream/:livestream_id/livecomment=12"); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.QueryStats.Budgets) != 2 || cfg.QueryStats.Budgets["GET /api/tag"] != 1 ||
+		cfg.QueryStats.Budgets["POST /api/livestream/:livestream_id/livecomment"] != 12 {
+		t.Errorf("budgets = %v", cfg.QueryStats.Budgets)
+	}
+	if err := cfg.envBindings()["ISUCON13_QUERY_BUDGETS"]("GET /api/tag=many"); err == nil {
+		t.Error("expected error")
+	}
+
+	for _, qs := range []QueryStatsConfig{
+		{RepeatThreshold: -1},
+		{Budgets: map[string]int{"/api/tag": 1}},
+		{Budgets: map[string]int{"FETCH /api/tag": 1}},
+		{Budgets: map[string]int{"GET api/tag": 1}},
+		{Budgets: map[string]int{"GET /api/tag": -1}},
+	} {
+		c := newTestConfig()
+		c.QueryStats = qs
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), "query_stats.") {
+			t.Errorf("%+v: err = %v", qs, err)
+		}
+	}
+	c := newTestConfig()
+	c.QueryStats.Budgets = map[string]int{"GET /api/tag": 0, "DELETE /api/livestream/:livestream_id": 5}
+	if err := c.Validate(); err != nil {
+		t.Errorf("err = %v", err)
+	}
+}
@@ -8,7 +8,6 @@ import (
 	"strconv"
 	"time"
 
-	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
@@ -46,23 +45,22 @@ func getReactionsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := dataStore.BeginReadTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	query := "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY created_at DESC"
+	var limit int
 	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
 		if err != nil {
 			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
 		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
 	}
 
-	reactionModels := []ReactionModel{}
-	if err := tx.SelectContext(ctx, &reactionModels, query, livestreamID); err != nil {
+	reactionModels, err := tx.Reactions().ListByLivestream(ctx, int64(livestreamID), limit)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, "failed to get reactions")
 	}
 
@@ -100,7 +98,7 @@ func postReactionHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := dataStore.BeginTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -113,15 +111,10 @@ func postReactionHandler(c echo.Context) error {
 		CreatedAt:    time.Now().Unix(),
 	}
 
-	result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
+	reactionID, err := tx.Reactions().Create(ctx, reactionModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
 	}
-
-	reactionID, err := result.LastInsertId()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
-	}
 	reactionModel.ID = reactionID
 
 	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
@@ -132,13 +125,14 @@ func postReactionHandler(c echo.Context) error {
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	reactionsTotal.Inc()
 
 	return c.JSON(http.StatusCreated, reaction)
 }
 
-func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel ReactionModel) (Reaction, error) {
-	userModel := UserModel{}
-	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", reactionModel.UserID); err != nil {
+func fillReactionResponse(ctx context.Context, tx Tx, reactionModel ReactionModel) (Reaction, error) {
+	userModel, err := tx.Users().Get(ctx, reactionModel.UserID)
+	if err != nil {
 		return Reaction{}, err
 	}
 	user, err := fillUserResponse(ctx, tx, userModel)
@@ -146,8 +140,8 @@ func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel Reacti
 		return Reaction{}, err
 	}
 
-	livestreamModel := LivestreamModel{}
-	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", reactionModel.LivestreamID); err != nil {
+	livestreamModel, err := tx.Livestreams().Get(ctx, reactionModel.LivestreamID)
+	if err != nil {
 		return Reaction{}, err
 	}
 	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
@@ -166,7 +160,7 @@ func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel Reacti
 	return reaction, nil
 }
 
-func fillReactionsResponse(ctx context.Context, tx *sqlx.Tx, reactionModels []ReactionModel) ([]Reaction, error) {
+func fillReactionsResponse(ctx context.Context, tx Tx, reactionModels []ReactionModel) ([]Reaction, error) {
 	if len(reactionModels) == 0 {
 		return []Reaction{}, nil
 	}
@@ -181,26 +175,18 @@ func fillReactionsResponse(ctx context.Context, tx *sqlx.Tx, reactionModels []Re
 		livestreamIDs[i] = reactionModel.LivestreamID
 	}
 
-	query, args, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", userIDs)
+	userModels, err := tx.Users().ListByIDs(ctx, userIDs)
 	if err != nil {
 		return nil, err
 	}
-	var userModels []UserModel
-	if err := tx.SelectContext(ctx, &userModels, tx.Rebind(query), args...); err != nil {
-		return nil, err
-	}
 	for _, userModel := range userModels {
 		userModelMap[userModel.ID] = userModel
 	}
 
-	query, args, err = sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+	livestreamModels, err := tx.Livestreams().ListByIDs(ctx, livestreamIDs)
 	if err != nil {
 		return nil, err
 	}
-	var livestreamModels []LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreamModels, tx.Rebind(query), args...); err != nil {
-		return nil, err
-	}
 	for _, livestreamModel := range livestreamModels {
 		livestreamModelMap[livestreamModel.ID] = livestreamModel
 	}
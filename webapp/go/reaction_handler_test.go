@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestReactions(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	bob, bobUser := ts.signup("bob")
+
+	livestream := ts.reserve(alice, 1, "stream")
+	path := fmt.Sprintf("/api/livestream/%d/reaction", livestream.ID)
+
+	first := decodeJSON[Reaction](t, bob.post(path, PostReactionRequest{EmojiName: "innocent"}), http.StatusCreated)
+	if first.ID == 0 || first.EmojiName != "innocent" || first.User != bobUser || first.Livestream.ID != livestream.ID {
+		t.Errorf("reaction = %+v", first)
+	}
+	second := decodeJSON[Reaction](t, alice.post(path, PostReactionRequest{EmojiName: "tada"}), http.StatusCreated)
+
+	// 新しい順に返る
+	reactions := decodeJSON[[]Reaction](t, bob.get(path), http.StatusOK)
+	if len(reactions) != 2 || reactions[0].ID != second.ID || reactions[1].ID != first.ID {
+		t.Errorf("reactions = %+v", reactions)
+	}
+	limited := decodeJSON[[]Reaction](t, bob.get(path+"?limit=1"), http.StatusOK)
+	if len(limited) != 1 || limited[0].ID != second.ID {
+		t.Errorf("limited = %+v", limited)
+	}
+
+	stats := decodeJSON[LivestreamStatistics](t, alice.get(fmt.Sprintf("/api/livestream/%d/statistics", livestream.ID)), http.StatusOK)
+	if stats.TotalReactions != 2 {
+		t.Errorf("total_reactions = %d", stats.TotalReactions)
+	}
+
+	expectError(t, bob.get(path+"?limit=abc"), http.StatusBadRequest)
+	expectError(t, bob.post("/api/livestream/abc/reaction", PostReactionRequest{EmojiName: "tada"}), http.StatusBadRequest)
+	expectError(t, bob.do(http.MethodPost, path, "tada"), http.StatusBadRequest)
+	expectError(t, ts.client().get(path), http.StatusForbidden)
+	expectError(t, ts.client().post(path, PostReactionRequest{EmojiName: "tada"}), http.StatusForbidden)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+// 見つからない場合は実装によらず sql.ErrNoRows を返す
+// UNIQUE制約違反は isDuplicateEntryError で判定できるエラーを返す
+var errDuplicateEntry = errors.New("duplicate entry")
+
+// Store はデータの読み書きの入口です。
+// ハンドラはdbConnを直接使わず、Storeから始めたトランザクション越しに各リポジトリを使います。
+type Store interface {
+	// トランザクションを使わずに読み書きする
+	Repositories
+
+	// 書き込みを伴うトランザクションを始める。常にプライマリで行う
+	BeginTx(ctx context.Context) (Tx, error)
+	// 読み取り専用のトランザクションを始める。使えればレプリカで行う
+	BeginReadTx(ctx context.Context) (Tx, error)
+}
+
+// Tx はトランザクション内で使うリポジトリの集まりです。
+type Tx interface {
+	Repositories
+
+	Commit() error
+	Rollback() error
+}
+
+type Repositories interface {
+	Users() UserRepository
+	Icons() IconRepository
+	Livestreams() LivestreamRepository
+	Livecomments() LivecommentRepository
+	Reactions() ReactionRepository
+	Reports() ReportRepository
+	NGWords() NGWordRepository
+	Tags() TagRepository
+	Slots() SlotRepository
+}
+
+var dataStore Store
+
+// UserRepository はユーザと、テーマ・ロール・凍結などユーザに1対1で紐づくものを扱います。
+type UserRepository interface {
+	// 作成したユーザのIDを返す
+	Create(ctx context.Context, user UserModel) (int64, error)
+	Get(ctx context.Context, id int64) (UserModel, error)
+	// 行ロックを取って取得する
+	GetForUpdate(ctx context.Context, id int64) (UserModel, error)
+	GetByName(ctx context.Context, name string) (UserModel, error)
+	CountByName(ctx context.Context, name string) (int, error)
+	List(ctx context.Context) ([]*UserModel, error)
+	ListByIDs(ctx context.Context, ids []int64) ([]UserModel, error)
+	ListNames(ctx context.Context) ([]string, error)
+	// ユーザと、ユーザに紐づく全てのデータを削除する (予約枠の返却は呼び出し側で行う)
+	Delete(ctx context.Context, user UserModel, livestreamIDs []int64) error
+
+	CreateTheme(ctx context.Context, theme ThemeModel) error
+	GetTheme(ctx context.Context, userID int64) (ThemeModel, error)
+
+	// user_rolesに行がなければRoleUserを返す
+	GetRole(ctx context.Context, userID int64) (Role, error)
+	// RoleUserを指定した場合は行を消す
+	SetRole(ctx context.Context, userID int64, role Role) error
+
+	GetSuspension(ctx context.Context, userID int64) (UserSuspensionModel, error)
+	ListSuspensions(ctx context.Context) ([]*UserSuspensionModel, error)
+	// 既に凍結されていれば上書きする
+	PutSuspension(ctx context.Context, suspension UserSuspensionModel) error
+	DeleteSuspension(ctx context.Context, userID int64) error
+
+	// アーカイブを除いて取得する
+	GetExport(ctx context.Context, userID int64) (UserExportModel, error)
+	GetExportArchive(ctx context.Context, id string) ([]byte, error)
+	// ユーザのジョブを置き換える
+	PutExport(ctx context.Context, export UserExportModel) error
+	// ジョブの結果を書き込む。その間に別のジョブに置き換えられていれば何もしない
+	FinishExport(ctx context.Context, export UserExportModel) error
+}
+
+// IconRepository はアイコンの履歴とブロックリストを扱います。画像本体はIconStoreに保存します。
+type IconRepository interface {
+	Create(ctx context.Context, userID int64, hash string, createdAt int64) (int64, error)
+	// 既存のアイコンを最新の行として複製する
+	Copy(ctx context.Context, id int64, createdAt int64) (int64, error)
+	Delete(ctx context.Context, id int64) error
+	// ユーザのアイコンのうち指定したIDのもの
+	GetByUser(ctx context.Context, id int64, userID int64) (IconModel, error)
+	// 最新の行を現在のアイコンとする
+	GetCurrent(ctx context.Context, userID int64) (IconModel, error)
+	// 新しい順
+	ListByUser(ctx context.Context, userID int64) ([]*IconModel, error)
+	ListHashesByUser(ctx context.Context, userID int64) ([]string, error)
+	// 全ユーザのアイコンを古い順に返す。キャッシュの作成用
+	ListHashes(ctx context.Context) ([]*iconHashRow, error)
+	CountByHash(ctx context.Context, hash string) (int, error)
+
+	ListBlocklist(ctx context.Context) ([]IconBlocklistModel, error)
+	ListBlockedHashes(ctx context.Context) ([]string, error)
+	IsBlocked(ctx context.Context, hash string) (bool, error)
+	// 既にあれば理由だけ更新する
+	PutBlocklist(ctx context.Context, entry IconBlocklistModel) error
+	// 削除した件数を返す
+	DeleteBlocklist(ctx context.Context, hash string) (int64, error)
+
+	// icon.store=db のときの画像本体。キーはiconStoreのキー
+	// 見つからなければ sql.ErrNoRows
+	GetImage(ctx context.Context, key string) ([]byte, error)
+	// 既にあれば上書きする
+	PutImage(ctx context.Context, key string, image []byte) error
+	DeleteImage(ctx context.Context, key string) error
+}
+
+// LivestreamRepository は配信と、配信ごとのタグ・視聴履歴・モデレーターを扱います。
+type LivestreamRepository interface {
+	Create(ctx context.Context, livestream LivestreamModel) (int64, error)
+	Get(ctx context.Context, id int64) (LivestreamModel, error)
+	// 新しい順。limitが0なら全件
+	List(ctx context.Context, limit int) ([]*LivestreamModel, error)
+	ListByUser(ctx context.Context, userID int64) ([]*LivestreamModel, error)
+	ListByIDs(ctx context.Context, ids []int64) ([]LivestreamModel, error)
+
+	AddTag(ctx context.Context, livestreamID int64, tagID int64) error
+	ListTags(ctx context.Context, livestreamID int64) ([]*LivestreamTagModel, error)
+	// 指定したタグのいずれかが付いた配信を新しい順に返す
+	ListTagged(ctx context.Context, tagIDs []int64) ([]*LivestreamTagModel, error)
+
+	AddViewer(ctx context.Context, viewer LivestreamViewerModel) error
+	RemoveViewer(ctx context.Context, userID int64, livestreamID int64) error
+	CountViewers(ctx context.Context, livestreamID int64) (int64, error)
+
+	// 既にモデレーターなら重複エラーを返す
+	AddModerator(ctx context.Context, moderator LivestreamModeratorModel) error
+	RemoveModerator(ctx context.Context, livestreamID int64, username string) error
+	IsModerator(ctx context.Context, livestreamID int64, userID int64) (bool, error)
+	ListModerators(ctx context.Context, livestreamID int64) ([]*LivestreamModeratorModel, error)
+}
+
+type LivecommentRepository interface {
+	Create(ctx context.Context, livecomment LivecommentModel) (int64, error)
+	Get(ctx context.Context, id int64) (LivecommentModel, error)
+	// 新しい順。hiddenUserIDs のユーザのコメントを除いてからlimit件に絞る。limitが0なら全件
+	ListByLivestream(ctx context.Context, livestreamID int64, limit int, hiddenUserIDs []int64) ([]LivecommentModel, error)
+	ListByUser(ctx context.Context, userID int64) ([]LivecommentModel, error)
+	// wordを含むコメントを削除する
+	DeleteContaining(ctx context.Context, livestreamID int64, word string) error
+
+	TotalTip(ctx context.Context) (int64, error)
+	// 配信者のユーザIDごとのチップ合計
+	SumTipsByStreamer(ctx context.Context) (map[int64]int64, error)
+	SumTipsByLivestream(ctx context.Context, livestreamID int64) (int64, error)
+	MaxTipByLivestream(ctx context.Context, livestreamID int64) (int64, error)
+}
+
+type ReactionRepository interface {
+	Create(ctx context.Context, reaction ReactionModel) (int64, error)
+	// 新しい順。limitが0なら全件
+	ListByLivestream(ctx context.Context, livestreamID int64, limit int) ([]ReactionModel, error)
+	ListByUser(ctx context.Context, userID int64) ([]ReactionModel, error)
+
+	// 配信者のユーザIDごとのリアクション数
+	CountByStreamer(ctx context.Context) (map[int64]int64, error)
+	CountByStreamerName(ctx context.Context, name string) (int64, error)
+	CountByLivestream(ctx context.Context, livestreamID int64) (int64, error)
+	// 配信者が受け取った中で最も多い絵文字。リアクションがなければ sql.ErrNoRows
+	FavoriteEmojiByStreamerName(ctx context.Context, name string) (string, error)
+}
+
+type ReportRepository interface {
+	Create(ctx context.Context, report LivecommentReportModel) (int64, error)
+	ListByLivestream(ctx context.Context, livestreamID int64) ([]*LivecommentReportModel, error)
+	ListByUser(ctx context.Context, userID int64) ([]LivecommentReportModel, error)
+	CountByLivestream(ctx context.Context, livestreamID int64) (int64, error)
+}
+
+type NGWordRepository interface {
+	Create(ctx context.Context, ngWord NGWord) (int64, error)
+	// 新しい順
+	ListByLivestream(ctx context.Context, userID int64, livestreamID int64) ([]*NGWord, error)
+	// コメントがNGワードを含むかどうか
+	Matches(ctx context.Context, comment string, word string) (bool, error)
+}
+
+type TagRepository interface {
+	Create(ctx context.Context, name string) (int64, error)
+	Get(ctx context.Context, id int64) (TagModel, error)
+	List(ctx context.Context) ([]*TagModel, error)
+}
+
+// SlotRepository は配信の予約枠を扱います。
+type SlotRepository interface {
+	// 期間内の予約枠を行ロックを取って取得する
+	ListForUpdate(ctx context.Context, startAt int64, endAt int64) ([]*ReservationSlotModel, error)
+	// 予約枠の残数
+	Remaining(ctx context.Context, startAt int64, endAt int64) (int64, error)
+	// 期間内の予約枠を1つずつ確保する
+	Reserve(ctx context.Context, startAt int64, endAt int64) error
+	// 期間内の予約枠を1つずつ返却する
+	Refund(ctx context.Context, startAt int64, endAt int64) error
+}
@@ -0,0 +1,1149 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// memoryStore はMySQLなしで動かすためのメモリ上のStoreです。テストで使います。
+// トランザクションは全体を1つのロックで直列化し、コピーした表に書いてコミット時に差し替えます。
+// トランザクションを持ったまま同じStoreを直接使うとデッドロックするので注意
+type memoryStore struct {
+	memoryRepositories
+
+	mu     sync.Mutex
+	tables *memoryTables
+}
+
+type memoryTables struct {
+	users          []UserModel
+	themes         []ThemeModel
+	roles          map[int64]Role
+	suspensions    map[int64]UserSuspensionModel
+	exports        map[int64]UserExportModel
+	icons          []IconModel
+	iconBlocklist  map[string]IconBlocklistModel
+	iconImages     map[string][]byte
+	livestreams    []LivestreamModel
+	livestreamTags []LivestreamTagModel
+	viewers        []LivestreamViewerModel
+	moderators     []LivestreamModeratorModel
+	livecomments   []LivecommentModel
+	reactions      []ReactionModel
+	reports        []LivecommentReportModel
+	ngWords        []NGWord
+	tags           []TagModel
+	slots          []ReservationSlotModel
+
+	// 表ごとのAUTO_INCREMENT
+	lastIDs map[string]int64
+}
+
+func newMemoryStore() *memoryStore {
+	s := &memoryStore{
+		tables: &memoryTables{
+			roles:         make(map[int64]Role),
+			suspensions:   make(map[int64]UserSuspensionModel),
+			exports:       make(map[int64]UserExportModel),
+			iconBlocklist: make(map[string]IconBlocklistModel),
+			iconImages:    make(map[string][]byte),
+			lastIDs:       make(map[string]int64),
+		},
+	}
+	s.memoryRepositories = memoryRepositories{do: func(fn func(*memoryTables) error) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return fn(s.tables)
+	}}
+	return s
+}
+
+func (t *memoryTables) clone() *memoryTables {
+	return &memoryTables{
+		users:          slices.Clone(t.users),
+		themes:         slices.Clone(t.themes),
+		roles:          maps.Clone(t.roles),
+		suspensions:    maps.Clone(t.suspensions),
+		exports:        maps.Clone(t.exports),
+		icons:          slices.Clone(t.icons),
+		iconBlocklist:  maps.Clone(t.iconBlocklist),
+		iconImages:     maps.Clone(t.iconImages),
+		livestreams:    slices.Clone(t.livestreams),
+		livestreamTags: slices.Clone(t.livestreamTags),
+		viewers:        slices.Clone(t.viewers),
+		moderators:     slices.Clone(t.moderators),
+		livecomments:   slices.Clone(t.livecomments),
+		reactions:      slices.Clone(t.reactions),
+		reports:        slices.Clone(t.reports),
+		ngWords:        slices.Clone(t.ngWords),
+		tags:           slices.Clone(t.tags),
+		slots:          slices.Clone(t.slots),
+		lastIDs:        maps.Clone(t.lastIDs),
+	}
+}
+
+func (t *memoryTables) nextID(table string) int64 {
+	t.lastIDs[table]++
+	return t.lastIDs[table]
+}
+
+func (s *memoryStore) BeginTx(ctx context.Context) (Tx, error) {
+	s.mu.Lock()
+	tx := &memoryTx{store: s, tables: s.tables.clone()}
+	tx.memoryRepositories = memoryRepositories{do: func(fn func(*memoryTables) error) error {
+		if tx.done {
+			return sql.ErrTxDone
+		}
+		return fn(tx.tables)
+	}}
+	return tx, nil
+}
+
+func (s *memoryStore) BeginReadTx(ctx context.Context) (Tx, error) {
+	return s.BeginTx(ctx)
+}
+
+type memoryTx struct {
+	memoryRepositories
+
+	store  *memoryStore
+	tables *memoryTables
+	done   bool
+}
+
+func (t *memoryTx) Commit() error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+	t.store.tables = t.tables
+	t.store.mu.Unlock()
+	return nil
+}
+
+func (t *memoryTx) Rollback() error {
+	if t.done {
+		return sql.ErrTxDone
+	}
+	t.done = true
+	t.store.mu.Unlock()
+	return nil
+}
+
+type memoryRepositories struct {
+	do func(fn func(*memoryTables) error) error
+}
+
+func (r memoryRepositories) Users() UserRepository {
+	return memoryUserRepository(r)
+}
+
+func (r memoryRepositories) Icons() IconRepository {
+	return memoryIconRepository(r)
+}
+
+func (r memoryRepositories) Livestreams() LivestreamRepository {
+	return memoryLivestreamRepository(r)
+}
+
+func (r memoryRepositories) Livecomments() LivecommentRepository {
+	return memoryLivecommentRepository(r)
+}
+
+func (r memoryRepositories) Reactions() ReactionRepository {
+	return memoryReactionRepository(r)
+}
+
+func (r memoryRepositories) Reports() ReportRepository {
+	return memoryReportRepository(r)
+}
+
+func (r memoryRepositories) NGWords() NGWordRepository {
+	return memoryNGWordRepository(r)
+}
+
+func (r memoryRepositories) Tags() TagRepository {
+	return memoryTagRepository(r)
+}
+
+func (r memoryRepositories) Slots() SlotRepository {
+	return memorySlotRepository(r)
+}
+
+// 条件に合う最初の行。なければ sql.ErrNoRows
+func findRow[T any](rows []T, match func(T) bool) (T, error) {
+	for _, row := range rows {
+		if match(row) {
+			return row, nil
+		}
+	}
+	var zero T
+	return zero, sql.ErrNoRows
+}
+
+// 条件に合う行を全て返す
+func filterRows[T any](rows []T, match func(T) bool) []T {
+	var matched []T
+	for _, row := range rows {
+		if match(row) {
+			matched = append(matched, row)
+		}
+	}
+	return matched
+}
+
+// 条件に合う行を消す
+func deleteRows[T any](rows []T, match func(T) bool) []T {
+	return slices.DeleteFunc(rows, match)
+}
+
+// 値の行をポインタのスライスにする
+func rowPointers[T any](rows []T) []*T {
+	pointers := make([]*T, len(rows))
+	for i := range rows {
+		pointers[i] = &rows[i]
+	}
+	return pointers
+}
+
+// limitが0なら全件
+func limitRows[T any](rows []T, limit int) []T {
+	if limit > 0 && len(rows) > limit {
+		return rows[:limit]
+	}
+	return rows
+}
+
+// MySQLの LIKE '%word%' の代わり。照合順序に合わせて大文字小文字は区別しない
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+type memoryUserRepository struct {
+	do func(fn func(*memoryTables) error) error
+}
+
+func (r memoryUserRepository) Create(ctx context.Context, user UserModel) (int64, error) {
+	err := r.do(func(t *memoryTables) error {
+		if _, err := findRow(t.users, func(u UserModel) bool { return u.Name == user.Name }); err == nil {
+			return errDuplicateEntry
+		}
+		user.ID = t.nextID("users")
+		t.users = append(t.users, user)
+		return nil
+	})
+	return user.ID, err
+}
+
+func (r memoryUserRepository) Get(ctx context.Context, id int64) (UserModel, error) {
+	var user UserModel
+	err := r.do(func(t *memoryTables) (err error) {
+		user, err = findRow(t.users, func(u UserModel) bool { return u.ID == id })
+		return err
+	})
+	return user, err
+}
+
+func (r memoryUserRepository) GetForUpdate(ctx context.Context, id int64) (UserModel, error) {
+	return r.Get(ctx, id)
+}
+
+func (r memoryUserRepository) GetByName(ctx context.Context, name string) (UserModel, error) {
+	var user UserModel
+	err := r.do(func(t *memoryTables) (err error) {
+		user, err = findRow(t.users, func(u UserModel) bool { return u.Name == name })
+		return err
+	})
+	return user, err
+}
+
+func (r memoryUserRepository) CountByName(ctx context.Context, name string) (int, error) {
+	var count int
+	err := r.do(func(t *memoryTables) error {
+		count = len(filterRows(t.users, func(u UserModel) bool { return u.Name == name }))
+		return nil
+	})
+	return count, err
+}
+
+func (r memoryUserRepository) List(ctx context.Context) ([]*UserModel, error) {
+	var users []*UserModel
+	err := r.do(func(t *memoryTables) error {
+		users = rowPointers(slices.Clone(t.users))
+		return nil
+	})
+	return users, err
+}
+
+func (r memoryUserRepository) ListByIDs(ctx context.Context, ids []int64) ([]UserModel, error) {
+	var users []UserModel
+	err := r.do(func(t *memoryTables) error {
+		users = filterRows(t.users, func(u UserModel) bool { return slices.Contains(ids, u.ID) })
+		return nil
+	})
+	return users, err
+}
+
+func (r memoryUserRepository) ListNames(ctx context.Context) ([]string, error) {
+	var names []string
+	err := r.do(func(t *memoryTables) error {
+		for _, u := range t.users {
+			names = append(names, u.Name)
+		}
+		return nil
+	})
+	return names, err
+}
+
+func (r memoryUserRepository) Delete(ctx context.Context, user UserModel, livestreamIDs []int64) error {
+	return r.do(func(t *memoryTables) error {
+		ownedLivestream := func(livestreamID int64) bool { return slices.Contains(livestreamIDs, livestreamID) }
+		var commentIDs []int64
+		for _, l := range t.livecomments {
+			if l.UserID == user.ID {
+				commentIDs = append(commentIDs, l.ID)
+			}
+		}
+
+		t.livestreamTags = deleteRows(t.livestreamTags, func(l LivestreamTagModel) bool { return ownedLivestream(l.LivestreamID) })
+		t.moderators = deleteRows(t.moderators, func(m LivestreamModeratorModel) bool {
+			return ownedLivestream(m.LivestreamID) || m.UserID == user.ID
+		})
+		t.reports = deleteRows(t.reports, func(r LivecommentReportModel) bool {
+			return ownedLivestream(r.LivestreamID) || r.UserID == user.ID || slices.Contains(commentIDs, r.LivecommentID)
+		})
+		t.ngWords = deleteRows(t.ngWords, func(w NGWord) bool { return ownedLivestream(w.LivestreamID) || w.UserID == user.ID })
+		t.reactions = deleteRows(t.reactions, func(r ReactionModel) bool { return ownedLivestream(r.LivestreamID) || r.UserID == user.ID })
+		t.livecomments = deleteRows(t.livecomments, func(l LivecommentModel) bool { return ownedLivestream(l.LivestreamID) || l.UserID == user.ID })
+		t.viewers = deleteRows(t.viewers, func(v LivestreamViewerModel) bool { return ownedLivestream(v.LivestreamID) || v.UserID == user.ID })
+		t.livestreams = deleteRows(t.livestreams, func(l LivestreamModel) bool { return l.UserID == user.ID })
+		t.icons = deleteRows(t.icons, func(i IconModel) bool { return i.UserID == user.ID })
+		t.themes = deleteRows(t.themes, func(th ThemeModel) bool { return th.UserID == user.ID })
+		delete(t.roles, user.ID)
+		delete(t.suspensions, user.ID)
+		delete(t.exports, user.ID)
+		t.users = deleteRows(t.users, func(u UserModel) bool { return u.ID == user.ID })
+		return nil
+	})
+}
+
+func (r memoryUserRepository) CreateTheme(ctx context.Context, theme ThemeModel) error {
+	return r.do(func(t *memoryTables) error {
+		theme.ID = t.nextID("themes")
+		t.themes = append(t.themes, theme)
+		return nil
+	})
+}
+
+func (r memoryUserRepository) GetTheme(ctx context.Context, userID int64) (ThemeModel, error) {
+	var theme ThemeModel
+	err := r.do(func(t *memoryTables) (err error) {
+		theme, err = findRow(t.themes, func(th ThemeModel) bool { return th.UserID == userID })
+		return err
+	})
+	return theme, err
+}
+
+func (r memoryUserRepository) GetRole(ctx context.Context, userID int64) (Role, error) {
+	role := RoleUser
+	err := r.do(func(t *memoryTables) error {
+		if v, ok := t.roles[userID]; ok {
+			role = v
+		}
+		return nil
+	})
+	return role, err
+}
+
+func (r memoryUserRepository) SetRole(ctx context.Context, userID int64, role Role) error {
+	return r.do(func(t *memoryTables) error {
+		if role == RoleUser {
+			delete(t.roles, userID)
+		} else {
+			t.roles[userID] = role
+		}
+		return nil
+	})
+}
+
+func (r memoryUserRepository) GetSuspension(ctx context.Context, userID int64) (UserSuspensionModel, error) {
+	var suspension UserSuspensionModel
+	err := r.do(func(t *memoryTables) error {
+		v, ok := t.suspensions[userID]
+		if !ok {
+			return sql.ErrNoRows
+		}
+		suspension = v
+		return nil
+	})
+	return suspension, err
+}
+
+func (r memoryUserRepository) ListSuspensions(ctx context.Context) ([]*UserSuspensionModel, error) {
+	var suspensions []*UserSuspensionModel
+	err := r.do(func(t *memoryTables) error {
+		for _, s := range t.suspensions {
+			s := s
+			suspensions = append(suspensions, &s)
+		}
+		return nil
+	})
+	return suspensions, err
+}
+
+func (r memoryUserRepository) PutSuspension(ctx context.Context, suspension UserSuspensionModel) error {
+	return r.do(func(t *memoryTables) error {
+		t.suspensions[suspension.UserID] = suspension
+		return nil
+	})
+}
+
+func (r memoryUserRepository) DeleteSuspension(ctx context.Context, userID int64) error {
+	return r.do(func(t *memoryTables) error {
+		delete(t.suspensions, userID)
+		return nil
+	})
+}
+
+func (r memoryUserRepository) GetExport(ctx context.Context, userID int64) (UserExportModel, error) {
+	var export UserExportModel
+	err := r.do(func(t *memoryTables) error {
+		v, ok := t.exports[userID]
+		if !ok {
+			return sql.ErrNoRows
+		}
+		export = v
+		export.Archive = nil
+		return nil
+	})
+	return export, err
+}
+
+func (r memoryUserRepository) GetExportArchive(ctx context.Context, id string) ([]byte, error) {
+	var archive []byte
+	err := r.do(func(t *memoryTables) error {
+		for _, export := range t.exports {
+			if export.ID == id {
+				archive = export.Archive
+				return nil
+			}
+		}
+		return sql.ErrNoRows
+	})
+	return archive, err
+}
+
+func (r memoryUserRepository) PutExport(ctx context.Context, export UserExportModel) error {
+	return r.do(func(t *memoryTables) error {
+		t.exports[export.UserID] = export
+		return nil
+	})
+}
+
+func (r memoryUserRepository) FinishExport(ctx context.Context, export UserExportModel) error {
+	return r.do(func(t *memoryTables) error {
+		if current, ok := t.exports[export.UserID]; ok && current.ID == export.ID {
+			t.exports[export.UserID] = export
+		}
+		return nil
+	})
+}
+
+type memoryIconRepository struct {
+	do func(fn func(*memoryTables) error) error
+}
+
+func (r memoryIconRepository) Create(ctx context.Context, userID int64, hash string, createdAt int64) (int64, error) {
+	var id int64
+	err := r.do(func(t *memoryTables) error {
+		id = t.nextID("icons")
+		t.icons = append(t.icons, IconModel{ID: id, UserID: userID, Hash: hash, CreatedAt: createdAt})
+		return nil
+	})
+	return id, err
+}
+
+func (r memoryIconRepository) Copy(ctx context.Context, id int64, createdAt int64) (int64, error) {
+	var newID int64
+	err := r.do(func(t *memoryTables) error {
+		icon, err := findRow(t.icons, func(i IconModel) bool { return i.ID == id })
+		if err != nil {
+			return err
+		}
+		icon.ID = t.nextID("icons")
+		icon.CreatedAt = createdAt
+		t.icons = append(t.icons, icon)
+		newID = icon.ID
+		return nil
+	})
+	return newID, err
+}
+
+func (r memoryIconRepository) Delete(ctx context.Context, id int64) error {
+	return r.do(func(t *memoryTables) error {
+		t.icons = deleteRows(t.icons, func(i IconModel) bool { return i.ID == id })
+		return nil
+	})
+}
+
+func (r memoryIconRepository) GetByUser(ctx context.Context, id int64, userID int64) (IconModel, error) {
+	var icon IconModel
+	err := r.do(func(t *memoryTables) (err error) {
+		icon, err = findRow(t.icons, func(i IconModel) bool { return i.ID == id && i.UserID == userID })
+		return err
+	})
+	return icon, err
+}
+
+func (r memoryIconRepository) GetCurrent(ctx context.Context, userID int64) (IconModel, error) {
+	var icon IconModel
+	err := r.do(func(t *memoryTables) error {
+		icons := filterRows(t.icons, func(i IconModel) bool { return i.UserID == userID })
+		if len(icons) == 0 {
+			return sql.ErrNoRows
+		}
+		icon = icons[len(icons)-1]
+		return nil
+	})
+	return icon, err
+}
+
+func (r memoryIconRepository) ListByUser(ctx context.Context, userID int64) ([]*IconModel, error) {
+	var icons []*IconModel
+	err := r.do(func(t *memoryTables) error {
+		rows := filterRows(t.icons, func(i IconModel) bool { return i.UserID == userID })
+		slices.Reverse(rows)
+		icons = rowPointers(rows)
+		return nil
+	})
+	return icons, err
+}
+
+func (r memoryIconRepository) ListHashesByUser(ctx context.Context, userID int64) ([]string, error) {
+	var hashes []string
+	err := r.do(func(t *memoryTables) error {
+		for _, i := range filterRows(t.icons, func(i IconModel) bool { return i.UserID == userID }) {
+			hashes = append(hashes, i.Hash)
+		}
+		return nil
+	})
+	return hashes, err
+}
+
+func (r memoryIconRepository) ListHashes(ctx context.Context) ([]*iconHashRow, error) {
+	var rows []*iconHashRow
+	err := r.do(func(t *memoryTables) error {
+		for _, i := range t.icons {
+			user, err := findRow(t.users, func(u UserModel) bool { return u.ID == i.UserID })
+			if err != nil || i.Hash == "" {
+				continue
+			}
+			rows = append(rows, &iconHashRow{UserID: i.UserID, UserName: user.Name, Hash: i.Hash})
+		}
+		return nil
+	})
+	return rows, err
+}
+
+func (r memoryIconRepository) CountByHash(ctx context.Context, hash string) (int, error) {
+	var count int
+	err := r.do(func(t *memoryTables) error {
+		count = len(filterRows(t.icons, func(i IconModel) bool { return i.Hash == hash }))
+		return nil
+	})
+	return count, err
+}
+
+func (r memoryIconRepository) ListBlocklist(ctx context.Context) ([]IconBlocklistModel, error) {
+	blocklist := []IconBlocklistModel{}
+	err := r.do(func(t *memoryTables) error {
+		for _, entry := range t.iconBlocklist {
+			blocklist = append(blocklist, entry)
+		}
+		sort.Slice(blocklist, func(i, j int) bool { return blocklist[i].CreatedAt > blocklist[j].CreatedAt })
+		return nil
+	})
+	return blocklist, err
+}
+
+func (r memoryIconRepository) ListBlockedHashes(ctx context.Context) ([]string, error) {
+	var hashes []string
+	err := r.do(func(t *memoryTables) error {
+		for hash := range t.iconBlocklist {
+			hashes = append(hashes, hash)
+		}
+		return nil
+	})
+	return hashes, err
+}
+
+func (r memoryIconRepository) IsBlocked(ctx context.Context, hash string) (bool, error) {
+	var blocked bool
+	err := r.do(func(t *memoryTables) error {
+		_, blocked = t.iconBlocklist[hash]
+		return nil
+	})
+	return blocked, err
+}
+
+func (r memoryIconRepository) PutBlocklist(ctx context.Context, entry IconBlocklistModel) error {
+	return r.do(func(t *memoryTables) error {
+		if existing, ok := t.iconBlocklist[entry.Hash]; ok {
+			existing.Reason = entry.Reason
+			entry = existing
+		}
+		t.iconBlocklist[entry.Hash] = entry
+		return nil
+	})
+}
+
+func (r memoryIconRepository) DeleteBlocklist(ctx context.Context, hash string) (int64, error) {
+	var n int64
+	err := r.do(func(t *memoryTables) error {
+		if _, ok := t.iconBlocklist[hash]; ok {
+			delete(t.iconBlocklist, hash)
+			n = 1
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (r memoryIconRepository) GetImage(ctx context.Context, key string) ([]byte, error) {
+	var image []byte
+	err := r.do(func(t *memoryTables) error {
+		v, ok := t.iconImages[key]
+		if !ok {
+			return sql.ErrNoRows
+		}
+		image = v
+		return nil
+	})
+	return image, err
+}
+
+func (r memoryIconRepository) PutImage(ctx context.Context, key string, image []byte) error {
+	return r.do(func(t *memoryTables) error {
+		t.iconImages[key] = slices.Clone(image)
+		return nil
+	})
+}
+
+func (r memoryIconRepository) DeleteImage(ctx context.Context, key string) error {
+	return r.do(func(t *memoryTables) error {
+		delete(t.iconImages, key)
+		return nil
+	})
+}
+
+type memoryLivestreamRepository struct {
+	do func(fn func(*memoryTables) error) error
+}
+
+func (r memoryLivestreamRepository) Create(ctx context.Context, livestream LivestreamModel) (int64, error) {
+	err := r.do(func(t *memoryTables) error {
+		livestream.ID = t.nextID("livestreams")
+		t.livestreams = append(t.livestreams, livestream)
+		return nil
+	})
+	return livestream.ID, err
+}
+
+func (r memoryLivestreamRepository) Get(ctx context.Context, id int64) (LivestreamModel, error) {
+	var livestream LivestreamModel
+	err := r.do(func(t *memoryTables) (err error) {
+		livestream, err = findRow(t.livestreams, func(l LivestreamModel) bool { return l.ID == id })
+		return err
+	})
+	return livestream, err
+}
+
+func (r memoryLivestreamRepository) ListByIDs(ctx context.Context, ids []int64) ([]LivestreamModel, error) {
+	var livestreams []LivestreamModel
+	err := r.do(func(t *memoryTables) error {
+		livestreams = filterRows(t.livestreams, func(l LivestreamModel) bool { return slices.Contains(ids, l.ID) })
+		return nil
+	})
+	return livestreams, err
+}
+
+func (r memoryLivestreamRepository) List(ctx context.Context, limit int) ([]*LivestreamModel, error) {
+	var livestreams []*LivestreamModel
+	err := r.do(func(t *memoryTables) error {
+		rows := slices.Clone(t.livestreams)
+		slices.Reverse(rows)
+		livestreams = rowPointers(limitRows(rows, limit))
+		return nil
+	})
+	return livestreams, err
+}
+
+func (r memoryLivestreamRepository) ListByUser(ctx context.Context, userID int64) ([]*LivestreamModel, error) {
+	var livestreams []*LivestreamModel
+	err := r.do(func(t *memoryTables) error {
+		livestreams = rowPointers(filterRows(t.livestreams, func(l LivestreamModel) bool { return l.UserID == userID }))
+		return nil
+	})
+	return livestreams, err
+}
+
+func (r memoryLivestreamRepository) AddTag(ctx context.Context, livestreamID int64, tagID int64) error {
+	return r.do(func(t *memoryTables) error {
+		t.livestreamTags = append(t.livestreamTags, LivestreamTagModel{
+			ID:           t.nextID("livestream_tags"),
+			LivestreamID: livestreamID,
+			TagID:        tagID,
+		})
+		return nil
+	})
+}
+
+func (r memoryLivestreamRepository) ListTags(ctx context.Context, livestreamID int64) ([]*LivestreamTagModel, error) {
+	var tags []*LivestreamTagModel
+	err := r.do(func(t *memoryTables) error {
+		tags = rowPointers(filterRows(t.livestreamTags, func(l LivestreamTagModel) bool { return l.LivestreamID == livestreamID }))
+		return nil
+	})
+	return tags, err
+}
+
+func (r memoryLivestreamRepository) ListTagged(ctx context.Context, tagIDs []int64) ([]*LivestreamTagModel, error) {
+	var tags []*LivestreamTagModel
+	err := r.do(func(t *memoryTables) error {
+		rows := filterRows(t.livestreamTags, func(l LivestreamTagModel) bool { return slices.Contains(tagIDs, l.TagID) })
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].LivestreamID > rows[j].LivestreamID })
+		tags = rowPointers(rows)
+		return nil
+	})
+	return tags, err
+}
+
+func (r memoryLivestreamRepository) AddViewer(ctx context.Context, viewer LivestreamViewerModel) error {
+	return r.do(func(t *memoryTables) error {
+		t.viewers = append(t.viewers, viewer)
+		return nil
+	})
+}
+
+func (r memoryLivestreamRepository) RemoveViewer(ctx context.Context, userID int64, livestreamID int64) error {
+	return r.do(func(t *memoryTables) error {
+		t.viewers = deleteRows(t.viewers, func(v LivestreamViewerModel) bool {
+			return v.UserID == userID && v.LivestreamID == livestreamID
+		})
+		return nil
+	})
+}
+
+func (r memoryLivestreamRepository) CountViewers(ctx context.Context, livestreamID int64) (int64, error) {
+	var count int64
+	err := r.do(func(t *memoryTables) error {
+		count = int64(len(filterRows(t.viewers, func(v LivestreamViewerModel) bool { return v.LivestreamID == livestreamID })))
+		return nil
+	})
+	return count, err
+}
+
+func (r memoryLivestreamRepository) AddModerator(ctx context.Context, moderator LivestreamModeratorModel) error {
+	return r.do(func(t *memoryTables) error {
+		if _, err := findRow(t.moderators, func(m LivestreamModeratorModel) bool {
+			return m.LivestreamID == moderator.LivestreamID && m.UserID == moderator.UserID
+		}); err == nil {
+			return errDuplicateEntry
+		}
+		moderator.ID = t.nextID("livestream_moderators")
+		t.moderators = append(t.moderators, moderator)
+		return nil
+	})
+}
+
+func (r memoryLivestreamRepository) RemoveModerator(ctx context.Context, livestreamID int64, username string) error {
+	return r.do(func(t *memoryTables) error {
+		user, err := findRow(t.users, func(u UserModel) bool { return u.Name == username })
+		if err != nil {
+			return nil
+		}
+		t.moderators = deleteRows(t.moderators, func(m LivestreamModeratorModel) bool {
+			return m.LivestreamID == livestreamID && m.UserID == user.ID
+		})
+		return nil
+	})
+}
+
+func (r memoryLivestreamRepository) IsModerator(ctx context.Context, livestreamID int64, userID int64) (bool, error) {
+	var found bool
+	err := r.do(func(t *memoryTables) error {
+		_, err := findRow(t.moderators, func(m LivestreamModeratorModel) bool {
+			return m.LivestreamID == livestreamID && m.UserID == userID
+		})
+		found = err == nil
+		return nil
+	})
+	return found, err
+}
+
+func (r memoryLivestreamRepository) ListModerators(ctx context.Context, livestreamID int64) ([]*LivestreamModeratorModel, error) {
+	var moderators []*LivestreamModeratorModel
+	err := r.do(func(t *memoryTables) error {
+		moderators = rowPointers(filterRows(t.moderators, func(m LivestreamModeratorModel) bool { return m.LivestreamID == livestreamID }))
+		return nil
+	})
+	return moderators, err
+}
+
+type memoryLivecommentRepository struct {
+	do func(fn func(*memoryTables) error) error
+}
+
+func (r memoryLivecommentRepository) Create(ctx context.Context, livecomment LivecommentModel) (int64, error) {
+	err := r.do(func(t *memoryTables) error {
+		livecomment.ID = t.nextID("livecomments")
+		t.livecomments = append(t.livecomments, livecomment)
+		return nil
+	})
+	return livecomment.ID, err
+}
+
+func (r memoryLivecommentRepository) Get(ctx context.Context, id int64) (LivecommentModel, error) {
+	var livecomment LivecommentModel
+	err := r.do(func(t *memoryTables) (err error) {
+		livecomment, err = findRow(t.livecomments, func(l LivecommentModel) bool { return l.ID == id })
+		return err
+	})
+	return livecomment, err
+}
+
+func (r memoryLivecommentRepository) ListByLivestream(ctx context.Context, livestreamID int64, limit int, hiddenUserIDs []int64) ([]LivecommentModel, error) {
+	livecomments := []LivecommentModel{}
+	err := r.do(func(t *memoryTables) error {
+		rows := filterRows(t.livecomments, func(l LivecommentModel) bool {
+			return l.LivestreamID == livestreamID && !slices.Contains(hiddenUserIDs, l.UserID)
+		})
+		slices.Reverse(rows)
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].CreatedAt > rows[j].CreatedAt })
+		livecomments = append(livecomments, limitRows(rows, limit)...)
+		return nil
+	})
+	return livecomments, err
+}
+
+func (r memoryLivecommentRepository) ListByUser(ctx context.Context, userID int64) ([]LivecommentModel, error) {
+	var livecomments []LivecommentModel
+	err := r.do(func(t *memoryTables) error {
+		livecomments = filterRows(t.livecomments, func(l LivecommentModel) bool { return l.UserID == userID })
+		return nil
+	})
+	return livecomments, err
+}
+
+func (r memoryLivecommentRepository) DeleteContaining(ctx context.Context, livestreamID int64, word string) error {
+	return r.do(func(t *memoryTables) error {
+		t.livecomments = deleteRows(t.livecomments, func(l LivecommentModel) bool {
+			return l.LivestreamID == livestreamID && containsFold(l.Comment, word)
+		})
+		return nil
+	})
+}
+
+func (r memoryLivecommentRepository) TotalTip(ctx context.Context) (int64, error) {
+	var totalTip int64
+	err := r.do(func(t *memoryTables) error {
+		for _, l := range t.livecomments {
+			totalTip += l.Tip
+		}
+		return nil
+	})
+	return totalTip, err
+}
+
+func (r memoryLivecommentRepository) SumTipsByStreamer(ctx context.Context) (map[int64]int64, error) {
+	tips := make(map[int64]int64)
+	err := r.do(func(t *memoryTables) error {
+		for _, l := range t.livecomments {
+			if livestream, err := findRow(t.livestreams, func(ls LivestreamModel) bool { return ls.ID == l.LivestreamID }); err == nil {
+				tips[livestream.UserID] += l.Tip
+			}
+		}
+		return nil
+	})
+	return tips, err
+}
+
+func (r memoryLivecommentRepository) SumTipsByLivestream(ctx context.Context, livestreamID int64) (int64, error) {
+	var totalTips int64
+	err := r.do(func(t *memoryTables) error {
+		for _, l := range filterRows(t.livecomments, func(l LivecommentModel) bool { return l.LivestreamID == livestreamID }) {
+			totalTips += l.Tip
+		}
+		return nil
+	})
+	return totalTips, err
+}
+
+func (r memoryLivecommentRepository) MaxTipByLivestream(ctx context.Context, livestreamID int64) (int64, error) {
+	var maxTip int64
+	err := r.do(func(t *memoryTables) error {
+		for _, l := range filterRows(t.livecomments, func(l LivecommentModel) bool { return l.LivestreamID == livestreamID }) {
+			maxTip = max(maxTip, l.Tip)
+		}
+		return nil
+	})
+	return maxTip, err
+}
+
+type memoryReactionRepository struct {
+	do func(fn func(*memoryTables) error) error
+}
+
+func (r memoryReactionRepository) Create(ctx context.Context, reaction ReactionModel) (int64, error) {
+	err := r.do(func(t *memoryTables) error {
+		reaction.ID = t.nextID("reactions")
+		t.reactions = append(t.reactions, reaction)
+		return nil
+	})
+	return reaction.ID, err
+}
+
+func (r memoryReactionRepository) ListByLivestream(ctx context.Context, livestreamID int64, limit int) ([]ReactionModel, error) {
+	reactions := []ReactionModel{}
+	err := r.do(func(t *memoryTables) error {
+		rows := filterRows(t.reactions, func(r ReactionModel) bool { return r.LivestreamID == livestreamID })
+		slices.Reverse(rows)
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].CreatedAt > rows[j].CreatedAt })
+		reactions = append(reactions, limitRows(rows, limit)...)
+		return nil
+	})
+	return reactions, err
+}
+
+func (r memoryReactionRepository) ListByUser(ctx context.Context, userID int64) ([]ReactionModel, error) {
+	var reactions []ReactionModel
+	err := r.do(func(t *memoryTables) error {
+		reactions = filterRows(t.reactions, func(r ReactionModel) bool { return r.UserID == userID })
+		return nil
+	})
+	return reactions, err
+}
+
+// 配信者ごとに受け取ったリアクションを集める
+func (t *memoryTables) reactionsByStreamer() map[int64][]ReactionModel {
+	owners := make(map[int64]int64, len(t.livestreams))
+	for _, l := range t.livestreams {
+		owners[l.ID] = l.UserID
+	}
+	reactions := make(map[int64][]ReactionModel)
+	for _, r := range t.reactions {
+		if userID, ok := owners[r.LivestreamID]; ok {
+			reactions[userID] = append(reactions[userID], r)
+		}
+	}
+	return reactions
+}
+
+func (r memoryReactionRepository) CountByStreamer(ctx context.Context) (map[int64]int64, error) {
+	counts := make(map[int64]int64)
+	err := r.do(func(t *memoryTables) error {
+		for userID, reactions := range t.reactionsByStreamer() {
+			counts[userID] = int64(len(reactions))
+		}
+		return nil
+	})
+	return counts, err
+}
+
+func (r memoryReactionRepository) CountByStreamerName(ctx context.Context, name string) (int64, error) {
+	var count int64
+	err := r.do(func(t *memoryTables) error {
+		user, err := findRow(t.users, func(u UserModel) bool { return u.Name == name })
+		if err != nil {
+			return nil
+		}
+		count = int64(len(t.reactionsByStreamer()[user.ID]))
+		return nil
+	})
+	return count, err
+}
+
+func (r memoryReactionRepository) CountByLivestream(ctx context.Context, livestreamID int64) (int64, error) {
+	var count int64
+	err := r.do(func(t *memoryTables) error {
+		count = int64(len(filterRows(t.reactions, func(r ReactionModel) bool { return r.LivestreamID == livestreamID })))
+		return nil
+	})
+	return count, err
+}
+
+func (r memoryReactionRepository) FavoriteEmojiByStreamerName(ctx context.Context, name string) (string, error) {
+	var favorite string
+	err := r.do(func(t *memoryTables) error {
+		user, err := findRow(t.users, func(u UserModel) bool { return u.Name == name })
+		if err != nil {
+			return sql.ErrNoRows
+		}
+		counts := make(map[string]int)
+		for _, r := range t.reactionsByStreamer()[user.ID] {
+			counts[r.EmojiName]++
+		}
+		if len(counts) == 0 {
+			return sql.ErrNoRows
+		}
+		// 数が同じなら名前の降順で先のもの
+		for emojiName, count := range counts {
+			if favorite == "" || count > counts[favorite] || (count == counts[favorite] && emojiName > favorite) {
+				favorite = emojiName
+			}
+		}
+		return nil
+	})
+	return favorite, err
+}
+
+type memoryReportRepository struct {
+	do func(fn func(*memoryTables) error) error
+}
+
+func (r memoryReportRepository) Create(ctx context.Context, report LivecommentReportModel) (int64, error) {
+	err := r.do(func(t *memoryTables) error {
+		report.ID = t.nextID("livecomment_reports")
+		t.reports = append(t.reports, report)
+		return nil
+	})
+	return report.ID, err
+}
+
+func (r memoryReportRepository) ListByLivestream(ctx context.Context, livestreamID int64) ([]*LivecommentReportModel, error) {
+	var reports []*LivecommentReportModel
+	err := r.do(func(t *memoryTables) error {
+		reports = rowPointers(filterRows(t.reports, func(r LivecommentReportModel) bool { return r.LivestreamID == livestreamID }))
+		return nil
+	})
+	return reports, err
+}
+
+func (r memoryReportRepository) ListByUser(ctx context.Context, userID int64) ([]LivecommentReportModel, error) {
+	var reports []LivecommentReportModel
+	err := r.do(func(t *memoryTables) error {
+		reports = filterRows(t.reports, func(r LivecommentReportModel) bool { return r.UserID == userID })
+		return nil
+	})
+	return reports, err
+}
+
+func (r memoryReportRepository) CountByLivestream(ctx context.Context, livestreamID int64) (int64, error) {
+	var count int64
+	err := r.do(func(t *memoryTables) error {
+		count = int64(len(filterRows(t.reports, func(r LivecommentReportModel) bool { return r.LivestreamID == livestreamID })))
+		return nil
+	})
+	return count, err
+}
+
+type memoryNGWordRepository struct {
+	do func(fn func(*memoryTables) error) error
+}
+
+func (r memoryNGWordRepository) Create(ctx context.Context, ngWord NGWord) (int64, error) {
+	err := r.do(func(t *memoryTables) error {
+		ngWord.ID = t.nextID("ng_words")
+		t.ngWords = append(t.ngWords, ngWord)
+		return nil
+	})
+	return ngWord.ID, err
+}
+
+func (r memoryNGWordRepository) ListByLivestream(ctx context.Context, userID int64, livestreamID int64) ([]*NGWord, error) {
+	var ngWords []*NGWord
+	err := r.do(func(t *memoryTables) error {
+		rows := filterRows(t.ngWords, func(w NGWord) bool { return w.UserID == userID && w.LivestreamID == livestreamID })
+		slices.Reverse(rows)
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].CreatedAt > rows[j].CreatedAt })
+		ngWords = rowPointers(rows)
+		return nil
+	})
+	return ngWords, err
+}
+
+func (r memoryNGWordRepository) Matches(ctx context.Context, comment string, word string) (bool, error) {
+	return containsFold(comment, word), nil
+}
+
+type memoryTagRepository struct {
+	do func(fn func(*memoryTables) error) error
+}
+
+func (r memoryTagRepository) Create(ctx context.Context, name string) (int64, error) {
+	var id int64
+	err := r.do(func(t *memoryTables) error {
+		if _, err := findRow(t.tags, func(tag TagModel) bool { return tag.Name == name }); err == nil {
+			return errDuplicateEntry
+		}
+		id = t.nextID("tags")
+		t.tags = append(t.tags, TagModel{ID: id, Name: name})
+		return nil
+	})
+	return id, err
+}
+
+func (r memoryTagRepository) Get(ctx context.Context, id int64) (TagModel, error) {
+	var tag TagModel
+	err := r.do(func(t *memoryTables) (err error) {
+		tag, err = findRow(t.tags, func(tag TagModel) bool { return tag.ID == id })
+		return err
+	})
+	return tag, err
+}
+
+func (r memoryTagRepository) List(ctx context.Context) ([]*TagModel, error) {
+	var tags []*TagModel
+	err := r.do(func(t *memoryTables) error {
+		tags = rowPointers(slices.Clone(t.tags))
+		return nil
+	})
+	return tags, err
+}
+
+type memorySlotRepository struct {
+	do func(fn func(*memoryTables) error) error
+}
+
+func (r memorySlotRepository) ListForUpdate(ctx context.Context, startAt int64, endAt int64) ([]*ReservationSlotModel, error) {
+	var slots []*ReservationSlotModel
+	err := r.do(func(t *memoryTables) error {
+		slots = rowPointers(filterRows(t.slots, func(s ReservationSlotModel) bool { return s.StartAt >= startAt && s.EndAt <= endAt }))
+		return nil
+	})
+	return slots, err
+}
+
+func (r memorySlotRepository) Remaining(ctx context.Context, startAt int64, endAt int64) (int64, error) {
+	var remaining int64
+	err := r.do(func(t *memoryTables) error {
+		slot, err := findRow(t.slots, func(s ReservationSlotModel) bool { return s.StartAt == startAt && s.EndAt == endAt })
+		remaining = slot.Slot
+		return err
+	})
+	return remaining, err
+}
+
+func (r memorySlotRepository) Reserve(ctx context.Context, startAt int64, endAt int64) error {
+	return r.addSlots(startAt, endAt, -1)
+}
+
+func (r memorySlotRepository) Refund(ctx context.Context, startAt int64, endAt int64) error {
+	return r.addSlots(startAt, endAt, 1)
+}
+
+func (r memorySlotRepository) addSlots(startAt int64, endAt int64, delta int64) error {
+	return r.do(func(t *memoryTables) error {
+		for i := range t.slots {
+			if t.slots[i].StartAt >= startAt && t.slots[i].EndAt <= endAt {
+				t.slots[i].Slot += delta
+			}
+		}
+		return nil
+	})
+}
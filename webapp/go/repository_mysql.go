@@ -0,0 +1,863 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// queryer は *sqlx.DB と *sqlx.Tx の共通部分です。
+// リポジトリはこれだけを通してクエリを発行するので、計測などはここを包めばよい
+type queryer interface {
+	GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error)
+}
+
+// MySQLに読み書きするStore
+// 書き込みは db (プライマリ) で、読み取り専用のトランザクションは replicas のレプリカで行う
+type mysqlStore struct {
+	mysqlRepositories
+	db       *sqlx.DB
+	replicas *ReplicaPool
+}
+
+func newMySQLStore(db *sqlx.DB, replicas *ReplicaPool) *mysqlStore {
+	return &mysqlStore{
+		mysqlRepositories: mysqlRepositories{q: instrumentedQueryer{q: db}},
+		db:                db,
+		replicas:          replicas,
+	}
+}
+
+func (s *mysqlStore) BeginTx(ctx context.Context) (Tx, error) {
+	ctx, span := startSpan(ctx, "db.transaction", trace.SpanKindInternal, attribute.String("db.system", "mysql"))
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		recordSpanError(span, err)
+		span.End()
+		return nil, err
+	}
+	return newMySQLTx(tx, span), nil
+}
+
+func (s *mysqlStore) BeginReadTx(ctx context.Context) (Tx, error) {
+	ctx, span := startSpan(ctx, "db.transaction", trace.SpanKindInternal, attribute.String("db.system", "mysql"), attribute.Bool("db.transaction.read_only", true))
+	tx, err := s.replicas.readDB(ctx, s.db).BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		recordSpanError(span, err)
+		span.End()
+		return nil, err
+	}
+	return newMySQLTx(tx, span), nil
+}
+
+// トランザクションの中のクエリは、トランザクションのspanの子にする
+type mysqlTx struct {
+	mysqlRepositories
+	tx   *sqlx.Tx
+	span trace.Span
+}
+
+func newMySQLTx(tx *sqlx.Tx, span trace.Span) *mysqlTx {
+	return &mysqlTx{
+		mysqlRepositories: mysqlRepositories{q: instrumentedQueryer{q: tx, parent: span}},
+		tx:                tx,
+		span:              span,
+	}
+}
+
+func (t *mysqlTx) Commit() error {
+	err := t.tx.Commit()
+	t.span.SetAttributes(attribute.String("db.transaction.outcome", "commit"))
+	recordSpanError(t.span, err)
+	t.span.End()
+	return err
+}
+
+// Commitの後に defer で呼ばれたときは何もしない
+func (t *mysqlTx) Rollback() error {
+	err := t.tx.Rollback()
+	if !errors.Is(err, sql.ErrTxDone) {
+		t.span.SetAttributes(attribute.String("db.transaction.outcome", "rollback"))
+		recordSpanError(t.span, err)
+		t.span.End()
+	}
+	return err
+}
+
+// クエリごとに時間を計測し、spanを作るqueryer
+// 指標とspanはクエリ名ごとに分けるので、リポジトリのメソッドで named を通して使う
+type instrumentedQueryer struct {
+	q      queryer
+	parent trace.Span
+	name   string
+}
+
+// name (UserRepository.GetByName など) をクエリ名にする
+func (q instrumentedQueryer) named(name string) instrumentedQueryer {
+	q.name = name
+	return q
+}
+
+func (q instrumentedQueryer) GetContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	done, err := q.observe(ctx, query)
+	if err != nil {
+		return err
+	}
+	err = q.q.GetContext(ctx, dest, query, args...)
+	done(err)
+	return err
+}
+
+func (q instrumentedQueryer) SelectContext(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	done, err := q.observe(ctx, query)
+	if err != nil {
+		return err
+	}
+	err = q.q.SelectContext(ctx, dest, query, args...)
+	done(err)
+	return err
+}
+
+func (q instrumentedQueryer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	done, err := q.observe(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := q.q.ExecContext(ctx, query, args...)
+	done(err)
+	return rs, err
+}
+
+func (q instrumentedQueryer) NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error) {
+	done, err := q.observe(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := q.q.NamedExecContext(ctx, query, arg)
+	done(err)
+	return rs, err
+}
+
+// クエリを始めるときに呼び、返した関数をクエリの結果で呼ぶ
+// 見つからなかった (sql.ErrNoRows) のは失敗として数えない
+// リクエストのクエリ数の上限を超えていて止める設定なら、クエリを実行させずにエラーを返す
+func (q instrumentedQueryer) observe(ctx context.Context, query string) (func(error), error) {
+	stats := queryStatsFromContext(ctx)
+	if stats != nil {
+		if err := stats.begin(query); err != nil {
+			return nil, err
+		}
+	}
+	start := time.Now()
+	name := q.name
+	if name == "" {
+		name = "unknown"
+	}
+	if q.parent != nil {
+		ctx = trace.ContextWithSpan(ctx, q.parent)
+	}
+	_, span := startSpan(ctx, name, trace.SpanKindClient, attribute.String("db.system", "mysql"), attribute.String("db.statement", query))
+
+	return func(err error) {
+		elapsed := time.Since(start)
+		sqlQueryDuration.Observe(elapsed.Seconds(), name)
+		if stats != nil {
+			stats.finish(elapsed)
+		}
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			sqlQueryErrorsTotal.Inc(name)
+			recordSpanError(span, err)
+		}
+		span.End()
+	}, nil
+}
+
+type mysqlRepositories struct {
+	q instrumentedQueryer
+}
+
+func (r mysqlRepositories) Users() UserRepository               { return mysqlUserRepository(r) }
+func (r mysqlRepositories) Icons() IconRepository               { return mysqlIconRepository(r) }
+func (r mysqlRepositories) Livestreams() LivestreamRepository   { return mysqlLivestreamRepository(r) }
+func (r mysqlRepositories) Livecomments() LivecommentRepository { return mysqlLivecommentRepository(r) }
+func (r mysqlRepositories) Reactions() ReactionRepository       { return mysqlReactionRepository(r) }
+func (r mysqlRepositories) Reports() ReportRepository           { return mysqlReportRepository(r) }
+func (r mysqlRepositories) NGWords() NGWordRepository           { return mysqlNGWordRepository(r) }
+func (r mysqlRepositories) Tags() TagRepository                 { return mysqlTagRepository(r) }
+func (r mysqlRepositories) Slots() SlotRepository               { return mysqlSlotRepository(r) }
+
+// INSERTしてAUTO_INCREMENTのIDを返す
+func insertNamed(ctx context.Context, q queryer, query string, arg interface{}) (int64, error) {
+	rs, err := q.NamedExecContext(ctx, query, arg)
+	if err != nil {
+		return 0, err
+	}
+	return rs.LastInsertId()
+}
+
+// limitが0なら付けない
+func withLimit(query string, limit int) string {
+	if limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", limit)
+	}
+	return query
+}
+
+type mysqlUserRepository struct {
+	q instrumentedQueryer
+}
+
+func (r mysqlUserRepository) Create(ctx context.Context, user UserModel) (int64, error) {
+	return insertNamed(ctx, r.q.named("UserRepository.Create"), "INSERT INTO users (name, display_name, description, password) VALUES(:name, :display_name, :description, :password)", user)
+}
+
+func (r mysqlUserRepository) Get(ctx context.Context, id int64) (UserModel, error) {
+	var user UserModel
+	err := r.q.named("UserRepository.Get").GetContext(ctx, &user, "SELECT * FROM users WHERE id = ?", id)
+	return user, err
+}
+
+func (r mysqlUserRepository) GetForUpdate(ctx context.Context, id int64) (UserModel, error) {
+	var user UserModel
+	err := r.q.named("UserRepository.GetForUpdate").GetContext(ctx, &user, "SELECT * FROM users WHERE id = ? FOR UPDATE", id)
+	return user, err
+}
+
+func (r mysqlUserRepository) GetByName(ctx context.Context, name string) (UserModel, error) {
+	var user UserModel
+	err := r.q.named("UserRepository.GetByName").GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", name)
+	return user, err
+}
+
+func (r mysqlUserRepository) CountByName(ctx context.Context, name string) (int, error) {
+	var count int
+	err := r.q.named("UserRepository.CountByName").GetContext(ctx, &count, "SELECT COUNT(*) FROM users WHERE name = ?", name)
+	return count, err
+}
+
+func (r mysqlUserRepository) List(ctx context.Context) ([]*UserModel, error) {
+	var users []*UserModel
+	err := r.q.named("UserRepository.List").SelectContext(ctx, &users, "SELECT * FROM users")
+	return users, err
+}
+
+func (r mysqlUserRepository) ListByIDs(ctx context.Context, ids []int64) ([]UserModel, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	query, args, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", ids)
+	if err != nil {
+		return nil, err
+	}
+	var users []UserModel
+	err = r.q.named("UserRepository.ListByIDs").SelectContext(ctx, &users, query, args...)
+	return users, err
+}
+
+func (r mysqlUserRepository) ListNames(ctx context.Context) ([]string, error) {
+	var names []string
+	err := r.q.named("UserRepository.ListNames").SelectContext(ctx, &names, "SELECT name FROM users")
+	return names, err
+}
+
+func (r mysqlUserRepository) Delete(ctx context.Context, user UserModel, livestreamIDs []int64) error {
+	// 配信者として持っている配信と、そこに付いたもの
+	if len(livestreamIDs) > 0 {
+		for _, table := range []string{"livestream_tags", "livestream_moderators", "livecomment_reports", "ng_words", "reactions", "livecomments", "livestream_viewers_history"} {
+			query, params, err := sqlx.In("DELETE FROM "+table+" WHERE livestream_id IN (?)", livestreamIDs)
+			if err != nil {
+				return fmt.Errorf("failed to construct IN query: %w", err)
+			}
+			if _, err := r.q.named("UserRepository.Delete").ExecContext(ctx, query, params...); err != nil {
+				return fmt.Errorf("failed to delete %s: %w", table, err)
+			}
+		}
+		if _, err := r.q.named("UserRepository.Delete").ExecContext(ctx, "DELETE FROM livestreams WHERE user_id = ?", user.ID); err != nil {
+			return fmt.Errorf("failed to delete livestreams: %w", err)
+		}
+	}
+
+	// 視聴者として他の配信に残したもの
+	// 自分のコメントに対する報告は、コメントと一緒に消す
+	if _, err := r.q.named("UserRepository.Delete").ExecContext(ctx, "DELETE r FROM livecomment_reports r INNER JOIN livecomments l ON l.id = r.livecomment_id WHERE l.user_id = ?", user.ID); err != nil {
+		return fmt.Errorf("failed to delete livecomment_reports: %w", err)
+	}
+	for _, table := range []string{"livecomment_reports", "ng_words", "reactions", "livecomments", "livestream_viewers_history", "livestream_moderators", "user_roles", "user_suspensions", "user_exports", "icons", "themes"} {
+		if _, err := r.q.named("UserRepository.Delete").ExecContext(ctx, "DELETE FROM "+table+" WHERE user_id = ?", user.ID); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", table, err)
+		}
+	}
+
+	if _, err := r.q.named("UserRepository.Delete").ExecContext(ctx, "DELETE FROM users WHERE id = ?", user.ID); err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+
+	return nil
+}
+
+func (r mysqlUserRepository) CreateTheme(ctx context.Context, theme ThemeModel) error {
+	_, err := r.q.named("UserRepository.CreateTheme").NamedExecContext(ctx, "INSERT INTO themes (user_id, dark_mode) VALUES(:user_id, :dark_mode)", theme)
+	return err
+}
+
+func (r mysqlUserRepository) GetTheme(ctx context.Context, userID int64) (ThemeModel, error) {
+	var theme ThemeModel
+	err := r.q.named("UserRepository.GetTheme").GetContext(ctx, &theme, "SELECT * FROM themes WHERE user_id = ?", userID)
+	return theme, err
+}
+
+func (r mysqlUserRepository) GetRole(ctx context.Context, userID int64) (Role, error) {
+	var role Role
+	if err := r.q.named("UserRepository.GetRole").GetContext(ctx, &role, "SELECT role FROM user_roles WHERE user_id = ?", userID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return RoleUser, nil
+		}
+		return "", err
+	}
+	return role, nil
+}
+
+func (r mysqlUserRepository) SetRole(ctx context.Context, userID int64, role Role) error {
+	if role == RoleUser {
+		_, err := r.q.named("UserRepository.SetRole").ExecContext(ctx, "DELETE FROM user_roles WHERE user_id = ?", userID)
+		return err
+	}
+	_, err := r.q.named("UserRepository.SetRole").NamedExecContext(ctx, "INSERT INTO user_roles (user_id, role) VALUES (:user_id, :role) ON DUPLICATE KEY UPDATE role = VALUES(role)", &UserRoleModel{
+		UserID: userID,
+		Role:   role,
+	})
+	return err
+}
+
+func (r mysqlUserRepository) GetSuspension(ctx context.Context, userID int64) (UserSuspensionModel, error) {
+	var suspension UserSuspensionModel
+	err := r.q.named("UserRepository.GetSuspension").GetContext(ctx, &suspension, "SELECT * FROM user_suspensions WHERE user_id = ?", userID)
+	return suspension, err
+}
+
+func (r mysqlUserRepository) ListSuspensions(ctx context.Context) ([]*UserSuspensionModel, error) {
+	var suspensions []*UserSuspensionModel
+	err := r.q.named("UserRepository.ListSuspensions").SelectContext(ctx, &suspensions, "SELECT * FROM user_suspensions")
+	return suspensions, err
+}
+
+func (r mysqlUserRepository) PutSuspension(ctx context.Context, suspension UserSuspensionModel) error {
+	_, err := r.q.named("UserRepository.PutSuspension").NamedExecContext(ctx, "INSERT INTO user_suspensions (user_id, reason, hide_livecomments, expires_at, created_at) VALUES (:user_id, :reason, :hide_livecomments, :expires_at, :created_at) ON DUPLICATE KEY UPDATE reason = VALUES(reason), hide_livecomments = VALUES(hide_livecomments), expires_at = VALUES(expires_at), created_at = VALUES(created_at)", suspension)
+	return err
+}
+
+func (r mysqlUserRepository) DeleteSuspension(ctx context.Context, userID int64) error {
+	_, err := r.q.named("UserRepository.DeleteSuspension").ExecContext(ctx, "DELETE FROM user_suspensions WHERE user_id = ?", userID)
+	return err
+}
+
+func (r mysqlUserRepository) GetExport(ctx context.Context, userID int64) (UserExportModel, error) {
+	var export UserExportModel
+	err := r.q.named("UserRepository.GetExport").GetContext(ctx, &export, "SELECT id, user_id, status, error, created_at, completed_at FROM user_exports WHERE user_id = ?", userID)
+	return export, err
+}
+
+func (r mysqlUserRepository) GetExportArchive(ctx context.Context, id string) ([]byte, error) {
+	var archive []byte
+	err := r.q.named("UserRepository.GetExportArchive").GetContext(ctx, &archive, "SELECT archive FROM user_exports WHERE id = ?", id)
+	return archive, err
+}
+
+func (r mysqlUserRepository) PutExport(ctx context.Context, export UserExportModel) error {
+	if export.Archive == nil {
+		export.Archive = []byte{}
+	}
+	_, err := r.q.named("UserRepository.PutExport").NamedExecContext(ctx, "INSERT INTO user_exports (user_id, id, status, archive, error, created_at, completed_at) VALUES (:user_id, :id, :status, :archive, :error, :created_at, :completed_at) ON DUPLICATE KEY UPDATE id = VALUES(id), status = VALUES(status), archive = VALUES(archive), error = VALUES(error), created_at = VALUES(created_at), completed_at = VALUES(completed_at)", export)
+	return err
+}
+
+func (r mysqlUserRepository) FinishExport(ctx context.Context, export UserExportModel) error {
+	if export.Archive == nil {
+		export.Archive = []byte{}
+	}
+	_, err := r.q.named("UserRepository.FinishExport").NamedExecContext(ctx, "UPDATE user_exports SET status = :status, archive = :archive, error = :error, completed_at = :completed_at WHERE user_id = :user_id AND id = :id", export)
+	return err
+}
+
+type mysqlIconRepository struct {
+	q instrumentedQueryer
+}
+
+func (r mysqlIconRepository) Create(ctx context.Context, userID int64, hash string, createdAt int64) (int64, error) {
+	rs, err := r.q.named("IconRepository.Create").ExecContext(ctx, "INSERT INTO icons (user_id, hash, image, created_at) VALUES (?, ?, '', ?)", userID, hash, createdAt)
+	if err != nil {
+		return 0, err
+	}
+	return rs.LastInsertId()
+}
+
+// 画像はハッシュで iconStore から引くので、ハッシュだけを複製する。image は Create と同じく空にする
+func (r mysqlIconRepository) Copy(ctx context.Context, id int64, createdAt int64) (int64, error) {
+	rs, err := r.q.named("IconRepository.Copy").ExecContext(ctx, "INSERT INTO icons (user_id, hash, image, created_at) SELECT user_id, hash, '', ? FROM icons WHERE id = ?", createdAt, id)
+	if err != nil {
+		return 0, err
+	}
+	return rs.LastInsertId()
+}
+
+func (r mysqlIconRepository) Delete(ctx context.Context, id int64) error {
+	_, err := r.q.named("IconRepository.Delete").ExecContext(ctx, "DELETE FROM icons WHERE id = ?", id)
+	return err
+}
+
+func (r mysqlIconRepository) GetByUser(ctx context.Context, id int64, userID int64) (IconModel, error) {
+	var icon IconModel
+	err := r.q.named("IconRepository.GetByUser").GetContext(ctx, &icon, "SELECT id, user_id, hash, created_at FROM icons WHERE id = ? AND user_id = ?", id, userID)
+	return icon, err
+}
+
+func (r mysqlIconRepository) GetCurrent(ctx context.Context, userID int64) (IconModel, error) {
+	var icon IconModel
+	err := r.q.named("IconRepository.GetCurrent").GetContext(ctx, &icon, "SELECT id, user_id, hash, created_at FROM icons WHERE user_id = ? ORDER BY id DESC LIMIT 1", userID)
+	return icon, err
+}
+
+func (r mysqlIconRepository) ListByUser(ctx context.Context, userID int64) ([]*IconModel, error) {
+	var icons []*IconModel
+	err := r.q.named("IconRepository.ListByUser").SelectContext(ctx, &icons, "SELECT id, user_id, hash, created_at FROM icons WHERE user_id = ? ORDER BY id DESC", userID)
+	return icons, err
+}
+
+func (r mysqlIconRepository) ListHashesByUser(ctx context.Context, userID int64) ([]string, error) {
+	var hashes []string
+	err := r.q.named("IconRepository.ListHashesByUser").SelectContext(ctx, &hashes, "SELECT hash FROM icons WHERE user_id = ?", userID)
+	return hashes, err
+}
+
+func (r mysqlIconRepository) ListHashes(ctx context.Context) ([]*iconHashRow, error) {
+	var rows []*iconHashRow
+	err := r.q.named("IconRepository.ListHashes").SelectContext(ctx, &rows, "SELECT i.user_id, u.name, i.hash FROM icons i INNER JOIN users u ON u.id = i.user_id WHERE i.hash != '' ORDER BY i.id")
+	return rows, err
+}
+
+func (r mysqlIconRepository) CountByHash(ctx context.Context, hash string) (int, error) {
+	var count int
+	err := r.q.named("IconRepository.CountByHash").GetContext(ctx, &count, "SELECT COUNT(*) FROM icons WHERE hash = ?", hash)
+	return count, err
+}
+
+func (r mysqlIconRepository) ListBlocklist(ctx context.Context) ([]IconBlocklistModel, error) {
+	blocklist := []IconBlocklistModel{}
+	err := r.q.named("IconRepository.ListBlocklist").SelectContext(ctx, &blocklist, "SELECT * FROM icon_blocklist ORDER BY created_at DESC")
+	return blocklist, err
+}
+
+func (r mysqlIconRepository) ListBlockedHashes(ctx context.Context) ([]string, error) {
+	var hashes []string
+	err := r.q.named("IconRepository.ListBlockedHashes").SelectContext(ctx, &hashes, "SELECT hash FROM icon_blocklist")
+	return hashes, err
+}
+
+func (r mysqlIconRepository) IsBlocked(ctx context.Context, hash string) (bool, error) {
+	var count int
+	if err := r.q.named("IconRepository.IsBlocked").GetContext(ctx, &count, "SELECT COUNT(*) FROM icon_blocklist WHERE hash = ?", hash); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (r mysqlIconRepository) PutBlocklist(ctx context.Context, entry IconBlocklistModel) error {
+	_, err := r.q.named("IconRepository.PutBlocklist").NamedExecContext(ctx, "INSERT INTO icon_blocklist (hash, reason, created_at) VALUES (:hash, :reason, :created_at) ON DUPLICATE KEY UPDATE reason = VALUES(reason)", entry)
+	return err
+}
+
+func (r mysqlIconRepository) DeleteBlocklist(ctx context.Context, hash string) (int64, error) {
+	rs, err := r.q.named("IconRepository.DeleteBlocklist").ExecContext(ctx, "DELETE FROM icon_blocklist WHERE hash = ?", hash)
+	if err != nil {
+		return 0, err
+	}
+	return rs.RowsAffected()
+}
+
+func (r mysqlIconRepository) GetImage(ctx context.Context, key string) ([]byte, error) {
+	var image []byte
+	err := r.q.named("IconRepository.GetImage").GetContext(ctx, &image, "SELECT image FROM icon_images WHERE `key` = ?", key)
+	return image, err
+}
+
+func (r mysqlIconRepository) PutImage(ctx context.Context, key string, image []byte) error {
+	_, err := r.q.named("IconRepository.PutImage").ExecContext(ctx, "INSERT INTO icon_images (`key`, image) VALUES (?, ?) ON DUPLICATE KEY UPDATE image = VALUES(image)", key, image)
+	return err
+}
+
+func (r mysqlIconRepository) DeleteImage(ctx context.Context, key string) error {
+	_, err := r.q.named("IconRepository.DeleteImage").ExecContext(ctx, "DELETE FROM icon_images WHERE `key` = ?", key)
+	return err
+}
+
+type mysqlLivestreamRepository struct {
+	q instrumentedQueryer
+}
+
+func (r mysqlLivestreamRepository) Create(ctx context.Context, livestream LivestreamModel) (int64, error) {
+	return insertNamed(ctx, r.q.named("LivestreamRepository.Create"), "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestream)
+}
+
+func (r mysqlLivestreamRepository) Get(ctx context.Context, id int64) (LivestreamModel, error) {
+	var livestream LivestreamModel
+	err := r.q.named("LivestreamRepository.Get").GetContext(ctx, &livestream, "SELECT * FROM livestreams WHERE id = ?", id)
+	return livestream, err
+}
+
+func (r mysqlLivestreamRepository) ListByIDs(ctx context.Context, ids []int64) ([]LivestreamModel, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	query, args, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", ids)
+	if err != nil {
+		return nil, err
+	}
+	var livestreams []LivestreamModel
+	err = r.q.named("LivestreamRepository.ListByIDs").SelectContext(ctx, &livestreams, query, args...)
+	return livestreams, err
+}
+
+func (r mysqlLivestreamRepository) List(ctx context.Context, limit int) ([]*LivestreamModel, error) {
+	var livestreams []*LivestreamModel
+	err := r.q.named("LivestreamRepository.List").SelectContext(ctx, &livestreams, withLimit("SELECT * FROM livestreams ORDER BY id DESC", limit))
+	return livestreams, err
+}
+
+func (r mysqlLivestreamRepository) ListByUser(ctx context.Context, userID int64) ([]*LivestreamModel, error) {
+	var livestreams []*LivestreamModel
+	err := r.q.named("LivestreamRepository.ListByUser").SelectContext(ctx, &livestreams, "SELECT * FROM livestreams WHERE user_id = ? ORDER BY id", userID)
+	return livestreams, err
+}
+
+func (r mysqlLivestreamRepository) AddTag(ctx context.Context, livestreamID int64, tagID int64) error {
+	_, err := r.q.named("LivestreamRepository.AddTag").NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", &LivestreamTagModel{
+		LivestreamID: livestreamID,
+		TagID:        tagID,
+	})
+	return err
+}
+
+func (r mysqlLivestreamRepository) ListTags(ctx context.Context, livestreamID int64) ([]*LivestreamTagModel, error) {
+	var tags []*LivestreamTagModel
+	err := r.q.named("LivestreamRepository.ListTags").SelectContext(ctx, &tags, "SELECT * FROM livestream_tags WHERE livestream_id = ?", livestreamID)
+	return tags, err
+}
+
+func (r mysqlLivestreamRepository) ListTagged(ctx context.Context, tagIDs []int64) ([]*LivestreamTagModel, error) {
+	if len(tagIDs) == 0 {
+		return nil, nil
+	}
+	query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE tag_id IN (?) ORDER BY livestream_id DESC", tagIDs)
+	if err != nil {
+		return nil, err
+	}
+	var tags []*LivestreamTagModel
+	err = r.q.named("LivestreamRepository.ListTagged").SelectContext(ctx, &tags, query, params...)
+	return tags, err
+}
+
+func (r mysqlLivestreamRepository) AddViewer(ctx context.Context, viewer LivestreamViewerModel) error {
+	_, err := r.q.named("LivestreamRepository.AddViewer").NamedExecContext(ctx, "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES(:user_id, :livestream_id, :created_at)", viewer)
+	return err
+}
+
+func (r mysqlLivestreamRepository) RemoveViewer(ctx context.Context, userID int64, livestreamID int64) error {
+	_, err := r.q.named("LivestreamRepository.RemoveViewer").ExecContext(ctx, "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", userID, livestreamID)
+	return err
+}
+
+func (r mysqlLivestreamRepository) CountViewers(ctx context.Context, livestreamID int64) (int64, error) {
+	var count int64
+	err := r.q.named("LivestreamRepository.CountViewers").GetContext(ctx, &count, "SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id = ?", livestreamID)
+	return count, err
+}
+
+func (r mysqlLivestreamRepository) AddModerator(ctx context.Context, moderator LivestreamModeratorModel) error {
+	_, err := r.q.named("LivestreamRepository.AddModerator").NamedExecContext(ctx, "INSERT INTO livestream_moderators (livestream_id, user_id, created_at) VALUES (:livestream_id, :user_id, :created_at)", moderator)
+	return err
+}
+
+func (r mysqlLivestreamRepository) RemoveModerator(ctx context.Context, livestreamID int64, username string) error {
+	_, err := r.q.named("LivestreamRepository.RemoveModerator").ExecContext(ctx, "DELETE m FROM livestream_moderators m INNER JOIN users u ON u.id = m.user_id WHERE m.livestream_id = ? AND u.name = ?", livestreamID, username)
+	return err
+}
+
+func (r mysqlLivestreamRepository) IsModerator(ctx context.Context, livestreamID int64, userID int64) (bool, error) {
+	var count int
+	if err := r.q.named("LivestreamRepository.IsModerator").GetContext(ctx, &count, "SELECT COUNT(*) FROM livestream_moderators WHERE livestream_id = ? AND user_id = ?", livestreamID, userID); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (r mysqlLivestreamRepository) ListModerators(ctx context.Context, livestreamID int64) ([]*LivestreamModeratorModel, error) {
+	var moderators []*LivestreamModeratorModel
+	err := r.q.named("LivestreamRepository.ListModerators").SelectContext(ctx, &moderators, "SELECT * FROM livestream_moderators WHERE livestream_id = ? ORDER BY id", livestreamID)
+	return moderators, err
+}
+
+type mysqlLivecommentRepository struct {
+	q instrumentedQueryer
+}
+
+func (r mysqlLivecommentRepository) Create(ctx context.Context, livecomment LivecommentModel) (int64, error) {
+	return insertNamed(ctx, r.q.named("LivecommentRepository.Create"), "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (:user_id, :livestream_id, :comment, :tip, :created_at)", livecomment)
+}
+
+func (r mysqlLivecommentRepository) Get(ctx context.Context, id int64) (LivecommentModel, error) {
+	var livecomment LivecommentModel
+	err := r.q.named("LivecommentRepository.Get").GetContext(ctx, &livecomment, "SELECT * FROM livecomments WHERE id = ?", id)
+	return livecomment, err
+}
+
+func (r mysqlLivecommentRepository) ListByLivestream(ctx context.Context, livestreamID int64, limit int, hiddenUserIDs []int64) ([]LivecommentModel, error) {
+	livecomments := []LivecommentModel{}
+	query, args := "SELECT * FROM livecomments WHERE livestream_id = ?", []interface{}{livestreamID}
+	if len(hiddenUserIDs) > 0 {
+		var err error
+		query, args, err = sqlx.In(query+" AND user_id NOT IN (?)", livestreamID, hiddenUserIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := r.q.named("LivecommentRepository.ListByLivestream").SelectContext(ctx, &livecomments, withLimit(query+" ORDER BY created_at DESC", limit), args...)
+	return livecomments, err
+}
+
+func (r mysqlLivecommentRepository) ListByUser(ctx context.Context, userID int64) ([]LivecommentModel, error) {
+	var livecomments []LivecommentModel
+	err := r.q.named("LivecommentRepository.ListByUser").SelectContext(ctx, &livecomments, "SELECT * FROM livecomments WHERE user_id = ? ORDER BY id", userID)
+	return livecomments, err
+}
+
+func (r mysqlLivecommentRepository) DeleteContaining(ctx context.Context, livestreamID int64, word string) error {
+	_, err := r.q.named("LivecommentRepository.DeleteContaining").ExecContext(ctx, "DELETE FROM livecomments WHERE livestream_id = ? AND comment LIKE ?", livestreamID, "%"+word+"%")
+	return err
+}
+
+func (r mysqlLivecommentRepository) TotalTip(ctx context.Context) (int64, error) {
+	var totalTip int64
+	err := r.q.named("LivecommentRepository.TotalTip").GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(tip), 0) FROM livecomments")
+	return totalTip, err
+}
+
+func (r mysqlLivecommentRepository) SumTipsByStreamer(ctx context.Context) (map[int64]int64, error) {
+	var rows []struct {
+		UserID int64 `db:"user_id"`
+		Tips   int64 `db:"tips"`
+	}
+	query := `
+SELECT u.id as user_id, IFNULL(SUM(lc.tip), 0) as tips FROM users u
+INNER JOIN livestreams l ON l.user_id = u.id
+INNER JOIN livecomments lc ON lc.livestream_id = l.id
+GROUP BY u.id`
+	if err := r.q.named("LivecommentRepository.SumTipsByStreamer").SelectContext(ctx, &rows, query); err != nil {
+		return nil, err
+	}
+	tips := make(map[int64]int64, len(rows))
+	for _, row := range rows {
+		tips[row.UserID] = row.Tips
+	}
+	return tips, nil
+}
+
+func (r mysqlLivecommentRepository) SumTipsByLivestream(ctx context.Context, livestreamID int64) (int64, error) {
+	var totalTips int64
+	err := r.q.named("LivecommentRepository.SumTipsByLivestream").GetContext(ctx, &totalTips, "SELECT IFNULL(SUM(l2.tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l.id = l2.livestream_id WHERE l.id = ?", livestreamID)
+	return totalTips, err
+}
+
+func (r mysqlLivecommentRepository) MaxTipByLivestream(ctx context.Context, livestreamID int64) (int64, error) {
+	var maxTip int64
+	err := r.q.named("LivecommentRepository.MaxTipByLivestream").GetContext(ctx, &maxTip, `SELECT IFNULL(MAX(tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l2.livestream_id = l.id WHERE l.id = ?`, livestreamID)
+	return maxTip, err
+}
+
+type mysqlReactionRepository struct {
+	q instrumentedQueryer
+}
+
+func (r mysqlReactionRepository) Create(ctx context.Context, reaction ReactionModel) (int64, error) {
+	return insertNamed(ctx, r.q.named("ReactionRepository.Create"), "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reaction)
+}
+
+func (r mysqlReactionRepository) ListByLivestream(ctx context.Context, livestreamID int64, limit int) ([]ReactionModel, error) {
+	reactions := []ReactionModel{}
+	err := r.q.named("ReactionRepository.ListByLivestream").SelectContext(ctx, &reactions, withLimit("SELECT * FROM reactions WHERE livestream_id = ? ORDER BY created_at DESC", limit), livestreamID)
+	return reactions, err
+}
+
+func (r mysqlReactionRepository) ListByUser(ctx context.Context, userID int64) ([]ReactionModel, error) {
+	var reactions []ReactionModel
+	err := r.q.named("ReactionRepository.ListByUser").SelectContext(ctx, &reactions, "SELECT * FROM reactions WHERE user_id = ? ORDER BY id", userID)
+	return reactions, err
+}
+
+func (r mysqlReactionRepository) CountByStreamer(ctx context.Context) (map[int64]int64, error) {
+	var rows []struct {
+		UserID    int64 `db:"user_id"`
+		Reactions int64 `db:"reactions"`
+	}
+	query := `
+SELECT u.id as user_id, COUNT(*) as reactions FROM users u
+INNER JOIN livestreams l ON l.user_id = u.id
+INNER JOIN reactions r ON r.livestream_id = l.id
+GROUP BY u.id`
+	if err := r.q.named("ReactionRepository.CountByStreamer").SelectContext(ctx, &rows, query); err != nil {
+		return nil, err
+	}
+	reactions := make(map[int64]int64, len(rows))
+	for _, row := range rows {
+		reactions[row.UserID] = row.Reactions
+	}
+	return reactions, nil
+}
+
+func (r mysqlReactionRepository) CountByStreamerName(ctx context.Context, name string) (int64, error) {
+	var count int64
+	query := `SELECT COUNT(*) FROM users u
+    INNER JOIN livestreams l ON l.user_id = u.id
+    INNER JOIN reactions r ON r.livestream_id = l.id
+    WHERE u.name = ?
+	`
+	err := r.q.named("ReactionRepository.CountByStreamerName").GetContext(ctx, &count, query, name)
+	return count, err
+}
+
+func (r mysqlReactionRepository) CountByLivestream(ctx context.Context, livestreamID int64) (int64, error) {
+	var count int64
+	err := r.q.named("ReactionRepository.CountByLivestream").GetContext(ctx, &count, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON l.id = r.livestream_id WHERE l.id = ?", livestreamID)
+	return count, err
+}
+
+func (r mysqlReactionRepository) FavoriteEmojiByStreamerName(ctx context.Context, name string) (string, error) {
+	var emojiName string
+	query := `
+	SELECT r.emoji_name
+	FROM users u
+	INNER JOIN livestreams l ON l.user_id = u.id
+	INNER JOIN reactions r ON r.livestream_id = l.id
+	WHERE u.name = ?
+	GROUP BY emoji_name
+	ORDER BY COUNT(*) DESC, emoji_name DESC
+	LIMIT 1
+	`
+	err := r.q.named("ReactionRepository.FavoriteEmojiByStreamerName").GetContext(ctx, &emojiName, query, name)
+	return emojiName, err
+}
+
+type mysqlReportRepository struct {
+	q instrumentedQueryer
+}
+
+func (r mysqlReportRepository) Create(ctx context.Context, report LivecommentReportModel) (int64, error) {
+	return insertNamed(ctx, r.q.named("ReportRepository.Create"), "INSERT INTO livecomment_reports(user_id, livestream_id, livecomment_id, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :created_at)", &report)
+}
+
+func (r mysqlReportRepository) ListByLivestream(ctx context.Context, livestreamID int64) ([]*LivecommentReportModel, error) {
+	var reports []*LivecommentReportModel
+	err := r.q.named("ReportRepository.ListByLivestream").SelectContext(ctx, &reports, "SELECT * FROM livecomment_reports WHERE livestream_id = ?", livestreamID)
+	return reports, err
+}
+
+func (r mysqlReportRepository) ListByUser(ctx context.Context, userID int64) ([]LivecommentReportModel, error) {
+	var reports []LivecommentReportModel
+	err := r.q.named("ReportRepository.ListByUser").SelectContext(ctx, &reports, "SELECT * FROM livecomment_reports WHERE user_id = ? ORDER BY id", userID)
+	return reports, err
+}
+
+func (r mysqlReportRepository) CountByLivestream(ctx context.Context, livestreamID int64) (int64, error) {
+	var count int64
+	err := r.q.named("ReportRepository.CountByLivestream").GetContext(ctx, &count, `SELECT COUNT(*) FROM livestreams l INNER JOIN livecomment_reports r ON r.livestream_id = l.id WHERE l.id = ?`, livestreamID)
+	return count, err
+}
+
+type mysqlNGWordRepository struct {
+	q instrumentedQueryer
+}
+
+func (r mysqlNGWordRepository) Create(ctx context.Context, ngWord NGWord) (int64, error) {
+	return insertNamed(ctx, r.q.named("NGWordRepository.Create"), "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &ngWord)
+}
+
+func (r mysqlNGWordRepository) ListByLivestream(ctx context.Context, userID int64, livestreamID int64) ([]*NGWord, error) {
+	var ngWords []*NGWord
+	err := r.q.named("NGWordRepository.ListByLivestream").SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? ORDER BY created_at DESC", userID, livestreamID)
+	return ngWords, err
+}
+
+func (r mysqlNGWordRepository) Matches(ctx context.Context, comment string, word string) (bool, error) {
+	var hitSpam int
+	query := `
+		SELECT COUNT(*)
+		FROM
+		(SELECT ? AS text) AS texts
+		INNER JOIN
+		(SELECT CONCAT('%', ?, '%')	AS pattern) AS patterns
+		ON texts.text LIKE patterns.pattern;
+		`
+	if err := r.q.named("NGWordRepository.Matches").GetContext(ctx, &hitSpam, query, comment, word); err != nil {
+		return false, err
+	}
+	return hitSpam >= 1, nil
+}
+
+type mysqlTagRepository struct {
+	q instrumentedQueryer
+}
+
+func (r mysqlTagRepository) Create(ctx context.Context, name string) (int64, error) {
+	rs, err := r.q.named("TagRepository.Create").ExecContext(ctx, "INSERT INTO tags (name) VALUES (?)", name)
+	if err != nil {
+		return 0, err
+	}
+	return rs.LastInsertId()
+}
+
+func (r mysqlTagRepository) Get(ctx context.Context, id int64) (TagModel, error) {
+	var tag TagModel
+	err := r.q.named("TagRepository.Get").GetContext(ctx, &tag, "SELECT * FROM tags WHERE id = ?", id)
+	return tag, err
+}
+
+func (r mysqlTagRepository) List(ctx context.Context) ([]*TagModel, error) {
+	var tags []*TagModel
+	err := r.q.named("TagRepository.List").SelectContext(ctx, &tags, "SELECT * FROM tags")
+	return tags, err
+}
+
+type mysqlSlotRepository struct {
+	q instrumentedQueryer
+}
+
+// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
+func (r mysqlSlotRepository) ListForUpdate(ctx context.Context, startAt int64, endAt int64) ([]*ReservationSlotModel, error) {
+	var slots []*ReservationSlotModel
+	err := r.q.named("SlotRepository.ListForUpdate").SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", startAt, endAt)
+	return slots, err
+}
+
+func (r mysqlSlotRepository) Remaining(ctx context.Context, startAt int64, endAt int64) (int64, error) {
+	var count int64
+	err := r.q.named("SlotRepository.Remaining").GetContext(ctx, &count, "SELECT slot FROM reservation_slots WHERE start_at = ? AND end_at = ?", startAt, endAt)
+	return count, err
+}
+
+func (r mysqlSlotRepository) Reserve(ctx context.Context, startAt int64, endAt int64) error {
+	_, err := r.q.named("SlotRepository.Reserve").ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt)
+	return err
+}
+
+func (r mysqlSlotRepository) Refund(ctx context.Context, startAt int64, endAt int64) error {
+	_, err := r.q.named("SlotRepository.Refund").ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt)
+	return err
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// サーバ間の呼び出しなど、セッションを持たないリクエストはこのヘッダでadminとして扱う
+	adminTokenHeader = "X-Isupipe-Admin-Token"
+)
+
+type Role string
+
+const (
+	// 一般ユーザ (user_rolesに行がない)
+	RoleUser Role = "user"
+	// 特定の配信のモデレーター (livestream_moderatorsで配信ごとに付与)
+	RoleStreamerModerator Role = "streamer_moderator"
+	// 全配信のモデレーター
+	RolePlatformModerator Role = "platform_moderator"
+	// 管理者
+	RoleAdmin Role = "admin"
+)
+
+// ロールの強さ。大きいほど権限が強い
+var roleLevels = map[Role]int{
+	RoleUser:              0,
+	RoleStreamerModerator: 1,
+	RolePlatformModerator: 2,
+	RoleAdmin:             3,
+}
+
+var adminToken string
+
+type UserRoleModel struct {
+	UserID int64 `db:"user_id"`
+	Role   Role  `db:"role"`
+}
+
+type LivestreamModeratorModel struct {
+	ID           int64 `db:"id"`
+	LivestreamID int64 `db:"livestream_id"`
+	UserID       int64 `db:"user_id"`
+	CreatedAt    int64 `db:"created_at"`
+}
+
+func (r Role) Valid() bool {
+	_, ok := roleLevels[r]
+	return ok
+}
+
+// AtLeast はロールが指定されたロール以上の権限を持つかどうかを返します。
+func (r Role) AtLeast(other Role) bool {
+	return roleLevels[r] >= roleLevels[other]
+}
+
+// 配信のモデレーションができるかどうかを返す
+// 配信者本人、その配信のモデレーター、プラットフォームモデレーター以上が対象
+func canModerateLivestream(ctx context.Context, tx Tx, userID int64, livestreamModel LivestreamModel) (bool, error) {
+	if livestreamModel.UserID == userID {
+		return true, nil
+	}
+
+	role, err := tx.Users().GetRole(ctx, userID)
+	if err != nil {
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user role: "+err.Error())
+	}
+	if role.AtLeast(RolePlatformModerator) {
+		return true, nil
+	}
+
+	isModerator, err := tx.Livestreams().IsModerator(ctx, livestreamModel.ID, userID)
+	if err != nil {
+		return false, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream moderators: "+err.Error())
+	}
+	return isModerator, nil
+}
+
+// 配信のモデレーションができなければ403を返す
+func authorizeLivestreamModeration(ctx context.Context, tx Tx, userID int64, livestreamModel LivestreamModel) error {
+	ok, err := canModerateLivestream(ctx, tx, userID, livestreamModel)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return echo.NewHTTPError(http.StatusForbidden, "you are not allowed to moderate this livestream")
+	}
+	return nil
+}
+
+// 指定したロール以上のユーザのみ通すミドルウェア
+// adminトークンを持つリクエストは常に通す
+func requireRole(role Role) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if hasAdminToken(c) {
+				return next(c)
+			}
+
+			if err := verifyUserSession(c); err != nil {
+				return err
+			}
+
+			// error already checked
+			sess, _ := session.Get(defaultSessionIDKey, c)
+			// existence already checked
+			userID := sess.Values[defaultUserIDKey].(int64)
+
+			userRole, err := dataStore.Users().GetRole(c.Request().Context(), userID)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user role: "+err.Error())
+			}
+			if !userRole.AtLeast(role) {
+				return echo.NewHTTPError(http.StatusForbidden, "permission denied")
+			}
+
+			return next(c)
+		}
+	}
+}
+
+func hasAdminToken(c echo.Context) bool {
+	if adminToken == "" {
+		return false
+	}
+	token := c.Request().Header.Get(adminTokenHeader)
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// 設定で指定したユーザをadminにする
+// まだいないユーザは登録後に運営APIで付与するしかないので、飛ばして警告だけ出す
+func seedAdminUsers(ctx context.Context, usernames []string) error {
+	if len(usernames) == 0 {
+		return nil
+	}
+
+	tx, err := dataStore.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, name := range usernames {
+		userModel, err := tx.Users().GetByName(ctx, name)
+		if errors.Is(err, sql.ErrNoRows) {
+			appLogger.WarnContext(ctx, "admin user not found", "username", name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := tx.Users().SetRole(ctx, userModel.ID, RoleAdmin); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	"net/http"
 	"sort"
 	"strconv"
@@ -71,14 +73,14 @@ func getUserStatisticsHandler(c echo.Context) error {
 	// ユーザごとに、紐づく配信について、累計リアクション数、累計ライブコメント数、累計売上金額を算出
 	// また、現在の合計視聴者数もだす
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := dataStore.BeginReadTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	var user UserModel
-	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
+	user, err := tx.Users().GetByName(ctx, username)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusBadRequest, "not found user that has the given username")
 		} else {
@@ -86,59 +88,44 @@ func getUserStatisticsHandler(c echo.Context) error {
 		}
 	}
 
-	// ランク算出
-	var users []*UserModel
-	if err := tx.SelectContext(ctx, &users, "SELECT * FROM users"); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+	stats, err := calcUserStatistics(ctx, tx, user)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
-	var ranking UserRanking
-	type UserScores struct {
-		UserID    int64 `db:"user_id"`
-		Reactions int64 `db:"reactions"`
-		Tips      int64 `db:"tips"`
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
-	userScoresMap := make(map[int64]*UserScores)
-	for _, user := range users {
-		userScoresMap[user.ID] = &UserScores{UserID: user.ID}
+
+	return c.JSON(http.StatusOK, stats)
+}
+
+// ユーザの統計情報を算出する
+func calcUserStatistics(ctx context.Context, tx Tx, user UserModel) (UserStatistics, error) {
+	// ランク算出
+	users, err := tx.Users().List(ctx)
+	if err != nil {
+		return UserStatistics{}, fmt.Errorf("failed to get users: %w", err)
 	}
 
+	var ranking UserRanking
+
 	// 最初に、全ユーザーのリアクション数を1つのクエリで集計
-	reactionsQuery := `
-SELECT u.id as user_id, COUNT(*) as reactions FROM users u
-INNER JOIN livestreams l ON l.user_id = u.id
-INNER JOIN reactions r ON r.livestream_id = l.id
-GROUP BY u.id`
-	var reactions []UserScores
-	if err := tx.SelectContext(ctx, &reactions, reactionsQuery); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
-	}
-	// Map the reactions back to the users.
-	for _, score := range reactions {
-		userScoresMap[score.UserID].Reactions = score.Reactions
+	reactions, err := tx.Reactions().CountByStreamer(ctx)
+	if err != nil {
+		return UserStatistics{}, fmt.Errorf("failed to count reactions: %w", err)
 	}
 
 	// 次に全ユーザーのチップの合計を別の1つのクエリで集計
-	tipsQuery := `
-SELECT u.id as user_id, IFNULL(SUM(lc.tip), 0) as tips FROM users u
-INNER JOIN livestreams l ON l.user_id = u.id
-INNER JOIN livecomments lc ON lc.livestream_id = l.id
-GROUP BY u.id`
-	var tips []UserScores
-	if err := tx.SelectContext(ctx, &tips, tipsQuery); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count tips: "+err.Error())
-	}
-	// Map the tips back to the users.
-	for _, score := range tips {
-		userScoresMap[score.UserID].Tips = score.Tips
+	tips, err := tx.Livecomments().SumTipsByStreamer(ctx)
+	if err != nil {
+		return UserStatistics{}, fmt.Errorf("failed to count tips: %w", err)
 	}
 
-	// Now you have all the scores in userScoresMap, you can construct your ranking.
-	for _, user := range users {
-		score := userScoresMap[user.ID]
+	for _, u := range users {
 		ranking = append(ranking, UserRankingEntry{
-			Username: user.Name,
-			Score:    score.Reactions + score.Tips,
+			Username: u.Name,
+			Score:    reactions[u.ID] + tips[u.ID],
 		})
 	}
 	sort.Sort(ranking)
@@ -146,35 +133,30 @@ GROUP BY u.id`
 	var rank int64 = 1
 	for i := len(ranking) - 1; i >= 0; i-- {
 		entry := ranking[i]
-		if entry.Username == username {
+		if entry.Username == user.Name {
 			break
 		}
 		rank++
 	}
 
 	// リアクション数
-	var totalReactions int64
-	query := `SELECT COUNT(*) FROM users u 
-    INNER JOIN livestreams l ON l.user_id = u.id 
-    INNER JOIN reactions r ON r.livestream_id = l.id
-    WHERE u.name = ?
-	`
-	if err := tx.GetContext(ctx, &totalReactions, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
+	totalReactions, err := tx.Reactions().CountByStreamerName(ctx, user.Name)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return UserStatistics{}, fmt.Errorf("failed to count total reactions: %w", err)
 	}
 
 	// ライブコメント数、チップ合計
 	var totalLivecomments int64
 	var totalTip int64
-	var livestreams []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	livestreams, err := tx.Livestreams().ListByUser(ctx, user.ID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return UserStatistics{}, fmt.Errorf("failed to get livestreams: %w", err)
 	}
 
 	for _, livestream := range livestreams {
-		var livecomments []*LivecommentModel
-		if err := tx.SelectContext(ctx, &livecomments, "SELECT * FROM livecomments WHERE livestream_id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+		livecomments, err := tx.Livecomments().ListByLivestream(ctx, livestream.ID, 0, nil)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return UserStatistics{}, fmt.Errorf("failed to get livecomments: %w", err)
 		}
 
 		for _, livecomment := range livecomments {
@@ -186,27 +168,17 @@ GROUP BY u.id`
 	// 合計視聴者数
 	var viewersCount int64
 	for _, livestream := range livestreams {
-		var cnt int64
-		if err := tx.GetContext(ctx, &cnt, "SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream_view_history: "+err.Error())
+		cnt, err := tx.Livestreams().CountViewers(ctx, livestream.ID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return UserStatistics{}, fmt.Errorf("failed to get livestream_view_history: %w", err)
 		}
 		viewersCount += cnt
 	}
 
 	// お気に入り絵文字
-	var favoriteEmoji string
-	query = `
-	SELECT r.emoji_name
-	FROM users u
-	INNER JOIN livestreams l ON l.user_id = u.id
-	INNER JOIN reactions r ON r.livestream_id = l.id
-	WHERE u.name = ?
-	GROUP BY emoji_name
-	ORDER BY COUNT(*) DESC, emoji_name DESC
-	LIMIT 1
-	`
-	if err := tx.GetContext(ctx, &favoriteEmoji, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
+	favoriteEmoji, err := tx.Reactions().FavoriteEmojiByStreamerName(ctx, user.Name)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return UserStatistics{}, fmt.Errorf("failed to find favorite emoji: %w", err)
 	}
 
 	stats := UserStatistics{
@@ -217,7 +189,7 @@ GROUP BY u.id`
 		TotalTip:          totalTip,
 		FavoriteEmoji:     favoriteEmoji,
 	}
-	return c.JSON(http.StatusOK, stats)
+	return stats, nil
 }
 
 func getLivestreamStatisticsHandler(c echo.Context) error {
@@ -233,14 +205,13 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	}
 	livestreamID := int64(id)
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := dataStore.BeginReadTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	var livestream LivestreamModel
-	if err := tx.GetContext(ctx, &livestream, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+	if _, err := tx.Livestreams().Get(ctx, livestreamID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusBadRequest, "cannot get stats of not found livestream")
 		} else {
@@ -248,21 +219,21 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 		}
 	}
 
-	var livestreams []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams"); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	livestreams, err := tx.Livestreams().List(ctx, 0)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
 	// ランク算出
 	var ranking LivestreamRanking
 	for _, livestream := range livestreams {
-		var reactions int64
-		if err := tx.GetContext(ctx, &reactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON l.id = r.livestream_id WHERE l.id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		reactions, err := tx.Reactions().CountByLivestream(ctx, livestream.ID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
 		}
 
-		var totalTips int64
-		if err := tx.GetContext(ctx, &totalTips, "SELECT IFNULL(SUM(l2.tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l.id = l2.livestream_id WHERE l.id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		totalTips, err := tx.Livecomments().SumTipsByLivestream(ctx, livestream.ID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count tips: "+err.Error())
 		}
 
@@ -284,26 +255,26 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	}
 
 	// 視聴者数算出
-	var viewersCount int64
-	if err := tx.GetContext(ctx, &viewersCount, `SELECT COUNT(*) FROM livestreams l INNER JOIN livestream_viewers_history h ON h.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	viewersCount, err := tx.Livestreams().CountViewers(ctx, livestreamID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
 	}
 
 	// 最大チップ額
-	var maxTip int64
-	if err := tx.GetContext(ctx, &maxTip, `SELECT IFNULL(MAX(tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l2.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	maxTip, err := tx.Livecomments().MaxTipByLivestream(ctx, livestreamID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find maximum tip livecomment: "+err.Error())
 	}
 
 	// リアクション数
-	var totalReactions int64
-	if err := tx.GetContext(ctx, &totalReactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON r.livestream_id = l.id WHERE l.id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	totalReactions, err := tx.Reactions().CountByLivestream(ctx, livestreamID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
 	}
 
 	// スパム報告数
-	var totalReports int64
-	if err := tx.GetContext(ctx, &totalReports, `SELECT COUNT(*) FROM livestreams l INNER JOIN livecomment_reports r ON r.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	totalReports, err := tx.Reports().CountByLivestream(ctx, livestreamID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total spam reports: "+err.Error())
 	}
 
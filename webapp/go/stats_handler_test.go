@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+// aliceが2枠、bobが1枠配信し、carolとbobが視聴・投稿する
+func seedStatistics(t *testing.T, ts *testServer) (first, second, bobs Livestream) {
+	t.Helper()
+
+	alice, _ := ts.signup("alice")
+	bob, _ := ts.signup("bob")
+	carol, _ := ts.signup("carol")
+
+	first = ts.reserve(alice, 1, "first")
+	second = ts.reserve(alice, 2, "second")
+	bobs = ts.reserve(bob, 3, "bob's")
+
+	path := func(livestream Livestream, suffix string) string {
+		return fmt.Sprintf("/api/livestream/%d/%s", livestream.ID, suffix)
+	}
+	for _, emoji := range []string{"tada", "innocent", "tada"} {
+		decodeJSON[Reaction](t, carol.post(path(first, "reaction"), PostReactionRequest{EmojiName: emoji}), http.StatusCreated)
+	}
+	decodeJSON[Reaction](t, alice.post(path(bobs, "reaction"), PostReactionRequest{EmojiName: "innocent"}), http.StatusCreated)
+
+	decodeJSON[Livecomment](t, carol.post(path(first, "livecomment"), PostLivecommentRequest{Comment: "great", Tip: 500}), http.StatusCreated)
+	decodeJSON[Livecomment](t, carol.post(path(first, "livecomment"), PostLivecommentRequest{Comment: "again"}), http.StatusCreated)
+	decodeJSON[Livecomment](t, bob.post(path(second, "livecomment"), PostLivecommentRequest{Comment: "nice", Tip: 300}), http.StatusCreated)
+
+	expectStatus(t, bob.post(path(first, "enter"), nil), http.StatusOK)
+	expectStatus(t, carol.post(path(first, "enter"), nil), http.StatusOK)
+
+	return first, second, bobs
+}
+
+func TestUserStatistics(t *testing.T) {
+	ts := newTestServer(t)
+	seedStatistics(t, ts)
+	c, _ := ts.signup("dave")
+
+	tests := []struct {
+		name string
+		want UserStatistics
+	}{
+		{"alice", UserStatistics{Rank: 1, ViewersCount: 2, TotalReactions: 3, TotalLivecomments: 3, TotalTip: 800, FavoriteEmoji: "tada"}},
+		{"bob", UserStatistics{Rank: 2, TotalReactions: 1, FavoriteEmoji: "innocent"}},
+		// スコアが同じならユーザ名の辞書順で後ろのほうが上位
+		{"dave", UserStatistics{Rank: 3}},
+		{"carol", UserStatistics{Rank: 4}},
+	}
+	for _, tt := range tests {
+		got := decodeJSON[UserStatistics](t, c.get("/api/user/"+tt.name+"/statistics"), http.StatusOK)
+		if got != tt.want {
+			t.Errorf("%s: statistics = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	expectError(t, c.get("/api/user/nobody/statistics"), http.StatusBadRequest)
+	expectError(t, ts.client().get("/api/user/alice/statistics"), http.StatusForbidden)
+}
+
+func TestLivestreamStatistics(t *testing.T) {
+	ts := newTestServer(t)
+	first, second, bobs := seedStatistics(t, ts)
+	c, _ := ts.signup("dave")
+
+	tests := []struct {
+		livestream Livestream
+		want       LivestreamStatistics
+	}{
+		{first, LivestreamStatistics{Rank: 1, ViewersCount: 2, TotalReactions: 3, MaxTip: 500}},
+		{second, LivestreamStatistics{Rank: 2, MaxTip: 300}},
+		{bobs, LivestreamStatistics{Rank: 3, TotalReactions: 1}},
+	}
+	for _, tt := range tests {
+		got := decodeJSON[LivestreamStatistics](t, c.get(fmt.Sprintf("/api/livestream/%d/statistics", tt.livestream.ID)), http.StatusOK)
+		if got != tt.want {
+			t.Errorf("%s: statistics = %+v, want %+v", tt.livestream.Title, got, tt.want)
+		}
+	}
+
+	expectError(t, c.get("/api/livestream/999/statistics"), http.StatusBadRequest)
+	expectError(t, c.get("/api/livestream/abc/statistics"), http.StatusBadRequest)
+	expectError(t, ts.client().get(fmt.Sprintf("/api/livestream/%d/statistics", first.ID)), http.StatusForbidden)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type UserSuspensionModel struct {
+	UserID           int64  `db:"user_id" json:"user_id"`
+	Reason           string `db:"reason" json:"reason"`
+	HideLivecomments bool   `db:"hide_livecomments" json:"hide_livecomments"`
+	// 0なら無期限
+	ExpiresAt int64 `db:"expires_at" json:"expires_at"`
+	CreatedAt int64 `db:"created_at" json:"created_at"`
+}
+
+// Active は指定時刻に凍結が有効かどうかを返します。
+func (s UserSuspensionModel) Active(now time.Time) bool {
+	return s.ExpiresAt == 0 || now.Unix() < s.ExpiresAt
+}
+
+// 全リクエストのセッション検証で参照するので、凍結情報はメモリに載せておく
+type SuspensionCache struct {
+	mu          sync.RWMutex
+	suspensions map[int64]UserSuspensionModel
+}
+
+var suspensionCache = NewSuspensionCache()
+
+func NewSuspensionCache() *SuspensionCache {
+	return &SuspensionCache{
+		suspensions: make(map[int64]UserSuspensionModel),
+	}
+}
+
+// Get は有効な凍結情報をキャッシュから取得します。期限切れのものは返しません。
+func (c *SuspensionCache) Get(userID int64) (UserSuspensionModel, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	suspension, found := c.suspensions[userID]
+	if !found || !suspension.Active(time.Now()) {
+		return UserSuspensionModel{}, false
+	}
+	return suspension, true
+}
+
+// IsSuspended は指定されたユーザが凍結中かどうかを返します。
+func (c *SuspensionCache) IsSuspended(userID int64) bool {
+	_, found := c.Get(userID)
+	return found
+}
+
+// LivecommentHiddenUserIDs はライブコメントを隠すべきユーザのIDを返します。
+func (c *SuspensionCache) LivecommentHiddenUserIDs() []int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := time.Now()
+	var userIDs []int64
+	for userID, suspension := range c.suspensions {
+		if suspension.HideLivecomments && suspension.Active(now) {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	return userIDs
+}
+
+// Set は凍結情報をキャッシュに追加します。
+func (c *SuspensionCache) Set(suspension UserSuspensionModel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.suspensions[suspension.UserID] = suspension
+}
+
+// Delete は凍結情報をキャッシュから削除します。
+func (c *SuspensionCache) Delete(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.suspensions, userID)
+}
+
+// 凍結情報をDBから読み直す
+func loadSuspensionCache(ctx context.Context) error {
+	suspensionModels, err := dataStore.Users().ListSuspensions(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get user suspensions: %w", err)
+	}
+
+	suspensions := make(map[int64]UserSuspensionModel, len(suspensionModels))
+	for _, suspensionModel := range suspensionModels {
+		suspensions[suspensionModel.UserID] = *suspensionModel
+	}
+
+	suspensionCache.mu.Lock()
+	defer suspensionCache.mu.Unlock()
+	suspensionCache.suspensions = suspensions
+
+	return nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
@@ -45,6 +46,7 @@ func (c *TagCache) GetTagByID(id int64) (TagModel, bool) {
 	defer c.mu.RUnlock()
 
 	tag, found := c.tags[id]
+	observeCacheLookup("tag", found)
 	return tag, found
 }
 
@@ -54,20 +56,37 @@ func (c *TagCache) GetTagIDByName(name string) (int64, bool) {
 	defer c.mu.RUnlock()
 
 	id, found := c.nameToID[name]
+	observeCacheLookup("tag", found)
 	return id, found
 }
 
+// Add はタグをキャッシュに追加します。
+func (c *TagCache) Add(tag TagModel) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tags[tag.ID] = tag
+	c.nameToID[tag.Name] = tag.ID
+}
+
 func initTagCache(c echo.Context) error {
-	ctx := c.Request().Context()
+	if err := loadTagCache(c.Request().Context()); err != nil {
+		return err
+	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	return c.JSON(http.StatusOK, &TagsResponse{})
+}
+
+// tagsテーブルからタグのキャッシュを作り直す
+func loadTagCache(ctx context.Context) error {
+	tx, err := dataStore.BeginTx(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
 	}
 	defer tx.Rollback()
 
-	var tagModels []*TagModel
-	if err := tx.SelectContext(ctx, &tagModels, "SELECT * FROM tags"); err != nil {
+	tagModels, err := tx.Tags().List(ctx)
+	if err != nil {
 		return fmt.Errorf("failed to get tags: %w", err)
 	}
 
@@ -78,12 +97,14 @@ func initTagCache(c echo.Context) error {
 	tagCache.mu.Lock()
 	defer tagCache.mu.Unlock()
 
+	tagCache.tags = make(map[int64]TagModel, len(tagModels))
+	tagCache.nameToID = make(map[string]int64, len(tagModels))
 	for _, tagModel := range tagModels {
 		tagCache.tags[tagModel.ID] = *tagModel
 		tagCache.nameToID[tagModel.Name] = tagModel.ID
 	}
 
-	return c.JSON(http.StatusOK, &TagsResponse{})
+	return nil
 }
 
 func getTagHandler(c echo.Context) error {
@@ -109,20 +130,18 @@ func getStreamerThemeHandler(c echo.Context) error {
 
 	if err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
-		c.Logger().Printf("verifyUserSession: %+v\n", err)
 		return err
 	}
 
 	username := c.Param("username")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := dataStore.BeginReadTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	userModel := UserModel{}
-	err = tx.GetContext(ctx, &userModel, "SELECT id FROM users WHERE name = ?", username)
+	userModel, err := tx.Users().GetByName(ctx, username)
 	if errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
 	}
@@ -130,8 +149,8 @@ func getStreamerThemeHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
-	themeModel := ThemeModel{}
-	if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ?", userModel.ID); err != nil {
+	themeModel, err := tx.Users().GetTheme(ctx, userModel.ID)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user theme: "+err.Error())
 	}
 
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// OpenTelemetryのトレース
+// OTLP/HTTPでcollectorに送るか、ファイルにJSONで書き出す
+
+const (
+	// レスポンスにトレースIDを入れるヘッダ
+	traceIDHeader = "X-Trace-Id"
+
+	tracingExportTimeout = 10 * time.Second
+)
+
+// 有効なトレーサ。nilならspanを作らない
+var tracer *Tracer
+
+// 他のサービスから受け取るトレースの文脈 (W3C Trace Context)
+var tracePropagator = propagation.TraceContext{}
+
+// Tracer はSDKのTracerProviderと、そこから作ったこのアプリのtrace.Tracerです
+type Tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+}
+
+// 閉じたspanは溜めてからまとめて exporter で書き出す
+func NewTracer(serviceName string, sampleRatio float64, exporter sdktrace.SpanExporter) *Tracer {
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter, sdktrace.WithExportTimeout(tracingExportTimeout)),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+		// 他のサービスから続くトレースは、記録するかどうかも親に合わせる
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	return &Tracer{provider: provider, tracer: provider.Tracer("isupipe")}
+}
+
+// 設定に合わせてトレーサを作る。無効ならnilを返す
+// 書き出しの失敗は logger に出す
+func newTracerFromConfig(cfg TracingConfig, logger *slog.Logger) (*Tracer, error) {
+	var exporter sdktrace.SpanExporter
+	switch cfg.Exporter {
+	case "none":
+		return nil, nil
+	case "file":
+		f, err := os.OpenFile(cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open trace file: %w", err)
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to set up trace file exporter: %w", err)
+		}
+	case "otlp":
+		var err error
+		exporter, err = otlptracehttp.New(context.Background(),
+			otlptracehttp.WithEndpointURL(strings.TrimSuffix(cfg.OTLPEndpoint, "/")+"/v1/traces"),
+			otlptracehttp.WithTimeout(tracingExportTimeout),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up otlp exporter: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter: %s", cfg.Exporter)
+	}
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Warn("failed to export spans", "error", err)
+	}))
+	return NewTracer(cfg.ServiceName, cfg.SampleRatio, exporter), nil
+}
+
+// Shutdown は溜まっているspanを書き出してから止める
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	return t.provider.Shutdown(ctx)
+}
+
+// startSpan は ctx のspanの子としてspanを始める。トレースが無効なら何も記録しないspanを返す
+func startSpan(ctx context.Context, name string, kind trace.SpanKind, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	t := tracer
+	if t == nil {
+		return ctx, noop.Span{}
+	}
+	return t.tracer.Start(ctx, name, trace.WithSpanKind(kind), trace.WithAttributes(attributes...))
+}
+
+// spanを失敗として記録する。err がnilなら何もしない
+func recordSpanError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// リクエストごとのspanを作り、トレースIDをレスポンスヘッダで返す
+// エラーの内容をspanに残すので、accessLogMiddlewareより内側で使う
+func tracingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if tracer == nil {
+			return next(c)
+		}
+
+		req := c.Request()
+		// traceparent があれば、他のサービスから続くトレースの子にする
+		ctx := tracePropagator.Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+		route := c.Path()
+		if route == "" {
+			route = "unmatched"
+		}
+		ctx, span := startSpan(ctx, req.Method+" "+route, trace.SpanKindServer,
+			attribute.String("http.request.method", req.Method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", req.URL.Path),
+		)
+		defer span.End()
+		c.SetRequest(req.WithContext(ctx))
+		traceID := span.SpanContext().TraceID().String()
+		c.Response().Header().Set(traceIDHeader, traceID)
+		setLogTraceID(ctx, traceID)
+
+		err := next(c)
+
+		status := responseStatus(c, err)
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		if status >= http.StatusInternalServerError {
+			spanErr := err
+			if spanErr == nil {
+				spanErr = errors.New(http.StatusText(status))
+			}
+			recordSpanError(span, spanErr)
+		}
+		return err
+	}
+}
+
+// 外部コマンドを実行し、標準出力と標準エラー出力をまとめて返す
+func runCommand(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return tracedCommand(ctx, (*exec.Cmd).CombinedOutput, name, args...)
+}
+
+// 外部コマンドを実行し、標準出力を返す
+func commandOutput(ctx context.Context, name string, args ...string) ([]byte, error) {
+	return tracedCommand(ctx, (*exec.Cmd).Output, name, args...)
+}
+
+func tracedCommand(ctx context.Context, run func(*exec.Cmd) ([]byte, error), name string, args ...string) ([]byte, error) {
+	ctx, span := startSpan(ctx, "exec "+name, trace.SpanKindInternal,
+		attribute.String("process.executable.name", name),
+		attribute.StringSlice("process.command_args", append([]string{name}, args...)),
+	)
+	defer span.End()
+
+	out, err := run(exec.CommandContext(ctx, name, args...))
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		span.SetAttributes(attribute.Int("process.exit_code", 0))
+	case errors.As(err, &exitErr):
+		span.SetAttributes(attribute.Int("process.exit_code", exitErr.ExitCode()))
+	}
+	recordSpanError(span, err)
+	return out, err
+}
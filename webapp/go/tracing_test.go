@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// テストの間だけトレースを有効にし、書き出されたspanを返す関数を返す
+func enableTestTracing(t *testing.T, sampleRatio float64) func() tracetest.SpanStubs {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	tr := NewTracer("isupipe-test", sampleRatio, exporter)
+	tracer = tr
+	t.Cleanup(func() {
+		tracer = nil
+		tr.Shutdown(context.Background())
+	})
+
+	return func() tracetest.SpanStubs {
+		t.Helper()
+		tracer = nil
+		// Shutdown するとexporterの記録も消えるので、書き出させるだけにする
+		if err := tr.provider.ForceFlush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return exporter.GetSpans()
+	}
+}
+
+func findSpan(spans tracetest.SpanStubs, name string) (tracetest.SpanStub, bool) {
+	for _, span := range spans {
+		if span.Name == name {
+			return span, true
+		}
+	}
+	return tracetest.SpanStub{}, false
+}
+
+func spanAttributeValue(span tracetest.SpanStub, key string) string {
+	for _, a := range span.Attributes {
+		if string(a.Key) == key {
+			return a.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	spans := enableTestTracing(t, 1)
+
+	rec := alice.get("/api/tag")
+	expectStatus(t, rec, http.StatusOK)
+	traceID := rec.Header().Get(traceIDHeader)
+	if len(traceID) != 32 {
+		t.Errorf("trace id = %q", traceID)
+	}
+
+	// 他のサービスから続くトレースはそのトレースIDを使う
+	req := httptest.NewRequest(http.MethodGet, "/api/user/alice", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	rec = alice.send(req)
+	expectStatus(t, rec, http.StatusOK)
+	if got := rec.Header().Get(traceIDHeader); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace id = %q", got)
+	}
+	expectError(t, alice.get("/api/user/nobody"), http.StatusNotFound)
+
+	// 読めない traceparent は無視して新しいトレースにする
+	req = httptest.NewRequest(http.MethodGet, "/api/tag", nil)
+	req.Header.Set("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	rec = alice.send(req)
+	if got := rec.Header().Get(traceIDHeader); len(got) != 32 || got == "00000000000000000000000000000000" {
+		t.Errorf("trace id = %q", got)
+	}
+
+	recorded := spans()
+	span, ok := findSpan(recorded, "GET /api/tag")
+	if !ok {
+		t.Fatalf("span not found in %+v", recorded)
+	}
+	if span.SpanContext.TraceID().String() != traceID || span.SpanKind != trace.SpanKindServer || span.Parent.IsValid() || span.Status.Code != codes.Unset ||
+		spanAttributeValue(span, "http.route") != "/api/tag" || spanAttributeValue(span, "http.response.status_code") != "200" {
+		t.Errorf("span = %+v", span)
+	}
+	if service, _ := span.Resource.Set().Value("service.name"); service.AsString() != "isupipe-test" {
+		t.Errorf("service.name = %q", service.Emit())
+	}
+
+	var user tracetest.SpanStubs
+	for _, span := range recorded {
+		if span.Name == "GET /api/user/:username" {
+			user = append(user, span)
+		}
+	}
+	if len(user) != 2 {
+		t.Fatalf("spans = %+v", user)
+	}
+	if user[0].SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || user[0].Parent.SpanID().String() != "00f067aa0ba902b7" ||
+		!user[0].Parent.IsRemote() {
+		t.Errorf("span = %+v", user[0])
+	}
+	// 404はサーバのエラーではない
+	if spanAttributeValue(user[1], "http.response.status_code") != "404" || user[1].Status.Code != codes.Unset {
+		t.Errorf("span = %+v", user[1])
+	}
+}
+
+func TestTracingSampling(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	spans := enableTestTracing(t, 0)
+
+	// 記録しなくてもトレースIDは返す
+	rec := alice.get("/api/tag")
+	if len(rec.Header().Get(traceIDHeader)) != 32 {
+		t.Errorf("trace id = %q", rec.Header().Get(traceIDHeader))
+	}
+	// 呼び出し元が記録しているトレースは記録する
+	req := httptest.NewRequest(http.MethodGet, "/api/tag", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	alice.send(req)
+
+	recorded := spans()
+	if len(recorded) != 1 || recorded[0].SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("spans = %+v", recorded)
+	}
+}
+
+func TestTracingQueries(t *testing.T) {
+	spans := enableTestTracing(t, 1)
+
+	// トランザクションのクエリは、リクエストの ctx で呼ばれてもトランザクションのspanの子にする
+	_, tx := startSpan(context.Background(), "db.transaction", trace.SpanKindInternal)
+	users := mysqlUserRepository{q: instrumentedQueryer{q: fakeQueryer{err: sql.ErrNoRows}, parent: tx}}
+	if _, err := users.GetByName(context.Background(), "alice"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("err = %v", err)
+	}
+	users = mysqlUserRepository{q: instrumentedQueryer{q: fakeQueryer{err: errors.New("connection refused")}, parent: tx}}
+	if _, err := users.GetByName(context.Background(), "bob"); err == nil {
+		t.Fatal("expected error")
+	}
+	tx.End()
+
+	recorded := spans()
+	if len(recorded) != 3 {
+		t.Fatalf("spans = %+v", recorded)
+	}
+	txID := recorded[2].SpanContext.SpanID()
+	for i, query := range recorded[:2] {
+		if query.Name != "UserRepository.GetByName" || query.SpanKind != trace.SpanKindClient || query.Parent.SpanID() != txID ||
+			spanAttributeValue(query, "db.statement") != "SELECT * FROM users WHERE name = ?" {
+			t.Errorf("span %d = %+v", i, query)
+		}
+	}
+	// 見つからないのは失敗ではない
+	if recorded[0].Status.Code != codes.Unset || recorded[1].Status != (sdktrace.Status{Code: codes.Error, Description: "connection refused"}) {
+		t.Errorf("statuses = %+v, %+v", recorded[0].Status, recorded[1].Status)
+	}
+}
+
+func TestTracingCommand(t *testing.T) {
+	spans := enableTestTracing(t, 1)
+
+	out, err := runCommand(context.Background(), "sh", "-c", "echo out; echo err >&2")
+	if err != nil || string(out) != "out\nerr\n" {
+		t.Errorf("out = %q, err = %v", out, err)
+	}
+	out, err = commandOutput(context.Background(), "sh", "-c", "echo out; echo err >&2; exit 3")
+	if err == nil || string(out) != "out\n" {
+		t.Errorf("out = %q, err = %v", out, err)
+	}
+
+	recorded := spans()
+	if len(recorded) != 2 {
+		t.Fatalf("spans = %+v", recorded)
+	}
+	if recorded[0].Name != "exec sh" || spanAttributeValue(recorded[0], "process.exit_code") != "0" || recorded[0].Status.Code != codes.Unset ||
+		spanAttributeValue(recorded[0], "process.command_args") != "[sh -c echo out; echo err >&2]" {
+		t.Errorf("span = %+v", recorded[0])
+	}
+	if spanAttributeValue(recorded[1], "process.exit_code") != "3" || recorded[1].Status.Code != codes.Error {
+		t.Errorf("span = %+v", recorded[1])
+	}
+}
+
+func TestTracingFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "traces.jsonl")
+	tr, err := newTracerFromConfig(TracingConfig{Exporter: "file", File: path, ServiceName: "isupipe", SampleRatio: 1}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer = tr
+	t.Cleanup(func() { tracer = nil })
+
+	ctx, parent := startSpan(context.Background(), "POST /api/register", trace.SpanKindServer)
+	_, span := startSpan(ctx, "exec pdnsutil", trace.SpanKindInternal, attribute.Int("process.exit_code", 1))
+	recordSpanError(span, errors.New("exit status 1"))
+	span.End()
+	parent.End()
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 1行に1つのspanをJSONで追記する
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type fileSpan struct {
+		Name        string
+		SpanContext struct{ TraceID, SpanID string }
+		Parent      struct{ SpanID string }
+		Status      struct{ Code, Description string }
+		Resource    []struct {
+			Key   string
+			Value struct{ Value any }
+		}
+	}
+	var got []fileSpan
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for dec.More() {
+		var span fileSpan
+		if err := dec.Decode(&span); err != nil {
+			t.Fatalf("%v: %s", err, b)
+		}
+		got = append(got, span)
+	}
+	if len(got) != 2 || got[0].Name != "exec pdnsutil" || got[1].Name != "POST /api/register" {
+		t.Fatalf("spans = %s", b)
+	}
+	if got[0].SpanContext.TraceID != got[1].SpanContext.TraceID || got[0].Parent.SpanID != got[1].SpanContext.SpanID ||
+		got[0].Status.Code != "Error" || got[0].Status.Description != "exit status 1" {
+		t.Errorf("spans = %s", b)
+	}
+	if resource := got[0].Resource; len(resource) != 1 || resource[0].Key != "service.name" || resource[0].Value.Value != "isupipe" {
+		t.Errorf("resource = %+v", resource)
+	}
+}
+
+func TestTracingOTLPExporter(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		select {
+		case requests <- r:
+		default:
+		}
+	}))
+	defer collector.Close()
+
+	tr, err := newTracerFromConfig(TracingConfig{Exporter: "otlp", OTLPEndpoint: collector.URL + "/", ServiceName: "isupipe", SampleRatio: 1}, slog.Default())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracer = tr
+	t.Cleanup(func() { tracer = nil })
+
+	_, span := startSpan(context.Background(), "GET /api/tag", trace.SpanKindServer)
+	span.End()
+	if err := tr.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case r := <-requests:
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("request = %s %s %s", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+	default:
+		t.Fatal("no spans were sent to the collector")
+	}
+}
@@ -1,22 +1,23 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
-	"os"
-	"os/exec"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
-	"github.com/gorilla/sessions"
-	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"golang.org/x/crypto/bcrypt"
@@ -47,6 +48,7 @@ type User struct {
 	Description string `json:"description,omitempty"`
 	Theme       Theme  `json:"theme,omitempty"`
 	IconHash    string `json:"icon_hash,omitempty"`
+	IconURL     string `json:"icon_url,omitempty"`
 }
 
 type Theme struct {
@@ -100,6 +102,7 @@ func addIconHash(id int64, hash string) {
 // キャッシュからアイコンハッシュを取得する
 func getIconHash(id int64) (string, bool) {
 	hash, ok := iconHashCache.Load(id)
+	observeCacheLookup("icon_hash", ok)
 	if ok {
 		return hash.(string), true
 	}
@@ -114,6 +117,7 @@ func addIconHashByUserName(userName string, hash string) {
 // ユーザー名に基づいてキャッシュからアイコンハッシュを取得する
 func getIconHashByUserName(userName string) (string, bool) {
 	hash, ok := iconHashCacheByUserName.Load(userName)
+	observeCacheLookup("icon_hash_by_name", ok)
 	if ok {
 		return hash.(string), true
 	}
@@ -125,46 +129,149 @@ func InitCache() {
 	iconHashCacheByUserName = sync.Map{}
 }
 
+type IconModel struct {
+	ID        int64  `db:"id"`
+	UserID    int64  `db:"user_id"`
+	Hash      string `db:"hash"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+// ユーザ名からアイコンを返すAPI
+// GET /api/user/:username/icon
+// ユーザ名とアイコンの対応は変わりうるので、キャッシュする場合も毎回再検証させる
 func getIconHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
 	username := c.Param("username")
 
-	ifNoneMatch := c.Request().Header.Get("If-None-Match")
+	size, err := parseIconSize(c.QueryParam("size"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-cache")
 
 	hash, found := getIconHashByUserName(username)
 
-	if found && hash == strings.Trim(ifNoneMatch, "\"") {
+	if found && !isIconBlocked(hash) && etagMatches(c.Request().Header.Get("If-None-Match"), iconStoreKey(hash, size)) {
+		c.Response().Header().Set("ETag", strconv.Quote(iconStoreKey(hash, size)))
 		return c.NoContent(http.StatusNotModified)
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := dataStore.BeginTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	var user UserModel
-	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
+	user, err := tx.Users().GetByName(ctx, username)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
 		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
-	fileName, found := getIconHash(user.ID)
+	iconModel, err := tx.Icons().GetCurrent(ctx, user.ID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return serveIcon(c, fallbackImageHash, time.Time{}, fallbackImageData)
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon: "+err.Error())
+	}
+
+	if isIconBlocked(iconModel.Hash) {
+		return serveIcon(c, fallbackImageHash, time.Time{}, fallbackImageData)
+	}
 
-	if !found {
-		return c.File(fallbackImage)
+	// dbのiconStoreはStoreを通して読むので、トランザクションを閉じてから画像を取る
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	iconFilePath := fileName
-	image, err := os.ReadFile(iconFilePath)
+	key := iconStoreKey(iconModel.Hash, size)
+	image, err := iconStore.Get(ctx, key)
+	if errors.Is(err, errIconNotFound) {
+		return serveIcon(c, fallbackImageHash, time.Time{}, fallbackImageData)
+	}
 	if err != nil {
-		return c.File(fallbackImage)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icon: "+err.Error())
 	}
 
-	return c.Blob(http.StatusOK, "image/jpeg", image)
+	return serveIcon(c, key, time.Unix(iconModel.CreatedAt, 0), image)
+}
+
+// ハッシュからアイコンを返すAPI
+// GET /api/icon/:hash
+// 内容はハッシュで決まるので、ずっとキャッシュしてよい
+func getIconByHashHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	hash := c.Param("hash")
+	if !iconHashPattern.MatchString(hash) {
+		return echo.NewHTTPError(http.StatusNotFound, "icon not found")
+	}
+
+	size, err := parseIconSize(c.QueryParam("size"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	// 長くキャッシュさせるのは画像を返すときだけ。404をキャッシュされると、後から保存された画像が見えなくなる
+	immutable := func() {
+		c.Response().Header().Set(echo.HeaderCacheControl, "public, max-age=31536000, immutable")
+	}
+
+	if hash == fallbackImageHash {
+		immutable()
+		return serveIcon(c, fallbackImageHash, time.Time{}, fallbackImageData)
+	}
+	if isIconBlocked(hash) {
+		return echo.NewHTTPError(http.StatusNotFound, "icon not found")
+	}
+
+	if etagMatches(c.Request().Header.Get("If-None-Match"), iconStoreKey(hash, size)) {
+		immutable()
+		c.Response().Header().Set("ETag", strconv.Quote(iconStoreKey(hash, size)))
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	image, err := iconStore.Get(ctx, iconStoreKey(hash, size))
+	if errors.Is(err, errIconNotFound) {
+		return echo.NewHTTPError(http.StatusNotFound, "icon not found")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icon: "+err.Error())
+	}
+
+	immutable()
+	return serveIcon(c, iconStoreKey(hash, size), time.Time{}, image)
+}
+
+// ETag/Last-Modifiedを付けて画像を返す
+// 条件付きリクエストとHEADはhttp.ServeContentに任せる
+func serveIcon(c echo.Context, etag string, modTime time.Time, image []byte) error {
+	header := c.Response().Header()
+	header.Set(echo.HeaderContentType, http.DetectContentType(image))
+	header.Set("ETag", strconv.Quote(etag))
+	http.ServeContent(c.Response(), c.Request(), "", modTime, bytes.NewReader(image))
+	return nil
+}
+
+// If-None-Matchに指定されたETagのいずれかに一致するか
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == "*" || strings.Trim(v, "\"") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// アイコンのURL。ハッシュごとに内容が変わらないので長期間キャッシュできる
+func iconURL(hash string) string {
+	return "/api/icon/" + hash
 }
 
 func postIconHandler(c echo.Context) error {
@@ -179,50 +286,58 @@ func postIconHandler(c echo.Context) error {
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	// リクエストボディのデコード
-	var req *PostIconRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	// リクエストボディから画像を取り出す
+	upload, err := readIconUpload(c)
+	if err != nil {
+		return err
 	}
 
-	// トランザクションの開始
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	// 画像を検証して、再エンコードと縮小版の生成を行う
+	icon, err := processIconImage(upload)
+	if errors.Is(err, errIconTooLarge) {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("icon image must be at most %d bytes", iconMaxBytes))
+	}
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
-	defer tx.Rollback()
 
-	// 古いアイコンの削除
-	if _, err := tx.ExecContext(ctx, "DELETE FROM icons WHERE user_id = ?", userID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old user icon: "+err.Error())
+	// 再エンコード後の画像のハッシュ値を計算し、保存先のキーとして使用
+	iconHash := fmt.Sprintf("%x", sha256.Sum256(icon.Original))
+
+	// ブロックリストに載っている画像は受け付けない (再エンコード前のハッシュでも確認する)
+	if isIconBlocked(iconHash) || isIconBlocked(fmt.Sprintf("%x", sha256.Sum256(upload))) {
+		return echo.NewHTTPError(http.StatusBadRequest, "this image is not allowed as an icon")
 	}
 
-	// 画像のハッシュ値を計算し、ファイル名として使用
-	iconHash := sha256.Sum256(req.Image)
-	iconFileName := fmt.Sprintf("%x", iconHash)
-	iconFilePath := "/opt/icons/" + iconFileName
-	// 画像をファイルに保存
-	err = os.WriteFile(iconFilePath, req.Image, 0644)
-	addIconHash(userID, iconFilePath)
-	if err != nil {
+	// 行が見えた時点で画像を取れるよう、行を作る前に画像を保存する
+	// 画像はハッシュをキーにしていて他のユーザと共有しうるので、この後失敗しても消さない
+	if err := putIcon(ctx, iconHash, icon); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save user icon: "+err.Error())
 	}
 
-	// 新しいアイコンの情報をデータベースに挿入
-	rs, err := tx.ExecContext(ctx, "INSERT INTO icons (user_id, image) VALUES (?, ?)", userID, iconFileName)
+	// トランザクションの開始
+	tx, err := dataStore.BeginTx(ctx)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new user icon: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
+	defer tx.Rollback()
 
-	iconID, err := rs.LastInsertId()
+	// 古いアイコンは履歴として残し、最新の行を現在のアイコンとする
+	// 新しいアイコンの情報をデータベースに挿入
+	iconID, err := tx.Icons().Create(ctx, userID, iconHash, time.Now().Unix())
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted icon id: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new user icon: "+err.Error())
 	}
 
 	// トランザクションのコミット
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
+	addIconHash(userID, iconHash)
+	if userName, ok := sess.Values[defaultUsernameKey].(string); ok {
+		addIconHashByUserName(userName, iconHash)
+	}
+	cacheBus.Publish(InvalidationEvent{Kind: InvalidateIcon, UserID: userID})
 
 	// レスポンスの送信
 	return c.JSON(http.StatusCreated, &PostIconResponse{
@@ -230,6 +345,196 @@ func postIconHandler(c echo.Context) error {
 	})
 }
 
+type IconHistoryEntry struct {
+	ID        int64  `json:"id"`
+	IconHash  string `json:"icon_hash"`
+	IconURL   string `json:"icon_url"`
+	Current   bool   `json:"current"`
+	Blocked   bool   `json:"blocked"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// アイコン履歴取得API
+// GET /api/icon/history
+func getIconHistoryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	iconModels, err := dataStore.Icons().ListByUser(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icon history: "+err.Error())
+	}
+
+	history := make([]IconHistoryEntry, len(iconModels))
+	for i, iconModel := range iconModels {
+		history[i] = IconHistoryEntry{
+			ID:        iconModel.ID,
+			IconHash:  iconModel.Hash,
+			IconURL:   iconURL(iconModel.Hash),
+			Current:   i == 0,
+			Blocked:   isIconBlocked(iconModel.Hash),
+			CreatedAt: iconModel.CreatedAt,
+		}
+	}
+
+	return c.JSON(http.StatusOK, history)
+}
+
+// 過去のアイコンに戻すAPI
+// POST /api/icon/history/:icon_id/revert
+// 履歴を残すため、選んだアイコンを最新の行として追加し直す
+func revertIconHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	iconID, err := strconv.ParseInt(c.Param("icon_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "icon_id in path must be integer")
+	}
+
+	tx, err := dataStore.BeginTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	iconModel, err := tx.Icons().GetByUser(ctx, iconID, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found icon that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get icon: "+err.Error())
+	}
+
+	if isIconBlocked(iconModel.Hash) {
+		return echo.NewHTTPError(http.StatusBadRequest, "this image is not allowed as an icon")
+	}
+
+	newIconID, err := tx.Icons().Copy(ctx, iconModel.ID, time.Now().Unix())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reverted icon: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	addIconHash(userID, iconModel.Hash)
+	if userName, ok := sess.Values[defaultUsernameKey].(string); ok {
+		addIconHashByUserName(userName, iconModel.Hash)
+	}
+	cacheBus.Publish(InvalidationEvent{Kind: InvalidateIcon, UserID: userID})
+
+	return c.JSON(http.StatusCreated, &PostIconResponse{
+		ID: newIconID,
+	})
+}
+
+// アイコンのアップロードを読み込む
+// JSON (base64), multipart/form-data の image フィールド, 画像そのもののボディに対応する
+// 検証と縮小のために画像全体をデコードするので、ストレージへ流し込まずに上限までメモリに読む
+func readIconUpload(c echo.Context) ([]byte, error) {
+	req := c.Request()
+	defer req.Body.Close()
+
+	tooLarge := echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("icon image must be at most %d bytes", iconMaxBytes))
+
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get(echo.HeaderContentType))
+	if err != nil {
+		// Content-Typeがない場合は従来通りJSONとして扱う
+		mediaType = echo.MIMEApplicationJSON
+	}
+
+	switch {
+	case mediaType == echo.MIMEApplicationJSON:
+		// base64で膨らむ分とJSONの余白を見込んで制限する
+		body := http.MaxBytesReader(c.Response(), req.Body, iconMaxBytes/3*4+4096)
+		var r PostIconRequest
+		if err := json.NewDecoder(body).Decode(&r); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return nil, tooLarge
+			}
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+		}
+		return r.Image, nil
+
+	case mediaType == echo.MIMEMultipartForm:
+		// ParseMultipartFormは一時ファイルに書き出すので、パートを直接読む
+		mr, err := req.MultipartReader()
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "failed to read multipart body: "+err.Error())
+		}
+		for {
+			part, err := mr.NextPart()
+			if errors.Is(err, io.EOF) {
+				return nil, echo.NewHTTPError(http.StatusBadRequest, "image field is required")
+			}
+			if err != nil {
+				return nil, echo.NewHTTPError(http.StatusBadRequest, "failed to read multipart body: "+err.Error())
+			}
+			if part.FormName() != "image" {
+				part.Close()
+				continue
+			}
+			image, err := readAllLimited(part, iconMaxBytes)
+			part.Close()
+			if errors.Is(err, errIconTooLarge) {
+				return nil, tooLarge
+			}
+			if err != nil {
+				return nil, echo.NewHTTPError(http.StatusBadRequest, "failed to read image field: "+err.Error())
+			}
+			return image, nil
+		}
+
+	case strings.HasPrefix(mediaType, "image/") || mediaType == echo.MIMEOctetStream:
+		if req.ContentLength > iconMaxBytes {
+			return nil, tooLarge
+		}
+		image, err := readAllLimited(req.Body, iconMaxBytes)
+		if errors.Is(err, errIconTooLarge) {
+			return nil, tooLarge
+		}
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "failed to read the request body: "+err.Error())
+		}
+		return image, nil
+
+	default:
+		return nil, echo.NewHTTPError(http.StatusUnsupportedMediaType, "unsupported content type: "+mediaType)
+	}
+}
+
+// 上限を超えたらerrIconTooLargeを返す
+func readAllLimited(r io.Reader, limit int64) ([]byte, error) {
+	var buf bytes.Buffer
+	n, err := buf.ReadFrom(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > limit {
+		return nil, errIconTooLarge
+	}
+	return buf.Bytes(), nil
+}
+
 func getMeHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -243,14 +548,13 @@ func getMeHandler(c echo.Context) error {
 	// existence already checked
 	userID := sess.Values[defaultUserIDKey].(int64)
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := dataStore.BeginTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	userModel := UserModel{}
-	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID)
+	userModel, err := tx.Users().Get(ctx, userID)
 	if errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
 	}
@@ -270,6 +574,122 @@ func getMeHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, user)
 }
 
+// アカウント削除API
+// DELETE /api/user/me
+func deleteMeHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dataStore.BeginTx(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel, err := tx.Users().GetForUpdate(ctx, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	iconHashes, err := tx.Icons().ListHashesByUser(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icons: "+err.Error())
+	}
+
+	if err := deleteUserData(ctx, tx, userModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete user: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// ここから先はDBから消えた後の後始末なので、失敗してもログに残すだけにする
+	iconHashCache.Delete(userModel.ID)
+	iconHashCacheByUserName.Delete(userModel.Name)
+	suspensionCache.Delete(userModel.ID)
+	cacheBus.Publish(InvalidationEvent{Kind: InvalidateUser, UserID: userModel.ID, UserName: userModel.Name})
+	for _, iconHash := range iconHashes {
+		if err := removeIconIfUnused(ctx, iconHash); err != nil {
+			appLogger.WarnContext(ctx, "failed to remove icon", "icon_hash", iconHash, "error", err)
+		}
+	}
+
+	if err := dnsProvider.DeleteRecord(ctx, userModel.Name); err != nil {
+		appLogger.WarnContext(ctx, "failed to delete dns record", "username", userModel.Name, "error", err)
+	}
+
+	sess.Options = sessionOptions(-1)
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// ユーザに紐づくデータを全て削除する
+// まだ始まっていない配信で確保していた予約枠は返却する
+func deleteUserData(ctx context.Context, tx Tx, userModel UserModel) error {
+	livestreamModels, err := tx.Livestreams().ListByUser(ctx, userModel.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get livestreams: %w", err)
+	}
+
+	now := time.Now().Unix()
+	livestreamIDs := make([]int64, 0, len(livestreamModels))
+	for _, livestreamModel := range livestreamModels {
+		livestreamIDs = append(livestreamIDs, livestreamModel.ID)
+		if livestreamModel.StartAt <= now {
+			continue
+		}
+		if err := tx.Slots().Refund(ctx, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+			return fmt.Errorf("failed to refund reservation_slots: %w", err)
+		}
+	}
+
+	return tx.Users().Delete(ctx, userModel, livestreamIDs)
+}
+
+// 他のユーザが同じ画像を使っていなければiconStoreから削除する
+func removeIconIfUnused(ctx context.Context, iconHash string) error {
+	count, err := dataStore.Icons().CountByHash(ctx, iconHash)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	for _, size := range append([]int{0}, iconVariantSizes...) {
+		if err := iconStore.Delete(ctx, iconStoreKey(iconHash, size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 元画像と縮小版をiconStoreに保存する
+func putIcon(ctx context.Context, iconHash string, icon *processedIcon) error {
+	for size, variant := range icon.Variants {
+		if err := iconStore.Put(ctx, iconStoreKey(iconHash, size), variant); err != nil {
+			return err
+		}
+	}
+	// 元画像は最後に保存する。DBに保存する場合はiconsの行の画像になる
+	return iconStore.Put(ctx, iconHash, icon.Original)
+}
+
 // ユーザ登録API
 // POST /api/register
 func registerHandler(c echo.Context) error {
@@ -281,8 +701,9 @@ func registerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	if req.Name == "pipe" {
-		return echo.NewHTTPError(http.StatusBadRequest, "the username 'pipe' is reserved")
+	req.Name = normalizeUsername(req.Name)
+	if err := validateUsername(req.Name); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptDefaultCost)
@@ -290,7 +711,7 @@ func registerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := dataStore.BeginTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
@@ -303,14 +724,12 @@ func registerHandler(c echo.Context) error {
 		HashedPassword: string(hashedPassword),
 	}
 
-	result, err := tx.NamedExecContext(ctx, "INSERT INTO users (name, display_name, description, password) VALUES(:name, :display_name, :description, :password)", userModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user: "+err.Error())
+	userID, err := tx.Users().Create(ctx, userModel)
+	if isDuplicateEntryError(err) {
+		return echo.NewHTTPError(http.StatusConflict, "the username is already taken")
 	}
-
-	userID, err := result.LastInsertId()
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted user id: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user: "+err.Error())
 	}
 
 	userModel.ID = userID
@@ -319,14 +738,10 @@ func registerHandler(c echo.Context) error {
 		UserID:   userID,
 		DarkMode: req.Theme.DarkMode,
 	}
-	if _, err := tx.NamedExecContext(ctx, "INSERT INTO themes (user_id, dark_mode) VALUES(:user_id, :dark_mode)", themeModel); err != nil {
+	if err := tx.Users().CreateTheme(ctx, themeModel); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user theme: "+err.Error())
 	}
 
-	if out, err := exec.Command("pdnsutil", "add-record", "u.isucon.dev", req.Name, "A", "0", powerDNSSubdomainAddress).CombinedOutput(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, string(out)+": "+err.Error())
-	}
-
 	user, err := fillUserResponse(ctx, tx, userModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
@@ -336,9 +751,71 @@ func registerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	// DNSレコードはコミット後に作る。作れなかった場合はユーザ登録を取り消す
+	if err := addDNSRecordWithRetry(ctx, userModel.Name, powerDNSSubdomainAddress); err != nil {
+		if rerr := rollbackRegistration(context.WithoutCancel(ctx), userModel); rerr != nil {
+			appLogger.ErrorContext(ctx, "failed to roll back registration", "username", userModel.Name, "error", rerr)
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to add dns record: "+err.Error())
+	}
+	cacheBus.Publish(InvalidationEvent{Kind: InvalidateUser, UserID: userModel.ID, UserName: userModel.Name})
+
 	return c.JSON(http.StatusCreated, user)
 }
 
+// DNSレコードの作成に失敗したユーザ登録を取り消す
+func rollbackRegistration(ctx context.Context, userModel UserModel) error {
+	tx, err := dataStore.BeginTx(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := deleteUserData(ctx, tx, userModel); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type UsernameAvailabilityResponse struct {
+	Name      string `json:"name"`
+	Available bool   `json:"available"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// ユーザ名の利用可否確認API
+// GET /api/register/availability?name=
+func getUsernameAvailabilityHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	name := normalizeUsername(c.QueryParam("name"))
+	if err := validateUsername(name); err != nil {
+		return c.JSON(http.StatusOK, &UsernameAvailabilityResponse{
+			Name:      name,
+			Available: false,
+			Reason:    err.Error(),
+		})
+	}
+
+	count, err := dataStore.Users().CountByName(ctx, name)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count users: "+err.Error())
+	}
+	if count > 0 {
+		return c.JSON(http.StatusOK, &UsernameAvailabilityResponse{
+			Name:      name,
+			Available: false,
+			Reason:    "username is already taken",
+		})
+	}
+
+	return c.JSON(http.StatusOK, &UsernameAvailabilityResponse{
+		Name:      name,
+		Available: true,
+	})
+}
+
 // ユーザログインAPI
 // POST /api/login
 func loginHandler(c echo.Context) error {
@@ -350,15 +827,16 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := dataStore.BeginTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	userModel := UserModel{}
-	// usernameはUNIQUEなので、whereで一意に特定できる
-	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", req.Username)
+	req.Username = normalizeUsername(req.Username)
+
+	// usernameはUNIQUEなので、一意に特定できる
+	userModel, err := tx.Users().GetByName(ctx, req.Username)
 	if errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
 	}
@@ -378,6 +856,10 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
 	}
 
+	if suspension, found := suspensionCache.Get(userModel.ID); found {
+		return echo.NewHTTPError(http.StatusForbidden, "this account is suspended: "+suspension.Reason)
+	}
+
 	sessionEndAt := time.Now().Add(1 * time.Hour)
 
 	sessionID := uuid.NewString()
@@ -387,11 +869,7 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
 	}
 
-	sess.Options = &sessions.Options{
-		Domain: "u.isucon.dev",
-		MaxAge: int(60000),
-		Path:   "/",
-	}
+	sess.Options = sessionOptions(60000)
 	sess.Values[defaultSessionIDKey] = sessionID
 	sess.Values[defaultUserIDKey] = userModel.ID
 	sess.Values[defaultUsernameKey] = userModel.Name
@@ -400,6 +878,7 @@ func loginHandler(c echo.Context) error {
 	if err := sess.Save(c.Request(), c.Response()); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
 	}
+	setLogUserID(ctx, userModel.ID)
 
 	return c.NoContent(http.StatusOK)
 }
@@ -415,14 +894,14 @@ func getUserHandler(c echo.Context) error {
 
 	username := c.Param("username")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := dataStore.BeginReadTx(ctx)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	userModel := UserModel{}
-	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", username); err != nil {
+	userModel, err := tx.Users().GetByName(ctx, username)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
 		}
@@ -441,6 +920,15 @@ func getUserHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, user)
 }
 
+// UNIQUE制約違反かどうか
+func isDuplicateEntryError(err error) bool {
+	if errors.Is(err, errDuplicateEntry) {
+		return true
+	}
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == 1062
+}
+
 func verifyUserSession(c echo.Context) error {
 	sess, err := session.Get(defaultSessionIDKey, c)
 	if err != nil {
@@ -452,7 +940,7 @@ func verifyUserSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "failed to get EXPIRES value from session")
 	}
 
-	_, ok = sess.Values[defaultUserIDKey].(int64)
+	userID, ok := sess.Values[defaultUserIDKey].(int64)
 	if !ok {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get USERID value from session")
 	}
@@ -462,24 +950,24 @@ func verifyUserSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
 	}
 
+	if suspensionCache.IsSuspended(userID) {
+		return echo.NewHTTPError(http.StatusForbidden, "this account is suspended")
+	}
+
+	setLogUserID(c.Request().Context(), userID)
 	return nil
 }
 
-func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (User, error) {
-	themeModel := ThemeModel{}
-	if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ?", userModel.ID); err != nil {
+func fillUserResponse(ctx context.Context, tx Tx, userModel UserModel) (User, error) {
+	themeModel, err := tx.Users().GetTheme(ctx, userModel.ID)
+	if err != nil {
 		return User{}, err
 	}
 
-	var image []byte
+	iconHash, found := getIconHash(userModel.ID)
 
-	fileName, found := getIconHash(userModel.ID)
-
-	if !found {
-		image, err := os.ReadFile(fallbackImage)
-		if err != nil {
-			return User{}, err
-		}
+	// ブロックされたアイコンはフォールバック画像に差し替える
+	if !found || isIconBlocked(iconHash) {
 		user := User{
 			ID:          userModel.ID,
 			Name:        userModel.Name,
@@ -489,20 +977,15 @@ func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (Us
 				ID:       themeModel.ID,
 				DarkMode: themeModel.DarkMode,
 			},
-			IconHash: fmt.Sprintf("%x", sha256.Sum256(image)),
+			IconHash: fallbackImageHash,
+			IconURL:  iconURL(fallbackImageHash),
 		}
 
-		addIconHashByUserName(userModel.Name, fmt.Sprintf("%x", sha256.Sum256(image)))
+		addIconHashByUserName(userModel.Name, fallbackImageHash)
 		return user, nil
 	}
 
-	iconFilePath := fileName
-	image, err := os.ReadFile(iconFilePath)
-	if err != nil {
-		return User{}, err
-	}
-	iconHash := sha256.Sum256(image)
-	addIconHashByUserName(userModel.Name, fmt.Sprintf("%x", iconHash))
+	addIconHashByUserName(userModel.Name, iconHash)
 	user := User{
 		ID:          userModel.ID,
 		Name:        userModel.Name,
@@ -512,7 +995,8 @@ func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (Us
 			ID:       themeModel.ID,
 			DarkMode: themeModel.DarkMode,
 		},
-		IconHash: fmt.Sprintf("%x", iconHash),
+		IconHash: iconHash,
+		IconURL:  iconURL(iconHash),
 	}
 
 	return user, nil
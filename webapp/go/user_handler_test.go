@@ -0,0 +1,536 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRegister(t *testing.T) {
+	ts := newTestServer(t)
+	c := ts.client()
+
+	user := decodeJSON[User](t, c.post("/api/register", PostUserRequest{
+		Name:        "Alice",
+		DisplayName: "ALICE",
+		Description: "hello",
+		Password:    "password",
+		Theme:       PostUserRequestTheme{DarkMode: true},
+	}), http.StatusCreated)
+	if user.ID == 0 || user.Name != "alice" || user.DisplayName != "ALICE" || user.Description != "hello" {
+		t.Errorf("user = %+v", user)
+	}
+	if !user.Theme.DarkMode || user.Theme.ID == 0 {
+		t.Errorf("theme = %+v", user.Theme)
+	}
+	if user.IconHash != fallbackImageHash || user.IconURL != "/api/icon/"+fallbackImageHash {
+		t.Errorf("icon = %s %s", user.IconHash, user.IconURL)
+	}
+	if addr, ok := ts.dns.Lookup("alice"); !ok || addr != testSubdomainAddress {
+		t.Errorf("dns record = %q, %v", addr, ok)
+	}
+	ts.waitForEvent(InvalidateUser, func(event InvalidationEvent) bool {
+		return event.UserID == user.ID && event.UserName == "alice"
+	})
+
+	expectError(t, c.post("/api/register", PostUserRequest{Name: "alice", Password: "password"}), http.StatusConflict)
+	expectError(t, c.post("/api/register", PostUserRequest{Name: "admin", Password: "password"}), http.StatusBadRequest)
+	expectError(t, c.post("/api/register", PostUserRequest{Name: "-alice", Password: "password"}), http.StatusBadRequest)
+	expectError(t, c.post("/api/register", PostUserRequest{Name: "", Password: "password"}), http.StatusBadRequest)
+	expectError(t, c.do(http.MethodPost, "/api/register", "alice"), http.StatusBadRequest)
+}
+
+func TestUsernameAvailability(t *testing.T) {
+	ts := newTestServer(t)
+	ts.signup("alice")
+	c := ts.client()
+
+	res := decodeJSON[UsernameAvailabilityResponse](t, c.get("/api/register/availability?name=bob"), http.StatusOK)
+	if !res.Available || res.Name != "bob" || res.Reason != "" {
+		t.Errorf("bob = %+v", res)
+	}
+	res = decodeJSON[UsernameAvailabilityResponse](t, c.get("/api/register/availability?name=ALICE"), http.StatusOK)
+	if res.Available || res.Name != "alice" || res.Reason == "" {
+		t.Errorf("alice = %+v", res)
+	}
+	res = decodeJSON[UsernameAvailabilityResponse](t, c.get("/api/register/availability?name=www"), http.StatusOK)
+	if res.Available || res.Reason != errUsernameReserved.Error() {
+		t.Errorf("www = %+v", res)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	ts := newTestServer(t)
+	ts.signup("alice")
+
+	c := ts.client()
+	expectError(t, c.post("/api/login", LoginRequest{Username: "alice", Password: "wrong"}), http.StatusUnauthorized)
+	expectError(t, c.post("/api/login", LoginRequest{Username: "nobody", Password: "password"}), http.StatusUnauthorized)
+	expectError(t, c.get("/api/user/me"), http.StatusForbidden)
+
+	rec := c.post("/api/login", LoginRequest{Username: "Alice", Password: "alice-password"})
+	expectStatus(t, rec, http.StatusOK)
+	if _, ok := c.cookies[defaultSessionIDKey]; !ok {
+		t.Fatalf("session cookie was not set: %v", rec.Header())
+	}
+
+	me := decodeJSON[User](t, c.get("/api/user/me"), http.StatusOK)
+	if me.Name != "alice" {
+		t.Errorf("me = %+v", me)
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	_, bob := ts.signup("bob")
+
+	user := decodeJSON[User](t, alice.get("/api/user/bob"), http.StatusOK)
+	if user != bob {
+		t.Errorf("user = %+v, want %+v", user, bob)
+	}
+	expectError(t, alice.get("/api/user/nobody"), http.StatusNotFound)
+	expectError(t, ts.client().get("/api/user/bob"), http.StatusForbidden)
+
+	theme := decodeJSON[Theme](t, alice.get("/api/user/bob/theme"), http.StatusOK)
+	if theme != bob.Theme {
+		t.Errorf("theme = %+v, want %+v", theme, bob.Theme)
+	}
+	expectError(t, alice.get("/api/user/nobody/theme"), http.StatusNotFound)
+	expectError(t, ts.client().get("/api/user/bob/theme"), http.StatusForbidden)
+}
+
+func TestGetTags(t *testing.T) {
+	ts := newTestServer(t)
+
+	res := decodeJSON[TagsResponse](t, ts.client().get("/api/tag"), http.StatusOK)
+	if len(res.Tags) != 3 {
+		t.Errorf("tags = %+v", res.Tags)
+	}
+	for _, tag := range res.Tags {
+		if tag.ID == 0 || tag.Name == "" {
+			t.Errorf("tag = %+v", tag)
+		}
+	}
+}
+
+func TestChannelHost(t *testing.T) {
+	ts := newTestServer(t)
+	alice, user := ts.signup("alice")
+
+	req := httptest.NewRequest(http.MethodGet, "/profile", nil)
+	req.Host = "alice." + dnsZone
+	got := decodeJSON[User](t, alice.send(req), http.StatusOK)
+	if got != user {
+		t.Errorf("profile = %+v, want %+v", got, user)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/theme", nil)
+	req.Host = "alice." + dnsZone + ":8080"
+	decodeJSON[Theme](t, alice.send(req), http.StatusOK)
+}
+
+// w×hの単色のPNG
+func testPNG(t *testing.T, w, h int, c color.Color) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// icon.store=db でも元画像と縮小版を保存して返せる
+func TestIconDBStore(t *testing.T) {
+	ts := newTestServer(t)
+	iconStore = newDBIconStore(ts.store)
+	alice, _ := ts.signup("alice")
+
+	decodeJSON[PostIconResponse](t, alice.post("/api/icon", PostIconRequest{Image: testPNG(t, 300, 300, color.RGBA{G: 255, A: 255})}), http.StatusCreated)
+	me := decodeJSON[User](t, alice.get("/api/user/me"), http.StatusOK)
+
+	// ユーザ名から引くときも、トランザクションを閉じてからStoreの画像を読む
+	for _, path := range []string{me.IconURL, "/api/user/alice/icon"} {
+		rec := alice.get(path)
+		expectStatus(t, rec, http.StatusOK)
+		if sum := fmt.Sprintf("%x", sha256.Sum256(rec.Body.Bytes())); sum != me.IconHash {
+			t.Errorf("%s: served icon hash = %s, want %s", path, sum, me.IconHash)
+		}
+	}
+	for _, size := range iconVariantSizes {
+		rec := alice.get(fmt.Sprintf("%s?size=%d", me.IconURL, size))
+		expectStatus(t, rec, http.StatusOK)
+		img, err := png.Decode(bytes.NewReader(rec.Body.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != size || b.Dy() != size {
+			t.Errorf("size %d: bounds = %v", size, b)
+		}
+		if _, err := ts.store.Icons().GetImage(context.Background(), iconStoreKey(me.IconHash, size)); err != nil {
+			t.Errorf("size %d: %v", size, err)
+		}
+	}
+}
+
+// 画像が読めないときは、見つからないときと違ってフォールバック画像にしない
+type failingIconStore struct {
+	IconStore
+}
+
+func (failingIconStore) Get(context.Context, string) ([]byte, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestIconStoreError(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	decodeJSON[PostIconResponse](t, alice.post("/api/icon", PostIconRequest{Image: testPNG(t, 16, 16, color.White)}), http.StatusCreated)
+
+	iconStore = failingIconStore{iconStore}
+	expectError(t, alice.get("/api/user/alice/icon"), http.StatusInternalServerError)
+}
+
+func TestIcon(t *testing.T) {
+	ts := newTestServer(t)
+	alice, user := ts.signup("alice")
+
+	// アイコンがなければフォールバック画像
+	rec := alice.get("/api/user/alice/icon")
+	expectStatus(t, rec, http.StatusOK)
+	if !bytes.Equal(rec.Body.Bytes(), fallbackImageData) {
+		t.Errorf("fallback image was not served")
+	}
+	expectError(t, alice.get("/api/user/nobody/icon"), http.StatusNotFound)
+
+	red := testPNG(t, 300, 300, color.RGBA{R: 255, A: 255})
+	first := decodeJSON[PostIconResponse](t, alice.post("/api/icon", PostIconRequest{Image: red}), http.StatusCreated)
+	if first.ID == 0 {
+		t.Errorf("icon id = %d", first.ID)
+	}
+	ts.waitForEvent(InvalidateIcon, func(event InvalidationEvent) bool { return event.UserID == user.ID })
+
+	me := decodeJSON[User](t, alice.get("/api/user/me"), http.StatusOK)
+	if me.IconHash == fallbackImageHash || me.IconURL != iconURL(me.IconHash) {
+		t.Fatalf("icon = %s %s", me.IconHash, me.IconURL)
+	}
+
+	rec = alice.get("/api/user/alice/icon")
+	expectStatus(t, rec, http.StatusOK)
+	if ct := rec.Header().Get(echo.HeaderContentType); ct != "image/png" {
+		t.Errorf("content type = %q", ct)
+	}
+	if sum := fmt.Sprintf("%x", sha256.Sum256(rec.Body.Bytes())); sum != me.IconHash {
+		t.Errorf("served icon hash = %s, want %s", sum, me.IconHash)
+	}
+	etag := rec.Header().Get("ETag")
+	if etag != strconv.Quote(me.IconHash) {
+		t.Errorf("etag = %s", etag)
+	}
+
+	// ETagが一致すれば304
+	req := httptest.NewRequest(http.MethodGet, "/api/user/alice/icon", nil)
+	req.Header.Set("If-None-Match", etag)
+	expectStatus(t, alice.send(req), http.StatusNotModified)
+
+	// 縮小版
+	rec = alice.get("/api/user/alice/icon?size=64")
+	expectStatus(t, rec, http.StatusOK)
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(rec.Body.Bytes())); err != nil || cfg.Width != 64 {
+		t.Errorf("variant = %+v, %v", cfg, err)
+	}
+	expectError(t, alice.get("/api/user/alice/icon?size=65"), http.StatusBadRequest)
+
+	// HEAD
+	rec = alice.send(httptest.NewRequest(http.MethodHead, "/api/user/alice/icon", nil))
+	expectStatus(t, rec, http.StatusOK)
+	if rec.Body.Len() != 0 {
+		t.Errorf("HEAD returned a body")
+	}
+
+	// ハッシュ指定
+	rec = ts.client().get("/api/icon/" + me.IconHash)
+	expectStatus(t, rec, http.StatusOK)
+	if cc := rec.Header().Get(echo.HeaderCacheControl); cc != "public, max-age=31536000, immutable" {
+		t.Errorf("cache control = %q", cc)
+	}
+	expectStatus(t, ts.client().send(httptest.NewRequest(http.MethodHead, "/api/icon/"+me.IconHash, nil)), http.StatusOK)
+	expectError(t, ts.client().get("/api/icon/not-a-hash"), http.StatusNotFound)
+	// 見つからないときは長くキャッシュさせない
+	rec = ts.client().get(fmt.Sprintf("/api/icon/%x", sha256.Sum256([]byte("unknown"))))
+	expectError(t, rec, http.StatusNotFound)
+	if cc := rec.Header().Get(echo.HeaderCacheControl); strings.Contains(cc, "immutable") {
+		t.Errorf("cache control on 404 = %q", cc)
+	}
+
+	// 画像そのもののボディでも受け付ける
+	blue := testPNG(t, 32, 32, color.RGBA{B: 255, A: 255})
+	req = httptest.NewRequest(http.MethodPost, "/api/icon", bytes.NewReader(blue))
+	req.Header.Set(echo.HeaderContentType, "image/png")
+	second := decodeJSON[PostIconResponse](t, alice.send(req), http.StatusCreated)
+
+	history := decodeJSON[[]IconHistoryEntry](t, alice.get("/api/icon/history"), http.StatusOK)
+	if len(history) != 2 || history[0].ID != second.ID || !history[0].Current || history[1].ID != first.ID || history[1].Current {
+		t.Fatalf("history = %+v", history)
+	}
+
+	reverted := decodeJSON[PostIconResponse](t, alice.post(fmt.Sprintf("/api/icon/history/%d/revert", first.ID), nil), http.StatusCreated)
+	me2 := decodeJSON[User](t, alice.get("/api/user/me"), http.StatusOK)
+	if me2.IconHash != me.IconHash {
+		t.Errorf("icon after revert = %s, want %s", me2.IconHash, me.IconHash)
+	}
+	history = decodeJSON[[]IconHistoryEntry](t, alice.get("/api/icon/history"), http.StatusOK)
+	if len(history) != 3 || history[0].ID != reverted.ID || history[0].IconHash != me.IconHash {
+		t.Errorf("history after revert = %+v", history)
+	}
+
+	expectError(t, alice.post("/api/icon/history/999/revert", nil), http.StatusNotFound)
+	expectError(t, alice.post("/api/icon/history/abc/revert", nil), http.StatusBadRequest)
+	expectError(t, alice.post("/api/icon", PostIconRequest{Image: []byte("not an image")}), http.StatusBadRequest)
+	req = httptest.NewRequest(http.MethodPost, "/api/icon", strings.NewReader("null"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	expectError(t, alice.send(req), http.StatusBadRequest)
+	req = httptest.NewRequest(http.MethodPost, "/api/icon", bytes.NewReader(blue))
+	req.Header.Set(echo.HeaderContentType, "text/plain")
+	expectError(t, alice.send(req), http.StatusUnsupportedMediaType)
+	expectError(t, ts.client().post("/api/icon", PostIconRequest{Image: red}), http.StatusForbidden)
+
+	// 他のユーザの履歴には戻せない
+	bob, _ := ts.signup("bob")
+	expectError(t, bob.post(fmt.Sprintf("/api/icon/history/%d/revert", first.ID), nil), http.StatusNotFound)
+}
+
+func TestIconTooLarge(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+
+	iconMaxBytes = 1024
+	req := httptest.NewRequest(http.MethodPost, "/api/icon", bytes.NewReader(make([]byte, 2048)))
+	req.Header.Set(echo.HeaderContentType, "image/png")
+	expectError(t, alice.send(req), http.StatusRequestEntityTooLarge)
+}
+
+func TestIconBlocklist(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+	admin := ts.admin()
+
+	decodeJSON[PostIconResponse](t, alice.post("/api/icon", PostIconRequest{Image: testPNG(t, 16, 16, color.White)}), http.StatusCreated)
+	me := decodeJSON[User](t, alice.get("/api/user/me"), http.StatusOK)
+
+	expectError(t, admin.post("/api/admin/icon/blocklist", PostIconBlocklistRequest{Hash: "xyz"}), http.StatusBadRequest)
+	entry := decodeJSON[IconBlocklistModel](t, admin.post("/api/admin/icon/blocklist", PostIconBlocklistRequest{Hash: me.IconHash, Reason: "spam"}), http.StatusCreated)
+	if entry.Hash != me.IconHash || entry.Reason != "spam" || entry.CreatedAt == 0 {
+		t.Errorf("entry = %+v", entry)
+	}
+	ts.waitForEvent(InvalidateIcon, func(event InvalidationEvent) bool { return event.Hash == me.IconHash })
+
+	blocklist := decodeJSON[[]IconBlocklistModel](t, admin.get("/api/admin/icon/blocklist"), http.StatusOK)
+	if len(blocklist) != 1 || blocklist[0] != entry {
+		t.Errorf("blocklist = %+v", blocklist)
+	}
+
+	// ブロックされたアイコンはフォールバック画像に差し替わる
+	blocked := decodeJSON[User](t, alice.get("/api/user/me"), http.StatusOK)
+	if blocked.IconHash != fallbackImageHash {
+		t.Errorf("blocked icon hash = %s", blocked.IconHash)
+	}
+	rec := alice.get("/api/user/alice/icon")
+	expectStatus(t, rec, http.StatusOK)
+	if !bytes.Equal(rec.Body.Bytes(), fallbackImageData) {
+		t.Errorf("blocked icon was served")
+	}
+	expectError(t, ts.client().get("/api/icon/"+me.IconHash), http.StatusNotFound)
+	expectError(t, alice.post("/api/icon", PostIconRequest{Image: testPNG(t, 16, 16, color.White)}), http.StatusBadRequest)
+	history := decodeJSON[[]IconHistoryEntry](t, alice.get("/api/icon/history"), http.StatusOK)
+	if len(history) != 1 || !history[0].Blocked {
+		t.Errorf("history = %+v", history)
+	}
+
+	expectStatus(t, admin.do(http.MethodDelete, "/api/admin/icon/blocklist/"+me.IconHash, nil), http.StatusNoContent)
+	expectError(t, admin.do(http.MethodDelete, "/api/admin/icon/blocklist/"+me.IconHash, nil), http.StatusNotFound)
+	unblocked := decodeJSON[User](t, alice.get("/api/user/me"), http.StatusOK)
+	if unblocked.IconHash != me.IconHash {
+		t.Errorf("unblocked icon hash = %s", unblocked.IconHash)
+	}
+}
+
+func TestDeleteMe(t *testing.T) {
+	ts := newTestServer(t)
+	alice, user := ts.signup("alice")
+	bob, _ := ts.signup("bob")
+
+	decodeJSON[PostIconResponse](t, alice.post("/api/icon", PostIconRequest{Image: testPNG(t, 16, 16, color.Black)}), http.StatusCreated)
+	me := decodeJSON[User](t, alice.get("/api/user/me"), http.StatusOK)
+
+	livestream := ts.reserve(alice, 1, "alice-stream")
+	decodeJSON[Livecomment](t, bob.post(fmt.Sprintf("/api/livestream/%d/livecomment", livestream.ID), PostLivecommentRequest{Comment: "hi", Tip: 10}), http.StatusCreated)
+	slot, _ := ts.store.Slots().Remaining(context.Background(), livestream.StartAt, livestream.EndAt)
+	if slot != testSlotCapacity-1 {
+		t.Fatalf("slot = %d", slot)
+	}
+
+	expectStatus(t, alice.do(http.MethodDelete, "/api/user/me", nil), http.StatusNoContent)
+	if _, ok := alice.cookies[defaultSessionIDKey]; ok {
+		t.Errorf("session cookie was not cleared")
+	}
+	expectError(t, alice.get("/api/user/me"), http.StatusForbidden)
+
+	expectError(t, bob.get("/api/user/alice"), http.StatusNotFound)
+	expectError(t, bob.get(fmt.Sprintf("/api/livestream/%d", livestream.ID)), http.StatusNotFound)
+	if _, ok := ts.dns.Lookup("alice"); ok {
+		t.Errorf("dns record was not deleted")
+	}
+	ts.waitForEvent(InvalidateUser, func(event InvalidationEvent) bool { return event.UserID == user.ID })
+	// 予約期間は過去なので、開始済みの配信として予約枠は返却されない
+	if slot, _ := ts.store.Slots().Remaining(context.Background(), livestream.StartAt, livestream.EndAt); slot != testSlotCapacity-1 {
+		t.Errorf("slot after delete = %d", slot)
+	}
+	if _, err := iconStore.Get(context.Background(), me.IconHash); err == nil {
+		t.Errorf("unused icon was not deleted")
+	}
+	expectError(t, ts.client().post("/api/login", LoginRequest{Username: "alice", Password: "alice-password"}), http.StatusUnauthorized)
+
+	// 同じ名前で登録し直せる
+	ts.signup("alice")
+}
+
+func TestUserExport(t *testing.T) {
+	ts := newTestServer(t)
+	alice, user := ts.signup("alice")
+	bob, _ := ts.signup("bob")
+
+	expectError(t, alice.get("/api/user/me/export/status"), http.StatusNotFound)
+
+	livestream := ts.reserve(alice, 2, "export", ts.tagID("雑談"))
+	decodeJSON[Livecomment](t, alice.post(fmt.Sprintf("/api/livestream/%d/livecomment", livestream.ID), PostLivecommentRequest{Comment: "mine", Tip: 5}), http.StatusCreated)
+	decodeJSON[Reaction](t, alice.post(fmt.Sprintf("/api/livestream/%d/reaction", livestream.ID), PostReactionRequest{EmojiName: "smile"}), http.StatusCreated)
+	decodeJSON[Reaction](t, bob.post(fmt.Sprintf("/api/livestream/%d/reaction", livestream.ID), PostReactionRequest{EmojiName: "heart"}), http.StatusCreated)
+
+	rec := alice.get("/api/user/me/export")
+	expectStatus(t, rec, http.StatusOK)
+	if ct := rec.Header().Get(echo.HeaderContentType); ct != "application/zip" {
+		t.Fatalf("content type = %q", ct)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var export UserExport
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+		if f.Name != "export.json" {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		dec := json.NewDecoder(r)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&export); err != nil {
+			t.Fatal(err)
+		}
+		r.Close()
+	}
+	if export.Profile.ID != user.ID || export.ExportedAt == 0 {
+		t.Fatalf("export = %+v", export)
+	}
+	if len(export.Livestreams) != 1 || len(export.Livestreams[0].Tags) != 1 || export.Livestreams[0].Tags[0].Name != "雑談" {
+		t.Errorf("livestreams = %+v", export.Livestreams)
+	}
+	if len(export.Livecomments) != 1 || export.Livecomments[0].Comment != "mine" {
+		t.Errorf("livecomments = %+v", export.Livecomments)
+	}
+	if len(export.Reactions) != 1 || export.Reactions[0].EmojiName != "smile" {
+		t.Errorf("reactions = %+v", export.Reactions)
+	}
+	if export.Statistics.TotalReactions != 2 || export.Statistics.TotalTip != 5 {
+		t.Errorf("statistics = %+v", export.Statistics)
+	}
+
+	status := decodeJSON[UserExportStatus](t, alice.get("/api/user/me/export/status"), http.StatusOK)
+	if status.Status != exportStatusCompleted || status.ID == "" || status.CompletedAt < status.CreatedAt {
+		t.Errorf("status = %+v", status)
+	}
+	if status.CompletedAt > time.Now().Unix() {
+		t.Errorf("completed_at is in the future: %d", status.CompletedAt)
+	}
+	// アイコンがなければ既定のJPEG
+	if fmt.Sprint(names) != "[export.json icon.jpg]" {
+		t.Errorf("files = %v", names)
+	}
+	expectError(t, ts.client().get("/api/user/me/export"), http.StatusForbidden)
+
+	// ジョブはDBに残るので、受け付けたのと別のサーバからも取れる
+	stored, err := ts.store.Users().GetExport(context.Background(), user.ID)
+	if err != nil || stored.ID != status.ID || stored.Status != exportStatusCompleted {
+		t.Errorf("stored export = %+v, %v", stored, err)
+	}
+
+	// 作り直すと、アップロードしたPNGはそのままの形式で入る
+	decodeJSON[PostIconResponse](t, alice.post("/api/icon", PostIconRequest{Image: testPNG(t, 16, 16, color.White)}), http.StatusCreated)
+	rec = alice.get("/api/user/me/export?refresh=true")
+	expectStatus(t, rec, http.StatusOK)
+	zr, err = zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zr.File) != 2 || zr.File[1].Name != "icon.png" {
+		t.Errorf("files = %v", zr.File)
+	}
+	if got := decodeJSON[UserExportStatus](t, alice.get("/api/user/me/export/status"), http.StatusOK); got.ID == status.ID {
+		t.Errorf("export is not refreshed: %+v", got)
+	}
+}
+
+func TestUserExportConcurrent(t *testing.T) {
+	ts := newTestServer(t)
+	alice, _ := ts.signup("alice")
+
+	// 同時に頼まれても始めるジョブは1つだけで、皆そのアーカイブを受け取る
+	const n = 8
+	dispositions := make([]string, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		c := &testClient{ts: ts, header: alice.header.Clone(), cookies: maps.Clone(alice.cookies)}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			dispositions[i] = c.get("/api/user/me/export").Header().Get(echo.HeaderContentDisposition)
+		}(i)
+	}
+	wg.Wait()
+
+	status := decodeJSON[UserExportStatus](t, alice.get("/api/user/me/export/status"), http.StatusOK)
+	for i, d := range dispositions {
+		if !strings.Contains(d, status.ID) {
+			t.Errorf("request %d: disposition = %q, want export %s", i, d, status.ID)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	// ユーザ名はそのまま <username>.u.isucon.dev のDNSラベルになるので、ラベルの上限に合わせる
+	usernameMaxLength = 63
+)
+
+// DNSラベルとして安全な文字だけを許可する (英小文字・数字・ハイフン、先頭末尾はハイフン以外)
+var usernamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// サービスやゾーンで使っている名前は登録させない
+var defaultReservedUsernames = []string{
+	"pipe",
+	"www",
+	"api",
+	"admin",
+	"administrator",
+	"root",
+	"ns",
+	"ns1",
+	"ns2",
+	"mail",
+	"smtp",
+	"ftp",
+	"static",
+	"assets",
+	"cdn",
+	"support",
+	"help",
+	"status",
+	"isucon",
+	"isupipe",
+}
+
+var (
+	errUsernameEmpty    = errors.New("username must not be empty")
+	errUsernameTooLong  = fmt.Errorf("username must be at most %d characters", usernameMaxLength)
+	errUsernameInvalid  = errors.New("username may only contain lowercase letters, digits and hyphens, and must not start or end with a hyphen")
+	errUsernameReserved = errors.New("username is reserved")
+)
+
+type ReservedUsernames struct {
+	mu    sync.RWMutex
+	names map[string]struct{}
+}
+
+var reservedUsernames = NewReservedUsernames()
+
+func NewReservedUsernames() *ReservedUsernames {
+	r := &ReservedUsernames{names: make(map[string]struct{})}
+	r.Set(defaultReservedUsernames)
+	return r
+}
+
+// Set は予約済みユーザ名の一覧を置き換えます。
+func (r *ReservedUsernames) Set(names []string) {
+	m := make(map[string]struct{}, len(names))
+	for _, name := range names {
+		if name = normalizeUsername(name); name != "" {
+			m[name] = struct{}{}
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names = m
+}
+
+// Contains は指定されたユーザ名が予約済みかどうかを返します。
+func (r *ReservedUsernames) Contains(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	_, found := r.names[normalizeUsername(name)]
+	return found
+}
+
+// 既定の予約語に設定で指定された名前を加える
+func loadReservedUsernames(extra []string) {
+	names := append([]string{}, defaultReservedUsernames...)
+	names = append(names, extra...)
+	reservedUsernames.Set(names)
+}
+
+// ユーザ名の大文字小文字を区別しないように畳み込む
+func normalizeUsername(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// 正規化済みのユーザ名がポリシーを満たすか検証する
+func validateUsername(name string) error {
+	if name == "" {
+		return errUsernameEmpty
+	}
+	if len(name) > usernameMaxLength {
+		return errUsernameTooLong
+	}
+	if !usernamePattern.MatchString(name) {
+		return errUsernameInvalid
+	}
+	if reservedUsernames.Contains(name) {
+		return errUsernameReserved
+	}
+	return nil
+}
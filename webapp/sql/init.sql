@@ -1,5 +1,7 @@
 TRUNCATE TABLE themes;
 TRUNCATE TABLE icons;
+TRUNCATE TABLE icon_images;
+TRUNCATE TABLE icon_blocklist;
 TRUNCATE TABLE reservation_slots;
 TRUNCATE TABLE livestream_viewers_history;
 TRUNCATE TABLE livecomment_reports;
@@ -10,6 +12,11 @@ TRUNCATE TABLE livestream_tags;
 TRUNCATE TABLE livecomments;
 TRUNCATE TABLE livestreams;
 TRUNCATE TABLE users;
+-- ロールも消える。設定の admin_users に書いたユーザは initialize の後にadminに戻す
+TRUNCATE TABLE user_roles;
+TRUNCATE TABLE livestream_moderators;
+TRUNCATE TABLE user_suspensions;
+TRUNCATE TABLE user_exports;
 
 ALTER TABLE `themes` auto_increment = 1;
 ALTER TABLE `icons` auto_increment = 1;
@@ -22,4 +29,5 @@ ALTER TABLE `reactions` auto_increment = 1;
 ALTER TABLE `tags` auto_increment = 1;
 ALTER TABLE `livecomments` auto_increment = 1;
 ALTER TABLE `livestreams` auto_increment = 1;
-ALTER TABLE `users` auto_increment = 1;
\ No newline at end of file
+ALTER TABLE `users` auto_increment = 1;
+ALTER TABLE `livestream_moderators` auto_increment = 1;
\ No newline at end of file